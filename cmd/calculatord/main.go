@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	grpcprom "github.com/grpc-ecosystem/go-grpc-middleware/providers/prometheus"
@@ -16,7 +21,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/vickleford/calculator/internal/apiserver"
+	"github.com/vickleford/calculator/internal/coordinator"
+	"github.com/vickleford/calculator/internal/leader"
 	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/reaper"
+	"github.com/vickleford/calculator/internal/reconciler"
+	"github.com/vickleford/calculator/internal/recurring"
+	"github.com/vickleford/calculator/internal/resultcache"
+	"github.com/vickleford/calculator/internal/scheduler"
 	"github.com/vickleford/calculator/internal/store"
 	"github.com/vickleford/calculator/internal/workqueue"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -28,35 +40,191 @@ func main() {
 	metricsAddr := flag.String("metrics", ":8081", "prometheus http metrics endpoint")
 	etcdAddr := flag.String("etcdAddr", "localhost:2379", "etcd endpoints")
 	rabbitAddr := flag.String("rmqAddr", "localhost:5672", "rabbitmq address")
+	queueBackend := flag.String("queue-backend", queueBackendRabbitMQ, "where to queue jobs: rabbitmq or etcd")
 	queueName := flag.String("queue", "calculations", "the workqueue name to use")
+	maxPriority := flag.Uint("maxPriority", 0, "declare the queue as a priority queue with this maximum priority, up to 255; 0 disables priorities")
+	exchange := flag.String("exchange", "", "the exchange to publish jobs to, routed by job type; the default exchange is used when empty")
+	deadLetterExchange := flag.String("deadLetterExchange", "", "the exchange to send rejected jobs to, such as jobs of an unknown version; the queue must be redeclared to change it")
+	exchangeKind := flag.String("exchangeKind", amqp.ExchangeDirect, "the kind of exchange to declare, such as direct or topic")
+	scheduleInterval := flag.Duration("scheduleInterval", time.Second, "how often to check for scheduled calculations that are due")
+	scheduleHistory := flag.Int("scheduleHistory", 10, "how many of the most recent runs of a recurring schedule to remember")
+	coordinateInterval := flag.Duration("coordinateInterval", time.Second, "how often to advance pipelines, starting the steps whose dependencies succeeded")
+	reapInterval := flag.Duration("reapInterval", 10*time.Second, "how often to check for calculations whose worker stopped heartbeating; 0 disables reaping")
+	reconcileInterval := flag.Duration("reconcileInterval", time.Minute, "how often to check for calculations that were never started; 0 disables reconciling")
+	reconcileThreshold := flag.Duration("reconcileThreshold", 10*time.Minute, "how long after it is due a calculation that has not started is republished; keep it longer than jobs wait in the queue")
+	reconcileDryRun := flag.Bool("reconcileDryRun", false, "only log and count the calculations that were never started rather than republishing them")
+	reapAction := flag.String("reapAction", string(reaper.Republish), "what to do with a calculation whose worker stopped heartbeating: republish or fail")
+	gracePeriod := flag.Duration("gracePeriod", 30*time.Second, "how long in-flight RPCs may take to finish on shutdown")
+	jobEncoding := flag.String("jobEncoding", jobEncodingJSON, "how to encode jobs for the workers: json or protobuf; upgrade the workers before choosing protobuf")
+	resultCache := flag.Bool("resultCache", false, "complete calculations at once with the cached result of an identical calculation; the workers must cache results")
+	resultCacheSize := flag.Int("resultCacheSize", 1000, "how many cached results to also keep in memory; 0 keeps none")
+	inlineThreshold := flag.Int64("inlineThreshold", 0, "calculate calculations costing up to this many additions while handling the request rather than queue them; 0 disables it")
+	maxBatchGetOperations := flag.Int("maxBatchGetOperations", 100, "the most operations BatchGetOperations may get at once, at least 1; keep it at most 42 to read them in one etcd transaction")
+	callbackHosts := flag.String("callbackHosts", "", "comma separated hosts, optionally with a port, that calculations may ask to be called back at; callbacks are refused when empty and need workers that call back")
+	coalesce := flag.Bool("coalesce", false, "have calculations follow an identical calculation in flight rather than run themselves; the workers must coalesce first")
+	spoolPath := flag.String("spool", "", "a file to spool jobs to while rabbitmq is unavailable; spooling is disabled when empty")
+	spoolMaxBytes := flag.Int64("spoolMaxBytes", 64<<20, "the most bytes the spool may hold; 0 means no limit")
+	spoolFsync := flag.String("spoolFsync", "always", "when to sync the spool to disk: always, interval or never")
+	spoolReplayInterval := flag.Duration("spoolReplayInterval", 5*time.Second, "how often to try publishing spooled jobs")
 	flag.Parse()
 
+	if *maxPriority > math.MaxUint8 {
+		log.Fatalf("maxPriority must not be greater than %d", math.MaxUint8)
+	}
+
+	if *queueBackend != queueBackendRabbitMQ && *queueBackend != queueBackendEtcd {
+		log.Fatalf("queue-backend must be %q or %q", queueBackendRabbitMQ, queueBackendEtcd)
+	}
+
+	if *jobEncoding != jobEncodingJSON && *jobEncoding != jobEncodingProtobuf {
+		log.Fatalf("jobEncoding must be %q or %q", jobEncodingJSON, jobEncodingProtobuf)
+	}
+
+	// Only RabbitMQ carries protobuf jobs; the others would quietly publish
+	// JSON instead.
+	if *jobEncoding == jobEncodingProtobuf && *queueBackend == queueBackendEtcd {
+		log.Fatalf("jobEncoding %q is not supported with queue-backend %q", jobEncodingProtobuf, queueBackendEtcd)
+	}
+	if *jobEncoding == jobEncodingProtobuf && *spoolPath != "" {
+		log.Fatalf("jobEncoding %q is not supported with spool", jobEncodingProtobuf)
+	}
+
+	// Only RabbitMQ is spooled for; etcd would quietly go without a spool.
+	if *spoolPath != "" && *queueBackend != queueBackendRabbitMQ {
+		log.Fatalf("spool is only supported with queue-backend %q", queueBackendRabbitMQ)
+	}
+
+	if *reapAction != string(reaper.Republish) && *reapAction != string(reaper.Fail) {
+		log.Fatalf("reapAction must be %q or %q", reaper.Republish, reaper.Fail)
+	}
+
+	if *scheduleHistory < 1 {
+		log.Fatalf("scheduleHistory must be at least 1")
+	}
+
+	if *maxBatchGetOperations < 1 {
+		log.Fatalf("maxBatchGetOperations must be at least 1")
+	}
+
+	// Splitting an empty list yields no hosts rather than an empty one.
+	callbackHostList := strings.FieldsFunc(*callbackHosts, func(r rune) bool { return r == ',' })
+
+	fsyncPolicy, ok := fsyncPolicies[*spoolFsync]
+	if !ok {
+		log.Fatalf("spoolFsync must be always, interval or never")
+	}
+
 	opts := daemonOpts{
-		listenAddr:  *listenAddr,
-		metricsAddr: *metricsAddr,
-		etcdAddr:    *etcdAddr,
-		rabbitAddr:  *rabbitAddr,
-		queueName:   *queueName,
+		listenAddr:         *listenAddr,
+		metricsAddr:        *metricsAddr,
+		etcdAddr:           *etcdAddr,
+		rabbitAddr:         *rabbitAddr,
+		queueBackend:       *queueBackend,
+		queueName:          *queueName,
+		maxPriority:        uint8(*maxPriority),
+		exchange:           *exchange,
+		exchangeKind:       *exchangeKind,
+		deadLetterExchange: *deadLetterExchange,
+		scheduleInterval:   *scheduleInterval,
+		scheduleHistory:    *scheduleHistory,
+		coordinateInterval: *coordinateInterval,
+		reapInterval:       *reapInterval,
+		reapAction:         reaper.Action(*reapAction),
+		gracePeriod:        *gracePeriod,
+		protobufJobs:       *jobEncoding == jobEncodingProtobuf,
+		resultCache:        *resultCache,
+		resultCacheSize:    *resultCacheSize,
+		coalesce:           *coalesce,
+		inlineThreshold:    *inlineThreshold,
+		maxBatchGet:        *maxBatchGetOperations,
+		callbackHosts:      callbackHostList,
+		reconcile: reconcileOpts{
+			interval:  *reconcileInterval,
+			threshold: *reconcileThreshold,
+			dryRun:    *reconcileDryRun,
+		},
+		spool: spoolOpts{
+			path:           *spoolPath,
+			maxBytes:       *spoolMaxBytes,
+			fsync:          fsyncPolicy,
+			replayInterval: *spoolReplayInterval,
+		},
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := daemonize(ctx, opts); err != nil {
+		log.Fatal(err)
 	}
 
-	log.Fatal(daemonize(opts))
+	log.Print("shut down")
 }
 
 type daemonOpts struct {
-	listenAddr  string
-	metricsAddr string
-	etcdAddr    string
-	rabbitAddr  string
-	queueName   string
+	listenAddr         string
+	metricsAddr        string
+	etcdAddr           string
+	rabbitAddr         string
+	queueBackend       string
+	queueName          string
+	maxPriority        uint8
+	exchange           string
+	exchangeKind       string
+	deadLetterExchange string
+	scheduleInterval   time.Duration
+	scheduleHistory    int
+	coordinateInterval time.Duration
+	reapInterval       time.Duration
+	reapAction         reaper.Action
+	reconcile          reconcileOpts
+	gracePeriod        time.Duration
+	protobufJobs       bool
+	resultCache        bool
+	resultCacheSize    int
+	coalesce           bool
+	inlineThreshold    int64
+	maxBatchGet        int
+	callbackHosts      []string
+	spool              spoolOpts
+}
+
+type reconcileOpts struct {
+	interval  time.Duration
+	threshold time.Duration
+	dryRun    bool
 }
 
+type spoolOpts struct {
+	path           string
+	maxBytes       int64
+	fsync          workqueue.FsyncPolicy
+	replayInterval time.Duration
+}
+
+var fsyncPolicies = map[string]workqueue.FsyncPolicy{
+	"always":   workqueue.FsyncAlways,
+	"interval": workqueue.FsyncInterval,
+	"never":    workqueue.FsyncNever,
+}
+
+const (
+	queueBackendRabbitMQ = "rabbitmq"
+	queueBackendEtcd     = "etcd"
+
+	jobEncodingJSON     = "json"
+	jobEncodingProtobuf = "protobuf"
+)
+
 func (opts daemonOpts) RabbitURL() string {
 	user := os.Getenv("CALCULATORD_RABBIT_USER")
 	pass := os.Getenv("CALCULATORD_RABBIT_PASS")
 	return fmt.Sprintf("amqp://%s:%s@%s/", user, pass, opts.rabbitAddr)
 }
 
-func daemonize(opts daemonOpts) error {
+// daemonize serves the API until ctx is done, then drains in-flight RPCs for up
+// to the grace period before releasing its connections.
+func daemonize(ctx context.Context, opts daemonOpts) error {
 	metricsRegistry := prometheus.NewRegistry()
 	metricsRegistry.MustRegister(
 		collectors.NewGoCollector(),
@@ -88,15 +256,123 @@ func daemonize(opts daemonOpts) error {
 
 		datastore := store.NewCalculationStore(etcdClient)
 
-		rmqConn, err := amqp.Dial(opts.RabbitURL())
+		producer, err := newProducer(opts, etcdClient)
 		if err != nil {
-			listenErr <- fmt.Errorf("error dialing rabbitmq at %q: %w", opts.rabbitAddr, err)
+			listenErr <- err
 			return
 		}
-		defer rmqConn.Close()
 
-		producer := workqueue.NewProducer(rmqConn,
-			workqueue.WithQueueName[workqueue.Producer](opts.queueName))
+		spoolDone := make(chan struct{})
+		if opts.spool.path != "" {
+			spool, err := workqueue.NewSpool(producer, opts.spool.path,
+				workqueue.WithMaxSpoolBytes[workqueue.Spool](opts.spool.maxBytes),
+				workqueue.WithFsyncPolicy[workqueue.Spool](opts.spool.fsync),
+				workqueue.WithReplayInterval[workqueue.Spool](opts.spool.replayInterval),
+			)
+			if err != nil {
+				listenErr <- err
+				return
+			}
+			metricsRegistry.MustRegister(spool)
+
+			go func() {
+				defer close(spoolDone)
+				spool.Run(ctx)
+			}()
+
+			producer = spooledProducer{spool, producer}
+		} else {
+			close(spoolDone)
+		}
+
+		// Every replica runs a scheduler but only the leader publishes.
+		schedulerDone := make(chan struct{})
+		go func() {
+			defer close(schedulerDone)
+			var schedulerOpts []scheduler.Option
+			if opts.protobufJobs {
+				schedulerOpts = append(schedulerOpts, scheduler.WithProtobufJobs())
+			}
+			s := scheduler.New(datastore, producer, opts.scheduleInterval, schedulerOpts...)
+			err := leader.Run(ctx, etcdClient, "calculatord/scheduler", s.Run)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("error running scheduler: %s", err)
+			}
+		}()
+
+		// Only the leader runs recurring schedules, as often as it checks for
+		// scheduled calculations.
+		recurringDone := make(chan struct{})
+		go func() {
+			defer close(recurringDone)
+			recurringOpts := []recurring.Option{recurring.WithHistory(opts.scheduleHistory)}
+			if opts.protobufJobs {
+				recurringOpts = append(recurringOpts, recurring.WithProtobufJobs())
+			}
+			s := recurring.New(datastore, producer, opts.scheduleInterval, recurringOpts...)
+			err := leader.Run(ctx, etcdClient, "calculatord/recurring", s.Run)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("error running recurring scheduler: %s", err)
+			}
+		}()
+
+		// Only the leader advances pipelines.
+		coordinatorDone := make(chan struct{})
+		go func() {
+			defer close(coordinatorDone)
+			var coordinatorOpts []coordinator.Option
+			if opts.protobufJobs {
+				coordinatorOpts = append(coordinatorOpts, coordinator.WithProtobufJobs())
+			}
+			c := coordinator.New(datastore, producer, opts.coordinateInterval, coordinatorOpts...)
+			err := leader.Run(ctx, etcdClient, "calculatord/coordinator", c.Run)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("error running coordinator: %s", err)
+			}
+		}()
+
+		// Likewise, only the leader reaps calculations left by dead workers.
+		reaperDone := make(chan struct{})
+		go func() {
+			defer close(reaperDone)
+			if opts.reapInterval <= 0 {
+				return
+			}
+			reaperOpts := []reaper.Option{reaper.WithAction(opts.reapAction)}
+			if opts.protobufJobs {
+				reaperOpts = append(reaperOpts, reaper.WithProtobufJobs())
+			}
+			heartbeats := store.NewHeartbeatStore(etcdClient)
+			r := reaper.New(datastore, heartbeats, producer, opts.reapInterval, reaperOpts...)
+			err := leader.Run(ctx, etcdClient, "calculatord/reaper", r.Run)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("error running reaper: %s", err)
+			}
+		}()
+
+		// And only the leader republishes calculations that were never started.
+		reconcilerDone := make(chan struct{})
+		if opts.reconcile.interval > 0 {
+			var reconcilerOpts []reconciler.Option
+			if opts.reconcile.dryRun {
+				reconcilerOpts = append(reconcilerOpts, reconciler.WithDryRun())
+			}
+			if opts.protobufJobs {
+				reconcilerOpts = append(reconcilerOpts, reconciler.WithProtobufJobs())
+			}
+			r := reconciler.New(datastore, producer, opts.reconcile.interval, opts.reconcile.threshold, reconcilerOpts...)
+			metricsRegistry.MustRegister(r)
+
+			go func() {
+				defer close(reconcilerDone)
+				err := leader.Run(ctx, etcdClient, "calculatord/reconciler", r.Run)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("error running reconciler: %s", err)
+				}
+			}()
+		} else {
+			close(reconcilerDone)
+		}
 
 		listener, err := net.Listen("tcp", opts.listenAddr)
 		if err != nil {
@@ -119,27 +395,168 @@ func daemonize(opts daemonOpts) error {
 			grpc.ChainUnaryInterceptor(srvMetrics.UnaryServerInterceptor()),
 		}
 		gRPCServer := grpc.NewServer(grpcOpts...)
-		pb.RegisterCalculationsServer(gRPCServer, apiserver.NewCalculations(datastore, producer))
+		apiOpts := []apiserver.Option{apiserver.WithMaxBatchGetOperations(opts.maxBatchGet)}
+		if opts.protobufJobs {
+			apiOpts = append(apiOpts, apiserver.WithProtobufJobs())
+		}
+		if opts.resultCache {
+			cacheMetrics := resultcache.NewMetrics()
+			metricsRegistry.MustRegister(cacheMetrics)
+
+			// The TTL only applies to results put, which the workers do.
+			var results resultcache.Cache = cacheMetrics.Instrument("etcd", store.NewResultStore(etcdClient, 0))
+			if opts.resultCacheSize > 0 {
+				results = cacheMetrics.Instrument("memory", resultcache.NewLRU(results, opts.resultCacheSize))
+			}
+			apiOpts = append(apiOpts, apiserver.WithResultCache(results))
+		}
+		if opts.coalesce {
+			apiOpts = append(apiOpts, apiserver.WithCoalescing())
+		}
+		if opts.inlineThreshold > 0 {
+			apiOpts = append(apiOpts, apiserver.WithInlineThreshold(opts.inlineThreshold))
+		}
+		if len(opts.callbackHosts) > 0 {
+			apiOpts = append(apiOpts, apiserver.WithCallbackHosts(opts.callbackHosts))
+		}
+		pb.RegisterCalculationsServer(gRPCServer, apiserver.NewCalculations(datastore, producer, apiOpts...))
 
-		listenErr <- gRPCServer.Serve(listener)
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			<-ctx.Done()
+			log.Print("draining gRPC server...")
+			stopGRPCServer(gRPCServer, opts.gracePeriod)
+		}()
+
+		// Serve returns as soon as a stop begins, so wait for in-flight RPCs
+		// to drain before the producer they may be publishing with is closed.
+		if err := gRPCServer.Serve(listener); err != nil {
+			listenErr <- err
+			return
+		}
+		<-drained
+		<-schedulerDone
+		<-recurringDone
+		<-coordinatorDone
+		<-reaperDone
+		<-reconcilerDone
+		<-spoolDone
+
+		if err := producer.Close(); err != nil {
+			log.Printf("error closing producer: %s", err)
+		}
+
+		listenErr <- nil
 	}()
 
-	metricsErr := make(chan error)
-	go func() {
-		handler := promhttp.HandlerFor(metricsRegistry,
+	metricsServer := &http.Server{
+		Addr: opts.metricsAddr,
+		Handler: promhttp.HandlerFor(metricsRegistry,
 			promhttp.HandlerOpts{
 				Timeout: 30 * time.Second,
 			},
-		)
-		metricsErr <- http.ListenAndServe(opts.metricsAddr, handler)
+		),
+	}
+
+	metricsErr := make(chan error)
+	go func() {
+		if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			metricsErr <- err
+		}
 	}()
 
 	log.Printf("running on %s with metrics on %s...", opts.listenAddr, opts.metricsAddr)
 
 	select {
 	case err := <-listenErr:
-		return fmt.Errorf("error running gRPC server: %w", err)
+		if err != nil {
+			return fmt.Errorf("error running gRPC server: %w", err)
+		}
 	case err := <-metricsErr:
 		return fmt.Errorf("error running metrics service: %w", err)
 	}
+
+	log.Print("gRPC server stopped; shutting down metrics service...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.gracePeriod)
+	defer cancel()
+
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("error shutting down metrics service: %w", err)
+	}
+
+	return nil
+}
+
+// jobProducer publishes jobs for the workers.
+type jobProducer interface {
+	PublishJSON(context.Context, any) error
+	Close() error
+}
+
+// rabbitMQProducer closes the connection along with the producer.
+type rabbitMQProducer struct {
+	*workqueue.Producer
+	conn *workqueue.RedialingConnection
+}
+
+func (p rabbitMQProducer) Close() error {
+	return errors.Join(p.Producer.Close(), p.conn.Close())
+}
+
+// spooledProducer publishes through a spool in front of producer.
+type spooledProducer struct {
+	*workqueue.Spool
+	producer jobProducer
+}
+
+func (p spooledProducer) Close() error {
+	return errors.Join(p.Spool.Close(), p.producer.Close())
+}
+
+// newProducer returns a producer for the configured queue backend.
+func newProducer(opts daemonOpts, etcdClient *clientv3.Client) (jobProducer, error) {
+	if opts.queueBackend == queueBackendEtcd {
+		return workqueue.NewEtcdProducer(etcdClient,
+			workqueue.WithPrefix[workqueue.EtcdProducer]("workqueues/"+opts.queueName),
+		), nil
+	}
+
+	rmqConn, err := workqueue.DialRedialing(opts.RabbitURL())
+	if err != nil {
+		return nil, fmt.Errorf("error dialing rabbitmq at %q: %w", opts.rabbitAddr, err)
+	}
+
+	producerOpts := []workqueue.AMQP091Option[workqueue.Producer]{
+		workqueue.WithQueueName[workqueue.Producer](opts.queueName),
+		workqueue.WithMaxPriority[workqueue.Producer](opts.maxPriority),
+		workqueue.WithDeadLetterExchange[workqueue.Producer](opts.deadLetterExchange),
+	}
+	if opts.exchange != "" {
+		producerOpts = append(producerOpts,
+			workqueue.WithExchange[workqueue.Producer](opts.exchange, opts.exchangeKind))
+	}
+
+	return rabbitMQProducer{workqueue.NewProducer(rmqConn, producerOpts...), rmqConn}, nil
+}
+
+// stopGRPCServer gracefully stops s, forcing it to stop if in-flight RPCs do not
+// finish within the grace period.
+func stopGRPCServer(s *grpc.Server, gracePeriod time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+
+	grace := time.NewTimer(gracePeriod)
+	defer grace.Stop()
+
+	select {
+	case <-stopped:
+	case <-grace.C:
+		log.Printf("RPCs did not finish within %s; forcing gRPC server to stop", gracePeriod)
+		s.Stop()
+	}
 }
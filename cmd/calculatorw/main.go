@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	grpcprom "github.com/grpc-ecosystem/go-grpc-middleware/providers/prometheus"
@@ -15,6 +20,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/vickleford/calculator/internal/leader"
+	"github.com/vickleford/calculator/internal/notifier"
 	"github.com/vickleford/calculator/internal/store"
 	"github.com/vickleford/calculator/internal/worker"
 	"github.com/vickleford/calculator/internal/workqueue"
@@ -26,36 +33,153 @@ func main() {
 	metricsAddr := flag.String("metrics", ":8081", "prometheus http metrics endpoint")
 	etcdAddr := flag.String("etcdAddr", "localhost:2379", "etcd endpoints")
 	rabbitAddr := flag.String("rmqAddr", "localhost:5672", "rabbitmq address")
+	queueBackend := flag.String("queue-backend", queueBackendRabbitMQ, "where to take jobs from: rabbitmq or etcd")
 	queueName := flag.String("queue", "calculations", "the workqueue name to use")
+	maxPriority := flag.Uint("maxPriority", 0, "declare the queue as a priority queue with this maximum priority, up to 255; 0 disables priorities")
+	exchange := flag.String("exchange", "", "the exchange to bind the queue to; the default exchange is used when empty")
+	deadLetterExchange := flag.String("deadLetterExchange", "", "the exchange to send rejected jobs to, such as jobs of an unknown version; the queue must be redeclared to change it")
+	exchangeKind := flag.String("exchangeKind", amqp.ExchangeDirect, "the kind of exchange to declare, such as direct or topic")
+	routingKeys := flag.String("routingKeys", worker.FibonacciOfRoutingKey, "comma separated routing keys of the jobs to take from the exchange")
+	gracePeriod := flag.Duration("gracePeriod", 30*time.Second, "how long in-flight calculations may take to finish on shutdown")
+	maxExecutionTime := flag.Duration("maxExecutionTime", 0, "how long a calculation may run before it fails with DEADLINE_EXCEEDED; 0 means no limit")
+	messageTimeout := flag.Duration("messageTimeout", 0, "how long a message may be handled before it is canceled, failing its calculation with DEADLINE_EXCEEDED; 0 means no limit")
+	retryMaxAttempts := flag.Int("retryMaxAttempts", 0, "how many times to try reading or writing a calculation before giving up on the job; 0 means no limit")
+	retryMaxElapsed := flag.Duration("retryMaxElapsed", 0, "how long to retry reading or writing a calculation before giving up on the job; 0 means no limit")
+	retryJitter := flag.String("retryJitter", "none", "how to spread out retries of reading or writing calculations: none, full or equal")
+	heartbeatTTL := flag.Duration("heartbeatTTL", 10*time.Second, "how long after the worker dies its running calculation is considered stalled; 0 disables heartbeats")
+	resultCacheTTL := flag.Duration("resultCacheTTL", 0, "how long to cache the results of successful calculations for identical calculations to reuse; 0 disables caching")
+	coalesce := flag.Bool("coalesce", false, "complete the calculations following each calculation run with its outcome; enable it before the daemon coalesces")
+	callbacks := flag.Bool("callbacks", false, "call back the clients of calculations that ask for it, signing with CALCULATORW_CALLBACK_SECRET; enable it before the daemon allows callbacks")
+	callbackAttempts := flag.Int("callbackAttempts", 5, "how many times to try calling back a client; at least 1")
+	callbackRedeliverAfter := flag.Duration("callbackRedeliverAfter", notifier.DefaultRedeliverAfter, "how long a pending callback goes without being attempted before a worker delivers it again, such as after the worker delivering it stopped; longer than a minute plus an attempt's timeout, and 0 disables redelivery")
+	callbackEncoding := flag.String("callbackEncoding", callbackEncodingJSON, "how to encode the operations sent to callbacks: json or protobuf")
 	flag.Parse()
 
+	if *maxPriority > math.MaxUint8 {
+		log.Fatalf("maxPriority must not be greater than %d", math.MaxUint8)
+	}
+
+	if *queueBackend != queueBackendRabbitMQ && *queueBackend != queueBackendEtcd {
+		log.Fatalf("queue-backend must be %q or %q", queueBackendRabbitMQ, queueBackendEtcd)
+	}
+
+	if *callbackEncoding != callbackEncodingJSON && *callbackEncoding != callbackEncodingProtobuf {
+		log.Fatalf("callbackEncoding must be %q or %q", callbackEncodingJSON, callbackEncodingProtobuf)
+	}
+
+	if *callbackAttempts < 1 {
+		log.Fatalf("callbackAttempts must be at least 1")
+	}
+
+	callbackSecret := os.Getenv("CALCULATORW_CALLBACK_SECRET")
+	if *callbacks && callbackSecret == "" {
+		log.Fatalf("CALCULATORW_CALLBACK_SECRET must be set to call back clients")
+	}
+
+	jitter, ok := jitters[*retryJitter]
+	if !ok {
+		log.Fatalf("retryJitter must be none, full or equal")
+	}
+
+	retryPolicy := worker.DefaultStoreRetryPolicy
+	retryPolicy.MaxAttempts = *retryMaxAttempts
+	retryPolicy.MaxElapsed = *retryMaxElapsed
+	retryPolicy.Jitter = jitter
+	retryPolicy.OnRetry = func(attempt int, err error, delay time.Duration) {
+		log.Printf("retrying in %s after attempt %d failed: %s", delay, attempt, err)
+	}
+
 	opts := workerOpts{
-		metricsAddr: *metricsAddr,
-		etcdAddr:    *etcdAddr,
-		rabbitAddr:  *rabbitAddr,
-		queueName:   *queueName,
+		metricsAddr:        *metricsAddr,
+		etcdAddr:           *etcdAddr,
+		rabbitAddr:         *rabbitAddr,
+		queueBackend:       *queueBackend,
+		queueName:          *queueName,
+		maxPriority:        uint8(*maxPriority),
+		exchange:           *exchange,
+		exchangeKind:       *exchangeKind,
+		deadLetterExchange: *deadLetterExchange,
+		routingKeys:        strings.Split(*routingKeys, ","),
+		gracePeriod:        *gracePeriod,
+		messageTimeout:     *messageTimeout,
+		maxExecutionTime:   *maxExecutionTime,
+		heartbeatTTL:       *heartbeatTTL,
+		resultCacheTTL:     *resultCacheTTL,
+		coalesce:           *coalesce,
+		retryPolicy:        retryPolicy,
+		callbacks: callbackOpts{
+			enabled:        *callbacks,
+			secret:         []byte(callbackSecret),
+			attempts:       *callbackAttempts,
+			redeliverAfter: *callbackRedeliverAfter,
+			protobuf:       *callbackEncoding == callbackEncodingProtobuf,
+		},
 	}
 
-	log.Fatal(daemonize(opts))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := daemonize(ctx, opts); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("shut down")
 }
 
 type workerOpts struct {
-	metricsAddr string
-	etcdAddr    string
-	rabbitAddr  string
-	queueName   string
+	metricsAddr        string
+	etcdAddr           string
+	rabbitAddr         string
+	queueBackend       string
+	queueName          string
+	maxPriority        uint8
+	exchange           string
+	exchangeKind       string
+	deadLetterExchange string
+	routingKeys        []string
+	gracePeriod        time.Duration
+	messageTimeout     time.Duration
+	maxExecutionTime   time.Duration
+	heartbeatTTL       time.Duration
+	resultCacheTTL     time.Duration
+	coalesce           bool
+	retryPolicy        worker.RetryPolicy
+	callbacks          callbackOpts
 }
 
+type callbackOpts struct {
+	enabled        bool
+	secret         []byte
+	attempts       int
+	redeliverAfter time.Duration
+	protobuf       bool
+}
+
+var jitters = map[string]worker.Jitter{
+	"none":  worker.NoJitter,
+	"full":  worker.FullJitter,
+	"equal": worker.EqualJitter,
+}
+
+const (
+	queueBackendRabbitMQ = "rabbitmq"
+	queueBackendEtcd     = "etcd"
+)
+
+const (
+	callbackEncodingJSON     = "json"
+	callbackEncodingProtobuf = "protobuf"
+)
+
 func (opts workerOpts) RabbitURL() string {
 	user := os.Getenv("CALCULATORW_RABBIT_USER")
 	pass := os.Getenv("CALCULATORW_RABBIT_PASS")
 	return fmt.Sprintf("amqp://%s:%s@%s/", user, pass, opts.rabbitAddr)
 }
 
-func daemonize(opts workerOpts) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
+// daemonize runs the worker until ctx is done, then stops taking new jobs and
+// gives the calculation in progress up to the grace period to finish.
+func daemonize(ctx context.Context, opts workerOpts) error {
 	metricsRegistry := prometheus.NewRegistry()
 	metricsRegistry.MustRegister(
 		collectors.NewGoCollector(),
@@ -87,39 +211,167 @@ func daemonize(opts workerOpts) error {
 
 		datastore := store.NewCalculationStore(etcdClient)
 
-		rmqConn, err := amqp.Dial(opts.RabbitURL())
+		handlerOpts := []worker.Option{
+			worker.WithMaxExecutionTime(opts.maxExecutionTime),
+			worker.WithRetryPolicy(opts.retryPolicy),
+		}
+		if opts.heartbeatTTL > 0 {
+			heartbeats := store.NewHeartbeatStore(etcdClient)
+			handlerOpts = append(handlerOpts, worker.WithHeartbeats(heartbeats, opts.heartbeatTTL))
+		}
+		if opts.resultCacheTTL > 0 {
+			results := store.NewResultStore(etcdClient, opts.resultCacheTTL)
+			handlerOpts = append(handlerOpts, worker.WithResultCache(results))
+		}
+		if opts.coalesce {
+			handlerOpts = append(handlerOpts, worker.WithCoalescing(datastore))
+		}
+		var callbacks *notifier.Notifier
+		if opts.callbacks.enabled {
+			policy := notifier.DefaultRetryPolicy
+			policy.MaxAttempts = opts.callbacks.attempts
+			notifierOpts := []notifier.Option{notifier.WithRetryPolicy(policy)}
+			if opts.callbacks.protobuf {
+				notifierOpts = append(notifierOpts, notifier.WithProtobufPayloads())
+			}
+			if opts.callbacks.redeliverAfter > 0 {
+				notifierOpts = append(notifierOpts, notifier.WithRedeliverAfter(opts.callbacks.redeliverAfter))
+			}
+			callbacks = notifier.New(datastore, opts.callbacks.secret, notifierOpts...)
+			handlerOpts = append(handlerOpts, worker.WithNotifier(callbacks))
+		}
+
+		// Only the leader among the workers redelivers the callbacks left
+		// behind by workers that stopped.
+		redeliveryCtx, stopRedelivery := context.WithCancel(ctx)
+		defer stopRedelivery()
+		redeliveryDone := make(chan struct{})
+		go func() {
+			defer close(redeliveryDone)
+			if callbacks == nil || opts.callbacks.redeliverAfter <= 0 {
+				return
+			}
+			err := leader.Run(redeliveryCtx, etcdClient, "calculatorw/callbacks", callbacks.Run)
+			if err != nil && redeliveryCtx.Err() == nil {
+				log.Printf("error redelivering callbacks: %s", err)
+			}
+		}()
+
+		fibonacciOfHandler := worker.NewFibOf(datastore, handlerOpts...)
+
+		handlerMetrics := workqueue.NewHandlerMetrics()
+		metricsRegistry.MustRegister(handlerMetrics)
+
+		middleware := []workqueue.Middleware{
+			handlerMetrics.Middleware(),
+			workqueue.Logging(slog.Default()),
+			workqueue.Recover(),
+		}
+		if opts.messageTimeout > 0 {
+			middleware = append(middleware, workqueue.Timeout(opts.messageTimeout))
+		}
+
+		handler := workqueue.Chain(fibonacciOfHandler, middleware...)
+
+		consumer, closeConsumer, err := newConsumer(opts, etcdClient, handler)
 		if err != nil {
-			workerErr <- fmt.Errorf("error dialing rabbitmq at %q: %w", opts.rabbitAddr, err)
+			workerErr <- err
 			return
 		}
-		defer rmqConn.Close()
+		defer closeConsumer()
 
-		fibonacciOfHandler := worker.NewFibOf(datastore)
+		err = consumer.Start(ctx)
+		if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+			// Shutdown was requested; this is not a failure.
+			err = nil
+		}
 
-		consumer := workqueue.NewConsumer(rmqConn,
-			fibonacciOfHandler,
-			workqueue.WithQueueName[workqueue.AMQP091Consumer](opts.queueName),
-		)
+		stopRedelivery()
+		<-redeliveryDone
 
-		workerErr <- consumer.Start(ctx)
+		if callbacks != nil {
+			// Callbacks are delivered in the background, so give those in
+			// progress the grace period to finish while etcd is still open.
+			// Those that do not finish are redelivered by another worker.
+			waitCtx, cancel := context.WithTimeout(context.Background(), opts.gracePeriod)
+			if err := callbacks.Wait(waitCtx); err != nil {
+				log.Printf("gave up waiting for callbacks to be delivered: %s", err)
+			}
+			cancel()
+		}
+		workerErr <- err
 	}()
 
-	metricsErr := make(chan error)
-	go func() {
-		handler := promhttp.HandlerFor(metricsRegistry,
+	metricsServer := &http.Server{
+		Addr: opts.metricsAddr,
+		Handler: promhttp.HandlerFor(metricsRegistry,
 			promhttp.HandlerOpts{
 				Timeout: 30 * time.Second,
 			},
-		)
-		metricsErr <- http.ListenAndServe(opts.metricsAddr, handler)
+		),
+	}
+
+	metricsErr := make(chan error)
+	go func() {
+		if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			metricsErr <- err
+		}
 	}()
 
 	log.Printf("running worker with metrics on %s...", opts.metricsAddr)
 
 	select {
 	case err := <-workerErr:
-		return fmt.Errorf("error running worker: %w", err)
+		if err != nil {
+			return fmt.Errorf("error running worker: %w", err)
+		}
 	case err := <-metricsErr:
 		return fmt.Errorf("error running metrics service: %w", err)
 	}
+
+	log.Print("worker stopped; shutting down metrics service...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.gracePeriod)
+	defer cancel()
+
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("error shutting down metrics service: %w", err)
+	}
+
+	return nil
+}
+
+// newConsumer returns a consumer for the configured queue backend and a function
+// to release its connections once it has stopped.
+func newConsumer(opts workerOpts, etcdClient *clientv3.Client, handler workqueue.Handler) (interface {
+	Start(context.Context) error
+}, func(), error) {
+	if opts.queueBackend == queueBackendEtcd {
+		consumer := workqueue.NewEtcdConsumer(etcdClient, handler,
+			workqueue.WithPrefix[workqueue.EtcdConsumer]("workqueues/"+opts.queueName),
+			workqueue.WithEtcdGracePeriod[workqueue.EtcdConsumer](opts.gracePeriod),
+		)
+		return consumer, func() {}, nil
+	}
+
+	rmqConn, err := amqp.Dial(opts.RabbitURL())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error dialing rabbitmq at %q: %w", opts.rabbitAddr, err)
+	}
+
+	consumerOpts := []workqueue.AMQP091Option[workqueue.AMQP091Consumer]{
+		workqueue.WithQueueName[workqueue.AMQP091Consumer](opts.queueName),
+		workqueue.WithMaxPriority[workqueue.AMQP091Consumer](opts.maxPriority),
+		workqueue.WithDeadLetterExchange[workqueue.AMQP091Consumer](opts.deadLetterExchange),
+		workqueue.WithGracePeriod[workqueue.AMQP091Consumer](opts.gracePeriod),
+	}
+	if opts.exchange != "" {
+		consumerOpts = append(consumerOpts,
+			workqueue.WithExchange[workqueue.AMQP091Consumer](opts.exchange, opts.exchangeKind),
+			workqueue.WithBindings[workqueue.AMQP091Consumer](opts.routingKeys...),
+		)
+	}
+
+	consumer := workqueue.NewConsumer(rmqConn, handler, consumerOpts...)
+	return consumer, func() { rmqConn.Close() }, nil
 }
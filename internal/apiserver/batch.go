@@ -0,0 +1,235 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (c *Calculations) BatchFibonacciOf(
+	ctx context.Context,
+	req *pb.BatchFibonacciOfRequest,
+) (*pb.BatchFibonacciOfResponse, error) {
+	if err := validateBatchFibonacciOfRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	resp := &pb.BatchFibonacciOfResponse{
+		Results: make([]*pb.BatchFibonacciOfResult, len(req.Requests)),
+	}
+
+	var calculations []store.Calculation
+	var jobs []worker.FibonacciOfJob
+	// indexes are the positions in the request of the calculations created
+	// together.
+	var indexes []int
+	var scheduled []store.Calculation
+	var scheduledIndexes []int
+
+	batch := store.Batch{
+		Name:    uuid.New().String(),
+		Created: c.clock.Now(),
+	}
+
+	for i, r := range req.Requests {
+		calculation, job, err := c.newFibonacciOf(r)
+		if err != nil {
+			resp.Results[i] = batchError(err)
+			continue
+		}
+		batch.Calculations = append(batch.Calculations, calculation.Name)
+
+		// Scheduled calculations are rare enough in a batch to create on
+		// their own.
+		if calculation.Metadata.Scheduled != nil {
+			scheduled = append(scheduled, calculation)
+			scheduledIndexes = append(scheduledIndexes, i)
+			continue
+		}
+
+		calculations = append(calculations, calculation)
+		jobs = append(jobs, job)
+		indexes = append(indexes, i)
+	}
+
+	// A batch in which nothing is started has nothing to wait for.
+	if len(batch.Calculations) == 0 {
+		batch.Done = true
+		batch.Completed = &batch.Created
+	}
+
+	// Record the batch before creating any of its calculations, so that a
+	// client retrying after failing to record it does not start them twice.
+	// Those that then fail to be created count as failed in the batch.
+	if err := c.store.CreateBatch(ctx, batch); err != nil {
+		log.Printf("error saving batch: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	for j, calculation := range scheduled {
+		resp.Results[scheduledIndexes[j]] = batchResult(c.schedule(ctx, calculation))
+	}
+
+	createErrs := c.store.CreateMany(ctx, calculations)
+
+	var created []store.Calculation
+	var createdJobs []worker.FibonacciOfJob
+	var createdIndexes []int
+	for j, err := range createErrs {
+		if errors.Is(err, store.ErrKeyAlreadyExists) {
+			log.Printf("tried to create calculation %s but it already exists", calculations[j].Name)
+			resp.Results[indexes[j]] = batchError(status.Error(codes.AlreadyExists, "already exists"))
+		} else if err != nil {
+			log.Printf("error saving calculation: %s", err)
+			resp.Results[indexes[j]] = batchError(status.Error(codes.Internal, "internal error"))
+		} else {
+			created = append(created, calculations[j])
+			createdJobs = append(createdJobs, jobs[j])
+			createdIndexes = append(createdIndexes, indexes[j])
+		}
+	}
+
+	publishErrs := worker.PublishFibonacciOfBatch(ctx, c.fibOfWorkQ, createdJobs, c.protobufJobs)
+	for j, err := range publishErrs {
+		if err != nil {
+			log.Printf("error publishing to workQueue for %s: %s", created[j].Name, err)
+			resp.Results[createdIndexes[j]] = batchError(status.Error(codes.Internal, "internal error"))
+			continue
+		}
+		resp.Results[createdIndexes[j]] = batchResult(operationFromCalculation(created[j], c.clock.Now()))
+	}
+
+	var err error
+	resp.Batch, err = batchOperation(batch, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func batchResult(op *longrunningpb.Operation, err error) *pb.BatchFibonacciOfResult {
+	if err != nil {
+		return batchError(err)
+	}
+
+	return &pb.BatchFibonacciOfResult{
+		Result: &pb.BatchFibonacciOfResult_Operation{Operation: op},
+	}
+}
+
+func batchError(err error) *pb.BatchFibonacciOfResult {
+	return &pb.BatchFibonacciOfResult{
+		Result: &pb.BatchFibonacciOfResult_Error{Error: status.Convert(err).Proto()},
+	}
+}
+
+// getBatchOperation returns the operation of the named batch, which is done
+// once every calculation in it is done, or of the pipeline by that name if there
+// is no such batch. Its errors are gRPC status errors.
+func (c *Calculations) getBatchOperation(ctx context.Context, name string) (*longrunningpb.Operation, error) {
+	batch, err := c.store.GetBatch(ctx, name)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return c.getPipelineOperation(ctx, name)
+	} else if err != nil {
+		log.Printf("error getting batch: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	return c.batchProgress(ctx, batch)
+}
+
+// batchProgress represents a batch as an operation, counting its calculations
+// that are done unless the batch is known to be done.
+func (c *Calculations) batchProgress(ctx context.Context, batch store.Batch) (*longrunningpb.Operation, error) {
+	if batch.Done {
+		return batchOperation(batch, len(batch.Calculations), batch.Failed)
+	}
+
+	calculations, err := c.store.GetMany(ctx, batch.Calculations)
+	if err != nil {
+		log.Printf("error getting calculations of batch %q: %s", batch.Name, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	now := c.clock.Now()
+
+	// Calculations that do not exist, such as those that failed to be
+	// created, count as failed.
+	done := len(batch.Calculations) - len(calculations)
+	failed := done
+	for _, calc := range calculations {
+		expired := calc.Metadata.Deadline != nil && !now.Before(*calc.Metadata.Deadline)
+		if calc.Done || expired {
+			done++
+		}
+		if calc.Error != nil || (!calc.Done && expired) {
+			failed++
+		}
+	}
+
+	if done == len(batch.Calculations) {
+		batch.Done = true
+		batch.Completed = &now
+		batch.Succeeded = done - failed
+		batch.Failed = failed
+
+		// Remember that the batch is done so that its calculations need not
+		// be read again. It can be worked out again if this fails.
+		if err := c.store.SaveBatch(ctx, batch); err != nil {
+			log.Printf("error saving done batch %q: %s", batch.Name, err)
+		}
+	}
+
+	return batchOperation(batch, done, failed)
+}
+
+// batchOperation represents a batch as an operation, given how many of its
+// calculations are done and how many of those failed.
+func batchOperation(batch store.Batch, done, failed int) (*longrunningpb.Operation, error) {
+	metadata := &pb.BatchMetadata{
+		Created:    timestamppb.New(batch.Created),
+		Operations: batch.Calculations,
+		Done:       int32(done),
+		Failed:     int32(failed),
+	}
+	if batch.Completed != nil {
+		metadata.Completed = timestamppb.New(*batch.Completed)
+	}
+
+	metadataAsAnyPB, err := anypb.New(metadata)
+	if err != nil {
+		log.Printf("error marshaling batch %q metadata to proto: %s", batch.Name, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	op := &longrunningpb.Operation{
+		Name:     batch.Name,
+		Metadata: metadataAsAnyPB,
+		Done:     batch.Done,
+	}
+
+	if batch.Done {
+		result, err := anypb.New(&pb.BatchResult{
+			Succeeded: int32(batch.Succeeded),
+			Failed:    int32(batch.Failed),
+		})
+		if err != nil {
+			log.Printf("error setting batch result to Any: %s", err)
+			return nil, status.Error(codes.Internal, "internal error")
+		}
+		op.Result = &longrunningpb.Operation_Response{Response: result}
+	}
+
+	return op, nil
+}
@@ -6,78 +6,201 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"cloud.google.com/go/longrunning/autogen/longrunningpb"
 	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/calculators"
+	"github.com/vickleford/calculator/internal/clock"
+	"github.com/vickleford/calculator/internal/operations"
 	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/resultcache"
 	"github.com/vickleford/calculator/internal/store"
 	"github.com/vickleford/calculator/internal/worker"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/types/known/anypb"
-	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var _ pb.CalculationsServer = &Calculations{}
 
+const (
+	defaultListPageSize = 50
+	maxListPageSize     = 1000
+	maxBatchSize        = 1000
+	maxPipelineSteps    = 32
+
+	defaultMaxBatchGetOperations = 100
+)
+
 type Calculations struct {
 	pb.UnimplementedCalculationsServer
 	store      datastore
 	fibOfWorkQ queue
+	clock      clock.Clock
+
+	// results, when set, completes calculations whose result is already
+	// known without running them.
+	results resultCache
+
+	// inline calculates calculations costing at most inlineThreshold at once
+	// rather than queue them for a worker.
+	inline          bool
+	inlineThreshold int64
+
+	// coalesce has calculations follow an identical calculation in flight
+	// rather than run themselves.
+	coalesce bool
+
+	// maxBatchGet limits how many operations BatchGetOperations gets at once.
+	maxBatchGet int
+
+	// callbackHosts are the hosts callback URLs may point to.
+	callbackHosts []string
+
+	protobufJobs bool
 }
 
 type datastore interface {
 	Create(context.Context, store.Calculation) error
 	Get(context.Context, string) (store.Calculation, error)
+	List(context.Context, string, int64) ([]store.Calculation, string, error)
+	CreateScheduled(context.Context, store.Calculation, json.RawMessage) error
+	CreateCoalesced(context.Context, store.Calculation, string) (string, error)
+	CreateMany(context.Context, []store.Calculation) []error
+	GetMany(context.Context, []string) ([]store.Calculation, error)
+	GetOperations(context.Context, []string) (store.Operations, error)
+	CreateBatch(context.Context, store.Batch) error
+	GetBatch(context.Context, string) (store.Batch, error)
+	SaveBatch(context.Context, store.Batch) error
+	CreatePipeline(context.Context, store.Pipeline) error
+	GetPipeline(context.Context, string) (store.Pipeline, error)
+	CreateSchedule(context.Context, store.Schedule) error
+	ListSchedules(context.Context, string, int64) ([]store.Schedule, string, error)
+	DeleteSchedule(context.Context, string) error
 }
 
 type queue interface {
 	PublishJSON(context.Context, any) error
 }
 
-func NewCalculations(store datastore, fibOfWorkQ queue) *Calculations {
-	return &Calculations{
-		store:      store,
-		fibOfWorkQ: fibOfWorkQ,
+type resultCache interface {
+	Get(context.Context, string) (json.RawMessage, bool, error)
+}
+
+type Option func(*Calculations)
+
+// WithProtobufJobs publishes jobs as protobuf when the queue supports it. Every
+// worker must be able to decode protobuf jobs first.
+func WithProtobufJobs() Option {
+	return func(c *Calculations) {
+		c.protobufJobs = true
+	}
+}
+
+// WithClock tells the time with clk.
+func WithClock(clk clock.Clock) Option {
+	return func(c *Calculations) {
+		c.clock = clk
+	}
+}
+
+// WithResultCache completes calculations at once with the result of an
+// identical calculation found in results, unless they skip the cache.
+func WithResultCache(results resultCache) Option {
+	return func(c *Calculations) {
+		c.results = results
+	}
+}
+
+// WithCoalescing has a calculation follow an identical calculation in flight,
+// sharing its outcome, rather than publish its own job. Calculations with a
+// deadline or a priority are not coalesced, so that they never wait on a
+// calculation without. Every worker must complete the followers of the
+// calculations they run first.
+func WithCoalescing() Option {
+	return func(c *Calculations) {
+		c.coalesce = true
+	}
+}
+
+// WithInlineThreshold calculates calculations whose estimated cost is at most
+// cost while handling the request, rather than queue them for a worker,
+// unless they force it. Calculations that are scheduled are always queued.
+func WithInlineThreshold(cost int64) Option {
+	return func(c *Calculations) {
+		c.inline = true
+		c.inlineThreshold = cost
+	}
+}
+
+// WithMaxBatchGetOperations limits BatchGetOperations to getting at most n
+// operations at once. It panics if n is not positive.
+func WithMaxBatchGetOperations(n int) Option {
+	if n < 1 {
+		panic(fmt.Sprintf("max batch get operations must be positive, not %d", n))
+	}
+
+	return func(c *Calculations) {
+		c.maxBatchGet = n
+	}
+}
+
+// WithCallbackHosts lets calculations be requested with a callback URL to any
+// of hosts, each a host name allowing any port or a host and port. Callbacks
+// are refused without it. The workers must call them back.
+func WithCallbackHosts(hosts []string) Option {
+	return func(c *Calculations) {
+		c.callbackHosts = hosts
+	}
+}
+
+func NewCalculations(store datastore, fibOfWorkQ queue, opts ...Option) *Calculations {
+	c := &Calculations{
+		store:       store,
+		fibOfWorkQ:  fibOfWorkQ,
+		clock:       clock.Real{},
+		maxBatchGet: defaultMaxBatchGetOperations,
 	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
 }
 
 func (c *Calculations) FibonacciOf(
 	ctx context.Context,
 	req *pb.FibonacciOfRequest,
 ) (*longrunningpb.Operation, error) {
-	// A typical implementation should validate the request. For example,
-	// requesting the Fibonacci at positions 0 or -5 should not be allowed. This
-	// implementation foregoes validation in order to exercise jobs failing
-	// since it is more difficult to get this simple thing to fail with long
-	// executions.
-
-	metadata := &pb.CalculationMetadata{
-		Created: timestamppb.Now(),
-	}
-	pbMeta, err := anypb.New(metadata)
+	calculation, job, err := c.newFibonacciOf(req)
 	if err != nil {
-		log.Printf("error creating calculation metadata: %s", err)
-		return nil, status.Error(codes.Internal, "internal error")
+		return nil, err
 	}
 
-	op := &longrunningpb.Operation{
-		Name:     uuid.New().String(),
-		Metadata: pbMeta,
+	if calculation.Metadata.Scheduled != nil {
+		return c.schedule(ctx, calculation)
 	}
 
-	calculation := store.Calculation{
-		Name: op.Name,
-		Metadata: store.CalculationMetadata{
-			Created: metadata.Created.AsTime(),
-		},
+	// Only the workers call back, so calculations with a callback are queued
+	// for them.
+	if req.CallbackUrl == "" {
+		if result, ok := c.cachedResult(ctx, req); ok {
+			return c.completeFromCache(ctx, calculation, result)
+		}
+
+		if c.inline && !req.ForceAsync && calculators.FibonacciCost(req.NthPosition) <= c.inlineThreshold {
+			return c.calculateInline(ctx, calculation, req)
+		}
 	}
 
 	// TODO: When it errors, it should generate a new name and try again. If it
 	// still doesn't work, return an error.
 	// TODO: We need to additionally consider cleanup of the calculation in
 	// the store, and furthermore what happens if that fails.
-	if err := c.store.Create(ctx, calculation); errors.Is(err, store.ErrKeyAlreadyExists) {
+	primary, err := c.create(ctx, calculation, req)
+	if errors.Is(err, store.ErrKeyAlreadyExists) {
 		log.Printf("tried to create calculation %s but it already exists", calculation.Name)
 		return nil, status.Error(codes.AlreadyExists, "already exists")
 	} else if err != nil {
@@ -85,19 +208,197 @@ func (c *Calculations) FibonacciOf(
 		return nil, status.Error(codes.Internal, "internal error")
 	}
 
+	if primary != calculation.Name {
+		log.Printf("calculation %s follows identical calculation %s in flight", calculation.Name, primary)
+		calculation.Metadata.Primary = primary
+		return operationFromCalculation(calculation, c.clock.Now())
+	}
+
+	if err := worker.PublishFibonacciOf(ctx, c.fibOfWorkQ, job, c.protobufJobs); err != nil {
+		log.Printf("error publishing to workQueue for %s: %s", calculation.Name, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	return operationFromCalculation(calculation, c.clock.Now())
+}
+
+// newFibonacciOf validates req and returns a new calculation for it along with
+// the job that runs it. Its errors are gRPC status errors.
+func (c *Calculations) newFibonacciOf(req *pb.FibonacciOfRequest) (store.Calculation, worker.FibonacciOfJob, error) {
+	// The position is deliberately left for the worker to reject, such as 0
+	// or -5, in order to exercise jobs failing since it is more difficult to
+	// get this simple thing to fail with long executions. Everything else,
+	// including the callback URL below, is validated here.
+	if err := validateFibonacciOfRequest(req); err != nil {
+		return store.Calculation{}, worker.FibonacciOfJob{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	calculation := store.Calculation{
+		Name: uuid.New().String(),
+		Metadata: store.CalculationMetadata{
+			Created:  c.clock.Now(),
+			Priority: uint8(req.Priority),
+		},
+	}
+
 	job := worker.FibonacciOfJob{
 		OperationName: calculation.Name,
 		First:         req.First,
 		Second:        req.Second,
 		Position:      req.NthPosition,
+		Priority:      uint8(req.Priority),
 	}
 
-	if err := c.fibOfWorkQ.PublishJSON(ctx, job); err != nil {
-		log.Printf("error publishing to workQueue for %s: %s", calculation.Name, err)
+	if req.Deadline != nil {
+		deadline := req.Deadline.AsTime()
+		if !deadline.After(calculation.Metadata.Created) {
+			return store.Calculation{}, worker.FibonacciOfJob{}, status.Error(codes.InvalidArgument, "deadline has already passed")
+		}
+		calculation.Metadata.Deadline = &deadline
+		job.Deadline = &deadline
+	}
+
+	// A calculation scheduled for the past may as well start now.
+	if req.NotBefore != nil && req.NotBefore.AsTime().After(calculation.Metadata.Created) {
+		notBefore := req.NotBefore.AsTime()
+		calculation.Metadata.Scheduled = &notBefore
+	}
+
+	if req.CallbackUrl != "" {
+		if err := validateCallbackURL(req.CallbackUrl, c.callbackHosts); err != nil {
+			return store.Calculation{}, worker.FibonacciOfJob{}, status.Error(codes.InvalidArgument, err.Error())
+		}
+		calculation.Metadata.Callback = &store.Callback{
+			URL:   req.CallbackUrl,
+			State: store.CallbackPending,
+		}
+	}
+
+	// Keep the job with the calculation so that it can be published again if
+	// it is lost.
+	var err error
+	calculation.Job, err = json.Marshal(job.Envelope())
+	if err != nil {
+		log.Printf("error marshaling job for %s: %s", calculation.Name, err)
+		return store.Calculation{}, worker.FibonacciOfJob{}, status.Error(codes.Internal, "internal error")
+	}
+
+	return calculation, job, nil
+}
+
+// create creates the calculation and returns the name of the calculation to
+// run for it, which is an identical calculation in flight when coalescing.
+func (c *Calculations) create(ctx context.Context, calculation store.Calculation, req *pb.FibonacciOfRequest) (string, error) {
+	if !c.coalesce || req.Deadline != nil || req.Priority > 0 {
+		return calculation.Name, c.store.Create(ctx, calculation)
+	}
+
+	key := resultcache.FibonacciOfKey(req.First, req.Second, req.NthPosition)
+	return c.store.CreateCoalesced(ctx, calculation, key)
+}
+
+// cachedResult returns the result of an identical calculation if it is cached
+// and the request does not skip the cache. Errors reading the cache are treated
+// as misses.
+func (c *Calculations) cachedResult(ctx context.Context, req *pb.FibonacciOfRequest) (json.RawMessage, bool) {
+	if c.results == nil || req.SkipCache {
+		return nil, false
+	}
+
+	result, ok, err := c.results.Get(ctx, resultcache.FibonacciOfKey(req.First, req.Second, req.NthPosition))
+	if err != nil {
+		log.Printf("error looking up cached result: %s", err)
+		return nil, false
+	}
+
+	return result, ok
+}
+
+// completeFromCache creates the calculation already done with the cached
+// result, without publishing its job.
+func (c *Calculations) completeFromCache(
+	ctx context.Context,
+	calculation store.Calculation,
+	result json.RawMessage,
+) (*longrunningpb.Operation, error) {
+	now := c.clock.Now()
+	calculation.Done = true
+	calculation.Result = result
+	calculation.Metadata.Started = &now
+	calculation.Metadata.Completed = &now
+	calculation.Metadata.Cached = true
+
+	return c.createDone(ctx, calculation)
+}
+
+// calculateInline calculates the number at once and creates the calculation
+// already done with its outcome, without publishing its job.
+func (c *Calculations) calculateInline(
+	ctx context.Context,
+	calculation store.Calculation,
+	req *pb.FibonacciOfRequest,
+) (*longrunningpb.Operation, error) {
+	started := c.clock.Now()
+	calculation.Metadata.Started = &started
+
+	solution, err := calculators.NewFibonacci(req.First, req.Second).NumberAtPositionContext(ctx, req.NthPosition)
+	if err != nil && ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	completed := c.clock.Now()
+	calculation.Done = true
+	calculation.Metadata.Completed = &completed
+
+	if errors.Is(err, calculators.ErrFibonacciPositionInvalid) {
+		calculation.Error = &rpcstatus.Status{Code: int32(codes.InvalidArgument), Message: err.Error()}
+	} else if err != nil {
+		calculation.Error = &rpcstatus.Status{Code: int32(codes.Internal), Message: err.Error()}
+	} else {
+		calculation.Result, err = json.Marshal(store.FibonacciOfResult{
+			First:    req.First,
+			Second:   req.Second,
+			Position: req.NthPosition,
+			Result:   solution,
+		})
+		if err != nil {
+			log.Printf("error marshaling result of %s: %s", calculation.Name, err)
+			return nil, status.Error(codes.Internal, "internal error")
+		}
+	}
+
+	return c.createDone(ctx, calculation)
+}
+
+// createDone creates a calculation that is already done and returns its
+// operation, so that it can be gotten like any other.
+func (c *Calculations) createDone(ctx context.Context, calculation store.Calculation) (*longrunningpb.Operation, error) {
+	if err := c.store.Create(ctx, calculation); errors.Is(err, store.ErrKeyAlreadyExists) {
+		log.Printf("tried to create calculation %s but it already exists", calculation.Name)
+		return nil, status.Error(codes.AlreadyExists, "already exists")
+	} else if err != nil {
+		log.Printf("error saving calculation: %s", err)
 		return nil, status.Error(codes.Internal, "internal error")
 	}
 
-	return op, nil
+	return operationFromCalculation(calculation, c.clock.Now())
+}
+
+// schedule creates a calculation whose job is held back in the store for the
+// scheduler to publish once it is due.
+func (c *Calculations) schedule(
+	ctx context.Context,
+	calculation store.Calculation,
+) (*longrunningpb.Operation, error) {
+	if err := c.store.CreateScheduled(ctx, calculation, calculation.Job); errors.Is(err, store.ErrKeyAlreadyExists) {
+		log.Printf("tried to create calculation %s but it already exists", calculation.Name)
+		return nil, status.Error(codes.AlreadyExists, "already exists")
+	} else if err != nil {
+		log.Printf("error saving scheduled calculation: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	return operationFromCalculation(calculation, c.clock.Now())
 }
 
 func (c *Calculations) GetOperation(
@@ -110,61 +411,105 @@ func (c *Calculations) GetOperation(
 
 	calc, err := c.store.Get(ctx, req.Name)
 	if errors.Is(err, store.ErrKeyNotFound) {
-		return nil, status.Error(codes.NotFound,
-			fmt.Sprintf("could not find operation %q", req.Name))
+		return c.getBatchOperation(ctx, req.Name)
 	} else if err != nil {
 		log.Printf("error getting calculation: %s", err)
 		return nil, status.Error(codes.Internal, "internal error")
 	}
 
-	metadata := &pb.CalculationMetadata{
-		Created: timestamppb.New(calc.Metadata.Created),
-	}
-	if calc.Metadata.Started != nil {
-		metadata.Started = timestamppb.New(*calc.Metadata.Started)
+	return operationFromCalculation(calc, c.clock.Now())
+}
+
+// BatchGetOperations gets the named calculations, batches and pipelines
+// together.
+func (c *Calculations) BatchGetOperations(
+	ctx context.Context,
+	req *pb.BatchGetOperationsRequest,
+) (*pb.BatchGetOperationsResponse, error) {
+	if err := validateBatchGetOperationsRequest(req, c.maxBatchGet); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	metadataAsAnyPB, err := anypb.New(metadata)
+
+	found, err := c.store.GetOperations(ctx, req.Names)
 	if err != nil {
-		log.Printf("error marshaling calculation %q metadata to proto: %s", calc.Name, err)
+		log.Printf("error getting operations: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
 	}
 
-	op := &longrunningpb.Operation{
-		Name:     calc.Name,
-		Metadata: metadataAsAnyPB,
-		Done:     calc.Done,
-	}
+	now := c.clock.Now()
 
-	if calc.Error != nil {
-		op.Result = &longrunningpb.Operation_Error{
-			Error: calc.Error,
+	ops := make(map[string]*longrunningpb.Operation, len(req.Names))
+	for _, calc := range found.Calculations {
+		if ops[calc.Name], err = operationFromCalculation(calc, now); err != nil {
+			return nil, err
 		}
-	} else if calc.Result != nil {
-		var resp *anypb.Any
-		var err error
-
-		result := store.FibonacciOfResult{}
-		if err := json.Unmarshal(calc.Result, &result); err != nil {
-			log.Printf("error unmarshaling calculation result: %s", err)
-			return nil, status.Error(codes.Internal, "unsupported calculation result type")
+	}
+	for _, batch := range found.Batches {
+		if ops[batch.Name], err = c.batchProgress(ctx, batch); err != nil {
+			return nil, err
 		}
-
-		fibonacciOfResponse := &pb.FibonacciOfResponse{
-			First:       result.First,
-			Second:      result.Second,
-			NthPosition: result.Position,
-			Result:      result.Result,
+	}
+	for _, pipeline := range found.Pipelines {
+		if ops[pipeline.Name], err = pipelineOperation(pipeline); err != nil {
+			return nil, err
 		}
+	}
 
-		resp, err = anypb.New(fibonacciOfResponse)
-		if err != nil {
-			log.Printf("error setting calculation result to Any: %s", err)
-			return nil, status.Error(codes.Internal, "internal error")
+	resp := &pb.BatchGetOperationsResponse{
+		Operations: make([]*longrunningpb.Operation, 0, len(req.Names)),
+	}
+	for _, name := range req.Names {
+		if op, ok := ops[name]; ok {
+			resp.Operations = append(resp.Operations, op)
+		} else {
+			resp.Missing = append(resp.Missing, name)
 		}
+	}
+
+	return resp, nil
+}
+
+func (c *Calculations) ListOperations(
+	ctx context.Context,
+	req *longrunningpb.ListOperationsRequest,
+) (*longrunningpb.ListOperationsResponse, error) {
+	if err := validateListOperationsRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
-		op.Result = &longrunningpb.Operation_Response{
-			Response: resp,
+	pageSize := req.PageSize
+	if pageSize == 0 {
+		pageSize = defaultListPageSize
+	} else if pageSize > maxListPageSize {
+		pageSize = maxListPageSize
+	}
+
+	calculations, next, err := c.store.List(ctx, req.PageToken, int64(pageSize))
+	if err != nil {
+		log.Printf("error listing calculations: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	now := c.clock.Now()
+
+	resp := &longrunningpb.ListOperationsResponse{
+		Operations:    make([]*longrunningpb.Operation, 0, len(calculations)),
+		NextPageToken: next,
+	}
+
+	for _, calc := range calculations {
+		op, err := operationFromCalculation(calc, now)
+		if err != nil {
+			return nil, err
 		}
+		resp.Operations = append(resp.Operations, op)
 	}
 
-	return op, nil
+	return resp, nil
+}
+
+// operationFromCalculation represents a stored calculation as an operation at
+// now. Its errors are gRPC status errors.
+func operationFromCalculation(calc store.Calculation, now time.Time) (*longrunningpb.Operation, error) {
+	return operations.FromCalculation(calc, now)
 }
@@ -5,13 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/longrunning/autogen/longrunningpb"
 	"github.com/google/uuid"
 	"github.com/vickleford/calculator/internal/apiserver"
+	"github.com/vickleford/calculator/internal/clock/clocktest"
 	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/resultcache"
 	"github.com/vickleford/calculator/internal/store"
 	"github.com/vickleford/calculator/internal/worker"
 	"google.golang.org/genproto/googleapis/rpc/code"
@@ -22,11 +26,30 @@ import (
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type fakeStore struct {
 	CreateFunc func(context.Context, store.Calculation) error
 	GetFunc    func(context.Context, string) (store.Calculation, error)
+	ListFunc   func(context.Context, string, int64) ([]store.Calculation, string, error)
+
+	CreateScheduledFunc func(context.Context, store.Calculation, json.RawMessage) error
+	CreateCoalescedFunc func(context.Context, store.Calculation, string) (string, error)
+
+	CreateManyFunc    func(context.Context, []store.Calculation) []error
+	GetManyFunc       func(context.Context, []string) ([]store.Calculation, error)
+	GetOperationsFunc func(context.Context, []string) (store.Operations, error)
+	CreateBatchFunc   func(context.Context, store.Batch) error
+	GetBatchFunc      func(context.Context, string) (store.Batch, error)
+	SaveBatchFunc     func(context.Context, store.Batch) error
+
+	CreatePipelineFunc func(context.Context, store.Pipeline) error
+	GetPipelineFunc    func(context.Context, string) (store.Pipeline, error)
+
+	CreateScheduleFunc func(context.Context, store.Schedule) error
+	ListSchedulesFunc  func(context.Context, string, int64) ([]store.Schedule, string, error)
+	DeleteScheduleFunc func(context.Context, string) error
 }
 
 func (s fakeStore) Create(ctx context.Context, c store.Calculation) error {
@@ -45,6 +68,118 @@ func (s fakeStore) Get(ctx context.Context, key string) (store.Calculation, erro
 	return s.GetFunc(ctx, key)
 }
 
+func (s fakeStore) List(ctx context.Context, after string, limit int64) ([]store.Calculation, string, error) {
+	if s.ListFunc == nil {
+		panic("List is unimplemented")
+	}
+
+	return s.ListFunc(ctx, after, limit)
+}
+
+func (s fakeStore) CreateScheduled(ctx context.Context, c store.Calculation, job json.RawMessage) error {
+	if s.CreateScheduledFunc == nil {
+		panic("CreateScheduled is unimplemented")
+	}
+
+	return s.CreateScheduledFunc(ctx, c, job)
+}
+
+func (s fakeStore) CreateCoalesced(ctx context.Context, c store.Calculation, key string) (string, error) {
+	if s.CreateCoalescedFunc == nil {
+		panic("CreateCoalesced is unimplemented")
+	}
+
+	return s.CreateCoalescedFunc(ctx, c, key)
+}
+
+func (s fakeStore) CreateMany(ctx context.Context, cs []store.Calculation) []error {
+	if s.CreateManyFunc == nil {
+		panic("CreateMany is unimplemented")
+	}
+
+	return s.CreateManyFunc(ctx, cs)
+}
+
+func (s fakeStore) GetMany(ctx context.Context, names []string) ([]store.Calculation, error) {
+	if s.GetManyFunc == nil {
+		panic("GetMany is unimplemented")
+	}
+
+	return s.GetManyFunc(ctx, names)
+}
+
+func (s fakeStore) GetOperations(ctx context.Context, names []string) (store.Operations, error) {
+	if s.GetOperationsFunc == nil {
+		panic("GetOperations is unimplemented")
+	}
+
+	return s.GetOperationsFunc(ctx, names)
+}
+
+func (s fakeStore) CreateBatch(ctx context.Context, b store.Batch) error {
+	if s.CreateBatchFunc == nil {
+		panic("CreateBatch is unimplemented")
+	}
+
+	return s.CreateBatchFunc(ctx, b)
+}
+
+func (s fakeStore) GetBatch(ctx context.Context, name string) (store.Batch, error) {
+	if s.GetBatchFunc == nil {
+		panic("GetBatch is unimplemented")
+	}
+
+	return s.GetBatchFunc(ctx, name)
+}
+
+func (s fakeStore) SaveBatch(ctx context.Context, b store.Batch) error {
+	if s.SaveBatchFunc == nil {
+		panic("SaveBatch is unimplemented")
+	}
+
+	return s.SaveBatchFunc(ctx, b)
+}
+
+func (s fakeStore) CreatePipeline(ctx context.Context, p store.Pipeline) error {
+	if s.CreatePipelineFunc == nil {
+		panic("CreatePipeline is unimplemented")
+	}
+
+	return s.CreatePipelineFunc(ctx, p)
+}
+
+func (s fakeStore) GetPipeline(ctx context.Context, name string) (store.Pipeline, error) {
+	if s.GetPipelineFunc == nil {
+		panic("GetPipeline is unimplemented")
+	}
+
+	return s.GetPipelineFunc(ctx, name)
+}
+
+func (s fakeStore) CreateSchedule(ctx context.Context, schedule store.Schedule) error {
+	if s.CreateScheduleFunc == nil {
+		panic("CreateSchedule is unimplemented")
+	}
+
+	return s.CreateScheduleFunc(ctx, schedule)
+}
+
+func (s fakeStore) ListSchedules(ctx context.Context, after string, limit int64) ([]store.Schedule, string, error) {
+	if s.ListSchedulesFunc == nil {
+		panic("ListSchedules is unimplemented")
+	}
+
+	return s.ListSchedulesFunc(ctx, after, limit)
+}
+
+func (s fakeStore) DeleteSchedule(ctx context.Context, name string) error {
+	if s.DeleteScheduleFunc == nil {
+		panic("DeleteSchedule is unimplemented")
+	}
+
+	return s.DeleteScheduleFunc(ctx, name)
+}
+
 type workQ struct {
 	message []byte
 }
@@ -66,6 +201,17 @@ func (q *workQ) PublishJSON(ctx context.Context, msg any) error {
 	return nil
 }
 
+// protoWorkQ is a workQ that can also publish protobuf.
+type protoWorkQ struct {
+	workQ
+	protoMessage proto.Message
+}
+
+func (q *protoWorkQ) PublishProto(ctx context.Context, msg proto.Message) error {
+	q.protoMessage = msg
+	return nil
+}
+
 func TestFibonacciOf_Create(t *testing.T) {
 	var createCalled bool
 
@@ -99,9 +245,9 @@ func TestFibonacciOf_Create(t *testing.T) {
 		t.Errorf("name is not a uuid or can't parse: %s", err)
 	}
 
-	fibOfJob := worker.FibonacciOfJob{}
-	if err := json.Unmarshal(queue.message, &fibOfJob); err != nil {
-		t.Errorf("error unmarshaling job: %s", err)
+	fibOfJob, err := worker.DecodeFibonacciOfJob(queue.message)
+	if err != nil {
+		t.Errorf("error decoding job: %s", err)
 	}
 
 	msgUUID, err := uuid.Parse(fibOfJob.OperationName)
@@ -130,6 +276,369 @@ func TestFibonacciOf_Create(t *testing.T) {
 	}
 }
 
+func TestFibonacciOf_KeepsJobWithCalculation(t *testing.T) {
+	var created store.Calculation
+
+	queue := &workQ{}
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			created = c
+			return nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, queue)
+
+	req := &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 5}
+	if _, err := server.FibonacciOf(context.Background(), req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	kept, err := worker.DecodeFibonacciOfJob(created.Job)
+	if err != nil {
+		t.Fatalf("error decoding the job kept with the calculation: %s", err)
+	}
+
+	published, err := worker.DecodeFibonacciOfJob(queue.message)
+	if err != nil {
+		t.Fatalf("error decoding job: %s", err)
+	}
+
+	if kept != published {
+		t.Errorf("expected the job %#v to be kept but got %#v", published, kept)
+	}
+}
+
+func TestFibonacciOf_Priority(t *testing.T) {
+	var created store.Calculation
+
+	queue := &workQ{}
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			created = c
+			return nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, queue)
+
+	req := &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 5, Priority: 7}
+	op, err := server.FibonacciOf(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if created.Metadata.Priority != 7 {
+		t.Errorf("expected stored priority 7 but got %d", created.Metadata.Priority)
+	}
+
+	fibOfJob, err := worker.DecodeFibonacciOfJob(queue.message)
+	if err != nil {
+		t.Errorf("error decoding job: %s", err)
+	}
+
+	if fibOfJob.MessagePriority() != 7 {
+		t.Errorf("expected job priority 7 but got %d", fibOfJob.MessagePriority())
+	}
+
+	metadata := new(pb.CalculationMetadata)
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		t.Errorf("unable to unmarshal metadata: %s", err)
+	} else if metadata.Priority != 7 {
+		t.Errorf("expected metadata priority 7 but got %d", metadata.Priority)
+	}
+}
+
+func TestFibonacciOf_ProtobufJobs(t *testing.T) {
+	queue := &protoWorkQ{}
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			return nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, queue, apiserver.WithProtobufJobs())
+
+	req := &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 5, Priority: 7}
+	op, err := server.FibonacciOf(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if queue.message != nil {
+		t.Errorf("expected no JSON job but got %s", queue.message)
+	}
+
+	b, err := proto.Marshal(queue.protoMessage)
+	if err != nil {
+		t.Fatalf("error marshaling published job: %s", err)
+	}
+
+	job := new(pb.FibonacciOfJob)
+	if err := proto.Unmarshal(b, job); err != nil {
+		t.Fatalf("error unmarshaling published job: %s", err)
+	}
+
+	expected := &pb.FibonacciOfJob{
+		OperationName: op.Name,
+		First:         0,
+		Second:        1,
+		Position:      5,
+		Priority:      7,
+		Version:       worker.CurrentJobVersion,
+	}
+	if !proto.Equal(job, expected) {
+		t.Errorf("expected job %v but got %v", expected, job)
+	}
+}
+
+func TestFibonacciOf_PriorityOutOfRange(t *testing.T) {
+	server := apiserver.NewCalculations(fakeStore{}, &workQ{})
+
+	req := &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 5, Priority: 256}
+	_, err := server.FibonacciOf(context.Background(), req)
+
+	if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.InvalidArgument {
+		t.Errorf("expected invalid argument but got %s", err)
+	}
+}
+
+func TestFibonacciOf_Deadline(t *testing.T) {
+	var created store.Calculation
+
+	queue := &workQ{}
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			created = c
+			return nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, queue)
+
+	deadline := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	req := &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 5, Deadline: timestamppb.New(deadline)}
+	op, err := server.FibonacciOf(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if created.Metadata.Deadline == nil || !created.Metadata.Deadline.Equal(deadline) {
+		t.Errorf("expected stored deadline %q but got %v", deadline, created.Metadata.Deadline)
+	}
+
+	job, err := worker.DecodeFibonacciOfJob(queue.message)
+	if err != nil {
+		t.Fatalf("error decoding job: %s", err)
+	}
+
+	if jobDeadline, ok := job.MessageDeadline(); !ok || !jobDeadline.Equal(deadline) {
+		t.Errorf("expected the job to expire at %q but got %v", deadline, job.Deadline)
+	}
+
+	metadata := new(pb.CalculationMetadata)
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		t.Errorf("unable to unmarshal metadata: %s", err)
+	} else if !metadata.Deadline.AsTime().Equal(deadline) {
+		t.Errorf("expected metadata deadline %q but got %q", deadline, metadata.Deadline.AsTime())
+	}
+}
+
+func TestFibonacciOf_InvalidDeadlines(t *testing.T) {
+	now := time.Now()
+
+	tests := map[string]*pb.FibonacciOfRequest{
+		"AlreadyPassed": {
+			NthPosition: 5,
+			Deadline:    timestamppb.New(now.Add(-time.Second)),
+		},
+		"BeforeNotBefore": {
+			NthPosition: 5,
+			NotBefore:   timestamppb.New(now.Add(time.Hour)),
+			Deadline:    timestamppb.New(now.Add(time.Minute)),
+		},
+	}
+
+	for name, req := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := apiserver.NewCalculations(fakeStore{}, &workQ{})
+
+			_, err := server.FibonacciOf(context.Background(), req)
+			if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.InvalidArgument {
+				t.Errorf("expected invalid argument but got %s", err)
+			}
+		})
+	}
+}
+
+func TestCalculations_ListOperations(t *testing.T) {
+	createdAt := time.Now().Add(-30 * time.Second)
+	names := []string{uuid.NewString(), uuid.NewString()}
+
+	var seenAfter string
+	var seenLimit int64
+
+	mockStore := fakeStore{
+		ListFunc: func(ctx context.Context, after string, limit int64) ([]store.Calculation, string, error) {
+			seenAfter, seenLimit = after, limit
+			return []store.Calculation{
+				{Name: names[0], Metadata: store.CalculationMetadata{Created: createdAt, Priority: 2, Scheduled: &createdAt}},
+				{Name: names[1], Metadata: store.CalculationMetadata{Created: createdAt}, Done: true},
+			}, names[1], nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, nil)
+
+	pageToken := uuid.NewString()
+	resp, err := server.ListOperations(context.Background(),
+		&longrunningpb.ListOperationsRequest{PageSize: 2, PageToken: pageToken})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if seenAfter != pageToken {
+		t.Errorf("expected to list after %q but got %q", pageToken, seenAfter)
+	}
+
+	if seenLimit != 2 {
+		t.Errorf("expected a limit of 2 but got %d", seenLimit)
+	}
+
+	if resp.NextPageToken != names[1] {
+		t.Errorf("expected next page token %q but got %q", names[1], resp.NextPageToken)
+	}
+
+	if len(resp.Operations) != 2 {
+		t.Fatalf("expected 2 operations but got %d", len(resp.Operations))
+	}
+
+	metadata := new(pb.CalculationMetadata)
+	if err := resp.Operations[0].Metadata.UnmarshalTo(metadata); err != nil {
+		t.Errorf("unable to unmarshal metadata: %s", err)
+	} else {
+		if metadata.Priority != 2 {
+			t.Errorf("expected priority 2 but got %d", metadata.Priority)
+		}
+		if !metadata.Scheduled.AsTime().Equal(createdAt) {
+			t.Errorf("expected scheduled time %q but got %q", createdAt, metadata.Scheduled.AsTime())
+		}
+	}
+
+	if !resp.Operations[1].Done {
+		t.Errorf("expected second operation to be done")
+	}
+}
+
+func TestCalculations_ListOperations_InvalidRequests(t *testing.T) {
+	tests := map[string]*longrunningpb.ListOperationsRequest{
+		"Filter":             {Filter: "done = true"},
+		"NegativePageSize":   {PageSize: -1},
+		"MalformedPageToken": {PageToken: "george"},
+	}
+
+	for name, req := range tests {
+		req := req
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := apiserver.NewCalculations(fakeStore{}, nil)
+
+			_, err := server.ListOperations(context.Background(), req)
+			if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.InvalidArgument {
+				t.Errorf("expected invalid argument but got %s", err)
+			}
+		})
+	}
+}
+
+func TestFibonacciOf_Scheduled(t *testing.T) {
+	notBefore := time.Now().Add(time.Hour)
+
+	var created store.Calculation
+	var scheduledJob json.RawMessage
+
+	queue := &workQ{}
+	mockStore := fakeStore{
+		CreateScheduledFunc: func(ctx context.Context, c store.Calculation, job json.RawMessage) error {
+			created, scheduledJob = c, job
+			return nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, queue)
+
+	req := &pb.FibonacciOfRequest{
+		First:       0,
+		Second:      1,
+		NthPosition: 5,
+		NotBefore:   timestamppb.New(notBefore),
+	}
+	op, err := server.FibonacciOf(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if queue.message != nil {
+		t.Errorf("expected nothing to be published until the schedule is due")
+	}
+
+	if created.Metadata.Scheduled == nil || !created.Metadata.Scheduled.Equal(notBefore) {
+		t.Errorf("expected stored scheduled time %q but got %v", notBefore, created.Metadata.Scheduled)
+	}
+
+	job, err := worker.DecodeFibonacciOfJob(scheduledJob)
+	if err != nil {
+		t.Errorf("error decoding scheduled job: %s", err)
+	}
+
+	if job.OperationName != op.Name || job.Position != req.NthPosition {
+		t.Errorf("unexpected scheduled job: %#v", job)
+	}
+
+	metadata := new(pb.CalculationMetadata)
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		t.Errorf("unable to unmarshal metadata: %s", err)
+	} else if !metadata.Scheduled.AsTime().Equal(notBefore) {
+		t.Errorf("expected scheduled metadata %q but got %q", notBefore, metadata.Scheduled.AsTime())
+	}
+}
+
+func TestFibonacciOf_ScheduledInThePastStartsNow(t *testing.T) {
+	var createCalled bool
+
+	queue := &workQ{}
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			createCalled = true
+			if c.Metadata.Scheduled != nil {
+				t.Errorf("expected no scheduled time but got %q", *c.Metadata.Scheduled)
+			}
+			return nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, queue)
+
+	req := &pb.FibonacciOfRequest{
+		First:       0,
+		Second:      1,
+		NthPosition: 5,
+		NotBefore:   timestamppb.New(time.Now().Add(-time.Hour)),
+	}
+	if _, err := server.FibonacciOf(context.Background(), req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !createCalled {
+		t.Error("expected Create to be called")
+	}
+
+	if queue.message == nil {
+		t.Error("expected the job to be published")
+	}
+}
+
 func TestCalculations_GetOperation(t *testing.T) {
 	createdAt := time.Now().Add(-30 * time.Second)
 	startedAt := time.Now().Add(-25 * time.Second)
@@ -204,19 +713,76 @@ func TestCalculations_GetOperation(t *testing.T) {
 			},
 		},
 		{
-			Name: "OperationInError",
+			Name: "OperationPastDeadline",
 			GetFunc: func(ctx context.Context, key string) (store.Calculation, error) {
+				deadline := createdAt.Add(10 * time.Second)
 				return store.Calculation{
 					Name: key,
 					Metadata: store.CalculationMetadata{
-						Created: createdAt,
-						Started: &startedAt,
+						Created:  createdAt,
+						Deadline: &deadline,
 					},
-					Done: true,
-					Error: &status.Status{
-						Code:    int32(code.Code_ABORTED),
-						Message: "it all happened so fast",
-						Details: []*anypb.Any{retryAsAny},
+				}, nil
+			},
+			assert: func(t *testing.T, op *longrunningpb.Operation, err error) {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				if !op.Done {
+					t.Errorf("expected an operation past its deadline to be done")
+				}
+
+				if code := op.GetError().GetCode(); code != int32(codes.DeadlineExceeded) {
+					t.Errorf("expected DEADLINE_EXCEEDED but got %d", code)
+				}
+
+				metadata := new(pb.CalculationMetadata)
+				if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+					t.Errorf("unable to unmarshal metadata: %s", err)
+				} else if !metadata.Deadline.AsTime().Equal(createdAt.Add(10 * time.Second)) {
+					t.Errorf("expected the deadline in the metadata but got %v", metadata.Deadline)
+				}
+			},
+		},
+		{
+			Name: "OperationRunningPastDeadline",
+			GetFunc: func(ctx context.Context, key string) (store.Calculation, error) {
+				deadline := createdAt.Add(10 * time.Second)
+				started := createdAt.Add(time.Second)
+				return store.Calculation{
+					Name: key,
+					Metadata: store.CalculationMetadata{
+						Created:  createdAt,
+						Started:  &started,
+						Deadline: &deadline,
+					},
+				}, nil
+			},
+			assert: func(t *testing.T, op *longrunningpb.Operation, err error) {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				if op.Done {
+					t.Errorf("expected a running operation to be left for its worker to finish but got %v", op)
+				}
+			},
+		},
+		{
+			Name: "OperationInError",
+			GetFunc: func(ctx context.Context, key string) (store.Calculation, error) {
+				return store.Calculation{
+					Name: key,
+					Metadata: store.CalculationMetadata{
+						Created: createdAt,
+						Started: &startedAt,
+					},
+					Done: true,
+					Error: &status.Status{
+						Code:    int32(code.Code_ABORTED),
+						Message: "it all happened so fast",
+						Details: []*anypb.Any{retryAsAny},
 					},
 				}, nil
 			},
@@ -434,6 +1000,12 @@ func TestCalculations_GetOperation(t *testing.T) {
 
 			mockStore := fakeStore{
 				GetFunc: test.GetFunc,
+				GetBatchFunc: func(ctx context.Context, name string) (store.Batch, error) {
+					return store.Batch{}, store.ErrKeyNotFound
+				},
+				GetPipelineFunc: func(ctx context.Context, name string) (store.Pipeline, error) {
+					return store.Pipeline{}, store.ErrKeyNotFound
+				},
 			}
 
 			server := apiserver.NewCalculations(mockStore, nil)
@@ -449,3 +1021,663 @@ func TestCalculations_GetOperation(t *testing.T) {
 		})
 	}
 }
+
+func TestFibonacciOf_CreatedByClock(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 7, 15, 20, 33, 8, 0, time.UTC))
+
+	var created store.Calculation
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			created = c
+			return nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, &workQ{}, apiserver.WithClock(clk))
+
+	req := &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 5}
+	op, err := server.FibonacciOf(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !created.Metadata.Created.Equal(clk.Now()) {
+		t.Errorf("expected stored created time %s but got %s", clk.Now(), created.Metadata.Created)
+	}
+
+	metadata := new(pb.CalculationMetadata)
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		t.Fatalf("unable to unmarshal metadata: %s", err)
+	}
+	if !metadata.Created.AsTime().Equal(clk.Now()) {
+		t.Errorf("expected created time %s but got %s", clk.Now(), metadata.Created.AsTime())
+	}
+}
+
+func TestCalculations_GetOperation_ByClock(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 7, 15, 20, 33, 8, 0, time.UTC))
+	deadline := clk.Now().Add(time.Second)
+	completed := clk.Now().Add(-time.Second)
+	expiring, done := uuid.NewString(), uuid.NewString()
+
+	calculations := map[string]store.Calculation{
+		expiring: {
+			Name:     expiring,
+			Metadata: store.CalculationMetadata{Created: clk.Now(), Deadline: &deadline},
+		},
+		done: {
+			Name:     done,
+			Metadata: store.CalculationMetadata{Created: clk.Now(), Completed: &completed},
+			Done:     true,
+			Result:   []byte(`{"position":5,"first":0,"second":1,"result":3}`),
+		},
+	}
+	mockStore := fakeStore{
+		GetFunc: func(ctx context.Context, name string) (store.Calculation, error) {
+			return calculations[name], nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, &workQ{}, apiserver.WithClock(clk))
+
+	getOperation := func(name string) *longrunningpb.Operation {
+		t.Helper()
+		op, err := server.GetOperation(context.Background(), &longrunningpb.GetOperationRequest{Name: name})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return op
+	}
+
+	if op := getOperation(expiring); op.Done {
+		t.Error("expected the operation not to be done before its deadline")
+	}
+
+	clk.Advance(time.Second)
+
+	if op := getOperation(expiring); !op.Done || op.GetError().GetCode() != int32(codes.DeadlineExceeded) {
+		t.Errorf("expected the operation to exceed its deadline but got %v", op)
+	}
+
+	metadata := new(pb.CalculationMetadata)
+	if err := getOperation(done).Metadata.UnmarshalTo(metadata); err != nil {
+		t.Fatalf("unable to unmarshal metadata: %s", err)
+	}
+	if !metadata.Completed.AsTime().Equal(completed) {
+		t.Errorf("expected completed time %s but got %v", completed, metadata.Completed)
+	}
+}
+
+type fakeResultCache map[string]json.RawMessage
+
+func (c fakeResultCache) Get(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	result, ok := c[key]
+	return result, ok, nil
+}
+
+func TestFibonacciOf_CachedResult(t *testing.T) {
+	results := fakeResultCache{
+		resultcache.FibonacciOfKey(0, 1, 5): []byte(`{"position":5,"first":0,"second":1,"result":3}`),
+	}
+
+	var created store.Calculation
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			created = c
+			return nil
+		},
+	}
+	queue := &workQ{}
+
+	server := apiserver.NewCalculations(mockStore, queue, apiserver.WithResultCache(results))
+
+	op, err := server.FibonacciOf(context.Background(), &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !op.Done {
+		t.Fatal("expected the operation to be done at once")
+	}
+
+	resp := new(pb.FibonacciOfResponse)
+	if err := op.GetResponse().UnmarshalTo(resp); err != nil {
+		t.Fatalf("unable to unmarshal response: %s", err)
+	}
+	if resp.Result != 3 {
+		t.Errorf("expected the cached result 3 but got %d", resp.Result)
+	}
+
+	metadata := new(pb.CalculationMetadata)
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		t.Fatalf("unable to unmarshal metadata: %s", err)
+	}
+	if !metadata.Cached {
+		t.Error("expected the operation to be marked as cached")
+	}
+
+	if !created.Done || !created.Metadata.Cached || created.Name != op.Name {
+		t.Errorf("expected a done, cached calculation to be stored but got %#v", created)
+	}
+
+	if queue.message != nil {
+		t.Errorf("expected no job to be published but published %s", queue.message)
+	}
+}
+
+func TestFibonacciOf_SkipCache(t *testing.T) {
+	results := fakeResultCache{
+		resultcache.FibonacciOfKey(0, 1, 5): []byte(`{"position":5,"first":0,"second":1,"result":3}`),
+	}
+
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			return nil
+		},
+	}
+
+	for name, req := range map[string]*pb.FibonacciOfRequest{
+		"skip_cache": {First: 0, Second: 1, NthPosition: 5, SkipCache: true},
+		"miss":       {First: 0, Second: 1, NthPosition: 6},
+	} {
+		t.Run(name, func(t *testing.T) {
+			queue := &workQ{}
+			server := apiserver.NewCalculations(mockStore, queue, apiserver.WithResultCache(results))
+
+			op, err := server.FibonacciOf(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if op.Done {
+				t.Error("expected the operation not to be done")
+			}
+
+			if queue.message == nil {
+				t.Error("expected the job to be published")
+			}
+		})
+	}
+}
+
+func TestFibonacciOf_Callback(t *testing.T) {
+	results := fakeResultCache{
+		resultcache.FibonacciOfKey(0, 1, 5): []byte(`{"position":5,"first":0,"second":1,"result":3}`),
+	}
+
+	var created store.Calculation
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			created = c
+			return nil
+		},
+	}
+	queue := &workQ{}
+
+	server := apiserver.NewCalculations(mockStore, queue,
+		apiserver.WithResultCache(results),
+		apiserver.WithCallbackHosts([]string{"hooks.example.com"}),
+	)
+
+	req := &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 5, CallbackUrl: "https://hooks.example.com:8443/done"}
+	op, err := server.FibonacciOf(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if op.Done || queue.message == nil {
+		t.Error("expected the calculation to be queued for a worker rather than taken from the cache")
+	}
+
+	if created.Metadata.Callback == nil || created.Metadata.Callback.URL != req.CallbackUrl || created.Metadata.Callback.State != store.CallbackPending {
+		t.Errorf("expected a pending callback to be stored but got %+v", created.Metadata.Callback)
+	}
+
+	metadata := new(pb.CalculationMetadata)
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		t.Fatalf("unable to unmarshal metadata: %s", err)
+	}
+	if metadata.Callback.GetUrl() != req.CallbackUrl || metadata.Callback.GetState() != pb.CallbackStatus_PENDING {
+		t.Errorf("expected the pending callback in the metadata but got %v", metadata.Callback)
+	}
+}
+
+func TestFibonacciOf_CallbackHostsIgnoreCase(t *testing.T) {
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error { return nil },
+	}
+	server := apiserver.NewCalculations(mockStore, &workQ{},
+		apiserver.WithCallbackHosts([]string{"Hooks.Example.com"}),
+	)
+
+	req := &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 5, CallbackUrl: "https://HOOKS.example.COM/done"}
+	if _, err := server.FibonacciOf(context.Background(), req); err != nil {
+		t.Errorf("expected the callback to be allowed but got %s", err)
+	}
+}
+
+func TestFibonacciOf_InvalidCallbacks(t *testing.T) {
+	tests := map[string]struct {
+		hosts []string
+		url   string
+	}{
+		"NotEnabled":     {nil, "https://hooks.example.com/done"},
+		"HostNotAllowed": {[]string{"hooks.example.com"}, "https://evil.example.com/done"},
+		"PortNotAllowed": {[]string{"hooks.example.com:443"}, "https://hooks.example.com:8443/done"},
+		"NotHTTP":        {[]string{"hooks.example.com"}, "ftp://hooks.example.com/done"},
+		"Unparsable":     {[]string{"hooks.example.com"}, "https://hooks.example.com/%zz"},
+		"MixedCaseHost":  {[]string{"hooks.example.com"}, "https://HOOKS.evil.com/done"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := apiserver.NewCalculations(fakeStore{}, &workQ{}, apiserver.WithCallbackHosts(test.hosts))
+
+			req := &pb.FibonacciOfRequest{NthPosition: 5, CallbackUrl: test.url}
+			_, err := server.FibonacciOf(context.Background(), req)
+			if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.InvalidArgument {
+				t.Errorf("expected invalid argument but got %s", err)
+			}
+		})
+	}
+}
+
+func TestFibonacciOf_CoalescingSkipsDeadlinesAndPriorities(t *testing.T) {
+	tests := map[string]*pb.FibonacciOfRequest{
+		"Deadline": {First: 0, Second: 1, NthPosition: 5, Deadline: timestamppb.New(time.Now().Add(time.Minute))},
+		"Priority": {First: 0, Second: 1, NthPosition: 5, Priority: 3},
+	}
+
+	for name, req := range tests {
+		t.Run(name, func(t *testing.T) {
+			var coalesced, created int
+			mockStore := fakeStore{
+				CreateFunc: func(ctx context.Context, c store.Calculation) error {
+					created++
+					return nil
+				},
+				CreateCoalescedFunc: func(ctx context.Context, c store.Calculation, key string) (string, error) {
+					coalesced++
+					return "primary", nil
+				},
+			}
+			queue := &workQ{}
+
+			server := apiserver.NewCalculations(mockStore, queue, apiserver.WithCoalescing())
+
+			if _, err := server.FibonacciOf(context.Background(), req); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if coalesced != 0 || created != 1 {
+				t.Errorf("expected the calculation to be created on its own but it was coalesced %d times", coalesced)
+			}
+			if queue.message == nil {
+				t.Error("expected the job to be published")
+			}
+		})
+	}
+}
+
+func TestFibonacciOf_Inline(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    *pb.FibonacciOfRequest
+		inline bool
+	}{
+		{
+			name:   "below threshold",
+			req:    &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 10},
+			inline: true,
+		},
+		{
+			name:   "above threshold",
+			req:    &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 11},
+			inline: false,
+		},
+		{
+			name:   "forced async",
+			req:    &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 10, ForceAsync: true},
+			inline: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var created store.Calculation
+			mockStore := fakeStore{
+				CreateFunc: func(ctx context.Context, c store.Calculation) error {
+					created = c
+					return nil
+				},
+			}
+			queue := &workQ{}
+
+			server := apiserver.NewCalculations(mockStore, queue, apiserver.WithInlineThreshold(8))
+
+			op, err := server.FibonacciOf(context.Background(), test.req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if op.Done != test.inline || created.Done != test.inline {
+				t.Fatalf("expected done to be %t but the operation is %t and the stored calculation %t", test.inline, op.Done, created.Done)
+			}
+
+			if published := queue.message != nil; published == test.inline {
+				t.Errorf("expected published to be %t", !test.inline)
+			}
+
+			if !test.inline {
+				return
+			}
+
+			resp := new(pb.FibonacciOfResponse)
+			if err := op.GetResponse().UnmarshalTo(resp); err != nil {
+				t.Fatalf("unable to unmarshal response: %s", err)
+			}
+			if resp.Result != 34 {
+				t.Errorf("expected 34 but got %d", resp.Result)
+			}
+
+			if created.Metadata.Started == nil || created.Metadata.Completed == nil {
+				t.Errorf("expected started and completed times to be stored but got %#v", created.Metadata)
+			}
+		})
+	}
+}
+
+func TestFibonacciOf_InlineInvalidPosition(t *testing.T) {
+	mockStore := fakeStore{
+		CreateFunc: func(ctx context.Context, c store.Calculation) error {
+			return nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, &workQ{}, apiserver.WithInlineThreshold(8))
+
+	op, err := server.FibonacciOf(context.Background(), &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: -1})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !op.Done || op.GetError().GetCode() != int32(codes.InvalidArgument) {
+		t.Errorf("expected the operation to fail with INVALID_ARGUMENT but got %v", op)
+	}
+}
+
+func TestBatchFibonacciOf_InvalidRequests(t *testing.T) {
+	tooMany := make([]*pb.FibonacciOfRequest, 1001)
+	for i := range tooMany {
+		tooMany[i] = &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 10}
+	}
+
+	tests := map[string]*pb.BatchFibonacciOfRequest{
+		"Empty":   {},
+		"TooMany": {Requests: tooMany},
+	}
+
+	for name, req := range tests {
+		req := req
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := apiserver.NewCalculations(fakeStore{}, nil)
+
+			_, err := server.BatchFibonacciOf(context.Background(), req)
+			if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.InvalidArgument {
+				t.Errorf("expected invalid argument but got %s", err)
+			}
+		})
+	}
+}
+
+func TestBatchFibonacciOf_QueuesEveryCalculation(t *testing.T) {
+	results := fakeResultCache{
+		resultcache.FibonacciOfKey(0, 1, 5): []byte(`{"position":5,"first":0,"second":1,"result":3}`),
+	}
+
+	var created []store.Calculation
+	mockStore := fakeStore{
+		CreateBatchFunc: func(ctx context.Context, b store.Batch) error { return nil },
+		CreateManyFunc: func(ctx context.Context, cs []store.Calculation) []error {
+			created = cs
+			return make([]error, len(cs))
+		},
+		// CreateCoalesced is left unimplemented to panic if coalescing.
+	}
+
+	server := apiserver.NewCalculations(mockStore, &workQ{},
+		apiserver.WithResultCache(results),
+		apiserver.WithCoalescing(),
+		apiserver.WithInlineThreshold(math.MaxInt64),
+	)
+
+	req := &pb.BatchFibonacciOfRequest{Requests: []*pb.FibonacciOfRequest{
+		{First: 0, Second: 1, NthPosition: 5},
+		{First: 0, Second: 1, NthPosition: 5},
+	}}
+	resp, err := server.BatchFibonacciOf(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(created) != 2 {
+		t.Fatalf("expected 2 calculations to be created but got %d", len(created))
+	}
+	for i, calc := range created {
+		if calc.Done || calc.Metadata.Cached || calc.Metadata.Primary != "" {
+			t.Errorf("expected calculation %d to be queued for a worker but got %+v", i, calc)
+		}
+		if resp.Results[i].GetOperation() == nil {
+			t.Errorf("expected calculation %d to be started but got %v", i, resp.Results[i].GetError())
+		}
+	}
+}
+
+func TestBatchFibonacciOf_StartsNothingWhenTheBatchIsNotRecorded(t *testing.T) {
+	mockStore := fakeStore{
+		CreateBatchFunc: func(ctx context.Context, b store.Batch) error {
+			return errors.New("etcd went away")
+		},
+		// CreateMany is left unimplemented to panic if called.
+	}
+	queue := &workQ{}
+
+	server := apiserver.NewCalculations(mockStore, queue)
+
+	req := &pb.BatchFibonacciOfRequest{Requests: []*pb.FibonacciOfRequest{{First: 0, Second: 1, NthPosition: 5}}}
+	_, err := server.BatchFibonacciOf(context.Background(), req)
+	if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.Internal {
+		t.Errorf("expected internal error but got %s", err)
+	}
+
+	if queue.message != nil {
+		t.Errorf("expected nothing to be published but got %s", queue.message)
+	}
+}
+
+func TestCalculations_BatchGetOperations(t *testing.T) {
+	createdAt := time.Now().Add(-30 * time.Second)
+	names := []string{uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString()}
+
+	var getOperationsCalls int
+	mockStore := fakeStore{
+		GetOperationsFunc: func(ctx context.Context, got []string) (store.Operations, error) {
+			getOperationsCalls++
+			// Found out of order, as a store may return them.
+			return store.Operations{
+				Calculations: []store.Calculation{
+					{Name: names[3], Metadata: store.CalculationMetadata{Created: createdAt}, Done: true},
+					{Name: names[0], Metadata: store.CalculationMetadata{Created: createdAt}},
+				},
+				Batches:   []store.Batch{{Name: names[2], Created: createdAt, Done: true, Completed: &createdAt}},
+				Pipelines: []store.Pipeline{{Name: names[4], Created: createdAt}},
+			}, nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, nil)
+
+	resp, err := server.BatchGetOperations(context.Background(), &pb.BatchGetOperationsRequest{Names: names})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if getOperationsCalls != 1 {
+		t.Errorf("expected the operations to be read at once but they were read %d times", getOperationsCalls)
+	}
+
+	var gotNames []string
+	for _, op := range resp.Operations {
+		gotNames = append(gotNames, op.Name)
+	}
+	expected := []string{names[0], names[2], names[3], names[4]}
+	if !slices.Equal(gotNames, expected) {
+		t.Errorf("expected operations %v in the order requested but got %v", expected, gotNames)
+	}
+
+	if len(resp.Missing) != 1 || resp.Missing[0] != names[1] {
+		t.Errorf("expected %s to be missing but got %v", names[1], resp.Missing)
+	}
+}
+
+func TestCalculations_BatchGetOperations_InvalidRequests(t *testing.T) {
+	tests := map[string]*pb.BatchGetOperationsRequest{
+		"Empty":     {},
+		"TooMany":   {Names: []string{uuid.NewString(), uuid.NewString(), uuid.NewString()}},
+		"NotAUUID":  {Names: []string{"george"}},
+		"OneBadOne": {Names: []string{uuid.NewString(), "george"}},
+	}
+
+	for name, req := range tests {
+		req := req
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := apiserver.NewCalculations(fakeStore{}, nil, apiserver.WithMaxBatchGetOperations(2))
+
+			_, err := server.BatchGetOperations(context.Background(), req)
+			if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.InvalidArgument {
+				t.Errorf("expected invalid argument but got %s", err)
+			}
+		})
+	}
+}
+
+func TestWithMaxBatchGetOperations_RejectsNonPositive(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a maximum of %d to be rejected", n)
+				}
+			}()
+			apiserver.WithMaxBatchGetOperations(n)
+		}()
+	}
+}
+
+func TestCreateSchedule(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 7, 15, 20, 33, 8, 0, time.UTC))
+
+	var created store.Schedule
+	mockStore := fakeStore{
+		CreateScheduleFunc: func(ctx context.Context, s store.Schedule) error {
+			created = s
+			return nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, nil, apiserver.WithClock(clk))
+
+	schedule, err := server.CreateSchedule(context.Background(), &pb.CreateScheduleRequest{
+		Cron:     "0 9 * * *",
+		Template: &pb.CalculationTemplate{First: 0, Second: 1, NthPosition: 10, Priority: 3},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expectedNext := time.Date(2024, 7, 16, 9, 0, 0, 0, time.UTC)
+	if !created.Next.Equal(expectedNext) || !schedule.NextRun.AsTime().Equal(expectedNext) {
+		t.Errorf("expected the next run at %s but got %s", expectedNext, created.Next)
+	}
+
+	if created.Name != schedule.Name || created.Cron != "0 9 * * *" {
+		t.Errorf("expected the schedule to be stored as returned but stored %+v", created)
+	}
+
+	expectedTemplate := store.CalculationTemplate{First: 0, Second: 1, Position: 10, Priority: 3}
+	if created.Template != expectedTemplate {
+		t.Errorf("expected template %+v but got %+v", expectedTemplate, created.Template)
+	}
+}
+
+func TestCreateSchedule_InvalidRequests(t *testing.T) {
+	template := &pb.CalculationTemplate{First: 0, Second: 1, NthPosition: 10}
+
+	tests := map[string]*pb.CreateScheduleRequest{
+		"MalformedCron":   {Cron: "every day", Template: template},
+		"NeverFires":      {Cron: "0 0 30 2 *", Template: template},
+		"MissingTemplate": {Cron: "@daily"},
+		"Priority":        {Cron: "@daily", Template: &pb.CalculationTemplate{Priority: 256}},
+	}
+
+	for name, req := range tests {
+		req := req
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := apiserver.NewCalculations(fakeStore{}, nil)
+
+			_, err := server.CreateSchedule(context.Background(), req)
+			if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.InvalidArgument {
+				t.Errorf("expected invalid argument but got %s", err)
+			}
+		})
+	}
+}
+
+func TestListSchedules(t *testing.T) {
+	names := []string{uuid.NewString(), uuid.NewString()}
+
+	mockStore := fakeStore{
+		ListSchedulesFunc: func(ctx context.Context, after string, limit int64) ([]store.Schedule, string, error) {
+			return []store.Schedule{
+				{Name: names[0], Cron: "@daily", Runs: []string{"b", "a"}},
+				{Name: names[1], Cron: "@hourly"},
+			}, names[1], nil
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, nil)
+
+	resp, err := server.ListSchedules(context.Background(), &pb.ListSchedulesRequest{PageSize: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(resp.Schedules) != 2 || resp.NextPageToken != names[1] {
+		t.Fatalf("expected 2 schedules and a next page but got %v", resp)
+	}
+
+	if !slices.Equal(resp.Schedules[0].RecentRuns, []string{"b", "a"}) {
+		t.Errorf("expected the recent runs newest first but got %v", resp.Schedules[0].RecentRuns)
+	}
+}
+
+func TestDeleteSchedule_NotFound(t *testing.T) {
+	mockStore := fakeStore{
+		DeleteScheduleFunc: func(ctx context.Context, name string) error {
+			return store.ErrKeyNotFound
+		},
+	}
+
+	server := apiserver.NewCalculations(mockStore, nil)
+
+	_, err := server.DeleteSchedule(context.Background(), &pb.DeleteScheduleRequest{Name: uuid.NewString()})
+	if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.NotFound {
+		t.Errorf("expected not found but got %s", err)
+	}
+}
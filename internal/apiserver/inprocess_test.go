@@ -0,0 +1,415 @@
+package apiserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"github.com/vickleford/calculator/internal/apiserver"
+	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"github.com/vickleford/calculator/internal/workqueue"
+)
+
+// memoryStore is a datastore for both the API and the worker.
+type memoryStore struct {
+	mu           sync.Mutex
+	calculations map[string]store.Calculation
+
+	// inFlight holds the primary calculation for each key and followers the
+	// calculations following each primary.
+	inFlight  map[string]string
+	followers map[string][]string
+
+	batches   map[string]store.Batch
+	pipelines map[string]store.Pipeline
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		calculations: make(map[string]store.Calculation),
+		inFlight:     make(map[string]string),
+		followers:    make(map[string][]string),
+		batches:      make(map[string]store.Batch),
+		pipelines:    make(map[string]store.Pipeline),
+	}
+}
+
+func (s *memoryStore) Create(ctx context.Context, c store.Calculation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.calculations[c.Name]; ok {
+		return store.ErrKeyAlreadyExists
+	}
+	s.calculations[c.Name] = c
+	return nil
+}
+
+func (s *memoryStore) CreateCoalesced(ctx context.Context, c store.Calculation, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.calculations[c.Name]; ok {
+		return "", store.ErrKeyAlreadyExists
+	}
+	primary, ok := s.inFlight[key]
+	if !ok {
+		s.inFlight[key] = c.Name
+		s.calculations[c.Name] = c
+		return c.Name, nil
+	}
+	c.Metadata.Primary = primary
+	s.calculations[c.Name] = c
+	s.followers[primary] = append(s.followers[primary], c.Name)
+	return primary, nil
+}
+
+func (s *memoryStore) Land(ctx context.Context, key, primary string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight[key] == primary {
+		delete(s.inFlight, key)
+	}
+	return append([]string(nil), s.followers[primary]...), nil
+}
+
+func (s *memoryStore) Unfollow(ctx context.Context, primary, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	followers := s.followers[primary]
+	for i, follower := range followers {
+		if follower == name {
+			s.followers[primary] = append(followers[:i], followers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateMany(ctx context.Context, cs []store.Calculation) []error {
+	errs := make([]error, len(cs))
+	for i, c := range cs {
+		errs[i] = s.Create(ctx, c)
+	}
+	return errs
+}
+
+func (s *memoryStore) GetMany(ctx context.Context, names []string) ([]store.Calculation, error) {
+	var cs []store.Calculation
+	for _, name := range names {
+		if c, err := s.Get(ctx, name); err == nil {
+			cs = append(cs, c)
+		}
+	}
+	return cs, nil
+}
+
+func (s *memoryStore) GetOperations(ctx context.Context, names []string) (store.Operations, error) {
+	var found store.Operations
+	for _, name := range names {
+		if c, err := s.Get(ctx, name); err == nil {
+			found.Calculations = append(found.Calculations, c)
+		} else if b, err := s.GetBatch(ctx, name); err == nil {
+			found.Batches = append(found.Batches, b)
+		} else if p, err := s.GetPipeline(ctx, name); err == nil {
+			found.Pipelines = append(found.Pipelines, p)
+		}
+	}
+	return found, nil
+}
+
+func (s *memoryStore) CreateBatch(ctx context.Context, b store.Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.batches[b.Name]; ok {
+		return store.ErrKeyAlreadyExists
+	}
+	s.batches[b.Name] = b
+	return nil
+}
+
+func (s *memoryStore) GetBatch(ctx context.Context, name string) (store.Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[name]
+	if !ok {
+		return b, store.ErrKeyNotFound
+	}
+	return b, nil
+}
+
+func (s *memoryStore) SaveBatch(ctx context.Context, b store.Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches[b.Name] = b
+	return nil
+}
+
+func (s *memoryStore) CreatePipeline(ctx context.Context, p store.Pipeline) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pipelines[p.Name]; ok {
+		return store.ErrKeyAlreadyExists
+	}
+	p.Version = 1
+	p.Steps = slices.Clone(p.Steps)
+	s.pipelines[p.Name] = p
+	return nil
+}
+
+func (s *memoryStore) GetPipeline(ctx context.Context, name string) (store.Pipeline, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pipelines[name]
+	if !ok {
+		return p, store.ErrKeyNotFound
+	}
+	p.Steps = slices.Clone(p.Steps)
+	return p, nil
+}
+
+func (s *memoryStore) SavePipeline(ctx context.Context, p store.Pipeline) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pipelines[p.Name].Version != p.Version {
+		return store.ErrUpdateUnsuccessful
+	}
+	p.Version++
+	p.Steps = slices.Clone(p.Steps)
+	s.pipelines[p.Name] = p
+	return nil
+}
+
+func (s *memoryStore) ActivePipelines(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name, p := range s.pipelines {
+		if !p.Done {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *memoryStore) CreateSchedule(ctx context.Context, schedule store.Schedule) error {
+	panic("CreateSchedule is unimplemented")
+}
+
+func (s *memoryStore) ListSchedules(ctx context.Context, after string, limit int64) ([]store.Schedule, string, error) {
+	panic("ListSchedules is unimplemented")
+}
+
+func (s *memoryStore) DeleteSchedule(ctx context.Context, name string) error {
+	panic("DeleteSchedule is unimplemented")
+}
+
+func (s *memoryStore) CreateScheduled(ctx context.Context, c store.Calculation, job json.RawMessage) error {
+	panic("CreateScheduled is unimplemented")
+}
+
+func (s *memoryStore) Get(ctx context.Context, name string) (store.Calculation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.calculations[name]
+	if !ok {
+		return c, store.ErrKeyNotFound
+	}
+	return c, nil
+}
+
+func (s *memoryStore) List(ctx context.Context, after string, limit int64) ([]store.Calculation, string, error) {
+	panic("List is unimplemented")
+}
+
+func (s *memoryStore) Save(ctx context.Context, c store.Calculation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calculations[c.Name] = c
+	return nil
+}
+
+func TestInProcess_FibonacciOf(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	datastore := newMemoryStore()
+	queue := workqueue.NewMemory()
+
+	server := apiserver.NewCalculations(datastore, queue)
+	consumer := workqueue.NewMemoryConsumer(queue, worker.NewFibOf(datastore))
+	go consumer.Start(ctx)
+
+	op, err := server.FibonacciOf(ctx, &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			t.Fatal("operation never finished")
+		case <-time.After(time.Millisecond):
+		}
+
+		op, err = server.GetOperation(ctx, &longrunningpb.GetOperationRequest{Name: op.Name})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	resp := &pb.FibonacciOfResponse{}
+	if err := op.GetResponse().UnmarshalTo(resp); err != nil {
+		t.Fatalf("unable to unmarshal response: %s", err)
+	}
+
+	if resp.Result != 34 {
+		t.Errorf("expected 34 but got %d", resp.Result)
+	}
+}
+
+func TestInProcess_CoalescesIdenticalCalculations(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	datastore := newMemoryStore()
+	queue := workqueue.NewMemory()
+
+	server := apiserver.NewCalculations(datastore, queue, apiserver.WithCoalescing())
+
+	// Request the calculation several times before any of it runs.
+	var ops []*longrunningpb.Operation
+	for range 3 {
+		op, err := server.FibonacciOf(ctx, &pb.FibonacciOfRequest{First: 0, Second: 1, NthPosition: 10})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ops = append(ops, op)
+	}
+
+	for _, op := range ops[1:] {
+		metadata := new(pb.CalculationMetadata)
+		if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+			t.Fatalf("unable to unmarshal metadata: %s", err)
+		}
+		if metadata.Primary != ops[0].Name {
+			t.Errorf("expected operation %s to follow %s but it follows %q", op.Name, ops[0].Name, metadata.Primary)
+		}
+	}
+
+	jobs := &countingHandler{next: worker.NewFibOf(datastore, worker.WithCoalescing(datastore))}
+	consumer := workqueue.NewMemoryConsumer(queue, jobs)
+	go consumer.Start(ctx)
+
+	for _, op := range ops {
+		var err error
+		for !op.Done {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("operation %s never finished", op.Name)
+			case <-time.After(time.Millisecond):
+			}
+
+			op, err = server.GetOperation(ctx, &longrunningpb.GetOperationRequest{Name: op.Name})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		resp := &pb.FibonacciOfResponse{}
+		if err := op.GetResponse().UnmarshalTo(resp); err != nil {
+			t.Fatalf("unable to unmarshal response: %s", err)
+		}
+		if resp.Result != 34 {
+			t.Errorf("expected 34 for %s but got %d", op.Name, resp.Result)
+		}
+	}
+
+	if n := jobs.handled.Load(); n != 1 {
+		t.Errorf("expected the calculation to run once but it ran %d times", n)
+	}
+
+	datastore.mu.Lock()
+	defer datastore.mu.Unlock()
+	if len(datastore.inFlight) != 0 || len(datastore.followers[ops[0].Name]) != 0 {
+		t.Errorf("expected nothing left in flight but got %v and %v", datastore.inFlight, datastore.followers)
+	}
+}
+
+// countingHandler counts the messages it handles.
+type countingHandler struct {
+	next    workqueue.Handler
+	handled atomic.Int32
+}
+
+func (h *countingHandler) Handle(ctx context.Context, payload []byte) error {
+	h.handled.Add(1)
+	return h.next.Handle(ctx, payload)
+}
+
+func TestInProcess_BatchFibonacciOf(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	datastore := newMemoryStore()
+	queue := workqueue.NewMemory()
+
+	server := apiserver.NewCalculations(datastore, queue)
+	consumer := workqueue.NewMemoryConsumer(queue, worker.NewFibOf(datastore))
+	go consumer.Start(ctx)
+
+	resp, err := server.BatchFibonacciOf(ctx, &pb.BatchFibonacciOfRequest{
+		Requests: []*pb.FibonacciOfRequest{
+			{First: 0, Second: 1, NthPosition: 10},
+			{First: 0, Second: 1, NthPosition: 11},
+			{First: 0, Second: 1, NthPosition: -1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(resp.Results) != 3 {
+		t.Fatalf("expected 3 results but got %d", len(resp.Results))
+	}
+	for i, result := range resp.Results {
+		if result.GetOperation() == nil {
+			t.Errorf("expected calculation %d to be started but got %v", i, result.GetError())
+		}
+	}
+
+	op := resp.Batch
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			t.Fatal("batch never finished")
+		case <-time.After(time.Millisecond):
+		}
+
+		op, err = server.GetOperation(ctx, &longrunningpb.GetOperationRequest{Name: op.Name})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	result := &pb.BatchResult{}
+	if err := op.GetResponse().UnmarshalTo(result); err != nil {
+		t.Fatalf("unable to unmarshal batch result: %s", err)
+	}
+	if result.Succeeded != 2 || result.Failed != 1 {
+		t.Errorf("expected 2 calculations to succeed and 1 to fail but got %v", result)
+	}
+
+	metadata := &pb.BatchMetadata{}
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		t.Fatalf("unable to unmarshal batch metadata: %s", err)
+	}
+	if metadata.Done != 3 || metadata.Failed != 1 || len(metadata.Operations) != 3 {
+		t.Errorf("unexpected batch metadata: %v", metadata)
+	}
+}
@@ -0,0 +1,134 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var stepStates = map[string]pb.PipelineStepStatus_State{
+	store.StepPending:   pb.PipelineStepStatus_PENDING,
+	store.StepRunning:   pb.PipelineStepStatus_RUNNING,
+	store.StepSucceeded: pb.PipelineStepStatus_SUCCEEDED,
+	store.StepFailed:    pb.PipelineStepStatus_FAILED,
+	store.StepSkipped:   pb.PipelineStepStatus_SKIPPED,
+}
+
+// SubmitPipeline records a pipeline for the coordinator to run. None of its
+// steps have started when it returns.
+func (c *Calculations) SubmitPipeline(
+	ctx context.Context,
+	req *pb.SubmitPipelineRequest,
+) (*longrunningpb.Operation, error) {
+	if err := validateSubmitPipelineRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	pipeline := store.Pipeline{
+		Name:    uuid.New().String(),
+		Created: c.clock.Now(),
+		Steps:   make([]store.PipelineStep, 0, len(req.Steps)),
+	}
+	for _, step := range req.Steps {
+		pipeline.Steps = append(pipeline.Steps, store.PipelineStep{
+			ID:       step.Id,
+			First:    pipelineInput(step.First),
+			Second:   pipelineInput(step.Second),
+			Position: pipelineInput(step.NthPosition),
+			State:    store.StepPending,
+		})
+	}
+
+	if err := c.store.CreatePipeline(ctx, pipeline); errors.Is(err, store.ErrKeyAlreadyExists) {
+		log.Printf("tried to create pipeline %s but it already exists", pipeline.Name)
+		return nil, status.Error(codes.AlreadyExists, "already exists")
+	} else if err != nil {
+		log.Printf("error saving pipeline: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	return pipelineOperation(pipeline)
+}
+
+func pipelineInput(input *pb.PipelineInput) store.PipelineInput {
+	return store.PipelineInput{
+		Value:  input.GetValue(),
+		Step:   input.GetStep(),
+		Modulo: input.GetModulo(),
+	}
+}
+
+// getPipelineOperation returns the operation of the named pipeline. Its errors
+// are gRPC status errors.
+func (c *Calculations) getPipelineOperation(ctx context.Context, name string) (*longrunningpb.Operation, error) {
+	pipeline, err := c.store.GetPipeline(ctx, name)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil, status.Error(codes.NotFound,
+			fmt.Sprintf("could not find operation %q", name))
+	} else if err != nil {
+		log.Printf("error getting pipeline: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	return pipelineOperation(pipeline)
+}
+
+// pipelineOperation represents a pipeline as an operation, with the status of
+// each step in its metadata.
+func pipelineOperation(pipeline store.Pipeline) (*longrunningpb.Operation, error) {
+	metadata := &pb.PipelineMetadata{
+		Created: timestamppb.New(pipeline.Created),
+		Steps:   make([]*pb.PipelineStepStatus, 0, len(pipeline.Steps)),
+	}
+	if pipeline.Completed != nil {
+		metadata.Completed = timestamppb.New(*pipeline.Completed)
+	}
+	for _, step := range pipeline.Steps {
+		metadata.Steps = append(metadata.Steps, &pb.PipelineStepStatus{
+			Id:        step.ID,
+			State:     stepStates[step.State],
+			Operation: step.Operation,
+			Error:     step.Error,
+		})
+	}
+
+	metadataAsAnyPB, err := anypb.New(metadata)
+	if err != nil {
+		log.Printf("error marshaling pipeline %q metadata to proto: %s", pipeline.Name, err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	op := &longrunningpb.Operation{
+		Name:     pipeline.Name,
+		Metadata: metadataAsAnyPB,
+		Done:     pipeline.Done,
+	}
+
+	if pipeline.Error != nil {
+		op.Result = &longrunningpb.Operation_Error{Error: pipeline.Error}
+	} else if pipeline.Done {
+		result := &pb.PipelineResult{Results: make(map[string]int64, len(pipeline.Steps))}
+		for _, step := range pipeline.Steps {
+			result.Results[step.ID] = step.Result
+		}
+
+		resultAsAnyPB, err := anypb.New(result)
+		if err != nil {
+			log.Printf("error setting pipeline result to Any: %s", err)
+			return nil, status.Error(codes.Internal, "internal error")
+		}
+		op.Result = &longrunningpb.Operation_Response{Response: resultAsAnyPB}
+	}
+
+	return op, nil
+}
@@ -0,0 +1,135 @@
+package apiserver_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"github.com/vickleford/calculator/internal/apiserver"
+	"github.com/vickleford/calculator/internal/coordinator"
+	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/worker"
+	"github.com/vickleford/calculator/internal/workqueue"
+	"google.golang.org/grpc/codes"
+	grpc_status "google.golang.org/grpc/status"
+)
+
+func TestSubmitPipeline_InvalidRequests(t *testing.T) {
+	step := func(id string, position *pb.PipelineInput) *pb.PipelineStep {
+		return &pb.PipelineStep{
+			Id:          id,
+			Second:      &pb.PipelineInput{Source: &pb.PipelineInput_Value{Value: 1}},
+			NthPosition: position,
+		}
+	}
+	value := func(v int64) *pb.PipelineInput {
+		return &pb.PipelineInput{Source: &pb.PipelineInput_Value{Value: v}}
+	}
+	from := func(id string, modulo int64) *pb.PipelineInput {
+		return &pb.PipelineInput{Source: &pb.PipelineInput_Step{Step: id}, Modulo: modulo}
+	}
+
+	tooMany := make([]*pb.PipelineStep, 33)
+	for i := range tooMany {
+		tooMany[i] = step(fmt.Sprint(i), value(10))
+	}
+
+	tests := map[string]*pb.SubmitPipelineRequest{
+		"Empty":            {},
+		"TooMany":          {Steps: tooMany},
+		"MissingID":        {Steps: []*pb.PipelineStep{step("", value(10))}},
+		"DuplicateID":      {Steps: []*pb.PipelineStep{step("a", value(10)), step("a", value(10))}},
+		"SelfReference":    {Steps: []*pb.PipelineStep{step("a", from("a", 0))}},
+		"ForwardReference": {Steps: []*pb.PipelineStep{step("a", from("b", 0)), step("b", value(10))}},
+		"UnknownStep":      {Steps: []*pb.PipelineStep{step("a", from("george", 0))}},
+		"NegativeModulo":   {Steps: []*pb.PipelineStep{step("a", value(10)), step("b", from("a", -5))}},
+		"ModuloOfValue":    {Steps: []*pb.PipelineStep{step("a", &pb.PipelineInput{Source: &pb.PipelineInput_Value{Value: 10}, Modulo: 3})}},
+	}
+
+	for name, req := range tests {
+		req := req
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := apiserver.NewCalculations(fakeStore{}, nil)
+
+			_, err := server.SubmitPipeline(context.Background(), req)
+			if statusErr, _ := grpc_status.FromError(err); statusErr.Code() != codes.InvalidArgument {
+				t.Errorf("expected invalid argument but got %s", err)
+			}
+		})
+	}
+}
+
+func TestSubmitPipeline_InOneProcess(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	datastore := newMemoryStore()
+	queue := workqueue.NewMemory()
+
+	server := apiserver.NewCalculations(datastore, queue)
+	consumer := workqueue.NewMemoryConsumer(queue, worker.NewFibOf(datastore))
+	go consumer.Start(ctx)
+	go coordinator.New(datastore, queue, time.Millisecond).Run(ctx)
+
+	value := func(v int64) *pb.PipelineInput {
+		return &pb.PipelineInput{Source: &pb.PipelineInput_Value{Value: v}}
+	}
+	from := func(id string, modulo int64) *pb.PipelineInput {
+		return &pb.PipelineInput{Source: &pb.PipelineInput_Step{Step: id}, Modulo: modulo}
+	}
+
+	op, err := server.SubmitPipeline(ctx, &pb.SubmitPipelineRequest{
+		Steps: []*pb.PipelineStep{
+			{Id: "a", First: value(0), Second: value(1), NthPosition: value(10)},
+			{Id: "b", First: value(0), Second: value(1), NthPosition: from("a", 10)},
+			{Id: "c", First: from("a", 0), Second: from("b", 0), NthPosition: value(3)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			t.Fatal("pipeline never finished")
+		case <-time.After(time.Millisecond):
+		}
+
+		op, err = server.GetOperation(ctx, &longrunningpb.GetOperationRequest{Name: op.Name})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if op.GetError() != nil {
+		t.Fatalf("unexpected pipeline error: %v", op.GetError())
+	}
+
+	result := &pb.PipelineResult{}
+	if err := op.GetResponse().UnmarshalTo(result); err != nil {
+		t.Fatalf("unable to unmarshal pipeline result: %s", err)
+	}
+
+	// F(10) is 34, F(34 mod 10) is 2, and the third number after them is 36.
+	expected := map[string]int64{"a": 34, "b": 2, "c": 36}
+	for id, n := range expected {
+		if result.Results[id] != n {
+			t.Errorf("expected step %s to result in %d but got %d", id, n, result.Results[id])
+		}
+	}
+
+	metadata := &pb.PipelineMetadata{}
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		t.Fatalf("unable to unmarshal pipeline metadata: %s", err)
+	}
+	for _, step := range metadata.Steps {
+		if step.State != pb.PipelineStepStatus_SUCCEEDED || step.Operation == "" {
+			t.Errorf("expected step %s to have succeeded as an operation but got %v", step.Id, step)
+		}
+	}
+}
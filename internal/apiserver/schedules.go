@@ -0,0 +1,140 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/cron"
+	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// CreateSchedule stores a schedule for the recurring scheduler to run.
+func (c *Calculations) CreateSchedule(
+	ctx context.Context,
+	req *pb.CreateScheduleRequest,
+) (*pb.Schedule, error) {
+	if err := validateCreateScheduleRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Each run is a FibonacciOf calculation, so the template must make a
+	// valid request.
+	template := &pb.FibonacciOfRequest{
+		First:       req.Template.First,
+		Second:      req.Template.Second,
+		NthPosition: req.Template.NthPosition,
+		Priority:    req.Template.Priority,
+	}
+	if err := validateFibonacciOfRequest(template); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid template: %s", err))
+	}
+
+	expr, _ := cron.Parse(req.Cron)
+	now := c.clock.Now()
+
+	schedule := store.Schedule{
+		Name: uuid.New().String(),
+		Cron: req.Cron,
+		Template: store.CalculationTemplate{
+			First:    req.Template.First,
+			Second:   req.Template.Second,
+			Position: req.Template.NthPosition,
+			Priority: uint8(req.Template.Priority),
+		},
+		Created: now,
+		Next:    expr.Next(now),
+	}
+
+	if schedule.Next.IsZero() {
+		return nil, status.Error(codes.InvalidArgument, "cron expression never fires")
+	}
+
+	if err := c.store.CreateSchedule(ctx, schedule); errors.Is(err, store.ErrKeyAlreadyExists) {
+		log.Printf("tried to create schedule %s but it already exists", schedule.Name)
+		return nil, status.Error(codes.AlreadyExists, "already exists")
+	} else if err != nil {
+		log.Printf("error saving schedule: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	return scheduleToProto(schedule), nil
+}
+
+func (c *Calculations) ListSchedules(
+	ctx context.Context,
+	req *pb.ListSchedulesRequest,
+) (*pb.ListSchedulesResponse, error) {
+	if err := validateListSchedulesRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	pageSize := req.PageSize
+	if pageSize == 0 {
+		pageSize = defaultListPageSize
+	} else if pageSize > maxListPageSize {
+		pageSize = maxListPageSize
+	}
+
+	schedules, next, err := c.store.ListSchedules(ctx, req.PageToken, int64(pageSize))
+	if err != nil {
+		log.Printf("error listing schedules: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	resp := &pb.ListSchedulesResponse{
+		Schedules:     make([]*pb.Schedule, 0, len(schedules)),
+		NextPageToken: next,
+	}
+	for _, schedule := range schedules {
+		resp.Schedules = append(resp.Schedules, scheduleToProto(schedule))
+	}
+
+	return resp, nil
+}
+
+func (c *Calculations) DeleteSchedule(
+	ctx context.Context,
+	req *pb.DeleteScheduleRequest,
+) (*emptypb.Empty, error) {
+	if err := validateDeleteScheduleRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := c.store.DeleteSchedule(ctx, req.Name); errors.Is(err, store.ErrKeyNotFound) {
+		return nil, status.Error(codes.NotFound,
+			fmt.Sprintf("could not find schedule %q", req.Name))
+	} else if err != nil {
+		log.Printf("error deleting schedule: %s", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func scheduleToProto(schedule store.Schedule) *pb.Schedule {
+	s := &pb.Schedule{
+		Name: schedule.Name,
+		Cron: schedule.Cron,
+		Template: &pb.CalculationTemplate{
+			First:       schedule.Template.First,
+			Second:      schedule.Template.Second,
+			NthPosition: schedule.Template.Position,
+			Priority:    uint32(schedule.Template.Priority),
+		},
+		Created:    timestamppb.New(schedule.Created),
+		RecentRuns: schedule.Runs,
+	}
+	if !schedule.Next.IsZero() {
+		s.NextRun = timestamppb.New(schedule.Next)
+	}
+
+	return s
+}
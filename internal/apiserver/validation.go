@@ -2,11 +2,166 @@ package apiserver
 
 import (
 	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strings"
 
 	"cloud.google.com/go/longrunning/autogen/longrunningpb"
 	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/cron"
+	"github.com/vickleford/calculator/internal/pb"
 )
 
+func validateFibonacciOfRequest(r *pb.FibonacciOfRequest) error {
+	if r.Priority > math.MaxUint8 {
+		return fmt.Errorf("priority must be between 0 and %d", math.MaxUint8)
+	}
+
+	if r.NotBefore != nil {
+		if err := r.NotBefore.CheckValid(); err != nil {
+			return fmt.Errorf("invalid not_before: %w", err)
+		}
+	}
+
+	if r.Deadline != nil {
+		if err := r.Deadline.CheckValid(); err != nil {
+			return fmt.Errorf("invalid deadline: %w", err)
+		}
+
+		if r.NotBefore != nil && !r.NotBefore.AsTime().Before(r.Deadline.AsTime()) {
+			return fmt.Errorf("deadline must be after not_before")
+		}
+	}
+
+	return nil
+}
+
+// validateCallbackURL ensures a callback URL is an HTTP URL to one of hosts,
+// each of which is a host name allowing any port or a host and port. Hosts are
+// compared case-insensitively, as host names are.
+func validateCallbackURL(raw string, hosts []string) error {
+	if len(hosts) == 0 {
+		return fmt.Errorf("callbacks are not enabled")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid callback_url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callback_url must be an http or https URL")
+	}
+
+	host, hostname := strings.ToLower(u.Host), strings.ToLower(u.Hostname())
+	allowed := func(h string) bool {
+		h = strings.ToLower(h)
+		return h == host || h == hostname
+	}
+	if !slices.ContainsFunc(hosts, allowed) {
+		return fmt.Errorf("callback_url host %q is not allowed", u.Host)
+	}
+
+	return nil
+}
+
+func validateBatchFibonacciOfRequest(r *pb.BatchFibonacciOfRequest) error {
+	if len(r.Requests) == 0 {
+		return fmt.Errorf("requests must not be empty")
+	}
+
+	if len(r.Requests) > maxBatchSize {
+		return fmt.Errorf("at most %d calculations may be requested at once", maxBatchSize)
+	}
+
+	return nil
+}
+
+// validateSubmitPipelineRequest ensures the steps form a DAG by only letting
+// steps take their inputs from the steps before them.
+func validateSubmitPipelineRequest(r *pb.SubmitPipelineRequest) error {
+	if len(r.Steps) == 0 {
+		return fmt.Errorf("steps must not be empty")
+	}
+
+	if len(r.Steps) > maxPipelineSteps {
+		return fmt.Errorf("a pipeline may have at most %d steps", maxPipelineSteps)
+	}
+
+	earlier := make(map[string]bool, len(r.Steps))
+	for i, step := range r.Steps {
+		if step.Id == "" {
+			return fmt.Errorf("step %d must have an id", i+1)
+		}
+
+		if earlier[step.Id] {
+			return fmt.Errorf("step id %q is not unique", step.Id)
+		}
+
+		inputs := []struct {
+			name  string
+			input *pb.PipelineInput
+		}{
+			{"first", step.First},
+			{"second", step.Second},
+			{"nth_position", step.NthPosition},
+		}
+		for _, in := range inputs {
+			if in.input.GetModulo() < 0 {
+				return fmt.Errorf("%s of step %q must not have a negative modulo", in.name, step.Id)
+			}
+
+			ref := in.input.GetStep()
+			if ref == "" && in.input.GetModulo() != 0 {
+				return fmt.Errorf("modulo of %s of step %q only applies to the result of a step", in.name, step.Id)
+			}
+
+			if ref != "" && !earlier[ref] {
+				return fmt.Errorf("%s of step %q refers to %q, which is not an earlier step", in.name, step.Id, ref)
+			}
+		}
+
+		earlier[step.Id] = true
+	}
+
+	return nil
+}
+
+func validateCreateScheduleRequest(r *pb.CreateScheduleRequest) error {
+	if _, err := cron.Parse(r.Cron); err != nil {
+		return fmt.Errorf("invalid cron expression: %w", err)
+	}
+
+	if r.Template == nil {
+		return fmt.Errorf("template must be set")
+	}
+
+	return nil
+}
+
+func validateListSchedulesRequest(r *pb.ListSchedulesRequest) error {
+	if r.PageSize < 0 {
+		return fmt.Errorf("page size must not be negative")
+	}
+
+	if r.PageToken != "" {
+		if _, err := uuid.Parse(r.PageToken); err != nil {
+			return fmt.Errorf("invalid page token")
+		}
+	}
+
+	return nil
+}
+
+func validateDeleteScheduleRequest(r *pb.DeleteScheduleRequest) error {
+	if _, err := uuid.Parse(r.Name); err != nil {
+		return fmt.Errorf("schedule name must be a UUID")
+	}
+
+	return nil
+}
+
 func validateGetOperationRequest(r *longrunningpb.GetOperationRequest) error {
 	_, err := uuid.Parse(r.Name)
 	if err != nil {
@@ -15,3 +170,39 @@ func validateGetOperationRequest(r *longrunningpb.GetOperationRequest) error {
 
 	return nil
 }
+
+func validateBatchGetOperationsRequest(r *pb.BatchGetOperationsRequest, max int) error {
+	if len(r.Names) == 0 {
+		return fmt.Errorf("names must not be empty")
+	}
+
+	if len(r.Names) > max {
+		return fmt.Errorf("at most %d operations may be requested at once", max)
+	}
+
+	for _, name := range r.Names {
+		if _, err := uuid.Parse(name); err != nil {
+			return fmt.Errorf("operation name %q must be a UUID", name)
+		}
+	}
+
+	return nil
+}
+
+func validateListOperationsRequest(r *longrunningpb.ListOperationsRequest) error {
+	if r.Filter != "" {
+		return fmt.Errorf("filtering operations is not supported")
+	}
+
+	if r.PageSize < 0 {
+		return fmt.Errorf("page size must not be negative")
+	}
+
+	if r.PageToken != "" {
+		if _, err := uuid.Parse(r.PageToken); err != nil {
+			return fmt.Errorf("invalid page token")
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,9 @@
 package calculators
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 var ErrFibonacciPositionInvalid = errors.New("Fibonacci number sequences start at position 1")
 
@@ -15,7 +18,26 @@ func NewFibonacci(first, second int64) *Fibonacci {
 	return &Fibonacci{first: first, second: second}
 }
 
+// cancellationCheckInterval is how many numbers of a sequence are calculated
+// between checks for cancellation.
+const cancellationCheckInterval = 1 << 16
+
+// FibonacciCost estimates the cost of calculating the number at position of a
+// Fibonacci sequence as how many numbers must be added to reach it.
+func FibonacciCost(position int64) int64 {
+	if position < 3 {
+		return 0
+	}
+	return position - 2
+}
+
 func (f *Fibonacci) NumberAtPosition(position int64) (int64, error) {
+	return f.NumberAtPositionContext(context.Background(), position)
+}
+
+// NumberAtPositionContext is like NumberAtPosition but stops early with the
+// context's error once ctx is done.
+func (f *Fibonacci) NumberAtPositionContext(ctx context.Context, position int64) (int64, error) {
 	if position < 1 {
 		return -1, ErrFibonacciPositionInvalid
 	}
@@ -30,6 +52,11 @@ func (f *Fibonacci) NumberAtPosition(position int64) (int64, error) {
 	var twoBefore, previous = f.first, f.second
 	var result int64
 	for i := int64(3); i <= position; i++ {
+		if i%cancellationCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return -1, err
+			}
+		}
 		result = twoBefore + previous
 		twoBefore, previous = previous, result
 	}
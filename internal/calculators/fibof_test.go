@@ -1,7 +1,9 @@
 package calculators_test
 
 import (
+	"context"
 	"errors"
+	"math"
 	"testing"
 
 	"github.com/vickleford/calculator/internal/calculators"
@@ -126,3 +128,44 @@ func TestFibonacci_NumberAtPosition(t *testing.T) {
 		})
 	}
 }
+
+func TestFibonacci_NumberAtPositionContext_StopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	f := calculators.NewFibonacci(0, 1)
+
+	result, err := f.NumberAtPositionContext(ctx, math.MaxInt64)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the calculation to be canceled but got %v", err)
+	}
+	if result != -1 {
+		t.Errorf("expected -1 but got %d", result)
+	}
+}
+
+func TestFibonacci_NumberAtPositionContext(t *testing.T) {
+	f := calculators.NewFibonacci(0, 1)
+
+	result, err := f.NumberAtPositionContext(context.Background(), 6)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if result != 5 {
+		t.Errorf("expected 5 but got %d", result)
+	}
+}
+
+func TestFibonacciCost(t *testing.T) {
+	for position, expected := range map[int64]int64{
+		-1:   0,
+		1:    0,
+		2:    0,
+		3:    1,
+		1000: 998,
+	} {
+		if cost := calculators.FibonacciCost(position); cost != expected {
+			t.Errorf("expected cost %d at position %d but got %d", expected, position, cost)
+		}
+	}
+}
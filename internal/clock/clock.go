@@ -0,0 +1,46 @@
+// Package clock tells the time in a way that tests can control. See package
+// clocktest for a fake clock.
+package clock
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d to pass, returning early with ctx's error if ctx is
+	// done first.
+	Sleep(ctx context.Context, d time.Duration) error
+	// WithTimeout is like context.WithTimeout, timed by the clock.
+	WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc)
+}
+
+// WithDeadline is like context.WithDeadline, timed by clk.
+func WithDeadline(ctx context.Context, clk Clock, deadline time.Time) (context.Context, context.CancelFunc) {
+	return clk.WithTimeout(ctx, deadline.Sub(clk.Now()))
+}
+
+// Real is the system clock.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (Real) WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, d)
+}
@@ -0,0 +1,179 @@
+// Package clocktest provides a fake clock.Clock for tests.
+package clocktest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock"
+)
+
+var _ clock.Clock = &Fake{}
+
+// Fake is a clock.Clock whose time only passes when it is advanced.
+type Fake struct {
+	mu      sync.Mutex
+	waiting *sync.Cond
+	now     time.Time
+	waiters []*waiter
+	sleeps  []time.Duration
+
+	autoAdvance bool
+}
+
+// waiter is something waiting for the clock to reach a time.
+type waiter struct {
+	at   time.Time
+	fire func()
+}
+
+type Option func(*Fake)
+
+// WithAutoAdvance advances the clock by however long it is slept on rather
+// than waiting for it to be advanced.
+func WithAutoAdvance() Option {
+	return func(c *Fake) {
+		c.autoAdvance = true
+	}
+}
+
+// NewFake returns a Fake clock set to now.
+func NewFake(now time.Time, opts ...Option) *Fake {
+	c := &Fake{now: now}
+	c.waiting = sync.NewCond(&c.mu)
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
+}
+
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, waking what was waiting for it.
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+
+	var due []*waiter
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+		} else {
+			due = append(due, w)
+		}
+	}
+	c.waiters = pending
+	c.mu.Unlock()
+
+	for _, w := range due {
+		w.fire()
+	}
+}
+
+// Sleeps returns how long the clock was slept on each time, in order.
+func (c *Fake) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+// BlockUntil waits until at least n sleeps or timeouts are waiting for the
+// clock to be advanced.
+func (c *Fake) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.waiting.Wait()
+	}
+}
+
+func (c *Fake) Sleep(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	c.sleeps = append(c.sleeps, d)
+	c.mu.Unlock()
+
+	if c.autoAdvance {
+		c.Advance(d)
+		return ctx.Err()
+	}
+
+	woken := make(chan struct{})
+	w := c.wait(d, func() { close(woken) })
+
+	select {
+	case <-woken:
+		return nil
+	case <-ctx.Done():
+		c.remove(w)
+		return ctx.Err()
+	}
+}
+
+func (c *Fake) WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	inner, cancel := context.WithCancel(ctx)
+	timeout := &timeoutContext{Context: inner, deadline: c.Now().Add(d)}
+
+	w := c.wait(d, func() {
+		timeout.timedOut.Store(true)
+		cancel()
+	})
+
+	return timeout, func() {
+		c.remove(w)
+		cancel()
+	}
+}
+
+func (c *Fake) wait(d time.Duration, fire func()) *waiter {
+	c.mu.Lock()
+	w := &waiter{at: c.now.Add(d), fire: fire}
+	if d <= 0 {
+		c.mu.Unlock()
+		fire()
+		return w
+	}
+	c.waiters = append(c.waiters, w)
+	c.waiting.Broadcast()
+	c.mu.Unlock()
+
+	return w
+}
+
+func (c *Fake) remove(w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.waiters {
+		if c.waiters[i] == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// timeoutContext is canceled with context.DeadlineExceeded when the fake clock
+// reaches its deadline.
+type timeoutContext struct {
+	context.Context
+	deadline time.Time
+	timedOut atomic.Bool
+}
+
+func (c *timeoutContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *timeoutContext) Err() error {
+	if c.timedOut.Load() {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
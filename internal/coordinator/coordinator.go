@@ -0,0 +1,314 @@
+// Package coordinator runs pipelines, starting each step's calculation once the
+// steps it depends on have succeeded.
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/clock"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+type datastore interface {
+	ActivePipelines(context.Context) ([]string, error)
+	GetPipeline(context.Context, string) (store.Pipeline, error)
+	SavePipeline(context.Context, store.Pipeline) error
+	Create(context.Context, store.Calculation) error
+	GetMany(context.Context, []string) ([]store.Calculation, error)
+}
+
+type queue interface {
+	PublishJSON(context.Context, any) error
+}
+
+// Coordinator advances active pipelines. Only one Coordinator should run at a
+// time; see package leader.
+type Coordinator struct {
+	store    datastore
+	queue    queue
+	interval time.Duration
+	clock    clock.Clock
+
+	protobufJobs bool
+}
+
+type Option func(*Coordinator)
+
+// WithClock tells the time with clk, which also times the interval.
+func WithClock(clk clock.Clock) Option {
+	return func(c *Coordinator) {
+		c.clock = clk
+	}
+}
+
+// WithProtobufJobs publishes jobs as protobuf when the queue supports it.
+func WithProtobufJobs() Option {
+	return func(c *Coordinator) {
+		c.protobufJobs = true
+	}
+}
+
+// New creates a Coordinator advancing pipelines every interval.
+func New(ds datastore, q queue, interval time.Duration, opts ...Option) *Coordinator {
+	c := &Coordinator{store: ds, queue: q, interval: interval, clock: clock.Real{}}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
+}
+
+// Run advances pipelines until ctx is done.
+func (c *Coordinator) Run(ctx context.Context) error {
+	for {
+		if n, err := c.Coordinate(ctx, c.clock.Now()); err != nil {
+			log.Printf("error coordinating pipelines: %s", err)
+		} else if n > 0 {
+			log.Printf("started %d pipeline steps", n)
+		}
+
+		if err := c.clock.Sleep(ctx, c.interval); err != nil {
+			return err
+		}
+	}
+}
+
+// Coordinate advances every active pipeline at now and returns how many steps
+// were started. A pipeline that cannot be advanced is logged and left for the
+// next pass.
+func (c *Coordinator) Coordinate(ctx context.Context, now time.Time) (int, error) {
+	names, err := c.store.ActivePipelines(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting active pipelines: %w", err)
+	}
+
+	var started int
+	for _, name := range names {
+		n, err := c.advance(ctx, name, now)
+		if err != nil {
+			log.Printf("error advancing pipeline %q: %s", name, err)
+		}
+		started += n
+	}
+
+	return started, nil
+}
+
+// advance records the outcome of the pipeline's running steps and starts the
+// steps whose dependencies have all succeeded. It returns how many steps it
+// started.
+func (c *Coordinator) advance(ctx context.Context, name string, now time.Time) (int, error) {
+	pipeline, err := c.store.GetPipeline(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var running []string
+	for _, step := range pipeline.Steps {
+		if step.State == store.StepRunning {
+			running = append(running, step.Operation)
+		}
+	}
+
+	calculations, err := c.store.GetMany(ctx, running)
+	if err != nil {
+		return 0, err
+	}
+	found := make(map[string]store.Calculation, len(calculations))
+	for _, calc := range calculations {
+		found[calc.Name] = calc
+	}
+
+	// Steps only depend on the steps before them, so one pass in order sees
+	// every dependency's state for this round.
+	byID := make(map[string]*store.PipelineStep, len(pipeline.Steps))
+	var changed bool
+	var start []*store.PipelineStep
+	for i := range pipeline.Steps {
+		step := &pipeline.Steps[i]
+		byID[step.ID] = step
+
+		switch step.State {
+		case store.StepRunning:
+			calc, ok := found[step.Operation]
+			if !ok {
+				// It was never created, such as when the previous
+				// coordinator stopped right after recording the step.
+				start = append(start, step)
+			} else if calc.Done {
+				finishStep(step, calc)
+				changed = true
+			}
+		case store.StepPending:
+			if ready, err := dependenciesSucceeded(step, byID); err != nil {
+				step.State = store.StepSkipped
+				step.Error = err
+				changed = true
+			} else if ready {
+				step.State = store.StepRunning
+				step.Operation = uuid.NewString()
+				start = append(start, step)
+				changed = true
+			}
+		}
+	}
+
+	if isDone(pipeline) {
+		pipeline.Done = true
+		pipeline.Completed = &now
+		pipeline.Error = firstError(pipeline)
+		changed = true
+	}
+
+	// Record the steps before starting them so that they are started under
+	// the names recorded, even when this coordinator stops in between.
+	if changed {
+		if err := c.store.SavePipeline(ctx, pipeline); errors.Is(err, store.ErrUpdateUnsuccessful) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	var started int
+	for _, step := range start {
+		if err := c.startStep(ctx, step, byID, now); err != nil {
+			log.Printf("error starting step %q of pipeline %q: %s", step.ID, name, err)
+			continue
+		}
+		started++
+	}
+
+	return started, nil
+}
+
+// finishStep records the outcome of a step's calculation that is done.
+func finishStep(step *store.PipelineStep, calc store.Calculation) {
+	if calc.Error != nil {
+		step.State = store.StepFailed
+		step.Error = calc.Error
+		return
+	}
+
+	var result store.FibonacciOfResult
+	if err := json.Unmarshal(calc.Result, &result); err != nil {
+		step.State = store.StepFailed
+		step.Error = &status.Status{
+			Code:    int32(codes.Internal),
+			Message: fmt.Sprintf("unable to read the result of operation %q", calc.Name),
+		}
+		return
+	}
+
+	step.State = store.StepSucceeded
+	step.Result = result.Result
+}
+
+// dependenciesSucceeded reports whether every step the step takes an input from
+// has succeeded. It returns why the step cannot run when one of them did not.
+func dependenciesSucceeded(step *store.PipelineStep, byID map[string]*store.PipelineStep) (bool, *status.Status) {
+	ready := true
+	for _, input := range []store.PipelineInput{step.First, step.Second, step.Position} {
+		if input.Step == "" {
+			continue
+		}
+
+		switch byID[input.Step].State {
+		case store.StepSucceeded:
+		case store.StepFailed, store.StepSkipped:
+			return false, &status.Status{
+				Code:    int32(codes.Aborted),
+				Message: fmt.Sprintf("step %q did not succeed", input.Step),
+			}
+		default:
+			ready = false
+		}
+	}
+
+	return ready, nil
+}
+
+func isDone(pipeline store.Pipeline) bool {
+	for _, step := range pipeline.Steps {
+		if step.State == store.StepPending || step.State == store.StepRunning {
+			return false
+		}
+	}
+
+	return true
+}
+
+// firstError is the error of the first step that failed, if any did.
+func firstError(pipeline store.Pipeline) *status.Status {
+	for _, step := range pipeline.Steps {
+		if step.State == store.StepFailed {
+			return &status.Status{
+				Code:    step.Error.GetCode(),
+				Message: fmt.Sprintf("step %q failed: %s", step.ID, step.Error.GetMessage()),
+			}
+		}
+	}
+
+	return nil
+}
+
+// startStep creates the step's calculation from its inputs and publishes its
+// job. A job that fails to publish is left to the reconciler, like that of any
+// other calculation.
+func (c *Coordinator) startStep(ctx context.Context, step *store.PipelineStep, byID map[string]*store.PipelineStep, now time.Time) error {
+	job := worker.FibonacciOfJob{
+		OperationName: step.Operation,
+		First:         resolve(step.First, byID),
+		Second:        resolve(step.Second, byID),
+		Position:      resolve(step.Position, byID),
+	}
+
+	calculation := store.Calculation{
+		Name:     step.Operation,
+		Metadata: store.CalculationMetadata{Created: now},
+	}
+
+	var err error
+	calculation.Job, err = json.Marshal(job.Envelope())
+	if err != nil {
+		return fmt.Errorf("error marshaling job: %w", err)
+	}
+
+	if err := c.store.Create(ctx, calculation); errors.Is(err, store.ErrKeyAlreadyExists) {
+		// Whoever created it published it too.
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error creating calculation: %w", err)
+	}
+
+	if err := worker.PublishFibonacciOf(ctx, c.queue, job, c.protobufJobs); err != nil {
+		return fmt.Errorf("error publishing job: %w", err)
+	}
+
+	return nil
+}
+
+// resolve returns the value of an input, given the steps it may refer to.
+func resolve(input store.PipelineInput, byID map[string]*store.PipelineStep) int64 {
+	if input.Step == "" {
+		return input.Value
+	}
+
+	result := byID[input.Step].Result
+	if input.Modulo > 0 {
+		// Go's remainder takes the sign of the dividend.
+		result = (result%input.Modulo + input.Modulo) % input.Modulo
+	}
+
+	return result
+}
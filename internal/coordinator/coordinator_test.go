@@ -0,0 +1,266 @@
+package coordinator_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock/clocktest"
+	"github.com/vickleford/calculator/internal/coordinator"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+type fakeStore struct {
+	pipelines    map[string]store.Pipeline
+	calculations map[string]store.Calculation
+}
+
+func newFakeStore(pipelines ...store.Pipeline) *fakeStore {
+	s := &fakeStore{
+		pipelines:    make(map[string]store.Pipeline),
+		calculations: make(map[string]store.Calculation),
+	}
+	for _, p := range pipelines {
+		s.pipelines[p.Name] = p
+	}
+	return s
+}
+
+func (s *fakeStore) ActivePipelines(ctx context.Context) ([]string, error) {
+	var names []string
+	for name, p := range s.pipelines {
+		if !p.Done {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *fakeStore) GetPipeline(ctx context.Context, name string) (store.Pipeline, error) {
+	p, ok := s.pipelines[name]
+	if !ok {
+		return p, store.ErrKeyNotFound
+	}
+	return p, nil
+}
+
+func (s *fakeStore) SavePipeline(ctx context.Context, p store.Pipeline) error {
+	if s.pipelines[p.Name].Version != p.Version {
+		return store.ErrUpdateUnsuccessful
+	}
+	p.Version++
+	s.pipelines[p.Name] = p
+	return nil
+}
+
+func (s *fakeStore) Create(ctx context.Context, c store.Calculation) error {
+	if _, ok := s.calculations[c.Name]; ok {
+		return store.ErrKeyAlreadyExists
+	}
+	s.calculations[c.Name] = c
+	return nil
+}
+
+func (s *fakeStore) GetMany(ctx context.Context, names []string) ([]store.Calculation, error) {
+	var found []store.Calculation
+	for _, name := range names {
+		if c, ok := s.calculations[name]; ok {
+			found = append(found, c)
+		}
+	}
+	return found, nil
+}
+
+// finish completes the calculation of the named step with result, or with err
+// when it is set.
+func (s *fakeStore) finish(t *testing.T, pipeline, step string, result int64, err *status.Status) {
+	t.Helper()
+
+	var operation string
+	for _, st := range s.pipelines[pipeline].Steps {
+		if st.ID == step {
+			operation = st.Operation
+		}
+	}
+
+	c, ok := s.calculations[operation]
+	if !ok {
+		t.Fatalf("step %s has no calculation", step)
+	}
+
+	c.Done = true
+	c.Error = err
+	if err == nil {
+		c.Result, _ = json.Marshal(store.FibonacciOfResult{Result: result})
+	}
+	s.calculations[operation] = c
+}
+
+type workQ struct {
+	published []worker.FibonacciOfJob
+}
+
+func (q *workQ) PublishJSON(ctx context.Context, msg any) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	job, err := worker.DecodeFibonacciOfJob(b)
+	if err != nil {
+		return err
+	}
+	q.published = append(q.published, job)
+	return nil
+}
+
+func newPipeline() store.Pipeline {
+	return store.Pipeline{
+		Name: "pipeline",
+		Steps: []store.PipelineStep{
+			{
+				ID:       "a",
+				Second:   store.PipelineInput{Value: 1},
+				Position: store.PipelineInput{Value: 10},
+				State:    store.StepPending,
+			},
+			{
+				ID:       "b",
+				Second:   store.PipelineInput{Value: 1},
+				Position: store.PipelineInput{Step: "a", Modulo: 10},
+				State:    store.StepPending,
+			},
+		},
+	}
+}
+
+func TestCoordinate_StartsStepsOnceTheirDependenciesSucceed(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeStore(newPipeline())
+	q := &workQ{}
+	c := coordinator.New(ds, q, time.Second)
+
+	if n, err := c.Coordinate(ctx, time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected to start 1 step but started %d: %v", n, err)
+	}
+	if len(q.published) != 1 || q.published[0].Position != 10 {
+		t.Fatalf("expected only step a to be published but got %+v", q.published)
+	}
+
+	// Nothing changes while a is running.
+	if n, err := c.Coordinate(ctx, time.Now()); err != nil || n != 0 {
+		t.Fatalf("expected to start no steps but started %d: %v", n, err)
+	}
+
+	ds.finish(t, "pipeline", "a", 34, nil)
+
+	if n, err := c.Coordinate(ctx, time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected to start 1 step but started %d: %v", n, err)
+	}
+	if len(q.published) != 2 || q.published[1].Position != 4 {
+		t.Fatalf("expected step b to be published at position 34 mod 10 but got %+v", q.published)
+	}
+
+	ds.finish(t, "pipeline", "b", 2, nil)
+
+	now := time.Now()
+	if _, err := c.Coordinate(ctx, now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pipeline := ds.pipelines["pipeline"]
+	if !pipeline.Done || pipeline.Error != nil || !pipeline.Completed.Equal(now) {
+		t.Errorf("expected the pipeline to have succeeded at %s but got %+v", now, pipeline)
+	}
+	if pipeline.Steps[0].Result != 34 || pipeline.Steps[1].Result != 2 {
+		t.Errorf("expected the results of the steps to be recorded but got %+v", pipeline.Steps)
+	}
+}
+
+func TestCoordinate_SkipsStepsWhoseDependenciesFailed(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeStore(newPipeline())
+	q := &workQ{}
+	c := coordinator.New(ds, q, time.Second)
+
+	if _, err := c.Coordinate(ctx, time.Now()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ds.finish(t, "pipeline", "a", 0, &status.Status{Code: int32(codes.InvalidArgument), Message: "bad position"})
+
+	if n, err := c.Coordinate(ctx, time.Now()); err != nil || n != 0 {
+		t.Fatalf("expected to start no steps but started %d: %v", n, err)
+	}
+
+	pipeline := ds.pipelines["pipeline"]
+	if pipeline.Steps[0].State != store.StepFailed || pipeline.Steps[1].State != store.StepSkipped {
+		t.Errorf("expected a to fail and b to be skipped but got %+v", pipeline.Steps)
+	}
+
+	if !pipeline.Done || pipeline.Error == nil {
+		t.Fatalf("expected the pipeline to be done with an error but got %+v", pipeline)
+	}
+	if pipeline.Error.Code != int32(codes.InvalidArgument) || !strings.Contains(pipeline.Error.Message, `"a"`) {
+		t.Errorf("expected the error of step a but got %v", pipeline.Error)
+	}
+}
+
+func TestCoordinate_StartsRunningStepsThatWereNeverCreated(t *testing.T) {
+	pipeline := newPipeline()
+	pipeline.Steps[0].State = store.StepRunning
+	pipeline.Steps[0].Operation = "recorded"
+
+	ds := newFakeStore(pipeline)
+	q := &workQ{}
+
+	if _, err := coordinator.New(ds, q, time.Second).Coordinate(context.Background(), time.Now()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, ok := ds.calculations["recorded"]; !ok {
+		t.Error("expected the calculation to be created under the recorded name")
+	}
+	if len(q.published) != 1 || q.published[0].OperationName != "recorded" {
+		t.Errorf("expected the job to be published for the recorded name but got %+v", q.published)
+	}
+}
+
+func TestRun_AdvancesPipelinesEveryInterval(t *testing.T) {
+	now := time.Now()
+	clk := clocktest.NewFake(now)
+	ds := newFakeStore(newPipeline())
+	q := &workQ{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- coordinator.New(ds, q, time.Minute, coordinator.WithClock(clk)).Run(ctx) }()
+
+	clk.BlockUntil(1)
+	if len(q.published) != 1 {
+		t.Fatalf("expected step a to start on the first pass but published %+v", q.published)
+	}
+	if created := ds.calculations[q.published[0].OperationName].Metadata.Created; !created.Equal(now) {
+		t.Errorf("expected step a to be created at %s but got %s", now, created)
+	}
+
+	ds.finish(t, "pipeline", "a", 34, nil)
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1)
+	if len(q.published) != 2 {
+		t.Fatalf("expected step b to start on the next pass but published %+v", q.published)
+	}
+	if created, expected := ds.calculations[q.published[1].OperationName].Metadata.Created, now.Add(time.Minute); !created.Equal(expected) {
+		t.Errorf("expected step b to be created at %s but got %s", expected, created)
+	}
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Run to stop when ctx is done but got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vickleford/calculator/internal/cron"
+)
+
+func TestNext(t *testing.T) {
+	// A Wednesday.
+	from := time.Date(2024, time.July, 17, 10, 30, 15, 0, time.UTC)
+
+	tests := map[string]struct {
+		expr     string
+		expected time.Time
+	}{
+		"EveryMinute":      {"* * * * *", time.Date(2024, time.July, 17, 10, 31, 0, 0, time.UTC)},
+		"EveryFiveMinutes": {"*/5 * * * *", time.Date(2024, time.July, 17, 10, 35, 0, 0, time.UTC)},
+		"Hourly":           {"@hourly", time.Date(2024, time.July, 17, 11, 0, 0, 0, time.UTC)},
+		"DailyAtNine":      {"0 9 * * *", time.Date(2024, time.July, 18, 9, 0, 0, 0, time.UTC)},
+		"List":             {"0 9,12 * * *", time.Date(2024, time.July, 17, 12, 0, 0, 0, time.UTC)},
+		"Weekdays":         {"0 8 * * 1-5", time.Date(2024, time.July, 18, 8, 0, 0, 0, time.UTC)},
+		"SundayAsSeven":    {"0 0 * * 7", time.Date(2024, time.July, 21, 0, 0, 0, 0, time.UTC)},
+		"Monthly":          {"@monthly", time.Date(2024, time.August, 1, 0, 0, 0, 0, time.UTC)},
+		"NextYear":         {"0 0 1 3 *", time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		"LeapDay":          {"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted.
+		"DayOfMonthOrWeek": {"0 0 20 * 5", time.Date(2024, time.July, 19, 0, 0, 0, 0, time.UTC)},
+		"Never":            {"0 0 30 2 *", time.Time{}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := cron.Parse(test.expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if next := s.Next(from); !next.Equal(test.expected) {
+				t.Errorf("expected %s but got %s", test.expected, next)
+			}
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"5/10 * * * *",
+		"a * * * *",
+		"@fortnightly",
+	} {
+		if _, err := cron.Parse(expr); err == nil {
+			t.Errorf("expected %q to be invalid", expr)
+		}
+	}
+}
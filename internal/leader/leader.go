@@ -0,0 +1,123 @@
+// Package leader runs work on only one of many replicas at a time by electing a
+// leader through etcd.
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// sessionTTL is how many seconds leadership outlives a replica that stops
+// renewing it, such as one that crashed.
+const sessionTTL = 10
+
+// retryDelay is how long to wait before campaigning again after failing to.
+const retryDelay = time.Second
+
+var errLeadershipLost = errors.New("leadership was lost")
+
+// Run campaigns to lead the named election and calls fn while leading. The
+// context given to fn is canceled if leadership is lost, after which Run
+// campaigns again. Run returns when ctx is done or fn returns for any other
+// reason.
+func Run(ctx context.Context, cli *clientv3.Client, election string, fn func(context.Context) error) error {
+	id, err := os.Hostname()
+	if err != nil {
+		id = "unknown"
+	}
+
+	for {
+		err := lead(ctx, cli, election, id, fn)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if errors.Is(err, errLeadershipLost) {
+			log.Printf("lost leadership of %q; campaigning again", election)
+			continue
+		}
+
+		var campaignErr *campaignError
+		if errors.As(err, &campaignErr) {
+			log.Printf("error campaigning for %q: %s", election, err)
+
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		return err
+	}
+}
+
+// campaignError is an error becoming the leader, after which campaigning should
+// be tried again.
+type campaignError struct {
+	err error
+}
+
+func (e *campaignError) Error() string {
+	return e.err.Error()
+}
+
+func (e *campaignError) Unwrap() error {
+	return e.err
+}
+
+func lead(
+	ctx context.Context,
+	cli *clientv3.Client,
+	election, id string,
+	fn func(context.Context) error,
+) error {
+	session, err := concurrency.NewSession(cli, concurrency.WithTTL(sessionTTL))
+	if err != nil {
+		return &campaignError{fmt.Errorf("error creating session: %w", err)}
+	}
+	defer session.Close()
+
+	e := concurrency.NewElection(session, election)
+	if err := e.Campaign(ctx, id); err != nil {
+		return &campaignError{fmt.Errorf("error campaigning: %w", err)}
+	}
+
+	log.Printf("%s is now the leader of %q", id, election)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-session.Done():
+			cancel()
+		case <-leaderCtx.Done():
+		}
+	}()
+
+	err = fn(leaderCtx)
+
+	select {
+	case <-session.Done():
+		return errLeadershipLost
+	default:
+	}
+
+	resignCtx, resignCancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer resignCancel()
+
+	if resignErr := e.Resign(resignCtx); resignErr != nil {
+		log.Printf("error resigning leadership of %q: %s", election, resignErr)
+	}
+
+	return err
+}
@@ -0,0 +1,72 @@
+package leader_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/leader"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestIntegration_Run_OnlyOneLeaderAtATime(t *testing.T) {
+	etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+	if etcdEndpoint == "" {
+		t.Skip(`set ETCD_ENDPOINT to run this test, e.g. ETCD_ENDPOINT="localhost:2379"`)
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdEndpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to set up client: %s", err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	election := "integration/" + uuid.NewString()
+
+	var leaders, maxLeaders, terms atomic.Int32
+	work := func(ctx context.Context) error {
+		n := leaders.Add(1)
+		defer leaders.Add(-1)
+		if n > maxLeaders.Load() {
+			maxLeaders.Store(n)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		if terms.Add(1) == 2 {
+			cancel()
+		}
+		return nil
+	}
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			for {
+				if err := leader.Run(ctx, cli, election, work); err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	if maxLeaders.Load() != 1 {
+		t.Errorf("expected 1 leader at a time but saw %d", maxLeaders.Load())
+	}
+}
@@ -0,0 +1,425 @@
+// Package notifier calls back the clients of calculations once they are done.
+//
+// A callback is an HTTP POST of the final operation to the calculation's
+// callback URL, as JSON or protobuf. It is signed with a secret shared with the
+// clients: the X-Calculator-Signature header is "sha256=" followed by the hex
+// HMAC-SHA256 of the X-Calculator-Timestamp header, a period and the body.
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock"
+	"github.com/vickleford/calculator/internal/operations"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Headers of each callback request. TimestampHeader carries the Unix time the
+// request was sent at, and SignatureHeader its signature as returned by Sign,
+// so receivers can check a callback came from this service.
+const (
+	TimestampHeader = "X-Calculator-Timestamp"
+	SignatureHeader = "X-Calculator-Signature"
+)
+
+// DefaultRetryPolicy tries a callback up to 5 times, waiting from a second up
+// to a minute between attempts. Client errors other than timeouts and rate
+// limiting are not retried.
+var DefaultRetryPolicy = worker.RetryPolicy{
+	InitialDelay: time.Second,
+	MaxDelay:     time.Minute,
+	Multiplier:   2,
+	MaxAttempts:  5,
+	Retryable: func(err error) bool {
+		return !errors.Is(err, errPermanent)
+	},
+}
+
+// DefaultRedeliverAfter is how long a pending callback goes without being
+// attempted before it is delivered again by default. It is longer than the
+// longest wait between attempts of DefaultRetryPolicy plus the time an attempt
+// may take.
+const DefaultRedeliverAfter = 5 * time.Minute
+
+// redeliveryInterval is how often left behind callbacks are looked for.
+const redeliveryInterval = time.Minute
+
+// batchSize is how many pending callbacks are read from the store at a time.
+const batchSize = 100
+
+// recordAttempts limits how many times recording a callback's progress is
+// tried.
+const recordAttempts = 10
+
+// errPermanent marks a callback that would fail again if it were retried.
+var errPermanent = errors.New("permanent failure")
+
+type datastore interface {
+	Get(context.Context, string) (store.Calculation, error)
+	Save(context.Context, store.Calculation) error
+	PendingCallbacks(context.Context, string, int64) ([]store.Calculation, string, error)
+}
+
+// Notifier delivers callbacks in the background and records how each is going
+// in its calculation.
+type Notifier struct {
+	store       datastore
+	client      *http.Client
+	secret      []byte
+	retryPolicy worker.RetryPolicy
+	protobuf    bool
+	clock       clock.Clock
+
+	redeliverAfter time.Duration
+
+	deliveries sync.WaitGroup
+	mu         sync.Mutex
+	delivering map[string]bool
+}
+
+type Option func(*Notifier)
+
+// WithHTTPClient makes callbacks with client. Callback URLs are only checked
+// against the allowed hosts when they are requested, so client should not
+// follow redirects.
+func WithHTTPClient(client *http.Client) Option {
+	return func(n *Notifier) {
+		n.client = client
+	}
+}
+
+// WithRetryPolicy retries callbacks according to p rather than
+// DefaultRetryPolicy.
+func WithRetryPolicy(p worker.RetryPolicy) Option {
+	return func(n *Notifier) {
+		n.retryPolicy = p
+	}
+}
+
+// WithProtobufPayloads sends the operation as binary protobuf instead of JSON.
+func WithProtobufPayloads() Option {
+	return func(n *Notifier) {
+		n.protobuf = true
+	}
+}
+
+// WithClock tells the time with clk, which also times redelivery and the retry
+// policy unless it has its own clock.
+func WithClock(clk clock.Clock) Option {
+	return func(n *Notifier) {
+		n.clock = clk
+	}
+}
+
+// WithRedeliverAfter has Redeliver deliver the pending callbacks that were not
+// attempted for d rather than DefaultRedeliverAfter. It should be longer than
+// the longest wait between attempts plus the time an attempt may take, or else
+// callbacks still being delivered by another worker are delivered twice.
+func WithRedeliverAfter(d time.Duration) Option {
+	return func(n *Notifier) {
+		n.redeliverAfter = d
+	}
+}
+
+// New creates a Notifier signing callbacks with secret.
+func New(ds datastore, secret []byte, opts ...Option) *Notifier {
+	n := &Notifier{
+		store:       ds,
+		client:      &http.Client{Timeout: 10 * time.Second, CheckRedirect: noRedirects},
+		secret:      secret,
+		retryPolicy: DefaultRetryPolicy,
+		clock:       clock.Real{},
+
+		redeliverAfter: DefaultRedeliverAfter,
+		delivering:     make(map[string]bool),
+	}
+
+	for _, o := range opts {
+		o(n)
+	}
+
+	if n.retryPolicy.Clock == nil {
+		n.retryPolicy.Clock = n.clock
+	}
+
+	return n
+}
+
+// Notify delivers the callback of a done calculation in the background, unless
+// it is already being delivered. The delivery outlives ctx; see Wait.
+func (n *Notifier) Notify(ctx context.Context, calculation store.Calculation) {
+	n.start(ctx, calculation)
+}
+
+// start delivers the callback like Notify and reports whether it did.
+func (n *Notifier) start(ctx context.Context, calculation store.Calculation) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.delivering[calculation.Name] {
+		return false
+	}
+	n.delivering[calculation.Name] = true
+
+	ctx = context.WithoutCancel(ctx)
+
+	n.deliveries.Add(1)
+	go func() {
+		defer n.deliveries.Done()
+		defer func() {
+			n.mu.Lock()
+			delete(n.delivering, calculation.Name)
+			n.mu.Unlock()
+		}()
+
+		if err := n.Deliver(ctx, calculation); err != nil {
+			log.Printf("error calling back calculation %q: %s", calculation.Name, err)
+		}
+	}()
+
+	return true
+}
+
+// Run redelivers left behind callbacks until ctx is done. Only one Notifier
+// should run at a time; see package leader.
+func (n *Notifier) Run(ctx context.Context) error {
+	for {
+		if count, err := n.Redeliver(ctx); err != nil {
+			log.Printf("error redelivering callbacks: %s", err)
+		} else if count > 0 {
+			log.Printf("redelivering %d left behind callbacks", count)
+		}
+
+		if err := n.clock.Sleep(ctx, redeliveryInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// Redeliver delivers in the background the pending callbacks of done
+// calculations that were not attempted for the redelivery period, such as
+// those of a worker that stopped before delivering them, and returns how many
+// it started delivering.
+func (n *Notifier) Redeliver(ctx context.Context) (int, error) {
+	now := n.clock.Now()
+
+	var redelivered int
+	var after string
+	for {
+		calculations, next, err := n.store.PendingCallbacks(ctx, after, batchSize)
+		if err != nil {
+			return redelivered, err
+		}
+
+		for _, calculation := range calculations {
+			if n.leftBehind(calculation, now) && n.start(ctx, calculation) {
+				redelivered++
+			}
+		}
+
+		if next == "" {
+			return redelivered, nil
+		}
+		after = next
+	}
+}
+
+// leftBehind reports whether the calculation's pending callback was not
+// attempted for the redelivery period at now, counting from when the
+// calculation was done if it never was.
+func (n *Notifier) leftBehind(calculation store.Calculation, now time.Time) bool {
+	callback := calculation.Metadata.Callback
+	if callback == nil || callback.State != store.CallbackPending {
+		return false
+	}
+
+	last := calculation.Metadata.Completed
+	if callback.LastAttempted != nil {
+		last = callback.LastAttempted
+	}
+
+	return last == nil || now.Sub(*last) >= n.redeliverAfter
+}
+
+// Wait waits for the callbacks being delivered, or until ctx is done.
+func (n *Notifier) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		n.deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Deliver calls back the client of a done calculation, retrying according to
+// the retry policy. Attempts already recorded in the calculation count towards
+// the policy's limit. It records each attempt in the calculation and returns
+// the last attempt's error if the callback could not be delivered.
+func (n *Notifier) Deliver(ctx context.Context, calculation store.Calculation) error {
+	if calculation.Metadata.Callback == nil {
+		return nil
+	}
+	url := calculation.Metadata.Callback.URL
+
+	policy := n.retryPolicy
+	if policy.MaxAttempts > 0 {
+		policy.MaxAttempts -= calculation.Metadata.Callback.Attempts
+		if policy.MaxAttempts < 1 {
+			n.record(ctx, calculation.Name, func(cb *store.Callback) {
+				cb.State = store.CallbackFailed
+			})
+			return fmt.Errorf("no attempts left after %d", calculation.Metadata.Callback.Attempts)
+		}
+	}
+
+	body, contentType, err := n.payload(calculation)
+	if err != nil {
+		n.record(ctx, calculation.Name, func(cb *store.Callback) {
+			cb.State = store.CallbackFailed
+			cb.LastError = err.Error()
+		})
+		return err
+	}
+
+	err = policy.Do(ctx, func() error {
+		err := n.post(ctx, url, body, contentType)
+		attempted := n.clock.Now()
+
+		n.record(ctx, calculation.Name, func(cb *store.Callback) {
+			cb.Attempts++
+			cb.LastAttempted = &attempted
+			if err != nil {
+				cb.LastError = err.Error()
+				return
+			}
+			cb.State = store.CallbackDelivered
+			cb.Delivered = &attempted
+		})
+
+		return err
+	})
+	if err != nil {
+		n.record(ctx, calculation.Name, func(cb *store.Callback) {
+			cb.State = store.CallbackFailed
+		})
+		return err
+	}
+
+	return nil
+}
+
+// payload encodes the final operation of calculation.
+func (n *Notifier) payload(calculation store.Calculation) ([]byte, string, error) {
+	op, err := operations.FromCalculation(calculation, n.clock.Now())
+	if err != nil {
+		return nil, "", fmt.Errorf("error representing calculation as an operation: %w", err)
+	}
+
+	if n.protobuf {
+		body, err := proto.Marshal(op)
+		if err != nil {
+			return nil, "", fmt.Errorf("error marshaling operation: %w", err)
+		}
+		return body, "application/x-protobuf", nil
+	}
+
+	body, err := protojson.Marshal(op)
+	if err != nil {
+		return nil, "", fmt.Errorf("error marshaling operation: %w", err)
+	}
+	return body, "application/json", nil
+}
+
+// noRedirects stops a callback from being redirected to a host it was not
+// allowed to call back.
+func noRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+func (n *Notifier) post(ctx context.Context, url string, body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: error creating request: %s", errPermanent, err)
+	}
+
+	timestamp := strconv.FormatInt(n.clock.Now().Unix(), 10)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(n.secret, timestamp, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting callback: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		return fmt.Errorf("%w: callback responded %s and redirects are not followed", errPermanent, resp.Status)
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("callback responded %s", resp.Status)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return fmt.Errorf("%w: callback responded %s", errPermanent, resp.Status)
+	default:
+		return fmt.Errorf("callback responded %s", resp.Status)
+	}
+}
+
+// record updates the callback of the named calculation with update, retrying
+// when the calculation changes in the meantime. A failure to record is logged
+// rather than failing the delivery.
+func (n *Notifier) record(ctx context.Context, name string, update func(*store.Callback)) {
+	policy := worker.DefaultStoreRetryPolicy
+	policy.MaxAttempts = recordAttempts
+	policy.Clock = n.clock
+
+	err := policy.Do(ctx, func() error {
+		calculation, err := n.store.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		if calculation.Metadata.Callback == nil {
+			return nil
+		}
+
+		update(calculation.Metadata.Callback)
+
+		return n.store.Save(ctx, calculation)
+	})
+	if err != nil {
+		log.Printf("error recording callback of calculation %q: %s", name, err)
+	}
+}
+
+// Sign returns the signature of a callback body sent at timestamp.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,382 @@
+package notifier_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"github.com/vickleford/calculator/internal/clock/clocktest"
+	"github.com/vickleford/calculator/internal/notifier"
+	"github.com/vickleford/calculator/internal/store"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+type fakeStore struct {
+	mu           sync.Mutex
+	calculations map[string]store.Calculation
+}
+
+func newFakeStore(c store.Calculation) *fakeStore {
+	return &fakeStore{calculations: map[string]store.Calculation{c.Name: c}}
+}
+
+func (s *fakeStore) Get(ctx context.Context, name string) (store.Calculation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.calculations[name]
+	if !ok {
+		return c, store.ErrKeyNotFound
+	}
+	if c.Metadata.Callback != nil {
+		callback := *c.Metadata.Callback
+		c.Metadata.Callback = &callback
+	}
+	return c, nil
+}
+
+func (s *fakeStore) Save(ctx context.Context, c store.Calculation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.calculations[c.Name].Metadata.Version != c.Metadata.Version {
+		return store.ErrUpdateUnsuccessful
+	}
+	c.Metadata.Version++
+	s.calculations[c.Name] = c
+	return nil
+}
+
+func (s *fakeStore) PendingCallbacks(ctx context.Context, after string, limit int64) ([]store.Calculation, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pending []store.Calculation
+	for _, c := range s.calculations {
+		if c.Done && c.Metadata.Callback != nil && c.Metadata.Callback.State == store.CallbackPending {
+			pending = append(pending, c)
+		}
+	}
+	return pending, "", nil
+}
+
+func (s *fakeStore) callback(name string) store.Callback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.calculations[name].Metadata.Callback
+}
+
+func doneCalculation(url string) store.Calculation {
+	result, _ := json.Marshal(store.FibonacciOfResult{Result: 55})
+	return store.Calculation{
+		Name:   "george",
+		Done:   true,
+		Result: result,
+		Metadata: store.CalculationMetadata{
+			Created:  time.Date(2024, time.July, 17, 10, 0, 0, 0, time.UTC),
+			Callback: &store.Callback{URL: url, State: store.CallbackPending},
+		},
+	}
+}
+
+func TestDeliver_SignsTheFinalOperation(t *testing.T) {
+	secret := []byte("shh")
+	now := time.Date(2024, time.July, 17, 10, 5, 0, 0, time.UTC)
+
+	var op longrunningpb.Operation
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		timestamp := r.Header.Get(notifier.TimestampHeader)
+		if expected := notifier.Sign(secret, timestamp, body); r.Header.Get(notifier.SignatureHeader) != expected {
+			t.Errorf("expected signature %q but got %q", expected, r.Header.Get(notifier.SignatureHeader))
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected a JSON payload but got %q", r.Header.Get("Content-Type"))
+		}
+		if err := protojson.Unmarshal(body, &op); err != nil {
+			t.Errorf("error unmarshaling payload: %s", err)
+		}
+	}))
+	defer srv.Close()
+
+	calculation := doneCalculation(srv.URL)
+	ds := newFakeStore(calculation)
+	n := notifier.New(ds, secret, notifier.WithClock(clocktest.NewFake(now)))
+
+	if err := n.Deliver(context.Background(), calculation); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if op.Name != "george" || !op.Done {
+		t.Errorf("expected the done operation george but got %v", &op)
+	}
+
+	callback := ds.callback("george")
+	if callback.State != store.CallbackDelivered || callback.Attempts != 1 {
+		t.Errorf("expected the callback to be delivered in 1 attempt but got %+v", callback)
+	}
+	if callback.Delivered == nil || !callback.Delivered.Equal(now) {
+		t.Errorf("expected the callback to be delivered at %s but got %v", now, callback.Delivered)
+	}
+}
+
+func TestDeliver_SendsProtobuf(t *testing.T) {
+	var op longrunningpb.Operation
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, &op); err != nil {
+			t.Errorf("error unmarshaling payload: %s", err)
+		}
+	}))
+	defer srv.Close()
+
+	calculation := doneCalculation(srv.URL)
+	n := notifier.New(newFakeStore(calculation), []byte("shh"), notifier.WithProtobufPayloads())
+
+	if err := n.Deliver(context.Background(), calculation); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if op.Name != "george" {
+		t.Errorf("expected operation george but got %v", &op)
+	}
+}
+
+func TestDeliver_RetriesUntilItSucceeds(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	calculation := doneCalculation(srv.URL)
+	ds := newFakeStore(calculation)
+	clk := clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())
+	n := notifier.New(ds, []byte("shh"), notifier.WithClock(clk))
+
+	if err := n.Deliver(context.Background(), calculation); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	callback := ds.callback("george")
+	if callback.State != store.CallbackDelivered || callback.Attempts != 3 {
+		t.Errorf("expected the callback to be delivered in 3 attempts but got %+v", callback)
+	}
+	if sleeps := clk.Sleeps(); len(sleeps) != 2 || sleeps[0] != time.Second || sleeps[1] != 2*time.Second {
+		t.Errorf("expected to back off 1s then 2s but slept %v", sleeps)
+	}
+}
+
+func TestDeliver_DoesNotRetryClientErrors(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer srv.Close()
+
+	calculation := doneCalculation(srv.URL)
+	ds := newFakeStore(calculation)
+	n := notifier.New(ds, []byte("shh"), notifier.WithClock(clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())))
+
+	if err := n.Deliver(context.Background(), calculation); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if calls != 1 {
+		t.Errorf("expected 1 call but got %d", calls)
+	}
+
+	callback := ds.callback("george")
+	if callback.State != store.CallbackFailed || callback.Attempts != 1 || callback.LastError == "" {
+		t.Errorf("expected the failure to be recorded but got %+v", callback)
+	}
+}
+
+func TestDeliver_DoesNotFollowRedirects(t *testing.T) {
+	var redirected bool
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer elsewhere.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, elsewhere.URL, http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	calculation := doneCalculation(srv.URL)
+	ds := newFakeStore(calculation)
+	n := notifier.New(ds, []byte("shh"), notifier.WithClock(clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())))
+
+	if err := n.Deliver(context.Background(), calculation); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if redirected {
+		t.Error("expected the redirect not to be followed")
+	}
+
+	callback := ds.callback("george")
+	if callback.State != store.CallbackFailed || callback.Attempts != 1 {
+		t.Errorf("expected the callback to fail without retrying but got %+v", callback)
+	}
+}
+
+func TestNotify_GivesUpAfterTheLastAttempt(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	calculation := doneCalculation(srv.URL)
+	ds := newFakeStore(calculation)
+	n := notifier.New(ds, []byte("shh"), notifier.WithClock(clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())))
+
+	n.Notify(context.Background(), calculation)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Wait(ctx); err != nil {
+		t.Fatalf("error waiting for the delivery: %s", err)
+	}
+
+	if calls != 5 {
+		t.Errorf("expected 5 calls but got %d", calls)
+	}
+
+	callback := ds.callback("george")
+	if callback.State != store.CallbackFailed || callback.Attempts != 5 {
+		t.Errorf("expected the callback to fail after 5 attempts but got %+v", callback)
+	}
+}
+
+func TestRedeliver_DeliversLeftBehindCallbacks(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer srv.Close()
+
+	now := time.Date(2024, time.July, 17, 11, 0, 0, 0, time.UTC)
+	tenMinutesAgo := now.Add(-10 * time.Minute)
+	aMinuteAgo := now.Add(-time.Minute)
+
+	leftBehind := doneCalculation(srv.URL)
+	leftBehind.Metadata.Completed = &tenMinutesAgo
+	leftBehind.Metadata.Callback.Attempts = 1
+	leftBehind.Metadata.Callback.LastAttempted = &tenMinutesAgo
+
+	inProgress := doneCalculation(srv.URL)
+	inProgress.Name = "paul"
+	inProgress.Metadata.Completed = &aMinuteAgo
+
+	ds := newFakeStore(leftBehind)
+	ds.calculations[inProgress.Name] = inProgress
+
+	n := notifier.New(ds, []byte("shh"), notifier.WithClock(clocktest.NewFake(now)))
+
+	redelivered, err := n.Redeliver(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Wait(ctx); err != nil {
+		t.Fatalf("error waiting for the delivery: %s", err)
+	}
+
+	if redelivered != 1 || calls.Load() != 1 {
+		t.Errorf("expected 1 callback to be redelivered but redelivered %d and saw %d calls", redelivered, calls.Load())
+	}
+
+	if callback := ds.callback("george"); callback.State != store.CallbackDelivered || callback.Attempts != 2 {
+		t.Errorf("expected the left behind callback to be delivered on its second attempt but got %+v", callback)
+	}
+
+	if callback := ds.callback("paul"); callback.State != store.CallbackPending || callback.Attempts != 0 {
+		t.Errorf("expected the recent callback to be left alone but got %+v", callback)
+	}
+}
+
+func TestRun_RedeliversCallbacksOnceLeftBehind(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer srv.Close()
+
+	now := time.Date(2024, time.July, 17, 11, 0, 0, 0, time.UTC)
+	calculation := doneCalculation(srv.URL)
+	calculation.Metadata.Completed = &now
+	ds := newFakeStore(calculation)
+
+	clk := clocktest.NewFake(now)
+	n := notifier.New(ds, []byte("shh"), notifier.WithClock(clk))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	runCtx, stop := context.WithCancel(ctx)
+	errs := make(chan error)
+	go func() { errs <- n.Run(runCtx) }()
+
+	clk.BlockUntil(1)
+	if calls.Load() != 0 {
+		t.Fatalf("expected no redelivery before the callback was left behind but saw %d calls", calls.Load())
+	}
+
+	clk.Advance(notifier.DefaultRedeliverAfter)
+	clk.BlockUntil(1)
+	if err := n.Wait(ctx); err != nil {
+		t.Fatalf("error waiting for the delivery: %s", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the left behind callback to be redelivered but saw %d calls", calls.Load())
+	}
+
+	stop()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Run to stop when ctx is done but got %v", err)
+	}
+}
+
+func TestDeliver_CountsEarlierAttempts(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer srv.Close()
+
+	calculation := doneCalculation(srv.URL)
+	calculation.Metadata.Callback.Attempts = 5
+	ds := newFakeStore(calculation)
+	n := notifier.New(ds, []byte("shh"), notifier.WithClock(clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())))
+
+	if err := n.Deliver(context.Background(), calculation); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if calls != 0 {
+		t.Errorf("expected no calls but got %d", calls)
+	}
+
+	if callback := ds.callback("george"); callback.State != store.CallbackFailed || callback.Attempts != 5 {
+		t.Errorf("expected the callback to fail without another attempt but got %+v", callback)
+	}
+}
@@ -0,0 +1,121 @@
+// Package operations represents stored calculations as
+// google.longrunning.Operations, as both the API and the callbacks to clients
+// show them.
+package operations
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/store"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var callbackStates = map[string]pb.CallbackStatus_State{
+	store.CallbackPending:   pb.CallbackStatus_PENDING,
+	store.CallbackDelivered: pb.CallbackStatus_DELIVERED,
+	store.CallbackFailed:    pb.CallbackStatus_FAILED,
+}
+
+func callbackStatus(callback *store.Callback) *pb.CallbackStatus {
+	s := &pb.CallbackStatus{
+		Url:       callback.URL,
+		State:     callbackStates[callback.State],
+		Attempts:  int32(callback.Attempts),
+		LastError: callback.LastError,
+	}
+	if callback.Delivered != nil {
+		s.Delivered = timestamppb.New(*callback.Delivered)
+	}
+
+	return s
+}
+
+// FromCalculation represents a stored calculation as an operation at now. Its
+// errors are gRPC status errors.
+func FromCalculation(calc store.Calculation, now time.Time) (*longrunningpb.Operation, error) {
+	metadata := &pb.CalculationMetadata{
+		Created:  timestamppb.New(calc.Metadata.Created),
+		Priority: uint32(calc.Metadata.Priority),
+	}
+	if calc.Metadata.Started != nil {
+		metadata.Started = timestamppb.New(*calc.Metadata.Started)
+	}
+	if calc.Metadata.Scheduled != nil {
+		metadata.Scheduled = timestamppb.New(*calc.Metadata.Scheduled)
+	}
+	if calc.Metadata.Deadline != nil {
+		metadata.Deadline = timestamppb.New(*calc.Metadata.Deadline)
+	}
+	if calc.Metadata.Completed != nil {
+		metadata.Completed = timestamppb.New(*calc.Metadata.Completed)
+	}
+	metadata.Cached = calc.Metadata.Cached
+	metadata.Primary = calc.Metadata.Primary
+	if calc.Metadata.Callback != nil {
+		metadata.Callback = callbackStatus(calc.Metadata.Callback)
+	}
+	metadataAsAnyPB, err := anypb.New(metadata)
+	if err != nil {
+		log.Printf("error marshaling calculation %q metadata to proto: %s", calc.Name, err)
+	}
+
+	op := &longrunningpb.Operation{
+		Name:     calc.Name,
+		Metadata: metadataAsAnyPB,
+		Done:     calc.Done,
+	}
+
+	// The job of an expired calculation may have been discarded before any
+	// worker could record that it expired. A calculation that started has a
+	// worker to record how it ends, which may yet be a result.
+	if !calc.Done && calc.Metadata.Started == nil && calc.Metadata.Deadline != nil && !now.Before(*calc.Metadata.Deadline) {
+		calc.Done = true
+		calc.Error = &rpcstatus.Status{
+			Code:    int32(codes.DeadlineExceeded),
+			Message: "the deadline passed before the calculation was done",
+		}
+		op.Done = true
+	}
+
+	if calc.Error != nil {
+		op.Result = &longrunningpb.Operation_Error{
+			Error: calc.Error,
+		}
+	} else if calc.Result != nil {
+		var resp *anypb.Any
+		var err error
+
+		result := store.FibonacciOfResult{}
+		if err := json.Unmarshal(calc.Result, &result); err != nil {
+			log.Printf("error unmarshaling calculation result: %s", err)
+			return nil, status.Error(codes.Internal, "unsupported calculation result type")
+		}
+
+		fibonacciOfResponse := &pb.FibonacciOfResponse{
+			First:       result.First,
+			Second:      result.Second,
+			NthPosition: result.Position,
+			Result:      result.Result,
+		}
+
+		resp, err = anypb.New(fibonacciOfResponse)
+		if err != nil {
+			log.Printf("error setting calculation result to Any: %s", err)
+			return nil, status.Error(codes.Internal, "internal error")
+		}
+
+		op.Result = &longrunningpb.Operation_Response{
+			Response: resp,
+		}
+	}
+
+	return op, nil
+}
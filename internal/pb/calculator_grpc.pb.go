@@ -12,6 +12,7 @@ import (
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 // This is a compile-time assertion to ensure that this generated file
@@ -20,10 +21,16 @@ import (
 const _ = grpc.SupportPackageIsVersion8
 
 const (
-	Calculations_FibonacciOf_FullMethodName    = "/calculator.Calculations/FibonacciOf"
-	Calculations_GetOperation_FullMethodName   = "/calculator.Calculations/GetOperation"
-	Calculations_ListOperations_FullMethodName = "/calculator.Calculations/ListOperations"
-	Calculations_WaitOperation_FullMethodName  = "/calculator.Calculations/WaitOperation"
+	Calculations_FibonacciOf_FullMethodName        = "/calculator.Calculations/FibonacciOf"
+	Calculations_BatchFibonacciOf_FullMethodName   = "/calculator.Calculations/BatchFibonacciOf"
+	Calculations_SubmitPipeline_FullMethodName     = "/calculator.Calculations/SubmitPipeline"
+	Calculations_CreateSchedule_FullMethodName     = "/calculator.Calculations/CreateSchedule"
+	Calculations_ListSchedules_FullMethodName      = "/calculator.Calculations/ListSchedules"
+	Calculations_DeleteSchedule_FullMethodName     = "/calculator.Calculations/DeleteSchedule"
+	Calculations_GetOperation_FullMethodName       = "/calculator.Calculations/GetOperation"
+	Calculations_BatchGetOperations_FullMethodName = "/calculator.Calculations/BatchGetOperations"
+	Calculations_ListOperations_FullMethodName     = "/calculator.Calculations/ListOperations"
+	Calculations_WaitOperation_FullMethodName      = "/calculator.Calculations/WaitOperation"
 )
 
 // CalculationsClient is the client API for Calculations service.
@@ -32,8 +39,31 @@ const (
 type CalculationsClient interface {
 	// FibonacciOf calculates the number at the Nth position in the sequence.
 	FibonacciOf(ctx context.Context, in *FibonacciOfRequest, opts ...grpc.CallOption) (*longrunningpb.Operation, error)
+	// BatchFibonacciOf starts many FibonacciOf calculations at once. Each
+	// calculation gets its own operation, or an error if it could not be
+	// started, and the batch gets an operation of its own that is done once
+	// every calculation in it is done. Unlike FibonacciOf, every calculation
+	// that is not scheduled is queued for a worker: results are neither taken
+	// from the cache nor calculated inline, and identical calculations in
+	// flight are not coalesced.
+	BatchFibonacciOf(ctx context.Context, in *BatchFibonacciOfRequest, opts ...grpc.CallOption) (*BatchFibonacciOfResponse, error)
+	// SubmitPipeline starts a pipeline of FibonacciOf calculations, whose steps
+	// may take their inputs from the results of earlier steps. Each step is
+	// started once the steps it depends on have succeeded.
+	SubmitPipeline(ctx context.Context, in *SubmitPipelineRequest, opts ...grpc.CallOption) (*longrunningpb.Operation, error)
+	// CreateSchedule creates a schedule that starts a calculation every time its
+	// cron expression fires.
+	CreateSchedule(ctx context.Context, in *CreateScheduleRequest, opts ...grpc.CallOption) (*Schedule, error)
+	// ListSchedules returns the schedules, ordered by name.
+	ListSchedules(ctx context.Context, in *ListSchedulesRequest, opts ...grpc.CallOption) (*ListSchedulesResponse, error)
+	// DeleteSchedule deletes a schedule. Calculations it already started are
+	// not affected.
+	DeleteSchedule(ctx context.Context, in *DeleteScheduleRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
 	// GetOperation returns an operation representing a calculation.
 	GetOperation(ctx context.Context, in *longrunningpb.GetOperationRequest, opts ...grpc.CallOption) (*longrunningpb.Operation, error)
+	// BatchGetOperations returns many operations at once, along with the names
+	// of those that could not be found.
+	BatchGetOperations(ctx context.Context, in *BatchGetOperationsRequest, opts ...grpc.CallOption) (*BatchGetOperationsResponse, error)
 	// ListOperations returns all the known operations.
 	ListOperations(ctx context.Context, in *longrunningpb.ListOperationsRequest, opts ...grpc.CallOption) (*longrunningpb.ListOperationsResponse, error)
 	// WaitOperation waits for the operation to complete up to a timeout. It is
@@ -59,6 +89,56 @@ func (c *calculationsClient) FibonacciOf(ctx context.Context, in *FibonacciOfReq
 	return out, nil
 }
 
+func (c *calculationsClient) BatchFibonacciOf(ctx context.Context, in *BatchFibonacciOfRequest, opts ...grpc.CallOption) (*BatchFibonacciOfResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchFibonacciOfResponse)
+	err := c.cc.Invoke(ctx, Calculations_BatchFibonacciOf_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *calculationsClient) SubmitPipeline(ctx context.Context, in *SubmitPipelineRequest, opts ...grpc.CallOption) (*longrunningpb.Operation, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(longrunningpb.Operation)
+	err := c.cc.Invoke(ctx, Calculations_SubmitPipeline_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *calculationsClient) CreateSchedule(ctx context.Context, in *CreateScheduleRequest, opts ...grpc.CallOption) (*Schedule, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Schedule)
+	err := c.cc.Invoke(ctx, Calculations_CreateSchedule_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *calculationsClient) ListSchedules(ctx context.Context, in *ListSchedulesRequest, opts ...grpc.CallOption) (*ListSchedulesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListSchedulesResponse)
+	err := c.cc.Invoke(ctx, Calculations_ListSchedules_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *calculationsClient) DeleteSchedule(ctx context.Context, in *DeleteScheduleRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Calculations_DeleteSchedule_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *calculationsClient) GetOperation(ctx context.Context, in *longrunningpb.GetOperationRequest, opts ...grpc.CallOption) (*longrunningpb.Operation, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(longrunningpb.Operation)
@@ -69,6 +149,16 @@ func (c *calculationsClient) GetOperation(ctx context.Context, in *longrunningpb
 	return out, nil
 }
 
+func (c *calculationsClient) BatchGetOperations(ctx context.Context, in *BatchGetOperationsRequest, opts ...grpc.CallOption) (*BatchGetOperationsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchGetOperationsResponse)
+	err := c.cc.Invoke(ctx, Calculations_BatchGetOperations_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *calculationsClient) ListOperations(ctx context.Context, in *longrunningpb.ListOperationsRequest, opts ...grpc.CallOption) (*longrunningpb.ListOperationsResponse, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(longrunningpb.ListOperationsResponse)
@@ -95,8 +185,31 @@ func (c *calculationsClient) WaitOperation(ctx context.Context, in *longrunningp
 type CalculationsServer interface {
 	// FibonacciOf calculates the number at the Nth position in the sequence.
 	FibonacciOf(context.Context, *FibonacciOfRequest) (*longrunningpb.Operation, error)
+	// BatchFibonacciOf starts many FibonacciOf calculations at once. Each
+	// calculation gets its own operation, or an error if it could not be
+	// started, and the batch gets an operation of its own that is done once
+	// every calculation in it is done. Unlike FibonacciOf, every calculation
+	// that is not scheduled is queued for a worker: results are neither taken
+	// from the cache nor calculated inline, and identical calculations in
+	// flight are not coalesced.
+	BatchFibonacciOf(context.Context, *BatchFibonacciOfRequest) (*BatchFibonacciOfResponse, error)
+	// SubmitPipeline starts a pipeline of FibonacciOf calculations, whose steps
+	// may take their inputs from the results of earlier steps. Each step is
+	// started once the steps it depends on have succeeded.
+	SubmitPipeline(context.Context, *SubmitPipelineRequest) (*longrunningpb.Operation, error)
+	// CreateSchedule creates a schedule that starts a calculation every time its
+	// cron expression fires.
+	CreateSchedule(context.Context, *CreateScheduleRequest) (*Schedule, error)
+	// ListSchedules returns the schedules, ordered by name.
+	ListSchedules(context.Context, *ListSchedulesRequest) (*ListSchedulesResponse, error)
+	// DeleteSchedule deletes a schedule. Calculations it already started are
+	// not affected.
+	DeleteSchedule(context.Context, *DeleteScheduleRequest) (*emptypb.Empty, error)
 	// GetOperation returns an operation representing a calculation.
 	GetOperation(context.Context, *longrunningpb.GetOperationRequest) (*longrunningpb.Operation, error)
+	// BatchGetOperations returns many operations at once, along with the names
+	// of those that could not be found.
+	BatchGetOperations(context.Context, *BatchGetOperationsRequest) (*BatchGetOperationsResponse, error)
 	// ListOperations returns all the known operations.
 	ListOperations(context.Context, *longrunningpb.ListOperationsRequest) (*longrunningpb.ListOperationsResponse, error)
 	// WaitOperation waits for the operation to complete up to a timeout. It is
@@ -112,9 +225,27 @@ type UnimplementedCalculationsServer struct {
 func (UnimplementedCalculationsServer) FibonacciOf(context.Context, *FibonacciOfRequest) (*longrunningpb.Operation, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method FibonacciOf not implemented")
 }
+func (UnimplementedCalculationsServer) BatchFibonacciOf(context.Context, *BatchFibonacciOfRequest) (*BatchFibonacciOfResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchFibonacciOf not implemented")
+}
+func (UnimplementedCalculationsServer) SubmitPipeline(context.Context, *SubmitPipelineRequest) (*longrunningpb.Operation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitPipeline not implemented")
+}
+func (UnimplementedCalculationsServer) CreateSchedule(context.Context, *CreateScheduleRequest) (*Schedule, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSchedule not implemented")
+}
+func (UnimplementedCalculationsServer) ListSchedules(context.Context, *ListSchedulesRequest) (*ListSchedulesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSchedules not implemented")
+}
+func (UnimplementedCalculationsServer) DeleteSchedule(context.Context, *DeleteScheduleRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSchedule not implemented")
+}
 func (UnimplementedCalculationsServer) GetOperation(context.Context, *longrunningpb.GetOperationRequest) (*longrunningpb.Operation, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetOperation not implemented")
 }
+func (UnimplementedCalculationsServer) BatchGetOperations(context.Context, *BatchGetOperationsRequest) (*BatchGetOperationsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGetOperations not implemented")
+}
 func (UnimplementedCalculationsServer) ListOperations(context.Context, *longrunningpb.ListOperationsRequest) (*longrunningpb.ListOperationsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListOperations not implemented")
 }
@@ -152,6 +283,96 @@ func _Calculations_FibonacciOf_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Calculations_BatchFibonacciOf_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchFibonacciOfRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculationsServer).BatchFibonacciOf(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculations_BatchFibonacciOf_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculationsServer).BatchFibonacciOf(ctx, req.(*BatchFibonacciOfRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Calculations_SubmitPipeline_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitPipelineRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculationsServer).SubmitPipeline(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculations_SubmitPipeline_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculationsServer).SubmitPipeline(ctx, req.(*SubmitPipelineRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Calculations_CreateSchedule_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateScheduleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculationsServer).CreateSchedule(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculations_CreateSchedule_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculationsServer).CreateSchedule(ctx, req.(*CreateScheduleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Calculations_ListSchedules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSchedulesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculationsServer).ListSchedules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculations_ListSchedules_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculationsServer).ListSchedules(ctx, req.(*ListSchedulesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Calculations_DeleteSchedule_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteScheduleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculationsServer).DeleteSchedule(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculations_DeleteSchedule_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculationsServer).DeleteSchedule(ctx, req.(*DeleteScheduleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Calculations_GetOperation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(longrunningpb.GetOperationRequest)
 	if err := dec(in); err != nil {
@@ -170,6 +391,24 @@ func _Calculations_GetOperation_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Calculations_BatchGetOperations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchGetOperationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculationsServer).BatchGetOperations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculations_BatchGetOperations_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculationsServer).BatchGetOperations(ctx, req.(*BatchGetOperationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Calculations_ListOperations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(longrunningpb.ListOperationsRequest)
 	if err := dec(in); err != nil {
@@ -217,10 +456,34 @@ var Calculations_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "FibonacciOf",
 			Handler:    _Calculations_FibonacciOf_Handler,
 		},
+		{
+			MethodName: "BatchFibonacciOf",
+			Handler:    _Calculations_BatchFibonacciOf_Handler,
+		},
+		{
+			MethodName: "SubmitPipeline",
+			Handler:    _Calculations_SubmitPipeline_Handler,
+		},
+		{
+			MethodName: "CreateSchedule",
+			Handler:    _Calculations_CreateSchedule_Handler,
+		},
+		{
+			MethodName: "ListSchedules",
+			Handler:    _Calculations_ListSchedules_Handler,
+		},
+		{
+			MethodName: "DeleteSchedule",
+			Handler:    _Calculations_DeleteSchedule_Handler,
+		},
 		{
 			MethodName: "GetOperation",
 			Handler:    _Calculations_GetOperation_Handler,
 		},
+		{
+			MethodName: "BatchGetOperations",
+			Handler:    _Calculations_BatchGetOperations_Handler,
+		},
 		{
 			MethodName: "ListOperations",
 			Handler:    _Calculations_ListOperations_Handler,
@@ -0,0 +1,220 @@
+// Package reaper recovers calculations left running by workers that died.
+package reaper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+// batchSize is how many stalled jobs are read from the store at a time.
+const batchSize = 100
+
+// Action is what to do with a calculation whose worker died.
+type Action string
+
+const (
+	// Republish publishes the calculation's job again for another worker.
+	Republish Action = "republish"
+	// Fail fails the calculation with UNAVAILABLE.
+	Fail Action = "fail"
+)
+
+type calculations interface {
+	Get(context.Context, string) (store.Calculation, error)
+}
+
+type heartbeats interface {
+	Stalled(context.Context, int64) ([]store.RunningJob, error)
+	Release(context.Context, store.RunningJob) error
+	Reap(context.Context, store.RunningJob, store.Calculation) error
+}
+
+type queue interface {
+	PublishJSON(context.Context, any) error
+}
+
+// Reaper finds calculations whose worker stopped heartbeating and republishes
+// or fails them. Only one Reaper should run at a time; see package leader.
+type Reaper struct {
+	calculations calculations
+	heartbeats   heartbeats
+	queue        queue
+	interval     time.Duration
+	clock        clock.Clock
+	action       Action
+
+	protobufJobs bool
+}
+
+type Option func(*Reaper)
+
+// WithAction sets what to do with stalled calculations. The default is to
+// republish them.
+func WithAction(a Action) Option {
+	return func(r *Reaper) {
+		r.action = a
+	}
+}
+
+// WithClock tells the time with clk, which also times the interval.
+func WithClock(clk clock.Clock) Option {
+	return func(r *Reaper) {
+		r.clock = clk
+	}
+}
+
+// WithProtobufJobs republishes jobs as protobuf when the queue supports it.
+func WithProtobufJobs() Option {
+	return func(r *Reaper) {
+		r.protobufJobs = true
+	}
+}
+
+// New creates a Reaper checking for stalled calculations every interval.
+func New(calcs calculations, hb heartbeats, q queue, interval time.Duration, opts ...Option) *Reaper {
+	r := &Reaper{
+		calculations: calcs,
+		heartbeats:   hb,
+		queue:        q,
+		interval:     interval,
+		clock:        clock.Real{},
+		action:       Republish,
+	}
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	return r
+}
+
+// Run reaps stalled calculations until ctx is done.
+func (r *Reaper) Run(ctx context.Context) error {
+	for {
+		if n, err := r.Reap(ctx); err != nil {
+			log.Printf("error reaping stalled calculations: %s", err)
+		} else if n > 0 {
+			log.Printf("reaped %d stalled calculations", n)
+		}
+
+		if err := r.clock.Sleep(ctx, r.interval); err != nil {
+			return err
+		}
+	}
+}
+
+// Reap republishes or fails every stalled calculation and returns how many
+// were reaped. Calculations that were done or started again by a worker since
+// are only forgotten.
+func (r *Reaper) Reap(ctx context.Context) (int, error) {
+	jobs, err := r.heartbeats.Stalled(ctx, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("error getting stalled jobs: %w", err)
+	}
+
+	var reaped int
+	for _, job := range jobs {
+		ok, err := r.reap(ctx, job)
+		if err != nil {
+			return reaped, err
+		}
+		if ok {
+			reaped++
+		}
+	}
+
+	return reaped, nil
+}
+
+func (r *Reaper) reap(ctx context.Context, job store.RunningJob) (bool, error) {
+	calculation, err := r.calculations.Get(ctx, job.Name)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return false, r.release(ctx, job)
+	} else if err != nil {
+		return false, fmt.Errorf("error getting calculation %q: %w", job.Name, err)
+	}
+
+	if calculation.Done {
+		return false, r.release(ctx, job)
+	}
+
+	switch r.action {
+	case Fail:
+		err = r.fail(ctx, calculation, job)
+	default:
+		err = r.republish(ctx, calculation, job)
+	}
+	if errors.Is(err, store.ErrUpdateUnsuccessful) {
+		// A worker took the calculation over in the meantime.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	log.Printf("reaped stalled calculation %q", job.Name)
+
+	return true, nil
+}
+
+// fail fails the calculation and forgets its job together, so that a worker
+// that took the calculation over in the meantime is left alone.
+func (r *Reaper) fail(ctx context.Context, calculation store.Calculation, job store.RunningJob) error {
+	calculation.Done = true
+	calculation.Error = &status.Status{
+		Code:    int32(codes.Unavailable),
+		Message: "the worker running the calculation stopped",
+	}
+
+	if err := r.heartbeats.Reap(ctx, job, calculation); err != nil {
+		return fmt.Errorf("error failing calculation %q: %w", calculation.Name, err)
+	}
+
+	return nil
+}
+
+// republish clears the calculation's started time, forgetting its job together
+// like fail, before publishing the job again so that the worker receiving it
+// may claim it. It is recorded as republished so that it is not also
+// reconciled.
+func (r *Reaper) republish(ctx context.Context, calculation store.Calculation, job store.RunningJob) error {
+	fibOfJob, err := worker.DecodeFibonacciOfJob(job.Payload)
+	if err != nil {
+		log.Printf("failing stalled calculation %q whose job cannot be decoded: %s", job.Name, err)
+		return r.fail(ctx, calculation, job)
+	}
+
+	now := r.clock.Now()
+	if calculation.Metadata.Started != nil {
+		calculation.Metadata.Redeliveries++
+	}
+	calculation.Metadata.Started = nil
+	calculation.Metadata.Republished = &now
+
+	if err := r.heartbeats.Reap(ctx, job, calculation); err != nil {
+		return fmt.Errorf("error resetting calculation %q: %w", calculation.Name, err)
+	}
+
+	if err := worker.PublishFibonacciOf(ctx, r.queue, fibOfJob, r.protobufJobs); err != nil {
+		return fmt.Errorf("error republishing job for %q: %w", job.Name, err)
+	}
+
+	return nil
+}
+
+func (r *Reaper) release(ctx context.Context, job store.RunningJob) error {
+	err := r.heartbeats.Release(ctx, job)
+	if err != nil && !errors.Is(err, store.ErrUpdateUnsuccessful) {
+		return fmt.Errorf("error releasing stalled job %q: %w", job.Name, err)
+	}
+
+	return nil
+}
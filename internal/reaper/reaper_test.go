@@ -0,0 +1,247 @@
+package reaper_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock/clocktest"
+	"github.com/vickleford/calculator/internal/reaper"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"google.golang.org/grpc/codes"
+)
+
+type fakeCalculations struct {
+	calculations map[string]store.Calculation
+}
+
+func (s *fakeCalculations) Get(ctx context.Context, name string) (store.Calculation, error) {
+	calc, ok := s.calculations[name]
+	if !ok {
+		return calc, store.ErrKeyNotFound
+	}
+	return calc, nil
+}
+
+type fakeHeartbeats struct {
+	calculations *fakeCalculations
+	stalled      []store.RunningJob
+	released     []string
+	reaped       []string
+	// reapErr is returned by Reap, such as when a worker took the job over.
+	reapErr error
+}
+
+func (h *fakeHeartbeats) Stalled(ctx context.Context, limit int64) ([]store.RunningJob, error) {
+	return h.stalled, nil
+}
+
+func (h *fakeHeartbeats) Release(ctx context.Context, job store.RunningJob) error {
+	h.released = append(h.released, job.Name)
+	return nil
+}
+
+func (h *fakeHeartbeats) Reap(ctx context.Context, job store.RunningJob, calc store.Calculation) error {
+	if h.reapErr != nil {
+		return h.reapErr
+	}
+	h.calculations.calculations[calc.Name] = calc
+	h.reaped = append(h.reaped, job.Name)
+	return nil
+}
+
+type workQ struct {
+	published []any
+}
+
+func (q *workQ) PublishJSON(ctx context.Context, msg any) error {
+	q.published = append(q.published, msg)
+	return nil
+}
+
+func runningJob(t *testing.T, name string) store.RunningJob {
+	t.Helper()
+	b, err := json.Marshal(worker.FibonacciOfJob{OperationName: name, Position: 5})
+	if err != nil {
+		t.Fatalf("unable to set up job: %s", err)
+	}
+	return store.RunningJob{Name: name, Payload: b}
+}
+
+func startedCalculation(name string) store.Calculation {
+	started := time.Now().Add(-time.Minute)
+	return store.Calculation{
+		Name:     name,
+		Metadata: store.CalculationMetadata{Started: &started},
+	}
+}
+
+func TestReap_Republish(t *testing.T) {
+	calcs := &fakeCalculations{calculations: map[string]store.Calculation{
+		"stalled": startedCalculation("stalled"),
+	}}
+	hb := &fakeHeartbeats{calculations: calcs, stalled: []store.RunningJob{runningJob(t, "stalled")}}
+	q := &workQ{}
+	now := time.Now()
+
+	n, err := reaper.New(calcs, hb, q, time.Second, reaper.WithClock(clocktest.NewFake(now))).Reap(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 1 {
+		t.Errorf("expected 1 reaped but got %d", n)
+	}
+
+	if len(q.published) != 1 {
+		t.Fatalf("expected the job to be republished but published %v", q.published)
+	}
+
+	b, err := json.Marshal(q.published[0])
+	if err != nil {
+		t.Fatalf("unable to marshal published job: %s", err)
+	}
+	job, err := worker.DecodeFibonacciOfJob(b)
+	if err != nil {
+		t.Fatalf("unable to decode published job: %s", err)
+	}
+	if job.OperationName != "stalled" || job.Position != 5 {
+		t.Errorf("unexpected job republished: %#v", job)
+	}
+
+	calc := calcs.calculations["stalled"]
+	if calc.Metadata.Started != nil {
+		t.Errorf("expected the started time to be cleared but got %s", calc.Metadata.Started)
+	}
+	if calc.Metadata.Redeliveries != 1 {
+		t.Errorf("expected 1 redelivery but got %d", calc.Metadata.Redeliveries)
+	}
+	if calc.Metadata.Republished == nil || !calc.Metadata.Republished.Equal(now) {
+		t.Errorf("expected the calculation to be recorded as republished at %s but got %v", now, calc.Metadata.Republished)
+	}
+
+	if len(hb.reaped) != 1 || hb.reaped[0] != "stalled" {
+		t.Errorf("expected the stalled job to be reaped but reaped %v", hb.reaped)
+	}
+}
+
+func TestReap_Fail(t *testing.T) {
+	calcs := &fakeCalculations{calculations: map[string]store.Calculation{
+		"stalled": startedCalculation("stalled"),
+	}}
+	hb := &fakeHeartbeats{calculations: calcs, stalled: []store.RunningJob{runningJob(t, "stalled")}}
+	q := &workQ{}
+
+	r := reaper.New(calcs, hb, q, time.Second, reaper.WithAction(reaper.Fail))
+	if _, err := r.Reap(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(q.published) != 0 {
+		t.Errorf("expected nothing to be published but published %v", q.published)
+	}
+
+	calc := calcs.calculations["stalled"]
+	if !calc.Done {
+		t.Error("expected the calculation to be done")
+	}
+	if calc.Error.GetCode() != int32(codes.Unavailable) {
+		t.Errorf("expected UNAVAILABLE but got %v", calc.Error)
+	}
+
+	if len(hb.reaped) != 1 {
+		t.Errorf("expected the stalled job to be reaped but reaped %v", hb.reaped)
+	}
+}
+
+func TestReap_DoneCalculationsAreOnlyReleased(t *testing.T) {
+	done := startedCalculation("done")
+	done.Done = true
+
+	calcs := &fakeCalculations{calculations: map[string]store.Calculation{"done": done}}
+	hb := &fakeHeartbeats{calculations: calcs, stalled: []store.RunningJob{runningJob(t, "done"), runningJob(t, "gone")}}
+	q := &workQ{}
+
+	n, err := reaper.New(calcs, hb, q, time.Second).Reap(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 0 {
+		t.Errorf("expected none reaped but got %d", n)
+	}
+
+	if len(q.published) != 0 {
+		t.Errorf("expected nothing to be published but published %v", q.published)
+	}
+
+	if len(hb.released) != 2 {
+		t.Errorf("expected both jobs to be released but released %v", hb.released)
+	}
+}
+
+func TestReap_CalculationTakenOver(t *testing.T) {
+	calcs := &fakeCalculations{
+		calculations: map[string]store.Calculation{"stalled": startedCalculation("stalled")},
+	}
+	hb := &fakeHeartbeats{
+		calculations: calcs,
+		stalled:      []store.RunningJob{runningJob(t, "stalled")},
+		reapErr:      store.ErrUpdateUnsuccessful,
+	}
+	q := &workQ{}
+
+	n, err := reaper.New(calcs, hb, q, time.Second).Reap(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 0 {
+		t.Errorf("expected none reaped but got %d", n)
+	}
+
+	if len(q.published) != 0 {
+		t.Errorf("expected nothing to be published but published %v", q.published)
+	}
+
+	if len(hb.released) != 0 || len(hb.reaped) != 0 {
+		t.Errorf("expected the job to be left to its new worker but released %v and reaped %v", hb.released, hb.reaped)
+	}
+
+	if calc := calcs.calculations["stalled"]; calc.Done || calc.Metadata.Started == nil {
+		t.Errorf("expected the calculation to be left to its new worker but got %+v", calc)
+	}
+}
+
+func TestRun_ReapsEveryInterval(t *testing.T) {
+	calcs := &fakeCalculations{calculations: map[string]store.Calculation{
+		"stalled": startedCalculation("stalled"),
+	}}
+	hb := &fakeHeartbeats{calculations: calcs}
+	q := &workQ{}
+	clk := clocktest.NewFake(time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- reaper.New(calcs, hb, q, time.Minute, reaper.WithClock(clk)).Run(ctx) }()
+
+	clk.BlockUntil(1)
+	if len(hb.reaped) != 0 {
+		t.Fatalf("expected nothing to be reaped before the job stalled but reaped %v", hb.reaped)
+	}
+
+	hb.stalled = []store.RunningJob{runningJob(t, "stalled")}
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1)
+	if len(hb.reaped) != 1 {
+		t.Errorf("expected the stalled job to be reaped on the next pass but reaped %v", hb.reaped)
+	}
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Run to stop when ctx is done but got %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+// Package reconciler publishes the jobs of calculations that were created but
+// never started again, such as when publishing the job failed or the broker
+// lost it. Those whose deadline passed are failed instead, as the broker
+// drops their jobs.
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vickleford/calculator/internal/clock"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+// batchSize is how many calculations are read from the store at a time.
+const batchSize = 100
+
+// Outcomes of reconciling an orphaned calculation.
+const (
+	outcomeRepublished   = "republished"
+	outcomeExpired       = "expired"
+	outcomeDryRun        = "dry_run"
+	outcomeUnrecoverable = "unrecoverable"
+	outcomeFailed        = "failed"
+)
+
+type datastore interface {
+	Get(context.Context, string) (store.Calculation, error)
+	NotStarted(context.Context, string, int64) ([]store.Calculation, string, error)
+	Save(context.Context, store.Calculation) error
+}
+
+type queue interface {
+	PublishJSON(context.Context, any) error
+}
+
+// Reconciler republishes the jobs of calculations that have not started long
+// after they were due to. Only one Reconciler should run at a time; see package
+// leader.
+//
+// A Reconciler is a prometheus.Collector describing the orphaned calculations
+// it finds.
+type Reconciler struct {
+	store     datastore
+	queue     queue
+	interval  time.Duration
+	threshold time.Duration
+	clock     clock.Clock
+
+	dryRun       bool
+	protobufJobs bool
+
+	orphaned *prometheus.CounterVec
+	found    prometheus.Gauge
+}
+
+type Option func(*Reconciler)
+
+// WithClock tells the time with clk, which also times the interval.
+func WithClock(clk clock.Clock) Option {
+	return func(r *Reconciler) {
+		r.clock = clk
+	}
+}
+
+// WithDryRun only logs and counts the orphaned calculations without
+// republishing their jobs.
+func WithDryRun() Option {
+	return func(r *Reconciler) {
+		r.dryRun = true
+	}
+}
+
+// WithProtobufJobs republishes jobs as protobuf when the queue supports it.
+func WithProtobufJobs() Option {
+	return func(r *Reconciler) {
+		r.protobufJobs = true
+	}
+}
+
+// New creates a Reconciler checking every interval for calculations that have
+// not started threshold after they were due to. The threshold should be longer
+// than jobs are expected to wait in the queue, or else jobs that are only slow
+// to start are published twice.
+func New(ds datastore, q queue, interval, threshold time.Duration, opts ...Option) *Reconciler {
+	r := &Reconciler{
+		store:     ds,
+		queue:     q,
+		interval:  interval,
+		threshold: threshold,
+		clock:     clock.Real{},
+		orphaned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "reconciler",
+			Name:      "orphaned_calculations_total",
+			Help:      "Total number of calculations found not started past the threshold by outcome.",
+		}, []string{"outcome"}),
+		found: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "reconciler",
+			Name:      "orphaned_calculations",
+			Help:      "Number of calculations found not started past the threshold by the last pass.",
+		}),
+	}
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	return r
+}
+
+// Run reconciles calculations until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) error {
+	for {
+		if n, err := r.Reconcile(ctx, r.clock.Now()); err != nil {
+			log.Printf("error reconciling calculations: %s", err)
+		} else if n > 0 {
+			log.Printf("found %d orphaned calculations", n)
+		}
+
+		if err := r.clock.Sleep(ctx, r.interval); err != nil {
+			return err
+		}
+	}
+}
+
+// Reconcile republishes the job of every calculation not started threshold
+// before now and returns how many such orphaned calculations were found.
+func (r *Reconciler) Reconcile(ctx context.Context, now time.Time) (int, error) {
+	var orphaned int
+	var after string
+
+	for {
+		calculations, next, err := r.store.NotStarted(ctx, after, batchSize)
+		if err != nil {
+			return orphaned, fmt.Errorf("error listing calculations not started: %w", err)
+		}
+
+		for _, calculation := range calculations {
+			if !r.isOrphaned(calculation, now) || r.isFollowing(ctx, calculation) {
+				continue
+			}
+			orphaned++
+			r.reconcile(ctx, calculation, now)
+		}
+
+		if next == "" {
+			break
+		}
+		after = next
+	}
+
+	r.found.Set(float64(orphaned))
+
+	return orphaned, nil
+}
+
+// isOrphaned reports whether the calculation has not started threshold after
+// it was due to, which is when it was created, scheduled for or last
+// republished.
+func (r *Reconciler) isOrphaned(calculation store.Calculation, now time.Time) bool {
+	if calculation.Done || calculation.Metadata.Started != nil {
+		return false
+	}
+
+	due := calculation.Metadata.Created
+	for _, t := range []*time.Time{calculation.Metadata.Scheduled, calculation.Metadata.Republished} {
+		if t != nil && t.After(due) {
+			due = *t
+		}
+	}
+
+	return now.Sub(due) >= r.threshold
+}
+
+// isFollowing reports whether the calculation is waiting for the outcome of an
+// identical calculation that is not yet done, so it is not meant to start.
+func (r *Reconciler) isFollowing(ctx context.Context, calculation store.Calculation) bool {
+	if calculation.Metadata.Primary == "" {
+		return false
+	}
+
+	primary, err := r.store.Get(ctx, calculation.Metadata.Primary)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return false
+	} else if err != nil {
+		log.Printf("error getting calculation %q followed by %q: %s", calculation.Metadata.Primary, calculation.Name, err)
+		return true
+	}
+
+	return !primary.Done
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, calculation store.Calculation, now time.Time) {
+	if deadline := calculation.Metadata.Deadline; deadline != nil && !now.Before(*deadline) {
+		r.expire(ctx, calculation, now)
+		return
+	}
+
+	if len(calculation.Job) == 0 {
+		log.Printf("calculation %q was never started and has no job to republish", calculation.Name)
+		r.orphaned.WithLabelValues(outcomeUnrecoverable).Inc()
+		return
+	}
+
+	job, err := worker.DecodeFibonacciOfJob(calculation.Job)
+	if err != nil {
+		log.Printf("calculation %q was never started and its job cannot be decoded: %s", calculation.Name, err)
+		r.orphaned.WithLabelValues(outcomeUnrecoverable).Inc()
+		return
+	}
+
+	if r.dryRun {
+		log.Printf("calculation %q was never started; not republishing its job in a dry run", calculation.Name)
+		r.orphaned.WithLabelValues(outcomeDryRun).Inc()
+		return
+	}
+
+	// Record the attempt first so that a calculation started in the meantime
+	// is not published again, and so that the next pass waits for the
+	// threshold again. A calculation left behind by the one it followed runs
+	// itself from now on.
+	calculation.Metadata.Republished = &now
+	calculation.Metadata.Primary = ""
+	if err := r.store.Save(ctx, calculation); errors.Is(err, store.ErrUpdateUnsuccessful) {
+		return
+	} else if err != nil {
+		log.Printf("error recording republishing calculation %q: %s", calculation.Name, err)
+		r.orphaned.WithLabelValues(outcomeFailed).Inc()
+		return
+	}
+
+	if err := worker.PublishFibonacciOf(ctx, r.queue, job, r.protobufJobs); err != nil {
+		log.Printf("error republishing job for %q: %s", calculation.Name, err)
+		r.orphaned.WithLabelValues(outcomeFailed).Inc()
+		return
+	}
+
+	log.Printf("republished the job of calculation %q that was never started", calculation.Name)
+	r.orphaned.WithLabelValues(outcomeRepublished).Inc()
+}
+
+// expire fails a calculation whose deadline passed before it started with
+// DEADLINE_EXCEEDED, as a worker would, so that it is done and its callback,
+// if any, is delivered.
+func (r *Reconciler) expire(ctx context.Context, calculation store.Calculation, now time.Time) {
+	if r.dryRun {
+		log.Printf("calculation %q expired before it started; not failing it in a dry run", calculation.Name)
+		r.orphaned.WithLabelValues(outcomeDryRun).Inc()
+		return
+	}
+
+	calculation.Done = true
+	calculation.Metadata.Completed = &now
+	calculation.Error = &status.Status{
+		Code:    int32(codes.DeadlineExceeded),
+		Message: "the deadline passed before the calculation started",
+	}
+	if err := r.store.Save(ctx, calculation); errors.Is(err, store.ErrUpdateUnsuccessful) {
+		return
+	} else if err != nil {
+		log.Printf("error failing expired calculation %q: %s", calculation.Name, err)
+		r.orphaned.WithLabelValues(outcomeFailed).Inc()
+		return
+	}
+
+	log.Printf("failed calculation %q that expired before it started", calculation.Name)
+	r.orphaned.WithLabelValues(outcomeExpired).Inc()
+}
+
+func (r *Reconciler) Describe(ch chan<- *prometheus.Desc) {
+	r.orphaned.Describe(ch)
+	r.found.Describe(ch)
+}
+
+func (r *Reconciler) Collect(ch chan<- prometheus.Metric) {
+	r.orphaned.Collect(ch)
+	r.found.Collect(ch)
+}
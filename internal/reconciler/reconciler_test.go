@@ -0,0 +1,308 @@
+package reconciler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vickleford/calculator/internal/clock/clocktest"
+	"github.com/vickleford/calculator/internal/reconciler"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"google.golang.org/grpc/codes"
+)
+
+type fakeStore struct {
+	calculations []store.Calculation
+	saved        []store.Calculation
+}
+
+func (s *fakeStore) Get(ctx context.Context, name string) (store.Calculation, error) {
+	for _, calc := range s.calculations {
+		if calc.Name == name {
+			return calc, nil
+		}
+	}
+	return store.Calculation{}, store.ErrKeyNotFound
+}
+
+func (s *fakeStore) NotStarted(ctx context.Context, after string, limit int64) ([]store.Calculation, string, error) {
+	var page []store.Calculation
+	for _, calc := range s.calculations {
+		if calc.Name > after && int64(len(page)) < limit {
+			page = append(page, calc)
+		}
+	}
+
+	var next string
+	if len(page) > 0 && page[len(page)-1].Name != s.calculations[len(s.calculations)-1].Name {
+		next = page[len(page)-1].Name
+	}
+
+	return page, next, nil
+}
+
+func (s *fakeStore) Save(ctx context.Context, calc store.Calculation) error {
+	s.saved = append(s.saved, calc)
+	return nil
+}
+
+type workQ struct {
+	published []any
+}
+
+func (q *workQ) PublishJSON(ctx context.Context, msg any) error {
+	q.published = append(q.published, msg)
+	return nil
+}
+
+func calculation(t *testing.T, name string, created time.Time) store.Calculation {
+	t.Helper()
+	job, err := json.Marshal(worker.FibonacciOfJob{OperationName: name, Position: 5}.Envelope())
+	if err != nil {
+		t.Fatalf("unable to set up job: %s", err)
+	}
+	return store.Calculation{
+		Name:     name,
+		Metadata: store.CalculationMetadata{Created: created},
+		Job:      job,
+	}
+}
+
+func TestReconcile_RepublishesOrphanedCalculations(t *testing.T) {
+	now := time.Now()
+	started := now.Add(-time.Hour)
+	scheduled := now.Add(-time.Second)
+
+	ds := &fakeStore{}
+	ds.calculations = append(ds.calculations, calculation(t, "a-orphaned", now.Add(-time.Hour)))
+
+	done := calculation(t, "b-done", now.Add(-time.Hour))
+	done.Done = true
+	ds.calculations = append(ds.calculations, done)
+
+	running := calculation(t, "c-started", now.Add(-time.Hour))
+	running.Metadata.Started = &started
+	ds.calculations = append(ds.calculations, running)
+
+	ds.calculations = append(ds.calculations, calculation(t, "d-recent", now.Add(-time.Second)))
+
+	recentlyDue := calculation(t, "e-scheduled", now.Add(-time.Hour))
+	recentlyDue.Metadata.Scheduled = &scheduled
+	ds.calculations = append(ds.calculations, recentlyDue)
+
+	q := &workQ{}
+
+	r := reconciler.New(ds, q, time.Second, time.Minute)
+	n, err := r.Reconcile(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 1 {
+		t.Errorf("expected 1 orphaned calculation but got %d", n)
+	}
+
+	if len(q.published) != 1 {
+		t.Fatalf("expected 1 job to be republished but published %v", q.published)
+	}
+
+	b, err := json.Marshal(q.published[0])
+	if err != nil {
+		t.Fatalf("unable to marshal published job: %s", err)
+	}
+	job, err := worker.DecodeFibonacciOfJob(b)
+	if err != nil {
+		t.Fatalf("unable to decode published job: %s", err)
+	}
+	if job.OperationName != "a-orphaned" {
+		t.Errorf("expected the orphaned job to be republished but got %#v", job)
+	}
+
+	if len(ds.saved) != 1 || ds.saved[0].Metadata.Republished == nil || !ds.saved[0].Metadata.Republished.Equal(now) {
+		t.Errorf("expected the calculation to be recorded as republished but saved %#v", ds.saved)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(r)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+
+	counts := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "reconciler_orphaned_calculations_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			counts[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+
+	if counts["republished"] != 1 {
+		t.Errorf("expected 1 republished calculation to be counted but got %v", counts)
+	}
+}
+
+func TestReconcile_WaitsForThresholdAfterRepublishing(t *testing.T) {
+	now := time.Now()
+	republished := now.Add(-time.Second)
+
+	calc := calculation(t, "orphaned", now.Add(-time.Hour))
+	calc.Metadata.Republished = &republished
+
+	ds := &fakeStore{calculations: []store.Calculation{calc}}
+	q := &workQ{}
+
+	n, err := reconciler.New(ds, q, time.Second, time.Minute).Reconcile(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 0 || len(q.published) != 0 {
+		t.Errorf("expected nothing to be republished but found %d and published %v", n, q.published)
+	}
+}
+
+func TestReconcile_DryRun(t *testing.T) {
+	now := time.Now()
+
+	ds := &fakeStore{calculations: []store.Calculation{calculation(t, "orphaned", now.Add(-time.Hour))}}
+	q := &workQ{}
+
+	n, err := reconciler.New(ds, q, time.Second, time.Minute, reconciler.WithDryRun()).Reconcile(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 1 {
+		t.Errorf("expected 1 orphaned calculation but got %d", n)
+	}
+
+	if len(q.published) != 0 || len(ds.saved) != 0 {
+		t.Errorf("expected a dry run to change nothing but published %v and saved %v", q.published, ds.saved)
+	}
+}
+
+func TestReconcile_FailsExpiredCalculations(t *testing.T) {
+	now := time.Now()
+	deadline := now.Add(-time.Minute)
+
+	expired := calculation(t, "expired", now.Add(-time.Hour))
+	expired.Metadata.Deadline = &deadline
+
+	ds := &fakeStore{calculations: []store.Calculation{expired}}
+	q := &workQ{}
+
+	n, err := reconciler.New(ds, q, time.Second, time.Minute).Reconcile(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 1 || len(q.published) != 0 {
+		t.Errorf("expected 1 orphaned calculation not to be republished but found %d and published %v", n, q.published)
+	}
+
+	if len(ds.saved) != 1 {
+		t.Fatalf("expected the calculation to be saved but saved %v", ds.saved)
+	}
+	saved := ds.saved[0]
+	if !saved.Done || saved.Error.GetCode() != int32(codes.DeadlineExceeded) || saved.Metadata.Completed == nil {
+		t.Errorf("expected the calculation to be failed with DEADLINE_EXCEEDED but saved %+v", saved)
+	}
+}
+
+func TestReconcile_PagesThroughCalculations(t *testing.T) {
+	now := time.Now()
+
+	ds := &fakeStore{}
+	for i := 0; i < 250; i++ {
+		ds.calculations = append(ds.calculations, calculation(t, time.Unix(int64(i), 0).UTC().Format("150405"), now.Add(-time.Hour)))
+	}
+	q := &workQ{}
+
+	n, err := reconciler.New(ds, q, time.Second, time.Minute).Reconcile(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 250 || len(q.published) != 250 {
+		t.Errorf("expected all 250 to be republished but found %d and published %d", n, len(q.published))
+	}
+}
+
+func TestReconcile_FollowersWaitForTheirPrimary(t *testing.T) {
+	now := time.Now()
+	started := now.Add(-time.Hour)
+
+	ds := &fakeStore{}
+
+	running := calculation(t, "a-primary-running", now.Add(-time.Hour))
+	running.Metadata.Started = &started
+	ds.calculations = append(ds.calculations, running)
+
+	done := calculation(t, "b-primary-done", now.Add(-time.Hour))
+	done.Done = true
+	ds.calculations = append(ds.calculations, done)
+
+	waiting := calculation(t, "c-waiting", now.Add(-time.Hour))
+	waiting.Metadata.Primary = running.Name
+	ds.calculations = append(ds.calculations, waiting)
+
+	leftBehind := calculation(t, "d-left-behind", now.Add(-time.Hour))
+	leftBehind.Metadata.Primary = done.Name
+	ds.calculations = append(ds.calculations, leftBehind)
+
+	q := &workQ{}
+
+	n, err := reconciler.New(ds, q, time.Minute, 10*time.Minute).Reconcile(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 1 {
+		t.Errorf("expected 1 orphaned calculation but found %d", n)
+	}
+
+	if len(ds.saved) != 1 || ds.saved[0].Name != leftBehind.Name {
+		t.Fatalf("expected only the follower left behind to be republished but saved %v", ds.saved)
+	}
+
+	if ds.saved[0].Metadata.Primary != "" {
+		t.Errorf("expected the republished follower to stop following but it follows %q", ds.saved[0].Metadata.Primary)
+	}
+}
+
+func TestRun_RepublishesCalculationsOnceOrphaned(t *testing.T) {
+	now := time.Now()
+	clk := clocktest.NewFake(now)
+	ds := &fakeStore{calculations: []store.Calculation{calculation(t, "a", now)}}
+	q := &workQ{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- reconciler.New(ds, q, 10*time.Minute, 5*time.Minute, reconciler.WithClock(clk)).Run(ctx)
+	}()
+
+	clk.BlockUntil(1)
+	if len(q.published) != 0 {
+		t.Fatalf("expected nothing to be republished within the threshold but published %d", len(q.published))
+	}
+
+	clk.Advance(10 * time.Minute)
+	clk.BlockUntil(1)
+	if len(q.published) != 1 {
+		t.Errorf("expected the orphaned calculation to be republished but published %d", len(q.published))
+	}
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Run to stop when ctx is done but got %v", err)
+	}
+}
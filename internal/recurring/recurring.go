@@ -0,0 +1,180 @@
+// Package recurring starts calculations on cron schedules.
+package recurring
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/clock"
+	"github.com/vickleford/calculator/internal/cron"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+)
+
+// batchSize is how many schedules are read from the store at a time.
+const batchSize = 100
+
+// defaultHistory is how many recent runs are kept on a schedule by default.
+const defaultHistory = 10
+
+type datastore interface {
+	DueSchedules(context.Context, time.Time, int64) ([]store.Schedule, bool, error)
+	RunSchedule(context.Context, store.Schedule, time.Time, store.Calculation) error
+}
+
+type queue interface {
+	PublishJSON(context.Context, any) error
+}
+
+// Scheduler starts a calculation for every schedule that is due. Only one
+// Scheduler should run at a time; see package leader.
+type Scheduler struct {
+	store    datastore
+	queue    queue
+	interval time.Duration
+	clock    clock.Clock
+	history  int
+
+	protobufJobs bool
+}
+
+type Option func(*Scheduler)
+
+// WithClock tells the time with clk, which also times the interval.
+func WithClock(clk clock.Clock) Option {
+	return func(s *Scheduler) {
+		s.clock = clk
+	}
+}
+
+// WithHistory keeps the names of the last n runs on each schedule.
+func WithHistory(n int) Option {
+	return func(s *Scheduler) {
+		s.history = n
+	}
+}
+
+// WithProtobufJobs publishes jobs as protobuf when the queue supports it.
+func WithProtobufJobs() Option {
+	return func(s *Scheduler) {
+		s.protobufJobs = true
+	}
+}
+
+// New creates a Scheduler checking for due schedules every interval.
+func New(ds datastore, q queue, interval time.Duration, opts ...Option) *Scheduler {
+	s := &Scheduler{store: ds, queue: q, interval: interval, clock: clock.Real{}, history: defaultHistory}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	return s
+}
+
+// Run starts the calculations of due schedules until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		if n, err := s.RunDue(ctx, s.clock.Now()); err != nil {
+			log.Printf("error running recurring schedules: %s", err)
+		} else if n > 0 {
+			log.Printf("started %d recurring calculations", n)
+		}
+
+		if err := s.clock.Sleep(ctx, s.interval); err != nil {
+			return err
+		}
+	}
+}
+
+// RunDue starts a calculation for every schedule due at now and returns how
+// many were started. A schedule that missed several runs, such as while no
+// scheduler was running, runs once.
+func (s *Scheduler) RunDue(ctx context.Context, now time.Time) (int, error) {
+	var started int
+
+	for {
+		schedules, more, err := s.store.DueSchedules(ctx, now, batchSize)
+		if err != nil {
+			return started, fmt.Errorf("error getting due schedules: %w", err)
+		}
+
+		var ran int
+		for _, schedule := range schedules {
+			ok, err := s.run(ctx, schedule, now)
+			if err != nil {
+				log.Printf("error running schedule %q: %s", schedule.Name, err)
+			}
+			if ok {
+				ran++
+			}
+		}
+		started += ran
+
+		// Schedules that ran are no longer due and stale marks were cleared
+		// while reading, so the next read finds the rest. Those that could not
+		// run wait for the next interval.
+		if !more || (len(schedules) > 0 && ran == 0) {
+			return started, nil
+		}
+	}
+}
+
+// run saves the next run of the schedule together with the calculation it
+// starts, so that the calculation is started once even if the schedule is
+// changed in the meantime, and then publishes the calculation's job. A
+// calculation whose job fails to publish is left to the reconciler.
+func (s *Scheduler) run(ctx context.Context, schedule store.Schedule, now time.Time) (bool, error) {
+	expr, err := cron.Parse(schedule.Cron)
+	if err != nil {
+		return false, fmt.Errorf("invalid cron expression %q: %w", schedule.Cron, err)
+	}
+
+	name := uuid.NewString()
+	due := schedule.Next
+
+	schedule.Next = expr.Next(now)
+	schedule.Runs = append([]string{name}, schedule.Runs...)
+	if len(schedule.Runs) > s.history {
+		schedule.Runs = schedule.Runs[:s.history]
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: name,
+		First:         schedule.Template.First,
+		Second:        schedule.Template.Second,
+		Position:      schedule.Template.Position,
+		Priority:      schedule.Template.Priority,
+	}
+
+	calculation := store.Calculation{
+		Name: name,
+		Metadata: store.CalculationMetadata{
+			Created:  now,
+			Priority: schedule.Template.Priority,
+		},
+	}
+
+	calculation.Job, err = json.Marshal(job.Envelope())
+	if err != nil {
+		return false, fmt.Errorf("error marshaling job: %w", err)
+	}
+
+	if err := s.store.RunSchedule(ctx, schedule, due, calculation); errors.Is(err, store.ErrUpdateUnsuccessful) {
+		// It was deleted or run by someone else.
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error creating calculation %q: %w", name, err)
+	}
+
+	if err := worker.PublishFibonacciOf(ctx, s.queue, job, s.protobufJobs); err != nil {
+		return true, fmt.Errorf("error publishing job for %q: %w", name, err)
+	}
+
+	return true, nil
+}
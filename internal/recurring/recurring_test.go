@@ -0,0 +1,195 @@
+package recurring_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock/clocktest"
+	"github.com/vickleford/calculator/internal/recurring"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+)
+
+type fakeStore struct {
+	schedules    []store.Schedule
+	calculations map[string]store.Calculation
+	runErr       error
+	// stale is how many marks left behind by schedules that have since
+	// changed come before the due schedules. Each read clears those it finds.
+	stale int
+}
+
+func (s *fakeStore) DueSchedules(ctx context.Context, now time.Time, limit int64) ([]store.Schedule, bool, error) {
+	var due []store.Schedule
+	for _, schedule := range s.schedules {
+		if !schedule.Next.IsZero() && !schedule.Next.After(now) {
+			due = append(due, schedule)
+		}
+	}
+
+	cleared := min(s.stale, int(limit))
+	s.stale -= cleared
+	n := min(len(due), int(limit)-cleared)
+	return due[:n], s.stale > 0 || len(due) > n, nil
+}
+
+func (s *fakeStore) RunSchedule(ctx context.Context, schedule store.Schedule, due time.Time, c store.Calculation) error {
+	if s.runErr != nil {
+		return s.runErr
+	}
+	for i := range s.schedules {
+		if s.schedules[i].Name == schedule.Name && s.schedules[i].Next.Equal(due) {
+			s.schedules[i] = schedule
+		}
+	}
+	s.calculations[c.Name] = c
+	return nil
+}
+
+type workQ struct {
+	published []worker.FibonacciOfJob
+}
+
+func (q *workQ) PublishJSON(ctx context.Context, msg any) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	job, err := worker.DecodeFibonacciOfJob(b)
+	if err != nil {
+		return err
+	}
+	q.published = append(q.published, job)
+	return nil
+}
+
+func TestRunDue(t *testing.T) {
+	now := time.Date(2024, 7, 15, 9, 0, 30, 0, time.UTC)
+
+	ds := &fakeStore{
+		schedules: []store.Schedule{
+			{
+				Name:     "due",
+				Cron:     "0 9 * * *",
+				Template: store.CalculationTemplate{Second: 1, Position: 10, Priority: 2},
+				Next:     time.Date(2024, 7, 15, 9, 0, 0, 0, time.UTC),
+				Runs:     []string{"older", "oldest"},
+			},
+			{
+				Name: "later",
+				Cron: "0 10 * * *",
+				Next: time.Date(2024, 7, 15, 10, 0, 0, 0, time.UTC),
+			},
+		},
+		calculations: make(map[string]store.Calculation),
+	}
+	q := &workQ{}
+
+	n, err := recurring.New(ds, q, time.Second, recurring.WithHistory(2)).RunDue(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 1 || len(q.published) != 1 {
+		t.Fatalf("expected 1 calculation to start but started %d and published %v", n, q.published)
+	}
+
+	job := q.published[0]
+	if job.Position != 10 || job.Second != 1 || job.Priority != 2 {
+		t.Errorf("expected the job to follow the template but got %+v", job)
+	}
+
+	calculation, ok := ds.calculations[job.OperationName]
+	if !ok {
+		t.Fatal("expected a calculation to be created for the job")
+	}
+	if len(calculation.Job) == 0 {
+		t.Error("expected the job to be kept with the calculation")
+	}
+
+	due := ds.schedules[0]
+	if expected := []string{job.OperationName, "older"}; !slices.Equal(due.Runs, expected) {
+		t.Errorf("expected the runs to be %v but got %v", expected, due.Runs)
+	}
+	if expected := time.Date(2024, 7, 16, 9, 0, 0, 0, time.UTC); !due.Next.Equal(expected) {
+		t.Errorf("expected the next run at %s but got %s", expected, due.Next)
+	}
+
+	if later := ds.schedules[1]; len(later.Runs) != 0 {
+		t.Errorf("expected the later schedule not to run but it ran %v", later.Runs)
+	}
+}
+
+func TestRunDue_ReadsPastPagesOfStaleMarks(t *testing.T) {
+	now := time.Now()
+
+	ds := &fakeStore{
+		schedules:    []store.Schedule{{Name: "due", Cron: "@hourly", Next: now.Add(-time.Minute)}},
+		calculations: make(map[string]store.Calculation),
+		stale:        150,
+	}
+	q := &workQ{}
+
+	n, err := recurring.New(ds, q, time.Second).RunDue(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 1 || len(q.published) != 1 {
+		t.Errorf("expected the schedule behind the stale marks to start but started %d", n)
+	}
+}
+
+func TestRunDue_SkipsSchedulesChangedSinceRead(t *testing.T) {
+	now := time.Now()
+
+	ds := &fakeStore{
+		schedules:    []store.Schedule{{Name: "deleted", Cron: "@hourly", Next: now.Add(-time.Minute)}},
+		calculations: make(map[string]store.Calculation),
+		runErr:       store.ErrUpdateUnsuccessful,
+	}
+	q := &workQ{}
+
+	n, err := recurring.New(ds, q, time.Second).RunDue(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 0 || len(q.published) != 0 || len(ds.calculations) != 0 {
+		t.Errorf("expected nothing to start but started %d", n)
+	}
+}
+
+func TestRun_StartsSchedulesAsTheyBecomeDue(t *testing.T) {
+	now := time.Now()
+	clk := clocktest.NewFake(now)
+	ds := &fakeStore{
+		schedules:    []store.Schedule{{Name: "later", Cron: "@hourly", Next: now.Add(time.Minute)}},
+		calculations: make(map[string]store.Calculation),
+	}
+	q := &workQ{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- recurring.New(ds, q, time.Minute, recurring.WithClock(clk)).Run(ctx) }()
+
+	clk.BlockUntil(1)
+	if len(q.published) != 0 {
+		t.Fatalf("expected nothing to start before the schedule is due but started %d", len(q.published))
+	}
+
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1)
+	if len(q.published) != 1 {
+		t.Errorf("expected the schedule to start once due but started %d", len(q.published))
+	}
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Run to stop when ctx is done but got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Package resultcache caches the results of calculations by what was
+// calculated, so that identical calculations are only run once.
+package resultcache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cache holds calculation results by key.
+type Cache interface {
+	// Get returns the result cached for key, and false if there is none.
+	Get(ctx context.Context, key string) (json.RawMessage, bool, error)
+	// Put caches result for key.
+	Put(ctx context.Context, key string, result json.RawMessage) error
+}
+
+// FibonacciOfKey returns the key of the result of calculating the number at
+// position of the Fibonacci sequence starting with first and second. The
+// parameters are hashed so that keys have a fixed length however large they
+// are.
+func FibonacciOfKey(first, second, position int64) string {
+	return key("fibonacci_of", fmt.Sprintf("first=%d;second=%d;position=%d", first, second, position))
+}
+
+func key(calculation, params string) string {
+	sum := sha256.Sum256([]byte(calculation + "\x00" + params))
+	return calculation + "/" + hex.EncodeToString(sum[:])
+}
+
+// LRU keeps up to size results in memory in front of another Cache. Results
+// are written through to the other Cache, and results it has are kept in
+// memory once read.
+type LRU struct {
+	next Cache
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key    string
+	result json.RawMessage
+}
+
+// NewLRU creates an LRU holding up to size results in front of next.
+func NewLRU(next Cache, size int) *LRU {
+	return &LRU{
+		next:    next,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *LRU) Get(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	if result, ok := c.get(key); ok {
+		return result, true, nil
+	}
+
+	result, ok, err := c.next.Get(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	c.add(key, result)
+
+	return result, true, nil
+}
+
+func (c *LRU) Put(ctx context.Context, key string, result json.RawMessage) error {
+	if err := c.next.Put(ctx, key, result); err != nil {
+		return err
+	}
+
+	c.add(key, result)
+
+	return nil
+}
+
+func (c *LRU) get(key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+
+	return e.Value.(lruEntry).result, true
+}
+
+func (c *LRU) add(key string, result json.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value = lruEntry{key, result}
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(lruEntry{key, result})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(lruEntry).key)
+	}
+}
+
+// Metrics counts the hits and misses of caches it instruments. It is a
+// prometheus.Collector.
+type Metrics struct {
+	lookups *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "resultcache",
+			Name:      "lookups_total",
+			Help:      "Total number of calculation results looked up by cache tier and whether they were found.",
+		}, []string{"tier", "result"}),
+	}
+}
+
+// Instrument counts the hits and misses of c under tier. Lookups that fail
+// count as errors.
+func (m *Metrics) Instrument(tier string, c Cache) Cache {
+	return instrumented{Cache: c, tier: tier, lookups: m.lookups}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.lookups.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.lookups.Collect(ch)
+}
+
+type instrumented struct {
+	Cache
+	tier    string
+	lookups *prometheus.CounterVec
+}
+
+func (c instrumented) Get(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	result, ok, err := c.Cache.Get(ctx, key)
+
+	switch {
+	case err != nil:
+		c.lookups.WithLabelValues(c.tier, "error").Inc()
+	case ok:
+		c.lookups.WithLabelValues(c.tier, "hit").Inc()
+	default:
+		c.lookups.WithLabelValues(c.tier, "miss").Inc()
+	}
+
+	return result, ok, err
+}
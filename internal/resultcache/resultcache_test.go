@@ -0,0 +1,132 @@
+package resultcache_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vickleford/calculator/internal/resultcache"
+)
+
+type fakeCache struct {
+	results map[string]json.RawMessage
+	gets    int
+}
+
+func (c *fakeCache) Get(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	c.gets++
+	result, ok := c.results[key]
+	return result, ok, nil
+}
+
+func (c *fakeCache) Put(ctx context.Context, key string, result json.RawMessage) error {
+	c.results[key] = result
+	return nil
+}
+
+func TestFibonacciOfKey(t *testing.T) {
+	key := resultcache.FibonacciOfKey(0, 1, 5)
+
+	if key != resultcache.FibonacciOfKey(0, 1, 5) {
+		t.Error("expected identical calculations to have the same key")
+	}
+
+	if !strings.HasPrefix(key, "fibonacci_of/") {
+		t.Errorf("expected the key to name the calculation but got %q", key)
+	}
+
+	for _, other := range []string{
+		resultcache.FibonacciOfKey(1, 0, 5),
+		resultcache.FibonacciOfKey(0, 1, 6),
+		resultcache.FibonacciOfKey(0, 15, 1),
+	} {
+		if other == key {
+			t.Errorf("expected different calculations to have different keys but both are %q", key)
+		}
+	}
+}
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	next := &fakeCache{results: map[string]json.RawMessage{}}
+	lru := resultcache.NewLRU(next, 2)
+
+	for _, key := range []string{"a", "b"} {
+		if err := lru.Put(ctx, key, json.RawMessage(`"`+key+`"`)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if len(next.results) != 2 {
+		t.Errorf("expected results to be written through but next holds %v", next.results)
+	}
+
+	// Use a so that b is the least recently used when c is added.
+	if _, ok, _ := lru.Get(ctx, "a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	if err := lru.Put(ctx, "c", json.RawMessage(`"c"`)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	next.gets = 0
+	for _, key := range []string{"a", "c"} {
+		if _, ok, _ := lru.Get(ctx, key); !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+	if next.gets != 0 {
+		t.Errorf("expected a and c to be found in memory but next was read %d times", next.gets)
+	}
+
+	result, ok, err := lru.Get(ctx, "b")
+	if err != nil || !ok || string(result) != `"b"` {
+		t.Errorf("expected b to be read from next but got %s, %t, %v", result, ok, err)
+	}
+	if next.gets != 1 {
+		t.Errorf("expected the evicted b to be read from next but next was read %d times", next.gets)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	metrics := resultcache.NewMetrics()
+	cache := metrics.Instrument("etcd", &fakeCache{results: map[string]json.RawMessage{"a": []byte(`1`)}})
+
+	for _, key := range []string{"a", "a", "b"} {
+		if _, _, err := cache.Get(ctx, key); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+
+	counts := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "resultcache_lookups_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			counts[labels["tier"]+"/"+labels["result"]] = m.GetCounter().GetValue()
+		}
+	}
+
+	expected := map[string]float64{"etcd/hit": 2, "etcd/miss": 1}
+	for lookup, n := range expected {
+		if counts[lookup] != n {
+			t.Errorf("expected %v %s lookups but got %v", n, lookup, counts[lookup])
+		}
+	}
+}
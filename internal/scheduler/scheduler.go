@@ -0,0 +1,120 @@
+// Package scheduler publishes jobs that were scheduled to start later once they
+// are due.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+)
+
+// batchSize is how many due jobs are read from the store at a time.
+const batchSize = 100
+
+type datastore interface {
+	DueJobs(context.Context, time.Time, int64) ([]store.ScheduledJob, error)
+	DeleteScheduled(context.Context, store.ScheduledJob) error
+}
+
+type queue interface {
+	PublishJSON(context.Context, any) error
+}
+
+// Scheduler publishes scheduled jobs once they are due. Only one Scheduler
+// should run at a time; see package leader.
+type Scheduler struct {
+	store    datastore
+	queue    queue
+	interval time.Duration
+	clock    clock.Clock
+
+	protobufJobs bool
+}
+
+type Option func(*Scheduler)
+
+// WithClock tells the time with clk, which also times the interval.
+func WithClock(clk clock.Clock) Option {
+	return func(s *Scheduler) {
+		s.clock = clk
+	}
+}
+
+// WithProtobufJobs publishes jobs as protobuf when the queue supports it.
+func WithProtobufJobs() Option {
+	return func(s *Scheduler) {
+		s.protobufJobs = true
+	}
+}
+
+// New creates a Scheduler checking for due jobs every interval.
+func New(ds datastore, q queue, interval time.Duration, opts ...Option) *Scheduler {
+	s := &Scheduler{store: ds, queue: q, interval: interval, clock: clock.Real{}}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	return s
+}
+
+// Run publishes due jobs until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		if n, err := s.PublishDue(ctx, s.clock.Now()); err != nil {
+			log.Printf("error publishing scheduled jobs: %s", err)
+		} else if n > 0 {
+			log.Printf("published %d scheduled jobs", n)
+		}
+
+		if err := s.clock.Sleep(ctx, s.interval); err != nil {
+			return err
+		}
+	}
+}
+
+// PublishDue publishes every job due at now and returns how many were
+// published. A job is removed from the schedule only once it is published, so
+// a job may be published more than once if removing it fails.
+func (s *Scheduler) PublishDue(ctx context.Context, now time.Time) (int, error) {
+	var published int
+
+	for {
+		jobs, err := s.store.DueJobs(ctx, now, batchSize)
+		if err != nil {
+			return published, fmt.Errorf("error getting due jobs: %w", err)
+		}
+
+		for _, job := range jobs {
+			if err := s.publish(ctx, job); err != nil {
+				return published, err
+			}
+			published++
+		}
+
+		if len(jobs) < batchSize {
+			return published, nil
+		}
+	}
+}
+
+func (s *Scheduler) publish(ctx context.Context, job store.ScheduledJob) error {
+	fibOfJob, err := worker.DecodeFibonacciOfJob(job.Payload)
+	if err != nil {
+		// It can never be published, and leaving it would wedge the schedule.
+		log.Printf("discarding scheduled job for %q that cannot be decoded: %s", job.Name, err)
+	} else if err := worker.PublishFibonacciOf(ctx, s.queue, fibOfJob, s.protobufJobs); err != nil {
+		return fmt.Errorf("error publishing scheduled job for %q: %w", job.Name, err)
+	}
+
+	if err := s.store.DeleteScheduled(ctx, job); err != nil {
+		return fmt.Errorf("error removing scheduled job for %q: %w", job.Name, err)
+	}
+
+	return nil
+}
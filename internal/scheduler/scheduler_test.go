@@ -0,0 +1,184 @@
+package scheduler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock/clocktest"
+	"github.com/vickleford/calculator/internal/scheduler"
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+)
+
+type fakeStore struct {
+	due     []store.ScheduledJob
+	deleted []store.ScheduledJob
+}
+
+func (s *fakeStore) DueJobs(ctx context.Context, now time.Time, limit int64) ([]store.ScheduledJob, error) {
+	var due []store.ScheduledJob
+	for _, job := range s.due {
+		if !job.NotBefore.After(now) && int64(len(due)) < limit {
+			due = append(due, job)
+		}
+	}
+	return due, nil
+}
+
+func (s *fakeStore) DeleteScheduled(ctx context.Context, job store.ScheduledJob) error {
+	s.deleted = append(s.deleted, job)
+	for i := range s.due {
+		if s.due[i].Name == job.Name {
+			s.due = append(s.due[:i], s.due[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+type workQ struct {
+	published []any
+	err       error
+}
+
+func (q *workQ) PublishJSON(ctx context.Context, msg any) error {
+	if q.err != nil {
+		return q.err
+	}
+	q.published = append(q.published, msg)
+	return nil
+}
+
+func scheduledJob(t *testing.T, name string, notBefore time.Time) store.ScheduledJob {
+	t.Helper()
+	b, err := json.Marshal(worker.FibonacciOfJob{OperationName: name, Position: 5, Priority: 2})
+	if err != nil {
+		t.Fatalf("unable to set up job: %s", err)
+	}
+	return store.ScheduledJob{Name: name, NotBefore: notBefore, Payload: b}
+}
+
+func TestPublishDue_PublishesOnlyDueJobs(t *testing.T) {
+	now := time.Now()
+	ds := &fakeStore{due: []store.ScheduledJob{
+		scheduledJob(t, "past", now.Add(-time.Minute)),
+		scheduledJob(t, "now", now),
+		scheduledJob(t, "future", now.Add(time.Minute)),
+	}}
+	q := &workQ{}
+
+	n, err := scheduler.New(ds, q, time.Second).PublishDue(context.Background(), now)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if n != 2 {
+		t.Errorf("expected 2 published but got %d", n)
+	}
+
+	if len(q.published) != 2 {
+		t.Fatalf("expected 2 published messages but got %d", len(q.published))
+	}
+
+	b, err := json.Marshal(q.published[0])
+	if err != nil {
+		t.Fatalf("unable to marshal published message: %s", err)
+	}
+
+	job, err := worker.DecodeFibonacciOfJob(b)
+	if err != nil {
+		t.Fatalf("expected a FibonacciOfJob to be published but got %s: %s", b, err)
+	}
+
+	if job.OperationName != "past" || job.Position != 5 || job.Priority != 2 {
+		t.Errorf("unexpected job: %#v", job)
+	}
+
+	if len(ds.due) != 1 || ds.due[0].Name != "future" {
+		t.Errorf("expected only the future job to remain scheduled: %#v", ds.due)
+	}
+}
+
+func TestPublishDue_KeepsJobWhenPublishFails(t *testing.T) {
+	now := time.Now()
+	ds := &fakeStore{due: []store.ScheduledJob{
+		scheduledJob(t, "past", now.Add(-time.Minute)),
+	}}
+	q := &workQ{err: errors.New("broker unavailable")}
+
+	if _, err := scheduler.New(ds, q, time.Second).PublishDue(context.Background(), now); err == nil {
+		t.Error("expected an error")
+	}
+
+	if len(ds.deleted) != 0 {
+		t.Errorf("expected the job to stay scheduled but %d were deleted", len(ds.deleted))
+	}
+}
+
+func TestPublishDue_ReadsEveryBatch(t *testing.T) {
+	now := time.Now()
+	ds := &fakeStore{}
+	for i := 0; i < 250; i++ {
+		ds.due = append(ds.due, scheduledJob(t, time.Duration(i).String(), now))
+	}
+	q := &workQ{}
+
+	n, err := scheduler.New(ds, q, time.Second).PublishDue(context.Background(), now)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if n != 250 {
+		t.Errorf("expected 250 published but got %d", n)
+	}
+}
+
+func TestPublishDue_DiscardsMalformedJobs(t *testing.T) {
+	now := time.Now()
+	ds := &fakeStore{due: []store.ScheduledJob{
+		{Name: "bad", NotBefore: now, Payload: []byte("not json")},
+	}}
+	q := &workQ{}
+
+	if _, err := scheduler.New(ds, q, time.Second).PublishDue(context.Background(), now); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if len(q.published) != 0 {
+		t.Errorf("expected nothing to be published")
+	}
+
+	if len(ds.deleted) != 1 {
+		t.Errorf("expected the malformed job to be removed")
+	}
+}
+
+func TestRun_PublishesJobsAsTheyBecomeDue(t *testing.T) {
+	now := time.Now()
+	clk := clocktest.NewFake(now)
+	ds := &fakeStore{due: []store.ScheduledJob{scheduledJob(t, "later", now.Add(time.Minute))}}
+	q := &workQ{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- scheduler.New(ds, q, time.Minute, scheduler.WithClock(clk)).Run(ctx) }()
+
+	clk.BlockUntil(1)
+	if len(q.published) != 0 {
+		t.Fatalf("expected nothing to be published before the job is due but published %d", len(q.published))
+	}
+
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1)
+	if len(q.published) != 1 {
+		t.Errorf("expected the job to be published once due but published %d", len(q.published))
+	}
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Run to stop when ctx is done but got %v", err)
+	}
+}
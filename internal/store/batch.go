@@ -0,0 +1,247 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const batchPrefix = "batches/"
+
+// maxTxnOps is how many operations are put in one transaction, which is the
+// most etcd allows by default.
+const maxTxnOps = 128
+
+// Batch is a group of calculations started together.
+type Batch struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Calculations are the names of the calculations in the batch.
+	Calculations []string `json:"calculations"`
+
+	// Done is set once every calculation in the batch is done, along with
+	// when that was noticed and how many calculations succeeded and failed.
+	Done      bool       `json:"done"`
+	Completed *time.Time `json:"completed,omitempty"`
+	Succeeded int        `json:"succeeded,omitempty"`
+	Failed    int        `json:"failed,omitempty"`
+}
+
+// CreateMany creates many Calculations for the first time in as few
+// transactions as it can. It returns the error creating each calculation, in
+// order, which is nil for those created. Like Create, the error is
+// ErrKeyAlreadyExists for a calculation that already exists.
+func (c *CalculationStore) CreateMany(ctx context.Context, calculations []Calculation) []error {
+	errs := make([]error, len(calculations))
+
+	// Each calculation takes two operations: itself and its not started mark.
+	const perTxn = maxTxnOps / 2
+
+	for start := 0; start < len(calculations); start += perTxn {
+		end := min(start+perTxn, len(calculations))
+		chunk := calculations[start:end]
+
+		cmps := make([]clientv3.Cmp, 0, len(chunk))
+		ops := make([]clientv3.Op, 0, 2*len(chunk))
+		for i, calculation := range chunk {
+			key := CalculationKey(calculation)
+
+			value, err := json.Marshal(calculation)
+			if err != nil {
+				errs[start+i] = fmt.Errorf("unable to marshal calculation %q to JSON: %w", calculation.Name, err)
+				continue
+			}
+
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+			ops = append(ops, clientv3.OpPut(key, string(value)), notStartedOp(calculation))
+		}
+
+		resp, err := c.cli.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			for i := range chunk {
+				if errs[start+i] == nil {
+					errs[start+i] = fmt.Errorf("error writing calculations: %w", err)
+				}
+			}
+			continue
+		}
+
+		if !resp.Succeeded {
+			// Some calculation already exists; find out which by creating
+			// them one at a time.
+			for i, calculation := range chunk {
+				if errs[start+i] == nil {
+					errs[start+i] = c.Create(ctx, calculation)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// GetMany returns the calculations with the given names that exist, reading
+// them in as few transactions as it can.
+func (c *CalculationStore) GetMany(ctx context.Context, names []string) ([]Calculation, error) {
+	calculations := make([]Calculation, 0, len(names))
+
+	for start := 0; start < len(names); start += maxTxnOps {
+		end := min(start+maxTxnOps, len(names))
+
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, name := range names[start:end] {
+			ops = append(ops, clientv3.OpGet(CalculationKey(Calculation{Name: name})))
+		}
+
+		resp, err := c.cli.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return nil, fmt.Errorf("error getting calculations: %w", err)
+		}
+
+		for _, r := range resp.Responses {
+			for _, kv := range r.GetResponseRange().Kvs {
+				var calc Calculation
+				if err := json.Unmarshal(kv.Value, &calc); err != nil {
+					return nil, fmt.Errorf("error unmarshaling calculation at %q: %w", kv.Key, err)
+				}
+				calc.Metadata.Version = kv.Version
+				calculations = append(calculations, calc)
+			}
+		}
+	}
+
+	return calculations, nil
+}
+
+// Operations are the calculations, batches and pipelines found by name.
+type Operations struct {
+	Calculations []Calculation
+	Batches      []Batch
+	Pipelines    []Pipeline
+}
+
+// GetOperations returns whichever of a calculation, a batch or a pipeline
+// exists by each of the given names, reading all three kinds together in as few
+// transactions as it can.
+func (c *CalculationStore) GetOperations(ctx context.Context, names []string) (Operations, error) {
+	var found Operations
+
+	// Each name takes three operations: one for each kind.
+	const perTxn = maxTxnOps / 3
+
+	for start := 0; start < len(names); start += perTxn {
+		end := min(start+perTxn, len(names))
+
+		ops := make([]clientv3.Op, 0, 3*(end-start))
+		for _, name := range names[start:end] {
+			ops = append(ops,
+				clientv3.OpGet(CalculationKey(Calculation{Name: name})),
+				clientv3.OpGet(BatchKey(name)),
+				clientv3.OpGet(PipelineKey(name)),
+			)
+		}
+
+		resp, err := c.cli.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return Operations{}, fmt.Errorf("error getting operations: %w", err)
+		}
+
+		for i, r := range resp.Responses {
+			for _, kv := range r.GetResponseRange().Kvs {
+				var err error
+				switch i % 3 {
+				case 0:
+					var calc Calculation
+					err = json.Unmarshal(kv.Value, &calc)
+					calc.Metadata.Version = kv.Version
+					found.Calculations = append(found.Calculations, calc)
+				case 1:
+					var batch Batch
+					err = json.Unmarshal(kv.Value, &batch)
+					found.Batches = append(found.Batches, batch)
+				case 2:
+					var pipeline Pipeline
+					err = json.Unmarshal(kv.Value, &pipeline)
+					pipeline.Version = kv.Version
+					found.Pipelines = append(found.Pipelines, pipeline)
+				}
+				if err != nil {
+					return Operations{}, fmt.Errorf("error unmarshaling operation at %q: %w", kv.Key, err)
+				}
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// CreateBatch creates a Batch for the first time. If it already exists, it
+// returns ErrKeyAlreadyExists.
+func (c *CalculationStore) CreateBatch(ctx context.Context, batch Batch) error {
+	key := BatchKey(batch.Name)
+
+	value, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("unable to marshal batch %q to JSON: %w", batch.Name, err)
+	}
+
+	resp, err := c.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+	).Then(
+		clientv3.OpPut(key, string(value)),
+	).Commit()
+	if err != nil {
+		return fmt.Errorf("error writing key: %q: %w", key, err)
+	}
+
+	if !resp.Succeeded {
+		return ErrKeyAlreadyExists
+	}
+
+	return nil
+}
+
+// GetBatch returns the batch with the given name, or ErrKeyNotFound.
+func (c *CalculationStore) GetBatch(ctx context.Context, name string) (Batch, error) {
+	key := BatchKey(name)
+
+	resp, err := c.cli.Get(ctx, key)
+	if err != nil {
+		return Batch{}, fmt.Errorf("error getting key %q: %w", key, err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return Batch{}, ErrKeyNotFound
+	}
+
+	var batch Batch
+	if err := json.Unmarshal(resp.Kvs[0].Value, &batch); err != nil {
+		return Batch{}, fmt.Errorf("error unmarshaling batch: %w", err)
+	}
+
+	return batch, nil
+}
+
+// SaveBatch saves the batch. Batches only change once, when they are done, so
+// it is not guarded against concurrent updates.
+func (c *CalculationStore) SaveBatch(ctx context.Context, batch Batch) error {
+	key := BatchKey(batch.Name)
+
+	value, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("unable to marshal batch %q to JSON: %w", batch.Name, err)
+	}
+
+	if _, err := c.cli.Put(ctx, key, string(value)); err != nil {
+		return fmt.Errorf("error writing key %q: %w", key, err)
+	}
+
+	return nil
+}
+
+func BatchKey(name string) string {
+	return batchPrefix + name
+}
@@ -0,0 +1,93 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/store"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestIntegration_CreateManyAndBatches(t *testing.T) {
+	etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+	if etcdEndpoint == "" {
+		t.Skip(`set ETCD_ENDPOINT to run this test, e.g. ETCD_ENDPOINT="localhost:2379"`)
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdEndpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to set up client: %s", err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calculations := store.NewCalculationStore(cli)
+
+	existing := store.Calculation{Name: uuid.NewString()}
+	if err := calculations.Create(ctx, existing); err != nil {
+		t.Fatalf("unexpected error creating calculation: %s", err)
+	}
+
+	// More than fit in one transaction, with one that already exists.
+	var many []store.Calculation
+	var names []string
+	for i := 0; i < 200; i++ {
+		c := store.Calculation{Name: uuid.NewString()}
+		many = append(many, c)
+		names = append(names, c.Name)
+	}
+	many[150] = existing
+
+	errs := calculations.CreateMany(ctx, many)
+	for i, err := range errs {
+		if i == 150 {
+			if !errors.Is(err, store.ErrKeyAlreadyExists) {
+				t.Errorf("expected the existing calculation to already exist but got %v", err)
+			}
+		} else if err != nil {
+			t.Errorf("unexpected error creating calculation %d: %s", i, err)
+		}
+	}
+
+	got, err := calculations.GetMany(ctx, append(names, uuid.NewString()))
+	if err != nil {
+		t.Fatalf("unexpected error getting calculations: %s", err)
+	}
+	if len(got) != 200 {
+		t.Errorf("expected to get the 200 calculations that exist but got %d", len(got))
+	}
+
+	batch := store.Batch{Name: uuid.NewString(), Created: time.Now(), Calculations: names}
+	if err := calculations.CreateBatch(ctx, batch); err != nil {
+		t.Fatalf("unexpected error creating batch: %s", err)
+	}
+	if err := calculations.CreateBatch(ctx, batch); !errors.Is(err, store.ErrKeyAlreadyExists) {
+		t.Errorf("expected creating the batch again to fail but got %v", err)
+	}
+
+	batch.Done = true
+	if err := calculations.SaveBatch(ctx, batch); err != nil {
+		t.Fatalf("unexpected error saving batch: %s", err)
+	}
+
+	saved, err := calculations.GetBatch(ctx, batch.Name)
+	if err != nil {
+		t.Fatalf("unexpected error getting batch: %s", err)
+	}
+	if !saved.Done || len(saved.Calculations) != 200 {
+		t.Errorf("unexpected batch: %+v", saved)
+	}
+
+	if _, err := calculations.GetBatch(ctx, uuid.NewString()); !errors.Is(err, store.ErrKeyNotFound) {
+		t.Errorf("expected a missing batch not to be found but got %v", err)
+	}
+}
@@ -10,11 +10,58 @@ import (
 type CalculationMetadata struct {
 	Created time.Time  `json:"created"`
 	Started *time.Time `json:"started,omitempty"`
+	// Completed is when the calculation was done.
+	Completed *time.Time `json:"completed,omitempty"`
+	// Priority is the priority the calculation was requested with.
+	Priority uint8 `json:"priority,omitempty"`
+	// Scheduled is the earliest time the calculation may start, if it was
+	// scheduled for later.
+	Scheduled *time.Time `json:"scheduled,omitempty"`
+	// Deadline is when the calculation expires if it has not been done.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Republished is when the calculation's job was last published again
+	// after it was lost.
+	Republished *time.Time `json:"republished,omitempty"`
+	// Redeliveries counts how many times a worker took over the calculation
+	// after another worker started it without finishing.
+	Redeliveries int `json:"redeliveries,omitempty"`
+	// Cached is set when the result was taken from the result of an identical
+	// calculation rather than calculated.
+	Cached bool `json:"cached,omitempty"`
+	// Primary is the name of the identical calculation in flight whose
+	// outcome this calculation waits for, instead of being run itself.
+	Primary string `json:"primary,omitempty"`
+	// Callback is where the client asked to be called back once the
+	// calculation is done, and how calling it back is going.
+	Callback *Callback `json:"callback,omitempty"`
 
 	// Version carries the version identifier stored of the Calculation.
 	Version int64 `json:"-"`
 }
 
+// States of a Callback.
+const (
+	CallbackPending   = "pending"
+	CallbackDelivered = "delivered"
+	CallbackFailed    = "failed"
+)
+
+// Callback is where to post the calculation's operation once it is done, and
+// how delivering it went.
+type Callback struct {
+	URL string `json:"url"`
+	// State is one of CallbackPending, CallbackDelivered or CallbackFailed.
+	State string `json:"state"`
+	// Attempts counts the attempts to deliver the callback.
+	Attempts int `json:"attempts,omitempty"`
+	// LastError is why the last attempt failed.
+	LastError string `json:"last_error,omitempty"`
+	// LastAttempted is when the callback was last attempted.
+	LastAttempted *time.Time `json:"last_attempted,omitempty"`
+	// Delivered is when the callback was delivered.
+	Delivered *time.Time `json:"delivered,omitempty"`
+}
+
 type CalculationError struct {
 	Message string   `json:"message"`
 	Details []string `json:"details"` // todo: revisit this.
@@ -31,6 +78,10 @@ type Calculation struct {
 	// Response is mutually exclusive with Error. It should only be set whe done
 	// is true.
 	Result json.RawMessage `json:"result,omitempty"` // todo: could this instead use generics?
+
+	// Job is the job that runs the calculation, as it is published, so that it
+	// can be published again if it is lost.
+	Job json.RawMessage `json:"job,omitempty"`
 }
 
 type FibonacciOfResult struct {
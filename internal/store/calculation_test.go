@@ -28,6 +28,12 @@ type etcdClientSpy struct {
 	// PutError is the error returned by Put
 	PutError error
 
+	// KeysSeenByDelete records the keys passed to Delete.
+	KeysSeenByDelete []string
+
+	// KeysSeenByGet records the keys passed to Get.
+	KeysSeenByGet []string
+
 	// ReturnGetResponse is what the spy will return when Get is called.
 	ReturnGetResponse *clientv3.GetResponse
 	// GetError is the error returned by Get.
@@ -57,6 +63,7 @@ func (s *etcdClientSpy) Get(
 	key string,
 	opts ...clientv3.OpOption,
 ) (*clientv3.GetResponse, error) {
+	s.KeysSeenByGet = append(s.KeysSeenByGet, key)
 	return s.ReturnGetResponse, s.GetError
 }
 
@@ -69,6 +76,15 @@ func (s *etcdClientSpy) Put(
 	return nil, s.PutError
 }
 
+func (s *etcdClientSpy) Delete(
+	ctx context.Context,
+	key string,
+	opts ...clientv3.OpOption,
+) (*clientv3.DeleteResponse, error) {
+	s.KeysSeenByDelete = append(s.KeysSeenByDelete, key)
+	return &clientv3.DeleteResponse{}, nil
+}
+
 func (s *etcdClientSpy) Txn(ctx context.Context) clientv3.Txn {
 	return s
 }
@@ -101,6 +117,8 @@ func (s *etcdClientSpy) Commit() (*clientv3.TxnResponse, error) {
 func TestSaveCalculation_WhenKeyDoesNotExist(t *testing.T) {
 	spy := NewETCDClientSpy()
 	spy.ReturnGetResponse = &clientv3.GetResponse{Count: 0}
+	spy.ShouldTxnIfSucceed = true
+	spy.ReturnTxnResponse = &clientv3.TxnResponse{Succeeded: true}
 	client := store.NewCalculationStore(spy)
 
 	calculation := store.Calculation{
@@ -116,15 +134,22 @@ func TestSaveCalculation_WhenKeyDoesNotExist(t *testing.T) {
 		t.Errorf("unexpected error: %s", err)
 	}
 
-	t.Logf("puts: %#v", spy.WritesSeenByPut)
-
-	if len(spy.WritesSeenByPut) != 1 {
-		t.Fatalf("got %d writes to put", len(spy.WritesSeenByPut))
+	ops := spy.OperationsSeenByThen
+	if len(ops) != 3 {
+		t.Fatalf("saw %d operations", len(ops))
 	}
 
-	if _, ok := spy.WritesSeenByPut[expectedKey]; !ok {
+	if !ops[0].IsPut() || string(ops[0].KeyBytes()) != expectedKey {
 		t.Errorf("did not see a write to key %q", expectedKey)
 	}
+
+	if !ops[1].IsPut() || string(ops[1].KeyBytes()) != "notstarted/some-operation-name" {
+		t.Errorf("expected the calculation to be marked not started but saw %v", ops[1])
+	}
+
+	if !ops[2].IsDelete() || string(ops[2].KeyBytes()) != "callbacks/some-operation-name" {
+		t.Errorf("expected the calculation not to be marked as having a pending callback but saw %v", ops[2])
+	}
 }
 
 func TestSaveCalculation_WhenKeyExists(t *testing.T) {
@@ -170,9 +195,17 @@ func TestSaveCalculation_WhenKeyExists(t *testing.T) {
 		}
 	}
 
-	if len(spy.OperationsSeenByThen) != 1 {
+	if len(spy.OperationsSeenByThen) != 3 {
 		t.Errorf("saw %d operations", len(spy.OperationsSeenByThen))
 	} else {
+		if mark := spy.OperationsSeenByThen[2]; !mark.IsDelete() || string(mark.KeyBytes()) != "callbacks/some-operation-name" {
+			t.Errorf("expected the calculation not to be marked as having a pending callback but saw %v", mark)
+		}
+
+		if mark := spy.OperationsSeenByThen[1]; !mark.IsDelete() || string(mark.KeyBytes()) != "notstarted/some-operation-name" {
+			t.Errorf("expected the started calculation to no longer be marked not started but saw %v", mark)
+		}
+
 		actual := spy.OperationsSeenByThen[0]
 		if !actual.IsPut() {
 			t.Errorf("expected a PUT operation")
@@ -276,7 +309,7 @@ func TestCreateCalculation_WhenKeyDoesNotExist(t *testing.T) {
 		}
 	}
 
-	if len(spy.OperationsSeenByThen) != 1 {
+	if len(spy.OperationsSeenByThen) != 2 {
 		t.Errorf("saw %d operations", len(spy.OperationsSeenByThen))
 	} else {
 		actual := spy.OperationsSeenByThen[0]
@@ -286,6 +319,9 @@ func TestCreateCalculation_WhenKeyDoesNotExist(t *testing.T) {
 		if key := string(actual.KeyBytes()); key != expectedKey {
 			t.Errorf("expected key %q but saw %q", expectedKey, key)
 		}
+		if mark := spy.OperationsSeenByThen[1]; !mark.IsPut() || string(mark.KeyBytes()) != "notstarted/some-operation-name" {
+			t.Errorf("expected the calculation to be marked not started but saw %v", mark)
+		}
 	}
 }
 
@@ -382,75 +418,79 @@ func TestCclaulationStore_Get_WhenKeyNotExists(t *testing.T) {
 	}
 }
 
-func TestSetStarted(t *testing.T) {
-	original := store.Calculation{
-		Name: uuid.NewString(),
-		Metadata: store.CalculationMetadata{
-			Created: time.Now(),
-		},
+func TestCalculationStore_List(t *testing.T) {
+	first := store.Calculation{Name: uuid.NewString(), Metadata: store.CalculationMetadata{Priority: 3}}
+	second := store.Calculation{Name: uuid.NewString(), Done: true}
+
+	var kvs []*mvccpb.KeyValue
+	for i, calc := range []store.Calculation{first, second} {
+		b, err := json.Marshal(calc)
+		if err != nil {
+			t.Fatalf("unable to set up test: %s", err)
+		}
+		kvs = append(kvs, &mvccpb.KeyValue{
+			Key:     []byte(store.CalculationKey(calc)),
+			Value:   b,
+			Version: int64(i + 1),
+		})
 	}
 
-	originalMarshaled, err := json.Marshal(original)
+	spy := NewETCDClientSpy()
+	spy.ReturnGetResponse = &clientv3.GetResponse{Kvs: kvs, Count: 5, More: true}
+
+	client := store.NewCalculationStore(spy)
+	actual, next, err := client.List(context.Background(), "previous", 2)
 	if err != nil {
-		t.Fatalf("unable to set up test: %s", err)
+		t.Errorf("unexpected error: %s", err)
 	}
 
-	var v int64 = 423893
-
-	spy := NewETCDClientSpy()
-	spy.ReturnGetResponse = &clientv3.GetResponse{
-		Kvs: []*mvccpb.KeyValue{
-			{
-				Value:   originalMarshaled,
-				Version: v,
-			},
-		},
-		Count: 1,
+	if len(spy.KeysSeenByGet) != 1 {
+		t.Errorf("expected 1 get but saw %d", len(spy.KeysSeenByGet))
+	} else if expected := "calculations/previous\x00"; spy.KeysSeenByGet[0] != expected {
+		t.Errorf("expected to list from %q but got %q", expected, spy.KeysSeenByGet[0])
 	}
 
-	spy.ShouldTxnIfSucceed = true
-	spy.ReturnTxnResponse = &clientv3.TxnResponse{
-		Succeeded: true,
+	if len(actual) != 2 {
+		t.Fatalf("expected 2 calculations but got %d", len(actual))
 	}
 
-	started := time.Now()
-	client := store.NewCalculationStore(spy)
-	err = client.SetStartedTime(context.Background(), original.Name, started)
-	if err != nil {
-		t.Errorf("unexpected error: %s", err)
+	if actual[0].Name != first.Name || actual[0].Metadata.Priority != 3 {
+		t.Errorf("unexpected first calculation: %#v", actual[0])
 	}
 
-	expectedKey := store.CalculationKey(original)
+	if actual[1].Name != second.Name || !actual[1].Done {
+		t.Errorf("unexpected second calculation: %#v", actual[1])
+	}
 
-	if len(spy.ComparisonsSeenByIf) != 1 {
-		t.Errorf("unexpected if comparisons: %#v", spy.ComparisonsSeenByIf)
-	} else {
-		actual := spy.ComparisonsSeenByIf[0]
-		if string(actual.Key) != expectedKey {
-			t.Errorf("saw key %q but expected %q", actual.Key, expectedKey)
-		}
+	if actual[1].Metadata.Version != 2 {
+		t.Errorf("expected version 2 but got %d", actual[1].Metadata.Version)
 	}
 
-	if len(spy.OperationsSeenByThen) != 1 {
-		t.Errorf("saw %d operations", len(spy.OperationsSeenByThen))
-		return
+	if next != second.Name {
+		t.Errorf("expected next page after %q but got %q", second.Name, next)
 	}
+}
+
+func TestCalculationStore_List_LastPage(t *testing.T) {
+	spy := NewETCDClientSpy()
+	spy.ReturnGetResponse = &clientv3.GetResponse{More: false}
 
-	actual := spy.OperationsSeenByThen[0]
-	if !actual.IsPut() {
-		t.Errorf("expected a PUT operation")
+	client := store.NewCalculationStore(spy)
+	actual, next, err := client.List(context.Background(), "", 10)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
 	}
-	if key := string(actual.KeyBytes()); key != expectedKey {
-		t.Errorf("expected key %q but saw %q", expectedKey, key)
+
+	if len(actual) != 0 {
+		t.Errorf("expected no calculations but got %d", len(actual))
 	}
 
-	savedCalculation := store.Calculation{}
-	if err := json.Unmarshal(actual.ValueBytes(), &savedCalculation); err != nil {
-		t.Errorf("unable to unmarshal written result: %s", err)
+	if next != "" {
+		t.Errorf("expected no next page but got %q", next)
 	}
 
-	if !started.Equal(*savedCalculation.Metadata.Started) {
-		t.Errorf("expected time %q but got %q", started, *savedCalculation.Metadata.Started)
+	if expected := "calculations/"; len(spy.KeysSeenByGet) != 1 || spy.KeysSeenByGet[0] != expected {
+		t.Errorf("expected to list from %q but saw %v", expected, spy.KeysSeenByGet)
 	}
 }
 
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Done calculations whose callback is still pending are also marked under
+// callbacks/<name>, so that callbacks left behind by a worker that stopped can
+// be found and delivered again. Each save of a calculation updates its mark in
+// the same transaction.
+const pendingCallbackPrefix = "callbacks/"
+
+// pendingCallbackOp marks the calculation's callback as pending once the
+// calculation is done, or clears its mark.
+func pendingCallbackOp(calculation Calculation) clientv3.Op {
+	key := pendingCallbackPrefix + calculation.Name
+	callback := calculation.Metadata.Callback
+	if calculation.Done && callback != nil && callback.State == CallbackPending {
+		return clientv3.OpPut(key, "")
+	}
+	return clientv3.OpDelete(key)
+}
+
+// PendingCallbacks returns up to limit done calculations whose callback is
+// pending, ordered by name, starting after the calculation named after, or
+// from the first when after is empty. Like NotStarted, it also returns the name
+// to list the next page after.
+func (c *CalculationStore) PendingCallbacks(ctx context.Context, after string, limit int64) ([]Calculation, string, error) {
+	calculations, next, err := c.marked(ctx, pendingCallbackPrefix, after, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing pending callbacks: %w", err)
+	}
+	return calculations, next, nil
+}
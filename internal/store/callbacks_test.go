@@ -0,0 +1,104 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/vickleford/calculator/internal/store"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestCalculationStore_SaveMarksPendingCallbacks(t *testing.T) {
+	tests := map[string]struct {
+		calculation store.Calculation
+		marked      bool
+	}{
+		"Pending": {
+			calculation: store.Calculation{Done: true, Metadata: store.CalculationMetadata{
+				Callback: &store.Callback{URL: "https://hooks.example.com", State: store.CallbackPending},
+			}},
+			marked: true,
+		},
+		"Delivered": {
+			calculation: store.Calculation{Done: true, Metadata: store.CalculationMetadata{
+				Callback: &store.Callback{URL: "https://hooks.example.com", State: store.CallbackDelivered},
+			}},
+		},
+		"NotDone": {
+			calculation: store.Calculation{Metadata: store.CalculationMetadata{
+				Callback: &store.Callback{URL: "https://hooks.example.com", State: store.CallbackPending},
+			}},
+		},
+		"NoCallback": {
+			calculation: store.Calculation{Done: true},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			spy := NewETCDClientSpy()
+			spy.ReturnGetResponse = &clientv3.GetResponse{}
+			spy.ShouldTxnIfSucceed = true
+			spy.ReturnTxnResponse = &clientv3.TxnResponse{Succeeded: true}
+
+			test.calculation.Name = "called-back"
+			client := store.NewCalculationStore(spy)
+			if err := client.Save(context.Background(), test.calculation); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			ops := spy.OperationsSeenByThen
+			if len(ops) != 3 || string(ops[2].KeyBytes()) != "callbacks/called-back" {
+				t.Fatalf("expected the callback's mark to be updated but saw %v", ops)
+			}
+			if ops[2].IsPut() != test.marked {
+				t.Errorf("expected the callback to be marked pending: %t", test.marked)
+			}
+		})
+	}
+}
+
+func TestCalculationStore_PendingCallbacks(t *testing.T) {
+	pending := store.Calculation{Name: "pending", Done: true}
+	value, err := json.Marshal(pending)
+	if err != nil {
+		t.Fatalf("unable to set up test: %s", err)
+	}
+
+	spy := NewETCDClientSpy()
+	spy.ReturnGetResponse = &clientv3.GetResponse{
+		Kvs: []*mvccpb.KeyValue{{Key: []byte("callbacks/pending")}},
+	}
+	spy.ShouldTxnIfSucceed = true
+	spy.ReturnTxnResponse = &clientv3.TxnResponse{
+		Succeeded: true,
+		Responses: []*etcdserverpb.ResponseOp{{
+			Response: &etcdserverpb.ResponseOp_ResponseRange{
+				ResponseRange: &etcdserverpb.RangeResponse{
+					Kvs: []*mvccpb.KeyValue{{Key: []byte(store.CalculationKey(pending)), Value: value, Version: 1}},
+				},
+			},
+		}},
+	}
+
+	client := store.NewCalculationStore(spy)
+	actual, next, err := client.PendingCallbacks(context.Background(), "", 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := "callbacks/"; len(spy.KeysSeenByGet) != 1 || spy.KeysSeenByGet[0] != expected {
+		t.Errorf("expected to list from %q but saw %v", expected, spy.KeysSeenByGet)
+	}
+
+	if len(actual) != 1 || actual[0].Name != "pending" {
+		t.Errorf("expected calculation pending but got %#v", actual)
+	}
+
+	if next != "" {
+		t.Errorf("expected no next page but got %q", next)
+	}
+}
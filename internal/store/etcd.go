@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
@@ -19,6 +18,7 @@ var (
 type etcdClient interface {
 	Get(context.Context, string, ...clientv3.OpOption) (*clientv3.GetResponse, error)
 	Put(context.Context, string, string, ...clientv3.OpOption) (*clientv3.PutResponse, error)
+	Delete(context.Context, string, ...clientv3.OpOption) (*clientv3.DeleteResponse, error)
 	Txn(context.Context) clientv3.Txn
 }
 
@@ -44,6 +44,7 @@ func (c *CalculationStore) Create(ctx context.Context, calculation Calculation)
 		clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
 	).Then(
 		clientv3.OpPut(key, string(value)),
+		notStartedOp(calculation),
 	).Commit()
 	if err != nil {
 		return fmt.Errorf("error writing key: %q: %w", key, err)
@@ -56,48 +57,6 @@ func (c *CalculationStore) Create(ctx context.Context, calculation Calculation)
 	return nil
 }
 
-// SetStartedAt records the Started time for the Calculation with the given name.
-func (c *CalculationStore) SetStartedTime(ctx context.Context, name string, t time.Time) error {
-	calculation := Calculation{Name: name}
-	key := CalculationKey(calculation)
-
-	getResp, err := c.cli.Get(ctx, key)
-	if err != nil {
-		return fmt.Errorf("unable to get calculation: %w", err)
-	}
-	if getResp.Count == 0 {
-		return fmt.Errorf("calculation %q does not exist", name)
-	}
-	if getResp.Count > 1 {
-		return fmt.Errorf("key %q is a prefix", key)
-	}
-
-	if err := json.Unmarshal(getResp.Kvs[0].Value, &calculation); err != nil {
-		return fmt.Errorf("error unmarshaling calculation %q: %s", name, err)
-	}
-	calculation.Metadata.Started = &t
-
-	update, err := json.Marshal(calculation)
-	if err != nil {
-		return fmt.Errorf("error marshaling updated calculation %q: %s", name, err)
-	}
-
-	resp, err := c.cli.Txn(ctx).If(
-		clientv3.Compare(clientv3.Version(key), "=", getResp.Kvs[0].Version),
-	).Then(
-		clientv3.OpPut(key, string(update)),
-	).Commit()
-	if err != nil {
-		return fmt.Errorf("error writing key %q: %w", key, err)
-	}
-
-	if !resp.Succeeded {
-		return ErrUpdateUnsuccessful
-	}
-
-	return nil
-}
-
 // Save saves or updates a Calculation in etcd.
 func (c *CalculationStore) Save(ctx context.Context, calculation Calculation) error {
 	key := CalculationKey(calculation)
@@ -113,7 +72,11 @@ func (c *CalculationStore) Save(ctx context.Context, calculation Calculation) er
 	}
 
 	if getResp.Count == 0 {
-		_, err := c.cli.Put(ctx, key, string(value))
+		_, err := c.cli.Txn(ctx).Then(
+			clientv3.OpPut(key, string(value)),
+			notStartedOp(calculation),
+			pendingCallbackOp(calculation),
+		).Commit()
 		if err != nil {
 			return fmt.Errorf("error writing key %q: %w", key, err)
 		}
@@ -132,6 +95,8 @@ func (c *CalculationStore) Save(ctx context.Context, calculation Calculation) er
 		clientv3.Compare(clientv3.Version(key), "=", calculation.Metadata.Version),
 	).Then(
 		clientv3.OpPut(key, string(value)),
+		notStartedOp(calculation),
+		pendingCallbackOp(calculation),
 	).Commit()
 	if err != nil {
 		return fmt.Errorf("transaction error: %w", err)
@@ -170,6 +135,46 @@ func (c *CalculationStore) Get(ctx context.Context, name string) (Calculation, e
 	return calc, err
 }
 
+// List returns up to limit calculations ordered by name, starting after the
+// calculation named after, or from the first when after is empty. It also
+// returns the name to list the next page after, which is empty when there are
+// no more calculations.
+func (c *CalculationStore) List(ctx context.Context, after string, limit int64) ([]Calculation, string, error) {
+	prefix := CalculationKey(Calculation{})
+
+	start := prefix
+	if after != "" {
+		// The smallest key sorting after the previous page's last key.
+		start = CalculationKey(Calculation{Name: after}) + "\x00"
+	}
+
+	getResp, err := c.cli.Get(ctx, start,
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)),
+		clientv3.WithLimit(limit),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing calculations: %w", err)
+	}
+
+	calculations := make([]Calculation, 0, len(getResp.Kvs))
+	for _, kv := range getResp.Kvs {
+		var calc Calculation
+		if err := json.Unmarshal(kv.Value, &calc); err != nil {
+			return nil, "", fmt.Errorf("error unmarshaling calculation at %q: %w", kv.Key, err)
+		}
+		calc.Metadata.Version = kv.Version
+		calculations = append(calculations, calc)
+	}
+
+	var next string
+	if getResp.More && len(calculations) > 0 {
+		next = calculations[len(calculations)-1].Name
+	}
+
+	return calculations, next, nil
+}
+
 func CalculationKey(calculation Calculation) string {
 	return fmt.Sprintf("calculations/%s", calculation.Name)
 }
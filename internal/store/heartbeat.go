@@ -0,0 +1,214 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// A worker running a calculation keeps two keys for it:
+//
+//	running/<name>     the job being run, kept until the worker stops it
+//	heartbeats/<name>  held by the worker's lease for as long as it is alive
+//
+// A running job without a heartbeat belongs to a worker that died.
+const (
+	runningPrefix   = "running/"
+	heartbeatPrefix = "heartbeats/"
+)
+
+type leasingEtcdClient interface {
+	etcdClient
+	Grant(context.Context, int64) (*clientv3.LeaseGrantResponse, error)
+	KeepAlive(context.Context, clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error)
+	Revoke(context.Context, clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error)
+}
+
+// RunningJob is the job of a calculation a worker has started.
+type RunningJob struct {
+	// Name is the name of the calculation the job is for.
+	Name string
+	// Payload is the job, as it would be published.
+	Payload json.RawMessage
+
+	// revision is the revision the job was last started at.
+	revision int64
+}
+
+// HeartbeatStore keeps track of the calculations workers are running, so that
+// those left behind by a worker that died can be found.
+type HeartbeatStore struct {
+	cli leasingEtcdClient
+}
+
+func NewHeartbeatStore(cli leasingEtcdClient) *HeartbeatStore {
+	return &HeartbeatStore{cli: cli}
+}
+
+// Start records that a worker is running the job for the named calculation and
+// keeps its heartbeat alive until the returned stop function is called or ctx
+// is done. The heartbeat expires ttl after the worker stops renewing it.
+func (h *HeartbeatStore) Start(ctx context.Context, name string, job json.RawMessage, ttl time.Duration) (func(context.Context) error, error) {
+	seconds := int64(ttl.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	lease, err := h.cli.Grant(ctx, seconds)
+	if err != nil {
+		return nil, fmt.Errorf("error granting heartbeat lease: %w", err)
+	}
+
+	running := runningPrefix + name
+	heartbeat := heartbeatPrefix + name
+
+	_, err = h.cli.Txn(ctx).Then(
+		clientv3.OpPut(running, string(job)),
+		clientv3.OpPut(heartbeat, "", clientv3.WithLease(lease.ID)),
+	).Commit()
+	if err != nil {
+		h.revoke(context.WithoutCancel(ctx), lease.ID)
+		return nil, fmt.Errorf("error writing heartbeat for %q: %w", name, err)
+	}
+
+	keepAliveCtx, cancel := context.WithCancel(ctx)
+
+	keepAlive, err := h.cli.KeepAlive(keepAliveCtx, lease.ID)
+	if err != nil {
+		cancel()
+		h.revoke(context.WithoutCancel(ctx), lease.ID)
+		return nil, fmt.Errorf("error keeping heartbeat alive for %q: %w", name, err)
+	}
+
+	go func() {
+		for range keepAlive {
+		}
+	}()
+
+	stop := func(ctx context.Context) error {
+		cancel()
+		defer h.revoke(ctx, lease.ID)
+
+		// Another worker may have taken over the calculation; leave its job
+		// and heartbeat alone.
+		_, err := h.cli.Txn(ctx).If(
+			clientv3.Compare(clientv3.LeaseValue(heartbeat), "=", lease.ID),
+		).Then(
+			clientv3.OpDelete(running),
+			clientv3.OpDelete(heartbeat),
+		).Commit()
+		if err != nil {
+			return fmt.Errorf("error removing heartbeat for %q: %w", name, err)
+		}
+
+		return nil
+	}
+
+	return stop, nil
+}
+
+func (h *HeartbeatStore) revoke(ctx context.Context, lease clientv3.LeaseID) {
+	if _, err := h.cli.Revoke(ctx, lease); err != nil {
+		log.Printf("error revoking heartbeat lease: %s", err)
+	}
+}
+
+// Stalled returns up to limit running jobs whose heartbeat has expired.
+func (h *HeartbeatStore) Stalled(ctx context.Context, limit int64) ([]RunningJob, error) {
+	heartbeats, err := h.cli.Get(ctx, heartbeatPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, fmt.Errorf("error getting heartbeats: %w", err)
+	}
+
+	alive := make(map[string]bool, len(heartbeats.Kvs))
+	for _, kv := range heartbeats.Kvs {
+		alive[strings.TrimPrefix(string(kv.Key), heartbeatPrefix)] = true
+	}
+
+	running, err := h.cli.Get(ctx, runningPrefix,
+		clientv3.WithPrefix(),
+		clientv3.WithLimit(int64(len(alive))+limit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting running jobs: %w", err)
+	}
+
+	var stalled []RunningJob
+	for _, kv := range running.Kvs {
+		name := strings.TrimPrefix(string(kv.Key), runningPrefix)
+		if alive[name] {
+			continue
+		}
+
+		stalled = append(stalled, RunningJob{
+			Name:     name,
+			Payload:  kv.Value,
+			revision: kv.ModRevision,
+		})
+		if int64(len(stalled)) == limit {
+			break
+		}
+	}
+
+	return stalled, nil
+}
+
+// Release forgets a stalled job once it has been dealt with. It returns
+// ErrUpdateUnsuccessful if a worker has started the job again since it stalled.
+func (h *HeartbeatStore) Release(ctx context.Context, job RunningJob) error {
+	running := runningPrefix + job.Name
+
+	resp, err := h.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(running), "=", job.revision),
+		clientv3.Compare(clientv3.CreateRevision(heartbeatPrefix+job.Name), "=", 0),
+	).Then(
+		clientv3.OpDelete(running),
+	).Commit()
+	if err != nil {
+		return fmt.Errorf("error releasing running job %q: %w", job.Name, err)
+	}
+
+	if !resp.Succeeded {
+		return ErrUpdateUnsuccessful
+	}
+
+	return nil
+}
+
+// Reap saves the calculation of a stalled job and forgets the job at once,
+// unless the calculation changed since it was read or a worker has started the
+// job again since it stalled, in which case it returns ErrUpdateUnsuccessful.
+func (h *HeartbeatStore) Reap(ctx context.Context, job RunningJob, calculation Calculation) error {
+	running := runningPrefix + job.Name
+	key := CalculationKey(calculation)
+
+	value, err := json.Marshal(calculation)
+	if err != nil {
+		return fmt.Errorf("unable to marshal calculation %q to JSON: %w", calculation.Name, err)
+	}
+
+	resp, err := h.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.Version(key), "=", calculation.Metadata.Version),
+		clientv3.Compare(clientv3.ModRevision(running), "=", job.revision),
+		clientv3.Compare(clientv3.CreateRevision(heartbeatPrefix+job.Name), "=", 0),
+	).Then(
+		clientv3.OpPut(key, string(value)),
+		clientv3.OpDelete(running),
+		notStartedOp(calculation),
+		pendingCallbackOp(calculation),
+	).Commit()
+	if err != nil {
+		return fmt.Errorf("error reaping running job %q: %w", job.Name, err)
+	}
+
+	if !resp.Succeeded {
+		return ErrUpdateUnsuccessful
+	}
+
+	return nil
+}
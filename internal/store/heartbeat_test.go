@@ -0,0 +1,164 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/store"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestIntegration_Heartbeats(t *testing.T) {
+	etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+	if etcdEndpoint == "" {
+		t.Skip(`set ETCD_ENDPOINT to run this test, e.g. ETCD_ENDPOINT="localhost:2379"`)
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdEndpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to set up client: %s", err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	heartbeats := store.NewHeartbeatStore(cli)
+
+	stalledFor := func(name string) (store.RunningJob, bool) {
+		t.Helper()
+		jobs, err := heartbeats.Stalled(ctx, 1000)
+		if err != nil {
+			t.Fatalf("unexpected error getting stalled jobs: %s", err)
+		}
+		for _, job := range jobs {
+			if job.Name == name {
+				return job, true
+			}
+		}
+		return store.RunningJob{}, false
+	}
+
+	t.Run("stopped", func(t *testing.T) {
+		name := uuid.NewString()
+
+		stop, err := heartbeats.Start(ctx, name, []byte(`{}`), time.Second)
+		if err != nil {
+			t.Fatalf("unexpected error starting heartbeat: %s", err)
+		}
+
+		// Outlive the lease to see that it is kept alive.
+		time.Sleep(2 * time.Second)
+		if _, ok := stalledFor(name); ok {
+			t.Error("expected the job not to stall while its heartbeat is kept")
+		}
+
+		if err := stop(ctx); err != nil {
+			t.Fatalf("unexpected error stopping heartbeat: %s", err)
+		}
+		if _, ok := stalledFor(name); ok {
+			t.Error("expected the stopped job to be forgotten")
+		}
+	})
+
+	t.Run("stalled", func(t *testing.T) {
+		name := uuid.NewString()
+
+		// A worker that dies stops renewing its heartbeat.
+		workerCtx, die := context.WithCancel(ctx)
+		if _, err := heartbeats.Start(workerCtx, name, []byte(`{"name":"job"}`), time.Second); err != nil {
+			t.Fatalf("unexpected error starting heartbeat: %s", err)
+		}
+		die()
+
+		var job store.RunningJob
+		var ok bool
+		for deadline := time.Now().Add(5 * time.Second); !ok && time.Now().Before(deadline); {
+			time.Sleep(250 * time.Millisecond)
+			job, ok = stalledFor(name)
+		}
+		if !ok {
+			t.Fatal("expected the job to stall once its heartbeat expired")
+		}
+
+		if string(job.Payload) != `{"name":"job"}` {
+			t.Errorf("unexpected payload: %s", job.Payload)
+		}
+
+		if err := heartbeats.Release(ctx, job); err != nil {
+			t.Fatalf("unexpected error releasing job: %s", err)
+		}
+		if _, ok := stalledFor(name); ok {
+			t.Error("expected the released job to be forgotten")
+		}
+
+		if err := heartbeats.Release(ctx, job); !errors.Is(err, store.ErrUpdateUnsuccessful) {
+			t.Errorf("expected releasing again to be unsuccessful but got %v", err)
+		}
+	})
+}
+
+// leasingClientSpy is an etcdClientSpy that can also be given leases.
+type leasingClientSpy struct {
+	*etcdClientSpy
+}
+
+func (s leasingClientSpy) Grant(context.Context, int64) (*clientv3.LeaseGrantResponse, error) {
+	return &clientv3.LeaseGrantResponse{ID: 1}, nil
+}
+
+func (s leasingClientSpy) KeepAlive(context.Context, clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	return make(chan *clientv3.LeaseKeepAliveResponse), nil
+}
+
+func (s leasingClientSpy) Revoke(context.Context, clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func TestHeartbeatStore_Reap(t *testing.T) {
+	for name, succeeded := range map[string]bool{"Reaped": true, "TakenOver": false} {
+		t.Run(name, func(t *testing.T) {
+			spy := NewETCDClientSpy()
+			spy.ShouldTxnIfSucceed = true
+			spy.ReturnTxnResponse = &clientv3.TxnResponse{Succeeded: succeeded}
+
+			calculation := store.Calculation{Name: "stalled", Metadata: store.CalculationMetadata{Version: 3}}
+
+			heartbeats := store.NewHeartbeatStore(leasingClientSpy{spy})
+			err := heartbeats.Reap(context.Background(), store.RunningJob{Name: "stalled"}, calculation)
+
+			if succeeded && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			} else if !succeeded && !errors.Is(err, store.ErrUpdateUnsuccessful) {
+				t.Fatalf("expected ErrUpdateUnsuccessful but got %v", err)
+			}
+
+			// The calculation must be unchanged, the job not started
+			// again and its worker still dead.
+			var keys []string
+			for _, cmp := range spy.ComparisonsSeenByIf {
+				keys = append(keys, string(cmp.Key))
+			}
+			expected := []string{store.CalculationKey(calculation), "running/stalled", "heartbeats/stalled"}
+			if !slices.Equal(keys, expected) {
+				t.Errorf("expected comparisons of %v but got %v", expected, keys)
+			}
+
+			ops := spy.OperationsSeenByThen
+			if len(ops) != 4 || !ops[0].IsPut() || string(ops[0].KeyBytes()) != store.CalculationKey(calculation) ||
+				!ops[1].IsDelete() || string(ops[1].KeyBytes()) != "running/stalled" ||
+				!ops[2].IsPut() || string(ops[2].KeyBytes()) != "notstarted/stalled" ||
+				!ops[3].IsDelete() || string(ops[3].KeyBytes()) != "callbacks/stalled" {
+				t.Errorf("expected the calculation to be saved and the job forgotten together but got %v", ops)
+			}
+		})
+	}
+}
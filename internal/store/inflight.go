@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Identical calculations in flight share the work of the first of them, the
+// primary. The others follow it and are completed with its outcome:
+//
+//	inflight/<key>                 the name of the primary calculating key
+//	followers/<primary>/<name>     a calculation following the primary
+//
+// Followers are only added while the primary is in flight, so once it is taken
+// out of flight its followers are all known.
+const (
+	inFlightPrefix = "inflight/"
+	followerPrefix = "followers/"
+)
+
+// maxCoalesceAttempts limits how many times CreateCoalesced retries when the
+// calculation in flight changes under it.
+const maxCoalesceAttempts = 5
+
+// CreateCoalesced creates a Calculation for the first time like Create, unless
+// an identical calculation with the same key is in flight. The calculation then
+// follows that one, recorded as its Primary. CreateCoalesced returns the name
+// of the primary calculation, which is the calculation's own name when it is
+// the one to run.
+func (c *CalculationStore) CreateCoalesced(ctx context.Context, calculation Calculation, key string) (string, error) {
+	calcKey := CalculationKey(calculation)
+	flightKey := inFlightPrefix + key
+
+	for attempt := 0; attempt < maxCoalesceAttempts; attempt++ {
+		flight, err := c.cli.Get(ctx, flightKey)
+		if err != nil {
+			return "", fmt.Errorf("error getting calculation in flight for %q: %w", key, err)
+		}
+
+		var primary string
+		var cmp clientv3.Cmp
+		if len(flight.Kvs) == 0 {
+			cmp = clientv3.Compare(clientv3.CreateRevision(flightKey), "=", 0)
+		} else {
+			primary = string(flight.Kvs[0].Value)
+			cmp = clientv3.Compare(clientv3.ModRevision(flightKey), "=", flight.Kvs[0].ModRevision)
+
+			// A primary that was done without landing, such as one that
+			// failed when its worker died, is replaced.
+			done, err := c.isDone(ctx, primary)
+			if err != nil {
+				return "", err
+			}
+			if done {
+				primary = ""
+			}
+		}
+
+		follow := calculation
+		follow.Metadata.Primary = primary
+
+		op := clientv3.OpPut(flightKey, calculation.Name)
+		if primary != "" {
+			op = clientv3.OpPut(FollowerKey(primary, calculation.Name), "")
+		}
+
+		value, err := json.Marshal(follow)
+		if err != nil {
+			return "", fmt.Errorf("unable to marshal calculation %q to JSON: %w", calculation.Name, err)
+		}
+
+		resp, err := c.cli.Txn(ctx).If(
+			clientv3.Compare(clientv3.CreateRevision(calcKey), "=", 0),
+			cmp,
+		).Then(
+			op,
+			clientv3.OpPut(calcKey, string(value)),
+			notStartedOp(follow),
+		).Else(
+			clientv3.OpGet(calcKey, clientv3.WithCountOnly()),
+		).Commit()
+		if err != nil {
+			return "", fmt.Errorf("error writing key: %q: %w", calcKey, err)
+		}
+
+		if resp.Succeeded && primary != "" {
+			return primary, nil
+		} else if resp.Succeeded {
+			return calculation.Name, nil
+		}
+
+		if resp.Responses[0].GetResponseRange().Count > 0 {
+			return "", ErrKeyAlreadyExists
+		}
+		// The calculation in flight changed since it was read; look again.
+	}
+
+	return "", fmt.Errorf("calculation in flight for %q kept changing: %w", key, ErrUpdateUnsuccessful)
+}
+
+// isDone reports whether the named calculation is done or no longer exists.
+func (c *CalculationStore) isDone(ctx context.Context, name string) (bool, error) {
+	calculation, err := c.Get(ctx, name)
+	if errors.Is(err, ErrKeyNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return calculation.Done, nil
+}
+
+// Land takes the named primary calculation out of flight for key, so that no
+// more calculations follow it, and returns the names of its followers. It may
+// be called again, such as by a worker that took the primary over, to get the
+// followers not yet forgotten.
+func (c *CalculationStore) Land(ctx context.Context, key, primary string) ([]string, error) {
+	flightKey := inFlightPrefix + key
+
+	_, err := c.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.Value(flightKey), "=", primary),
+	).Then(
+		clientv3.OpDelete(flightKey),
+	).Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error landing calculation %q: %w", primary, err)
+	}
+
+	prefix := FollowerKey(primary, "")
+	resp, err := c.cli.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, fmt.Errorf("error getting followers of %q: %w", primary, err)
+	}
+
+	followers := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		followers = append(followers, strings.TrimPrefix(string(kv.Key), prefix))
+	}
+
+	return followers, nil
+}
+
+// Unfollow forgets that the named calculation follows primary, once it has
+// been completed.
+func (c *CalculationStore) Unfollow(ctx context.Context, primary, name string) error {
+	if _, err := c.cli.Delete(ctx, FollowerKey(primary, name)); err != nil {
+		return fmt.Errorf("error forgetting follower %q of %q: %w", name, primary, err)
+	}
+
+	return nil
+}
+
+// FollowerKey is the key marking the named calculation as following primary.
+func FollowerKey(primary, name string) string {
+	return followerPrefix + primary + "/" + name
+}
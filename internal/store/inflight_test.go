@@ -0,0 +1,76 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/store"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestIntegration_CoalescedCalculations(t *testing.T) {
+	etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+	if etcdEndpoint == "" {
+		t.Skip(`set ETCD_ENDPOINT to run this test, e.g. ETCD_ENDPOINT="localhost:2379"`)
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdEndpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to set up client: %s", err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calculations := store.NewCalculationStore(cli)
+	key := uuid.NewString()
+
+	create := func() string {
+		t.Helper()
+		name := uuid.NewString()
+		primary, err := calculations.CreateCoalesced(ctx, store.Calculation{Name: name}, key)
+		if err != nil {
+			t.Fatalf("unexpected error creating calculation: %s", err)
+		}
+		return primary
+	}
+
+	first := create()
+	if second := create(); second != first {
+		t.Errorf("expected the second calculation to follow %s but it follows %s", first, second)
+	}
+
+	followers, err := calculations.Land(ctx, key, first)
+	if err != nil {
+		t.Fatalf("unexpected error landing calculation: %s", err)
+	}
+	if len(followers) != 1 {
+		t.Fatalf("expected 1 follower but got %v", followers)
+	}
+
+	follower, err := calculations.Get(ctx, followers[0])
+	if err != nil {
+		t.Fatalf("unexpected error getting follower: %s", err)
+	}
+	if follower.Metadata.Primary != first {
+		t.Errorf("expected the follower to record its primary %s but got %q", first, follower.Metadata.Primary)
+	}
+
+	if third := create(); third == first {
+		t.Error("expected a calculation created after landing not to follow the landed calculation")
+	}
+
+	if err := calculations.Unfollow(ctx, first, followers[0]); err != nil {
+		t.Fatalf("unexpected error forgetting follower: %s", err)
+	}
+	if followers, err := calculations.Land(ctx, key, first); err != nil || len(followers) != 0 {
+		t.Errorf("expected no followers left but got %v, %v", followers, err)
+	}
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Calculations neither started nor done are also marked under
+// notstarted/<name>, so the reconciler can find them without reading every
+// calculation. Each write of a calculation updates its mark in the same
+// transaction.
+const notStartedPrefix = "notstarted/"
+
+// notStartedOp marks the calculation as not started, or clears its mark once it
+// has started or is done.
+func notStartedOp(calculation Calculation) clientv3.Op {
+	key := notStartedPrefix + calculation.Name
+	if calculation.Done || calculation.Metadata.Started != nil {
+		return clientv3.OpDelete(key)
+	}
+	return clientv3.OpPut(key, "")
+}
+
+// NotStarted returns up to limit calculations neither started nor done, ordered
+// by name, starting after the calculation named after, or from the first when
+// after is empty. Like List, it also returns the name to list the next page
+// after, which is empty when there are no more calculations.
+func (c *CalculationStore) NotStarted(ctx context.Context, after string, limit int64) ([]Calculation, string, error) {
+	calculations, next, err := c.marked(ctx, notStartedPrefix, after, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing calculations not started: %w", err)
+	}
+	return calculations, next, nil
+}
+
+// marked returns up to limit calculations marked under prefix, ordered by name,
+// starting after the calculation named after, and the name to list the next
+// page after.
+func (c *CalculationStore) marked(ctx context.Context, prefix, after string, limit int64) ([]Calculation, string, error) {
+	start := prefix
+	if after != "" {
+		start = prefix + after + "\x00"
+	}
+
+	getResp, err := c.cli.Get(ctx, start,
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)),
+		clientv3.WithLimit(limit),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+		clientv3.WithKeysOnly(),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	names := make([]string, 0, len(getResp.Kvs))
+	for _, kv := range getResp.Kvs {
+		names = append(names, strings.TrimPrefix(string(kv.Key), prefix))
+	}
+
+	calculations, err := c.GetMany(ctx, names)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if getResp.More && len(names) > 0 {
+		next = names[len(names)-1]
+	}
+
+	return calculations, next, nil
+}
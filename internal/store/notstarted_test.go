@@ -0,0 +1,60 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/vickleford/calculator/internal/store"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestCalculationStore_NotStarted(t *testing.T) {
+	waiting := store.Calculation{Name: "waiting"}
+	value, err := json.Marshal(waiting)
+	if err != nil {
+		t.Fatalf("unable to set up test: %s", err)
+	}
+
+	spy := NewETCDClientSpy()
+	spy.ReturnGetResponse = &clientv3.GetResponse{
+		Kvs:  []*mvccpb.KeyValue{{Key: []byte("notstarted/waiting")}},
+		More: true,
+	}
+	spy.ShouldTxnIfSucceed = true
+	spy.ReturnTxnResponse = &clientv3.TxnResponse{
+		Succeeded: true,
+		Responses: []*etcdserverpb.ResponseOp{{
+			Response: &etcdserverpb.ResponseOp_ResponseRange{
+				ResponseRange: &etcdserverpb.RangeResponse{
+					Kvs: []*mvccpb.KeyValue{{Key: []byte(store.CalculationKey(waiting)), Value: value, Version: 1}},
+				},
+			},
+		}},
+	}
+
+	client := store.NewCalculationStore(spy)
+	actual, next, err := client.NotStarted(context.Background(), "previous", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := "notstarted/previous\x00"; len(spy.KeysSeenByGet) != 1 || spy.KeysSeenByGet[0] != expected {
+		t.Errorf("expected to list from %q but saw %v", expected, spy.KeysSeenByGet)
+	}
+
+	ops := spy.OperationsSeenByThen
+	if len(ops) != 1 || !ops[0].IsGet() || string(ops[0].KeyBytes()) != store.CalculationKey(waiting) {
+		t.Errorf("expected to get the calculation marked not started but saw %v", ops)
+	}
+
+	if len(actual) != 1 || actual[0].Name != "waiting" {
+		t.Errorf("expected calculation waiting but got %#v", actual)
+	}
+
+	if next != "waiting" {
+		t.Errorf("expected next page after %q but got %q", "waiting", next)
+	}
+}
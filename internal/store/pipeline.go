@@ -0,0 +1,165 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// Pipelines are kept under pipelines/<name>. Those not yet done are also
+// marked under activepipelines/<name> for the coordinator to find.
+const (
+	pipelinePrefix       = "pipelines/"
+	activePipelinePrefix = "activepipelines/"
+)
+
+// States of a pipeline step.
+const (
+	StepPending   = "pending"
+	StepRunning   = "running"
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+)
+
+// PipelineInput is an input to a pipeline step: either Value, or the result of
+// the step named Step reduced modulo Modulo when it is positive.
+type PipelineInput struct {
+	Value  int64  `json:"value,omitempty"`
+	Step   string `json:"step,omitempty"`
+	Modulo int64  `json:"modulo,omitempty"`
+}
+
+// PipelineStep is a FibonacciOf calculation in a pipeline.
+type PipelineStep struct {
+	ID       string        `json:"id"`
+	First    PipelineInput `json:"first"`
+	Second   PipelineInput `json:"second"`
+	Position PipelineInput `json:"position"`
+
+	State string `json:"state"`
+	// Operation is the name of the step's calculation once it is running.
+	Operation string `json:"operation,omitempty"`
+	// Result is the result of the calculation once the step succeeded.
+	Result int64 `json:"result,omitempty"`
+	// Error is why the step failed or was skipped.
+	Error *status.Status `json:"error,omitempty"`
+}
+
+// Pipeline is a group of calculations whose inputs may depend on each other's
+// results.
+type Pipeline struct {
+	Name    string         `json:"name"`
+	Created time.Time      `json:"created"`
+	Steps   []PipelineStep `json:"steps"`
+
+	// Done is set once every step is done. Error is the first step error when
+	// any step did not succeed.
+	Done      bool           `json:"done"`
+	Completed *time.Time     `json:"completed,omitempty"`
+	Error     *status.Status `json:"error,omitempty"`
+
+	// Version carries the version identifier stored of the Pipeline.
+	Version int64 `json:"-"`
+}
+
+// CreatePipeline creates a Pipeline for the first time and marks it active. If
+// it already exists, it returns ErrKeyAlreadyExists.
+func (c *CalculationStore) CreatePipeline(ctx context.Context, pipeline Pipeline) error {
+	key := PipelineKey(pipeline.Name)
+
+	value, err := json.Marshal(pipeline)
+	if err != nil {
+		return fmt.Errorf("unable to marshal pipeline %q to JSON: %w", pipeline.Name, err)
+	}
+
+	resp, err := c.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+	).Then(
+		clientv3.OpPut(key, string(value)),
+		clientv3.OpPut(activePipelinePrefix+pipeline.Name, ""),
+	).Commit()
+	if err != nil {
+		return fmt.Errorf("error writing key: %q: %w", key, err)
+	}
+
+	if !resp.Succeeded {
+		return ErrKeyAlreadyExists
+	}
+
+	return nil
+}
+
+// GetPipeline returns the pipeline with the given name, or ErrKeyNotFound.
+func (c *CalculationStore) GetPipeline(ctx context.Context, name string) (Pipeline, error) {
+	key := PipelineKey(name)
+
+	resp, err := c.cli.Get(ctx, key)
+	if err != nil {
+		return Pipeline{}, fmt.Errorf("error getting key %q: %w", key, err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return Pipeline{}, ErrKeyNotFound
+	}
+
+	var pipeline Pipeline
+	if err := json.Unmarshal(resp.Kvs[0].Value, &pipeline); err != nil {
+		return Pipeline{}, fmt.Errorf("error unmarshaling pipeline: %w", err)
+	}
+	pipeline.Version = resp.Kvs[0].Version
+
+	return pipeline, nil
+}
+
+// SavePipeline updates a Pipeline unless it changed since it was read, in which
+// case it returns ErrUpdateUnsuccessful. A pipeline saved as done is no longer
+// active.
+func (c *CalculationStore) SavePipeline(ctx context.Context, pipeline Pipeline) error {
+	key := PipelineKey(pipeline.Name)
+
+	value, err := json.Marshal(pipeline)
+	if err != nil {
+		return fmt.Errorf("unable to marshal pipeline %q to JSON: %w", pipeline.Name, err)
+	}
+
+	ops := []clientv3.Op{clientv3.OpPut(key, string(value))}
+	if pipeline.Done {
+		ops = append(ops, clientv3.OpDelete(activePipelinePrefix+pipeline.Name))
+	}
+
+	resp, err := c.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.Version(key), "=", pipeline.Version),
+	).Then(ops...).Commit()
+	if err != nil {
+		return fmt.Errorf("transaction error: %w", err)
+	} else if !resp.Succeeded {
+		return ErrUpdateUnsuccessful
+	}
+
+	return nil
+}
+
+// ActivePipelines returns the names of the pipelines not yet done.
+func (c *CalculationStore) ActivePipelines(ctx context.Context) ([]string, error) {
+	resp, err := c.cli.Get(ctx, activePipelinePrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, fmt.Errorf("error getting active pipelines: %w", err)
+	}
+
+	names := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		names = append(names, strings.TrimPrefix(string(kv.Key), activePipelinePrefix))
+	}
+
+	return names, nil
+}
+
+func PipelineKey(name string) string {
+	return pipelinePrefix + name
+}
@@ -0,0 +1,77 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/store"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestIntegration_Pipelines(t *testing.T) {
+	etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+	if etcdEndpoint == "" {
+		t.Skip(`set ETCD_ENDPOINT to run this test, e.g. ETCD_ENDPOINT="localhost:2379"`)
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdEndpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to set up client: %s", err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipelines := store.NewCalculationStore(cli)
+
+	pipeline := store.Pipeline{
+		Name:    uuid.NewString(),
+		Created: time.Now(),
+		Steps:   []store.PipelineStep{{ID: "a", State: store.StepPending}},
+	}
+	if err := pipelines.CreatePipeline(ctx, pipeline); err != nil {
+		t.Fatalf("unexpected error creating pipeline: %s", err)
+	}
+	if err := pipelines.CreatePipeline(ctx, pipeline); !errors.Is(err, store.ErrKeyAlreadyExists) {
+		t.Errorf("expected creating the pipeline again to fail but got %v", err)
+	}
+
+	active, err := pipelines.ActivePipelines(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting active pipelines: %s", err)
+	}
+	if !slices.Contains(active, pipeline.Name) {
+		t.Errorf("expected %s to be active but got %v", pipeline.Name, active)
+	}
+
+	got, err := pipelines.GetPipeline(ctx, pipeline.Name)
+	if err != nil {
+		t.Fatalf("unexpected error getting pipeline: %s", err)
+	}
+
+	stale := got
+	got.Done = true
+	if err := pipelines.SavePipeline(ctx, got); err != nil {
+		t.Fatalf("unexpected error saving pipeline: %s", err)
+	}
+	if err := pipelines.SavePipeline(ctx, stale); !errors.Is(err, store.ErrUpdateUnsuccessful) {
+		t.Errorf("expected saving a stale pipeline to fail but got %v", err)
+	}
+
+	active, err = pipelines.ActivePipelines(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting active pipelines: %s", err)
+	}
+	if slices.Contains(active, pipeline.Name) {
+		t.Errorf("expected %s to no longer be active once done", pipeline.Name)
+	}
+}
@@ -0,0 +1,287 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Schedules are kept under schedules/<name>. Those that fire again are also
+// marked under schedulesdue/<next run>/<name>, so that the schedules due can be
+// found without reading every schedule.
+const (
+	schedulePrefix    = "schedules/"
+	scheduleDuePrefix = "schedulesdue/"
+)
+
+// CalculationTemplate is the FibonacciOf calculation a Schedule starts.
+type CalculationTemplate struct {
+	First    int64 `json:"first"`
+	Second   int64 `json:"second"`
+	Position int64 `json:"position"`
+	Priority uint8 `json:"priority,omitempty"`
+}
+
+// Schedule starts a calculation every time its cron expression fires.
+type Schedule struct {
+	Name     string              `json:"name"`
+	Cron     string              `json:"cron"`
+	Template CalculationTemplate `json:"template"`
+	Created  time.Time           `json:"created"`
+	// Next is when the schedule next starts a calculation.
+	Next time.Time `json:"next"`
+	// Runs are the names of the calculations most recently started, newest
+	// first.
+	Runs []string `json:"runs,omitempty"`
+
+	// Version carries the version identifier stored of the Schedule.
+	Version int64 `json:"-"`
+}
+
+// CreateSchedule creates a Schedule for the first time. If it already exists,
+// it returns ErrKeyAlreadyExists.
+func (c *CalculationStore) CreateSchedule(ctx context.Context, schedule Schedule) error {
+	key := ScheduleKey(schedule.Name)
+
+	value, err := json.Marshal(schedule)
+	if err != nil {
+		return fmt.Errorf("unable to marshal schedule %q to JSON: %w", schedule.Name, err)
+	}
+
+	ops := []clientv3.Op{clientv3.OpPut(key, string(value))}
+	if !schedule.Next.IsZero() {
+		ops = append(ops, clientv3.OpPut(scheduleDueKey(schedule.Name, schedule.Next), ""))
+	}
+
+	resp, err := c.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+	).Then(ops...).Commit()
+	if err != nil {
+		return fmt.Errorf("error writing key: %q: %w", key, err)
+	}
+
+	if !resp.Succeeded {
+		return ErrKeyAlreadyExists
+	}
+
+	return nil
+}
+
+// RunSchedule saves a Schedule that was due at due along with the Calculation
+// it starts, unless the schedule changed or was deleted since it was read, in
+// which case it returns ErrUpdateUnsuccessful and neither is saved.
+func (c *CalculationStore) RunSchedule(ctx context.Context, schedule Schedule, due time.Time, calculation Calculation) error {
+	key := ScheduleKey(schedule.Name)
+	calcKey := CalculationKey(calculation)
+
+	value, err := json.Marshal(schedule)
+	if err != nil {
+		return fmt.Errorf("unable to marshal schedule %q to JSON: %w", schedule.Name, err)
+	}
+
+	calcValue, err := json.Marshal(calculation)
+	if err != nil {
+		return fmt.Errorf("unable to marshal calculation %q to JSON: %w", calculation.Name, err)
+	}
+
+	ops := []clientv3.Op{
+		clientv3.OpPut(key, string(value)),
+		clientv3.OpDelete(scheduleDueKey(schedule.Name, due)),
+		clientv3.OpPut(calcKey, string(calcValue)),
+		notStartedOp(calculation),
+	}
+	if !schedule.Next.IsZero() {
+		ops = append(ops, clientv3.OpPut(scheduleDueKey(schedule.Name, schedule.Next), ""))
+	}
+
+	resp, err := c.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.Version(key), "=", schedule.Version),
+		clientv3.Compare(clientv3.CreateRevision(calcKey), "=", 0),
+	).Then(ops...).Commit()
+	if err != nil {
+		return fmt.Errorf("transaction error: %w", err)
+	} else if !resp.Succeeded {
+		return ErrUpdateUnsuccessful
+	}
+
+	return nil
+}
+
+// DueSchedules returns up to limit schedules due to run at now, earliest
+// first, and whether more are due beyond them. Marks left behind by schedules
+// that were deleted or have run since are cleared along the way, so fewer than
+// limit schedules may be returned even when more are due.
+func (c *CalculationStore) DueSchedules(ctx context.Context, now time.Time, limit int64) ([]Schedule, bool, error) {
+	// Keys sort by time, so everything before the first key not yet due is due.
+	end := scheduleDueTimeKey(now.Add(time.Nanosecond))
+
+	resp, err := c.cli.Get(ctx, scheduleDuePrefix,
+		clientv3.WithRange(end),
+		clientv3.WithLimit(limit),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+		clientv3.WithKeysOnly(),
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting due schedules: %w", err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, false, nil
+	}
+
+	ops := make([]clientv3.Op, 0, len(resp.Kvs))
+	dues := make([]time.Time, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		name, due, err := parseScheduleDueKey(string(kv.Key))
+		if err != nil {
+			return nil, false, err
+		}
+		ops = append(ops, clientv3.OpGet(ScheduleKey(name)))
+		dues = append(dues, due)
+	}
+
+	got, err := c.cli.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting due schedules: %w", err)
+	}
+
+	schedules := make([]Schedule, 0, len(resp.Kvs))
+	var stale []clientv3.Op
+	for i, r := range got.Responses {
+		kvs := r.GetResponseRange().Kvs
+		if len(kvs) == 0 {
+			stale = append(stale, clientv3.OpDelete(string(resp.Kvs[i].Key)))
+			continue
+		}
+
+		var schedule Schedule
+		if err := json.Unmarshal(kvs[0].Value, &schedule); err != nil {
+			return nil, false, fmt.Errorf("error unmarshaling schedule at %q: %w", kvs[0].Key, err)
+		}
+		schedule.Version = kvs[0].Version
+
+		if !schedule.Next.Equal(dues[i]) {
+			stale = append(stale, clientv3.OpDelete(string(resp.Kvs[i].Key)))
+			continue
+		}
+
+		schedules = append(schedules, schedule)
+	}
+
+	if len(stale) > 0 {
+		if _, err := c.cli.Txn(ctx).Then(stale...).Commit(); err != nil {
+			return nil, false, fmt.Errorf("error clearing stale due schedules: %w", err)
+		}
+	}
+
+	return schedules, resp.More, nil
+}
+
+// ListSchedules returns up to limit schedules ordered by name, starting after
+// the schedule named after, or from the first when after is empty. It also
+// returns the name to list the next page after, which is empty when there are
+// no more schedules.
+func (c *CalculationStore) ListSchedules(ctx context.Context, after string, limit int64) ([]Schedule, string, error) {
+	start := schedulePrefix
+	if after != "" {
+		// The smallest key sorting after the previous page's last key.
+		start = ScheduleKey(after) + "\x00"
+	}
+
+	resp, err := c.cli.Get(ctx, start,
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(schedulePrefix)),
+		clientv3.WithLimit(limit),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing schedules: %w", err)
+	}
+
+	schedules := make([]Schedule, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var schedule Schedule
+		if err := json.Unmarshal(kv.Value, &schedule); err != nil {
+			return nil, "", fmt.Errorf("error unmarshaling schedule at %q: %w", kv.Key, err)
+		}
+		schedule.Version = kv.Version
+		schedules = append(schedules, schedule)
+	}
+
+	var next string
+	if resp.More && len(schedules) > 0 {
+		next = schedules[len(schedules)-1].Name
+	}
+
+	return schedules, next, nil
+}
+
+// DeleteSchedule deletes the named schedule, or returns ErrKeyNotFound if there
+// is none.
+func (c *CalculationStore) DeleteSchedule(ctx context.Context, name string) error {
+	key := ScheduleKey(name)
+
+	getResp, err := c.cli.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error getting key %q: %w", key, err)
+	}
+
+	if len(getResp.Kvs) == 0 {
+		return ErrKeyNotFound
+	}
+
+	var schedule Schedule
+	if err := json.Unmarshal(getResp.Kvs[0].Value, &schedule); err != nil {
+		return fmt.Errorf("error unmarshaling schedule: %w", err)
+	}
+
+	// Should the schedule run in the meantime, DueSchedules clears its new
+	// mark once it finds the schedule gone.
+	ops := []clientv3.Op{clientv3.OpDelete(key)}
+	if !schedule.Next.IsZero() {
+		ops = append(ops, clientv3.OpDelete(scheduleDueKey(name, schedule.Next)))
+	}
+
+	resp, err := c.cli.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return fmt.Errorf("error deleting key %q: %w", key, err)
+	}
+
+	if resp.Responses[0].GetResponseDeleteRange().Deleted == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+func ScheduleKey(name string) string {
+	return schedulePrefix + name
+}
+
+// scheduleDueKey marks the named schedule as due at next. Keys sort by when the
+// schedule is due.
+func scheduleDueKey(name string, next time.Time) string {
+	return scheduleDueTimeKey(next) + "/" + name
+}
+
+func scheduleDueTimeKey(t time.Time) string {
+	// Zero padded so that lexical order is chronological order.
+	return fmt.Sprintf("%s%020d", scheduleDuePrefix, t.UnixNano())
+}
+
+func parseScheduleDueKey(key string) (string, time.Time, error) {
+	timestamp, name, ok := strings.Cut(strings.TrimPrefix(key, scheduleDuePrefix), "/")
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("malformed due schedule key %q", key)
+	}
+
+	var nanos int64
+	if _, err := fmt.Sscanf(timestamp, "%d", &nanos); err != nil {
+		return "", time.Time{}, fmt.Errorf("malformed time in due schedule key %q: %w", key, err)
+	}
+
+	return name, time.Unix(0, nanos), nil
+}
@@ -0,0 +1,143 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/store"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestIntegration_Schedules(t *testing.T) {
+	etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+	if etcdEndpoint == "" {
+		t.Skip(`set ETCD_ENDPOINT to run this test, e.g. ETCD_ENDPOINT="localhost:2379"`)
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdEndpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to set up client: %s", err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	schedules := store.NewCalculationStore(cli)
+
+	now := time.Now().UTC()
+	schedule := store.Schedule{Name: uuid.NewString(), Cron: "@daily", Created: now, Next: now.Add(-time.Minute)}
+	if err := schedules.CreateSchedule(ctx, schedule); err != nil {
+		t.Fatalf("unexpected error creating schedule: %s", err)
+	}
+	if err := schedules.CreateSchedule(ctx, schedule); !errors.Is(err, store.ErrKeyAlreadyExists) {
+		t.Errorf("expected creating the schedule again to fail but got %v", err)
+	}
+
+	var found store.Schedule
+	var after string
+	for {
+		page, next, err := schedules.ListSchedules(ctx, after, 10)
+		if err != nil {
+			t.Fatalf("unexpected error listing schedules: %s", err)
+		}
+		for _, s := range page {
+			if s.Name == schedule.Name {
+				found = s
+			}
+		}
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if found.Name == "" {
+		t.Fatalf("expected to list schedule %s", schedule.Name)
+	}
+
+	due, _, err := schedules.DueSchedules(ctx, schedule.Next, 1000)
+	if err != nil {
+		t.Fatalf("unexpected error getting due schedules: %s", err)
+	}
+	if !slices.ContainsFunc(due, func(s store.Schedule) bool { return s.Name == schedule.Name }) {
+		t.Fatalf("expected schedule %s to be due at %s", schedule.Name, schedule.Next)
+	}
+
+	stale := found
+	run := store.Calculation{Name: uuid.NewString()}
+	found.Runs = []string{run.Name}
+	found.Next = schedule.Next.Add(24 * time.Hour)
+	if err := schedules.RunSchedule(ctx, found, schedule.Next, run); err != nil {
+		t.Fatalf("unexpected error running schedule: %s", err)
+	}
+	if _, err := schedules.Get(ctx, run.Name); err != nil {
+		t.Errorf("expected the run's calculation to be created but got %v", err)
+	}
+	if err := schedules.RunSchedule(ctx, stale, schedule.Next, store.Calculation{Name: uuid.NewString()}); !errors.Is(err, store.ErrUpdateUnsuccessful) {
+		t.Errorf("expected running a stale schedule to fail but got %v", err)
+	}
+
+	due, _, err = schedules.DueSchedules(ctx, schedule.Next, 1000)
+	if err != nil {
+		t.Fatalf("unexpected error getting due schedules: %s", err)
+	}
+	if slices.ContainsFunc(due, func(s store.Schedule) bool { return s.Name == schedule.Name }) {
+		t.Errorf("expected schedule %s to no longer be due once it ran", schedule.Name)
+	}
+
+	if err := schedules.DeleteSchedule(ctx, schedule.Name); err != nil {
+		t.Fatalf("unexpected error deleting schedule: %s", err)
+	}
+	if err := schedules.DeleteSchedule(ctx, schedule.Name); !errors.Is(err, store.ErrKeyNotFound) {
+		t.Errorf("expected deleting the schedule again not to find it but got %v", err)
+	}
+}
+
+func TestCalculationStore_RunSchedule(t *testing.T) {
+	due := time.Date(2024, 7, 15, 9, 0, 0, 0, time.UTC)
+	schedule := store.Schedule{Name: "daily", Cron: "@daily", Next: due.Add(24 * time.Hour), Version: 4}
+	calculation := store.Calculation{Name: "run"}
+
+	spy := NewETCDClientSpy()
+	spy.ShouldTxnIfSucceed = true
+	spy.ReturnTxnResponse = &clientv3.TxnResponse{Succeeded: true}
+
+	if err := store.NewCalculationStore(spy).RunSchedule(context.Background(), schedule, due, calculation); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var keys []string
+	for _, cmp := range spy.ComparisonsSeenByIf {
+		keys = append(keys, string(cmp.Key))
+	}
+	if expected := []string{store.ScheduleKey("daily"), store.CalculationKey(calculation)}; !slices.Equal(keys, expected) {
+		t.Errorf("expected comparisons of %v but got %v", expected, keys)
+	}
+
+	var writes []string
+	for _, op := range spy.OperationsSeenByThen {
+		kind := "put"
+		if op.IsDelete() {
+			kind = "delete"
+		}
+		writes = append(writes, kind+" "+string(op.KeyBytes()))
+	}
+	expected := []string{
+		"put schedules/daily",
+		"delete schedulesdue/01721034000000000000/daily",
+		"put calculations/run",
+		"put notstarted/run",
+		"put schedulesdue/01721120400000000000/daily",
+	}
+	if !slices.Equal(writes, expected) {
+		t.Errorf("expected the schedule and its calculation to be written together as %v but got %v", expected, writes)
+	}
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const resultPrefix = "results/"
+
+// ResultStore caches calculation results by key, each for a TTL after it is
+// put. Results put close together share a lease, so that caching many results
+// does not grant as many leases.
+type ResultStore struct {
+	cli   leasingEtcdClient
+	ttl   time.Duration
+	clock clock.Clock
+
+	mu sync.Mutex
+	// lease expires the results put until reuseUntil.
+	lease      clientv3.LeaseID
+	reuseUntil time.Time
+}
+
+type ResultStoreOption func(*ResultStore)
+
+// WithResultClock tells the time with clk when deciding whether to share a
+// lease.
+func WithResultClock(clk clock.Clock) ResultStoreOption {
+	return func(r *ResultStore) {
+		r.clock = clk
+	}
+}
+
+func NewResultStore(cli leasingEtcdClient, ttl time.Duration, opts ...ResultStoreOption) *ResultStore {
+	r := &ResultStore{cli: cli, ttl: ttl, clock: clock.Real{}}
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	return r
+}
+
+// Get returns the result cached for key, and false if there is none.
+func (r *ResultStore) Get(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	resp, err := r.cli.Get(ctx, resultPrefix+key)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting cached result %q: %w", key, err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, false, nil
+	}
+
+	return resp.Kvs[0].Value, true, nil
+}
+
+// Put caches result for key. It expires after the store's TTL, or up to a tenth
+// of it later, since it shares its lease with the results put around then.
+func (r *ResultStore) Put(ctx context.Context, key string, result json.RawMessage) error {
+	lease, err := r.leaseFor(ctx)
+	if err != nil {
+		return fmt.Errorf("error granting lease for cached result %q: %w", key, err)
+	}
+
+	_, err = r.cli.Put(ctx, resultPrefix+key, string(result), clientv3.WithLease(lease))
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		// The shared lease is gone, such as when etcd lost it; grant another.
+		r.forget(lease)
+		if lease, err = r.leaseFor(ctx); err != nil {
+			return fmt.Errorf("error granting lease for cached result %q: %w", key, err)
+		}
+		_, err = r.cli.Put(ctx, resultPrefix+key, string(result), clientv3.WithLease(lease))
+	}
+	if err != nil {
+		return fmt.Errorf("error caching result %q: %w", key, err)
+	}
+
+	return nil
+}
+
+// leaseFor returns the lease to put a result with now, granting a new one when
+// the last has been used for a tenth of the TTL. Each lease lasts that much
+// longer than the TTL so every result lives for at least the TTL.
+func (r *ResultStore) leaseFor(ctx context.Context) (clientv3.LeaseID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	if r.lease != clientv3.NoLease && now.Before(r.reuseUntil) {
+		return r.lease, nil
+	}
+
+	reuse := max(r.ttl/10, time.Second)
+	seconds := int64(math.Ceil((r.ttl + reuse).Seconds()))
+
+	lease, err := r.cli.Grant(ctx, seconds)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+
+	r.lease = lease.ID
+	r.reuseUntil = now.Add(reuse)
+
+	return r.lease, nil
+}
+
+// forget stops reusing lease.
+func (r *ResultStore) forget(lease clientv3.LeaseID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lease == lease {
+		r.lease = clientv3.NoLease
+	}
+}
@@ -0,0 +1,144 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/clock/clocktest"
+	"github.com/vickleford/calculator/internal/store"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestIntegration_ResultStore(t *testing.T) {
+	etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+	if etcdEndpoint == "" {
+		t.Skip(`set ETCD_ENDPOINT to run this test, e.g. ETCD_ENDPOINT="localhost:2379"`)
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdEndpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to set up client: %s", err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	results := store.NewResultStore(cli, time.Second)
+	key := uuid.NewString()
+
+	if _, ok, err := results.Get(ctx, key); err != nil || ok {
+		t.Fatalf("expected no result but got %t, %v", ok, err)
+	}
+
+	if err := results.Put(ctx, key, []byte(`{"result":3}`)); err != nil {
+		t.Fatalf("unexpected error putting result: %s", err)
+	}
+
+	result, ok, err := results.Get(ctx, key)
+	if err != nil || !ok {
+		t.Fatalf("expected the result to be cached but got %t, %v", ok, err)
+	}
+	if string(result) != `{"result":3}` {
+		t.Errorf("unexpected result: %s", result)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ok && time.Now().Before(deadline); {
+		time.Sleep(250 * time.Millisecond)
+		_, ok, _ = results.Get(ctx, key)
+	}
+	if ok {
+		t.Error("expected the result to expire after its TTL")
+	}
+}
+
+// grantCountingSpy is a leasingClientSpy counting the leases granted, whose
+// first puts fail as if their lease were gone.
+type grantCountingSpy struct {
+	leasingClientSpy
+	grants     []int64
+	lostLeases int
+}
+
+func (s *grantCountingSpy) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	s.grants = append(s.grants, ttl)
+	return &clientv3.LeaseGrantResponse{ID: clientv3.LeaseID(len(s.grants))}, nil
+}
+
+func (s *grantCountingSpy) Put(ctx context.Context, key, value string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	if s.lostLeases > 0 {
+		s.lostLeases--
+		return nil, rpctypes.ErrLeaseNotFound
+	}
+	return s.leasingClientSpy.Put(ctx, key, value, opts...)
+}
+
+func TestResultStore_SharesLeases(t *testing.T) {
+	spy := &grantCountingSpy{leasingClientSpy: leasingClientSpy{NewETCDClientSpy()}}
+	results := store.NewResultStore(spy, time.Minute)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := results.Put(context.Background(), key, []byte(`{"result":1}`)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if len(spy.grants) != 1 {
+		t.Fatalf("expected 1 lease for results put together but saw %d", len(spy.grants))
+	}
+	if spy.grants[0] != 66 {
+		t.Errorf("expected the lease to outlast the TTL by a tenth but it lasts %ds", spy.grants[0])
+	}
+	if len(spy.WritesSeenByPut) != 3 {
+		t.Errorf("expected 3 results to be cached but saw %d", len(spy.WritesSeenByPut))
+	}
+}
+
+func TestResultStore_GrantsAnotherLeaseOnceTheLastIsUsedForATenthOfTheTTL(t *testing.T) {
+	spy := &grantCountingSpy{leasingClientSpy: leasingClientSpy{NewETCDClientSpy()}}
+	clk := clocktest.NewFake(time.Now())
+	results := store.NewResultStore(spy, time.Minute, store.WithResultClock(clk))
+
+	put := func(key string) {
+		t.Helper()
+		if err := results.Put(context.Background(), key, []byte(`{"result":1}`)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	put("a")
+	clk.Advance(5 * time.Second)
+	put("b")
+	if len(spy.grants) != 1 {
+		t.Fatalf("expected results put within a tenth of the TTL to share a lease but saw %d", len(spy.grants))
+	}
+
+	clk.Advance(time.Second)
+	put("c")
+	if len(spy.grants) != 2 {
+		t.Errorf("expected another lease after a tenth of the TTL but saw %d", len(spy.grants))
+	}
+}
+
+func TestResultStore_GrantsAnotherLeaseWhenItIsLost(t *testing.T) {
+	spy := &grantCountingSpy{leasingClientSpy: leasingClientSpy{NewETCDClientSpy()}, lostLeases: 1}
+	results := store.NewResultStore(spy, time.Minute)
+
+	if err := results.Put(context.Background(), "a", []byte(`{"result":1}`)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(spy.grants) != 2 {
+		t.Errorf("expected another lease after losing the first but saw %d", len(spy.grants))
+	}
+	if _, ok := spy.WritesSeenByPut["results/a"]; !ok {
+		t.Error("expected the result to be cached")
+	}
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const scheduledPrefix = "scheduled/"
+
+// ScheduledJob is a job held back until its calculation is due to start.
+type ScheduledJob struct {
+	// Name is the name of the calculation the job is for.
+	Name string
+	// NotBefore is the earliest time the job may be published.
+	NotBefore time.Time
+	// Payload is the job to publish.
+	Payload json.RawMessage
+}
+
+// CreateScheduled creates a Calculation whose job is held back until the
+// calculation's scheduled time. Like Create, it returns ErrKeyAlreadyExists if
+// the calculation already exists.
+func (c *CalculationStore) CreateScheduled(ctx context.Context, calculation Calculation, job json.RawMessage) error {
+	if calculation.Metadata.Scheduled == nil {
+		return fmt.Errorf("calculation %q has no scheduled time", calculation.Name)
+	}
+
+	key := CalculationKey(calculation)
+
+	value, err := json.Marshal(calculation)
+	if err != nil {
+		return fmt.Errorf("unable to marshal calculation %q to JSON: %w", calculation.Name, err)
+	}
+
+	scheduled := ScheduledJob{
+		Name:      calculation.Name,
+		NotBefore: *calculation.Metadata.Scheduled,
+		Payload:   job,
+	}
+
+	resp, err := c.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+	).Then(
+		clientv3.OpPut(key, string(value)),
+		clientv3.OpPut(ScheduledJobKey(scheduled), string(job)),
+		notStartedOp(calculation),
+	).Commit()
+	if err != nil {
+		return fmt.Errorf("error writing key: %q: %w", key, err)
+	}
+
+	if !resp.Succeeded {
+		return ErrKeyAlreadyExists
+	}
+
+	return nil
+}
+
+// DueJobs returns up to limit scheduled jobs that may be published at now,
+// earliest first.
+func (c *CalculationStore) DueJobs(ctx context.Context, now time.Time, limit int64) ([]ScheduledJob, error) {
+	// Keys sort by time, so everything before the first key not yet due is due.
+	end := scheduledTimeKey(now.Add(time.Nanosecond))
+
+	getResp, err := c.cli.Get(ctx, scheduledPrefix,
+		clientv3.WithRange(end),
+		clientv3.WithLimit(limit),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting due jobs: %w", err)
+	}
+
+	jobs := make([]ScheduledJob, 0, len(getResp.Kvs))
+	for _, kv := range getResp.Kvs {
+		job, err := parseScheduledJobKey(string(kv.Key))
+		if err != nil {
+			return nil, err
+		}
+		job.Payload = kv.Value
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// DeleteScheduled removes a scheduled job once it has been published.
+func (c *CalculationStore) DeleteScheduled(ctx context.Context, job ScheduledJob) error {
+	key := ScheduledJobKey(job)
+	if _, err := c.cli.Delete(ctx, key); err != nil {
+		return fmt.Errorf("error deleting key %q: %w", key, err)
+	}
+
+	return nil
+}
+
+// ScheduledJobKey is the key of a scheduled job. Keys sort by when the job is
+// due.
+func ScheduledJobKey(job ScheduledJob) string {
+	return scheduledTimeKey(job.NotBefore) + "/" + job.Name
+}
+
+func scheduledTimeKey(t time.Time) string {
+	// Zero padded so that lexical order is chronological order.
+	return fmt.Sprintf("%s%020d", scheduledPrefix, t.UnixNano())
+}
+
+func parseScheduledJobKey(key string) (ScheduledJob, error) {
+	var job ScheduledJob
+
+	timestamp, name, ok := strings.Cut(strings.TrimPrefix(key, scheduledPrefix), "/")
+	if !ok {
+		return job, fmt.Errorf("malformed scheduled job key %q", key)
+	}
+
+	var nanos int64
+	if _, err := fmt.Sscanf(timestamp, "%d", &nanos); err != nil {
+		return job, fmt.Errorf("malformed time in scheduled job key %q: %w", key, err)
+	}
+
+	job.Name = name
+	job.NotBefore = time.Unix(0, nanos)
+
+	return job, nil
+}
@@ -0,0 +1,138 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/store"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestCreateScheduled(t *testing.T) {
+	scheduled := time.Now().Add(time.Hour)
+	calculation := store.Calculation{
+		Name: uuid.NewString(),
+		Metadata: store.CalculationMetadata{
+			Created:   time.Now(),
+			Scheduled: &scheduled,
+		},
+	}
+	job := json.RawMessage(`{"operation_name":"george"}`)
+
+	spy := NewETCDClientSpy()
+	spy.ShouldTxnIfSucceed = true
+	spy.ReturnTxnResponse = &clientv3.TxnResponse{Succeeded: true}
+
+	client := store.NewCalculationStore(spy)
+	if err := client.CreateScheduled(context.Background(), calculation, job); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if len(spy.OperationsSeenByThen) != 3 {
+		t.Fatalf("expected 3 operations but saw %d", len(spy.OperationsSeenByThen))
+	}
+
+	if key := string(spy.OperationsSeenByThen[0].KeyBytes()); key != store.CalculationKey(calculation) {
+		t.Errorf("expected the calculation to be written first but saw %q", key)
+	}
+
+	expectedKey := store.ScheduledJobKey(store.ScheduledJob{Name: calculation.Name, NotBefore: scheduled})
+	actual := spy.OperationsSeenByThen[1]
+	if key := string(actual.KeyBytes()); key != expectedKey {
+		t.Errorf("expected key %q but saw %q", expectedKey, key)
+	}
+	if value := string(actual.ValueBytes()); value != string(job) {
+		t.Errorf("expected the job to be written but saw %q", value)
+	}
+}
+
+func TestCreateScheduled_WhenKeyAlreadyExists(t *testing.T) {
+	scheduled := time.Now().Add(time.Hour)
+	calculation := store.Calculation{
+		Name:     uuid.NewString(),
+		Metadata: store.CalculationMetadata{Scheduled: &scheduled},
+	}
+
+	spy := NewETCDClientSpy()
+	spy.ReturnTxnResponse = &clientv3.TxnResponse{Succeeded: false}
+
+	client := store.NewCalculationStore(spy)
+	err := client.CreateScheduled(context.Background(), calculation, json.RawMessage(`{}`))
+	if !errors.Is(err, store.ErrKeyAlreadyExists) {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestCreateScheduled_RequiresScheduledTime(t *testing.T) {
+	client := store.NewCalculationStore(NewETCDClientSpy())
+	err := client.CreateScheduled(context.Background(), store.Calculation{Name: "george"}, nil)
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestDueJobs(t *testing.T) {
+	due := store.ScheduledJob{
+		Name:      uuid.NewString(),
+		NotBefore: time.Unix(0, time.Now().Add(-time.Minute).UnixNano()),
+	}
+
+	spy := NewETCDClientSpy()
+	spy.ReturnGetResponse = &clientv3.GetResponse{
+		Kvs: []*mvccpb.KeyValue{
+			{Key: []byte(store.ScheduledJobKey(due)), Value: []byte(`{"position":5}`)},
+		},
+		Count: 1,
+	}
+
+	client := store.NewCalculationStore(spy)
+	jobs, err := client.DueJobs(context.Background(), time.Now(), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 job but got %d", len(jobs))
+	}
+
+	if jobs[0].Name != due.Name {
+		t.Errorf("expected name %q but got %q", due.Name, jobs[0].Name)
+	}
+
+	if !jobs[0].NotBefore.Equal(due.NotBefore) {
+		t.Errorf("expected time %q but got %q", due.NotBefore, jobs[0].NotBefore)
+	}
+
+	if string(jobs[0].Payload) != `{"position":5}` {
+		t.Errorf("unexpected payload: %s", jobs[0].Payload)
+	}
+}
+
+func TestDeleteScheduled(t *testing.T) {
+	job := store.ScheduledJob{Name: uuid.NewString(), NotBefore: time.Now()}
+
+	spy := NewETCDClientSpy()
+	client := store.NewCalculationStore(spy)
+	if err := client.DeleteScheduled(context.Background(), job); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if len(spy.KeysSeenByDelete) != 1 || spy.KeysSeenByDelete[0] != store.ScheduledJobKey(job) {
+		t.Errorf("expected key %q to be deleted but saw %v",
+			store.ScheduledJobKey(job), spy.KeysSeenByDelete)
+	}
+}
+
+func TestScheduledJobKey_SortsChronologically(t *testing.T) {
+	earlier := store.ScheduledJobKey(store.ScheduledJob{Name: "z", NotBefore: time.Unix(9, 0)})
+	later := store.ScheduledJobKey(store.ScheduledJob{Name: "a", NotBefore: time.Unix(10, 0)})
+
+	if earlier >= later {
+		t.Errorf("expected %q to sort before %q", earlier, later)
+	}
+}
@@ -0,0 +1,147 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/workqueue"
+	"google.golang.org/protobuf/proto"
+)
+
+// CurrentJobVersion is the version of the job schema jobs are published with.
+// Version 1 jobs were published as a bare FibonacciOfJob; since version 2,
+// JSON jobs are wrapped in an envelope giving their version.
+//
+// A change to FibonacciOfJob that older workers would misread needs a new
+// version with an upgrade from the previous one in jobUpgrades.
+const CurrentJobVersion = 2
+
+// ErrUnknownJobVersion is returned when decoding a job published with a version
+// this worker does not know, such as one from a newer deploy. Such jobs are not
+// requeued.
+var ErrUnknownJobVersion = errors.New("unknown job version")
+
+// jobUpgrades upgrade the JSON of a job from the version it is keyed by to the
+// next version.
+var jobUpgrades = map[int]func(json.RawMessage) (json.RawMessage, error){
+	// Version 2 only introduced the envelope.
+	1: func(job json.RawMessage) (json.RawMessage, error) { return job, nil },
+}
+
+// fibonacciOfEnvelope publishes a FibonacciOfJob as JSON with its version,
+// routed and prioritized like the job.
+type fibonacciOfEnvelope struct {
+	Version int            `json:"version"`
+	Job     FibonacciOfJob `json:"job"`
+
+	// The job is repeated at the top level, where workers from before the
+	// envelope read it, so that they can still handle jobs published during a
+	// rolling upgrade. Workers that know the envelope read Job.
+	FibonacciOfJob
+}
+
+func (e fibonacciOfEnvelope) RoutingKey() string {
+	return e.Job.RoutingKey()
+}
+
+func (e fibonacciOfEnvelope) MessagePriority() uint8 {
+	return e.Job.MessagePriority()
+}
+
+func (e fibonacciOfEnvelope) MessageDeadline() (time.Time, bool) {
+	return e.Job.MessageDeadline()
+}
+
+// Envelope returns the job wrapped in the current version's envelope to be
+// published as JSON.
+func (j FibonacciOfJob) Envelope() any {
+	return fibonacciOfEnvelope{Version: CurrentJobVersion, Job: j, FibonacciOfJob: j}
+}
+
+// DecodeFibonacciOfJob decodes a JSON job published with any known version,
+// upgrading it to the current FibonacciOfJob.
+func DecodeFibonacciOfJob(payload []byte) (FibonacciOfJob, error) {
+	var envelope struct {
+		Version *int            `json:"version"`
+		Job     json.RawMessage `json:"job"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return FibonacciOfJob{}, fmt.Errorf("unable to unmarshal payload: %w", err)
+	}
+
+	version, raw := 1, json.RawMessage(payload)
+	if envelope.Version != nil {
+		version, raw = *envelope.Version, envelope.Job
+	}
+
+	if version < 1 || version > CurrentJobVersion {
+		return FibonacciOfJob{}, unknownJobVersion(version)
+	}
+
+	for ; version < CurrentJobVersion; version++ {
+		var err error
+		if raw, err = jobUpgrades[version](raw); err != nil {
+			return FibonacciOfJob{}, fmt.Errorf("unable to upgrade job from version %d: %w", version, err)
+		}
+	}
+
+	var job FibonacciOfJob
+	if err := json.Unmarshal(raw, &job); err != nil {
+		return FibonacciOfJob{}, fmt.Errorf("unable to unmarshal job: %w", err)
+	}
+
+	return job, nil
+}
+
+// decodeFibonacciOfProto decodes a protobuf job published with any known
+// version.
+func decodeFibonacciOfProto(payload []byte) (FibonacciOfJob, error) {
+	var msg pb.FibonacciOfJob
+	if err := proto.Unmarshal(payload, &msg); err != nil {
+		return FibonacciOfJob{}, fmt.Errorf("unable to unmarshal payload: %w", err)
+	}
+
+	if msg.Version > CurrentJobVersion {
+		return FibonacciOfJob{}, unknownJobVersion(int(msg.Version))
+	}
+
+	job := FibonacciOfJob{
+		OperationName: msg.OperationName,
+		First:         msg.First,
+		Second:        msg.Second,
+		Position:      msg.Position,
+		Priority:      uint8(msg.Priority),
+	}
+	if msg.Deadline != nil {
+		deadline := msg.Deadline.AsTime()
+		job.Deadline = &deadline
+	}
+
+	return job, nil
+}
+
+func unknownJobVersion(version int) error {
+	return fmt.Errorf("%w %d: %w", ErrUnknownJobVersion, version, workqueue.ErrDoNotRequeue)
+}
+
+// decodeFibonacciOfJob decodes payload by the content type it was delivered
+// with, so that JSON and protobuf jobs may be handled alike.
+func decodeFibonacciOfJob(ctx context.Context, payload []byte) (FibonacciOfJob, error) {
+	contentType := workqueue.ContentTypeJSON
+	if d, ok := workqueue.DeliveryFromContext(ctx); ok && d.ContentType != "" {
+		contentType = d.ContentType
+	}
+
+	switch contentType {
+	case workqueue.ContentTypeJSON:
+		return DecodeFibonacciOfJob(payload)
+	case workqueue.ContentTypeProtobuf:
+		return decodeFibonacciOfProto(payload)
+	default:
+		return FibonacciOfJob{}, fmt.Errorf("unsupported content type %q: %w", contentType, workqueue.ErrDoNotRequeue)
+	}
+}
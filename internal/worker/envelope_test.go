@@ -0,0 +1,157 @@
+package worker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/worker"
+	"github.com/vickleford/calculator/internal/workqueue"
+)
+
+// The payloads in testdata/jobs were recorded from each version of the job
+// schema. Keep them as they are; they stand in for jobs still in flight when a
+// new version is deployed.
+func recordedJob(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "jobs", name))
+	if err != nil {
+		t.Fatalf("unable to read recorded job: %s", err)
+	}
+	return b
+}
+
+func TestDecodeFibonacciOfJob_RecordedVersions(t *testing.T) {
+	tests := map[string]worker.FibonacciOfJob{
+		"fibonacci_of_v1.json": {
+			OperationName: "4ea7e923-8ec0-42ff-b974-97b9869f8ab4",
+			Second:        1,
+			Position:      10,
+		},
+		"fibonacci_of_v1_priority.json": {
+			OperationName: "4ea7e923-8ec0-42ff-b974-97b9869f8ab4",
+			Second:        1,
+			Position:      10,
+			Priority:      3,
+		},
+		"fibonacci_of_v2.json": {
+			OperationName: "4ea7e923-8ec0-42ff-b974-97b9869f8ab4",
+			Second:        1,
+			Position:      10,
+			Priority:      3,
+		},
+	}
+
+	for name, expected := range tests {
+		t.Run(name, func(t *testing.T) {
+			job, err := worker.DecodeFibonacciOfJob(recordedJob(t, name))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if job != expected {
+				t.Errorf("expected %#v but got %#v", expected, job)
+			}
+		})
+	}
+}
+
+func TestDecodeFibonacciOfJob_RejectsFutureVersions(t *testing.T) {
+	_, err := worker.DecodeFibonacciOfJob(recordedJob(t, "fibonacci_of_v3.json"))
+
+	if !errors.Is(err, worker.ErrUnknownJobVersion) {
+		t.Errorf("expected ErrUnknownJobVersion but got %v", err)
+	}
+
+	if !errors.Is(err, workqueue.ErrDoNotRequeue) {
+		t.Errorf("expected the job to be dead-lettered rather than requeued but got %v", err)
+	}
+}
+
+func TestDecodeFibonacciOfJob_RoundTripsCurrentVersion(t *testing.T) {
+	job := worker.FibonacciOfJob{OperationName: "george", First: 2, Second: 3, Position: 7, Priority: 1}
+
+	b, err := json.Marshal(job.Envelope())
+	if err != nil {
+		t.Fatalf("unable to marshal envelope: %s", err)
+	}
+
+	var envelope struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(b, &envelope); err != nil || envelope.Version != worker.CurrentJobVersion {
+		t.Errorf("expected version %d in %s", worker.CurrentJobVersion, b)
+	}
+
+	decoded, err := worker.DecodeFibonacciOfJob(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if decoded != job {
+		t.Errorf("expected %#v but got %#v", job, decoded)
+	}
+}
+
+func TestEnvelope_ReadableAsVersion1(t *testing.T) {
+	job := worker.FibonacciOfJob{OperationName: "george", First: 2, Second: 3, Position: 7, Priority: 1}
+
+	b, err := json.Marshal(job.Envelope())
+	if err != nil {
+		t.Fatalf("unable to marshal envelope: %s", err)
+	}
+
+	// Workers from before the envelope unmarshal the payload as the job.
+	var v1 worker.FibonacciOfJob
+	if err := json.Unmarshal(b, &v1); err != nil {
+		t.Fatalf("unable to unmarshal envelope as a version 1 job: %s", err)
+	}
+
+	if v1 != job {
+		t.Errorf("expected %#v but got %#v", job, v1)
+	}
+}
+
+func TestFibOfWorker_RecordedProtobufVersions(t *testing.T) {
+	protobuf := workqueue.ContextWithDelivery(context.Background(), workqueue.Delivery{
+		ContentType: workqueue.ContentTypeProtobuf,
+	})
+
+	t.Run("current", func(t *testing.T) {
+		var gotName string
+		fakeStore := &storeSpy{}
+		fakeStore.getFunc = func(_ context.Context, name string) (store.Calculation, error) {
+			gotName = name
+			return store.Calculation{}, errors.New("stop here")
+		}
+
+		ctx, cancel := context.WithCancel(protobuf)
+		cancel()
+
+		w := worker.NewFibOf(fakeStore)
+		w.Handle(ctx, recordedJob(t, "fibonacci_of_v2.pb"))
+
+		if gotName != "4ea7e923-8ec0-42ff-b974-97b9869f8ab4" {
+			t.Errorf("expected the job to be decoded but it got %q", gotName)
+		}
+	})
+
+	t.Run("future", func(t *testing.T) {
+		fakeStore := &storeSpy{}
+
+		w := worker.NewFibOf(fakeStore)
+		err := w.Handle(protobuf, recordedJob(t, "fibonacci_of_v3.pb"))
+
+		if !errors.Is(err, worker.ErrUnknownJobVersion) || !errors.Is(err, workqueue.ErrDoNotRequeue) {
+			t.Errorf("expected an unknown version not to be requeued but got %v", err)
+		}
+
+		if len(fakeStore.saves) != 0 {
+			t.Errorf("expected the job not to start but it saved %#v", fakeStore.saved)
+		}
+	})
+}
@@ -2,34 +2,137 @@ package worker
 
 import (
 	"context"
+	"errors"
+	"math/rand/v2"
 	"time"
+
+	"github.com/vickleford/calculator/internal/clock"
+	"github.com/vickleford/calculator/internal/store"
 )
 
 type Task func() error
 
+// Jitter spreads out the delays between retries so that many callers failing
+// at once do not all retry at once.
+type Jitter int
+
+const (
+	// NoJitter waits the full delay.
+	NoJitter Jitter = iota
+	// FullJitter waits anywhere up to the full delay.
+	FullJitter
+	// EqualJitter waits at least half the delay and up to the full delay.
+	EqualJitter
+)
+
+// RetryPolicy describes how a Task is retried. Delays between attempts start at
+// InitialDelay and grow by Multiplier up to MaxDelay, if it is set.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       Jitter
+
+	// MaxAttempts limits how many times the Task is tried. There is no limit
+	// when it is 0.
+	MaxAttempts int
+	// MaxElapsed limits how long the Task is retried for. Retrying stops
+	// rather than wait past it. There is no limit when it is 0.
+	MaxElapsed time.Duration
+
+	// Retryable reports whether a Task failing with err should be retried.
+	// Every error is retried when it is nil.
+	Retryable func(err error) bool
+	// OnRetry, when set, is called before waiting to retry after a failed
+	// attempt, counted from 1.
+	OnRetry func(attempt int, err error, delay time.Duration)
+
+	// Clock waits between attempts. The system clock is used when it is nil.
+	Clock clock.Clock
+}
+
+// DefaultRetryPolicy retries every error until the context is done, waiting
+// from 30ms up to 10 minutes between attempts.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialDelay: 30 * time.Millisecond,
+	MaxDelay:     10 * time.Minute,
+	Multiplier:   2,
+}
+
+// DefaultStoreRetryPolicy is like DefaultRetryPolicy except that it does not
+// retry reading calculations that do not exist.
+var DefaultStoreRetryPolicy = RetryPolicy{
+	InitialDelay: 30 * time.Millisecond,
+	MaxDelay:     10 * time.Minute,
+	Multiplier:   2,
+	Retryable: func(err error) bool {
+		return !errors.Is(err, store.ErrKeyNotFound)
+	},
+}
+
+// Retry tries f until it succeeds according to DefaultRetryPolicy.
 func Retry(ctx context.Context, f Task) error {
-	var delay, ceiling, factor time.Duration = 30 * time.Millisecond, 10 * time.Minute, 2
+	return DefaultRetryPolicy.Do(ctx, f)
+}
 
-	for {
-		if err := f(); err == nil {
+// Do tries f until it succeeds, it fails with an error that is not retryable,
+// the policy's limits are reached or ctx is done. It returns f's last error,
+// or ctx's error if ctx is done.
+func (p RetryPolicy) Do(ctx context.Context, f Task) error {
+	clk := p.Clock
+	if clk == nil {
+		clk = clock.Real{}
+	}
+
+	start := clk.Now()
+	delay := p.InitialDelay
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
 			return nil
 		}
 
-		wait := time.NewTicker(delay)
+		if p.Retryable != nil && !p.Retryable(err) {
+			return err
+		}
+
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return err
+		}
+
+		wait := p.jitter(delay)
+		if p.MaxElapsed > 0 && clk.Now().Add(wait).Sub(start) > p.MaxElapsed {
+			return err
+		}
 
-		select {
-		case <-wait.C:
-			delay = delay * factor
-			if delay > ceiling {
-				delay = ceiling
-			}
-		case <-ctx.Done():
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err, wait)
 		}
 
-		wait.Stop()
+		if err := clk.Sleep(ctx, wait); err != nil {
+			return err
+		}
 
-		if ctx.Err() != nil {
-			return ctx.Err()
+		delay = time.Duration(float64(delay) * p.Multiplier)
+		if p.MaxDelay > 0 && delay > p.MaxDelay {
+			delay = p.MaxDelay
 		}
 	}
 }
+
+func (p RetryPolicy) jitter(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		return 0
+	}
+
+	switch p.Jitter {
+	case FullJitter:
+		return rand.N(delay)
+	case EqualJitter:
+		half := delay / 2
+		return half + rand.N(delay-half)
+	default:
+		return delay
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/vickleford/calculator/internal/clock/clocktest"
 	"github.com/vickleford/calculator/internal/worker"
 )
 
@@ -88,3 +89,150 @@ func TestRetry_WhenItEventuallySucceeds(t *testing.T) {
 		t.Errorf("got %d executions", executions)
 	}
 }
+
+func TestRetryPolicy_Delays(t *testing.T) {
+	clk := clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())
+	policy := worker.RetryPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     5 * time.Second,
+		Multiplier:   2,
+		MaxAttempts:  6,
+		Clock:        clk,
+	}
+
+	var executions int
+	err := policy.Do(context.Background(), func() error {
+		executions++
+		return errors.New("keep going")
+	})
+	if err == nil || err.Error() != "keep going" {
+		t.Errorf("expected the last error but got %v", err)
+	}
+
+	if executions != 6 {
+		t.Errorf("expected 6 executions but got %d", executions)
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	if fmt.Sprint(clk.Sleeps()) != fmt.Sprint(expected) {
+		t.Errorf("expected delays %v but got %v", expected, clk.Sleeps())
+	}
+}
+
+func TestRetryPolicy_MaxElapsed(t *testing.T) {
+	clk := clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())
+	policy := worker.RetryPolicy{
+		InitialDelay: time.Second,
+		Multiplier:   2,
+		MaxElapsed:   10 * time.Second,
+		Clock:        clk,
+	}
+
+	var executions int
+	err := policy.Do(context.Background(), func() error {
+		executions++
+		return errors.New("keep going")
+	})
+	if err == nil {
+		t.Error("expected an error")
+	}
+
+	// 1s, 2s and 4s fit in 10s but another 8s would not.
+	if executions != 4 {
+		t.Errorf("expected 4 executions but got %d", executions)
+	}
+}
+
+func TestRetryPolicy_NotRetryable(t *testing.T) {
+	clk := clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())
+	permanent := errors.New("permanent")
+	policy := worker.RetryPolicy{
+		InitialDelay: time.Second,
+		Multiplier:   2,
+		Retryable: func(err error) bool {
+			return !errors.Is(err, permanent)
+		},
+		Clock: clk,
+	}
+
+	var executions int
+	err := policy.Do(context.Background(), func() error {
+		executions++
+		if executions == 3 {
+			return permanent
+		}
+		return errors.New("keep going")
+	})
+	if !errors.Is(err, permanent) {
+		t.Errorf("expected the permanent error but got %v", err)
+	}
+
+	if executions != 3 {
+		t.Errorf("expected 3 executions but got %d", executions)
+	}
+}
+
+func TestRetryPolicy_OnRetry(t *testing.T) {
+	clk := clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())
+
+	var attempts []int
+	var delays []time.Duration
+	policy := worker.RetryPolicy{
+		InitialDelay: time.Second,
+		Multiplier:   3,
+		MaxAttempts:  3,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			attempts = append(attempts, attempt)
+			delays = append(delays, delay)
+		},
+		Clock: clk,
+	}
+
+	policy.Do(context.Background(), func() error {
+		return errors.New("keep going")
+	})
+
+	if fmt.Sprint(attempts) != "[1 2]" {
+		t.Errorf("expected retries after attempts 1 and 2 but got %v", attempts)
+	}
+
+	if fmt.Sprint(delays) != fmt.Sprint(clk.Sleeps()) {
+		t.Errorf("expected the delays slept %v but got %v", clk.Sleeps(), delays)
+	}
+}
+
+func TestRetryPolicy_Jitter(t *testing.T) {
+	for name, tc := range map[string]struct {
+		jitter   worker.Jitter
+		min, max time.Duration
+	}{
+		"full":  {worker.FullJitter, 0, time.Second},
+		"equal": {worker.EqualJitter, time.Second / 2, time.Second},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clk := clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())
+			policy := worker.RetryPolicy{
+				InitialDelay: time.Second,
+				Multiplier:   1,
+				MaxAttempts:  100,
+				Jitter:       tc.jitter,
+				Clock:        clk,
+			}
+
+			policy.Do(context.Background(), func() error {
+				return errors.New("keep going")
+			})
+
+			var varied bool
+			for _, d := range clk.Sleeps() {
+				if d < tc.min || d >= tc.max {
+					t.Errorf("expected delays in [%s, %s) but got %s", tc.min, tc.max, d)
+				}
+				varied = varied || d != clk.Sleeps()[0]
+			}
+			if !varied {
+				t.Error("expected the delays to vary")
+			}
+		})
+	}
+}
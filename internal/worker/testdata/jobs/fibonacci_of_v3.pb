@@ -0,0 +1,3 @@
+
+$4ea7e923-8ec0-42ff-b974-97b9869f8ab4 
+(0
\ No newline at end of file
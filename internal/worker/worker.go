@@ -9,9 +9,15 @@ import (
 	"time"
 
 	"github.com/vickleford/calculator/internal/calculators"
+	"github.com/vickleford/calculator/internal/clock"
+	"github.com/vickleford/calculator/internal/pb"
+	"github.com/vickleford/calculator/internal/resultcache"
 	"github.com/vickleford/calculator/internal/store"
+	"github.com/vickleford/calculator/internal/workqueue"
 	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // FibonacciOfJob signals to begin a FibonacciOf calculation.
@@ -26,26 +32,259 @@ type FibonacciOfJob struct {
 	// considered synonomous with "index". The first number in the sequence is
 	// position 1.
 	Position int64 `json:"position"`
+	// Priority orders the job ahead of lower priority jobs on a priority queue.
+	Priority uint8 `json:"priority,omitempty"`
+	// Deadline is when the job expires. Expired jobs are not started.
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// Expired reports whether the job's deadline has passed at now.
+func (j FibonacciOfJob) Expired(now time.Time) bool {
+	return j.Deadline != nil && !now.Before(*j.Deadline)
+}
+
+// MessageDeadline publishes the job to expire at its deadline.
+func (j FibonacciOfJob) MessageDeadline() (time.Time, bool) {
+	if j.Deadline == nil {
+		return time.Time{}, false
+	}
+	return *j.Deadline, true
+}
+
+// MessagePriority publishes the job with its priority.
+func (j FibonacciOfJob) MessagePriority() uint8 {
+	return j.Priority
+}
+
+// FibonacciOfRoutingKey routes FibonacciOfJobs when they are published to an
+// exchange.
+const FibonacciOfRoutingKey = "fibonacci_of"
+
+// RoutingKey routes the job by its type.
+func (j FibonacciOfJob) RoutingKey() string {
+	return FibonacciOfRoutingKey
+}
+
+// Proto returns the job as a protobuf message, routed and prioritized like the
+// job when it is published.
+func (j FibonacciOfJob) Proto() proto.Message {
+	msg := &pb.FibonacciOfJob{
+		OperationName: j.OperationName,
+		First:         j.First,
+		Second:        j.Second,
+		Position:      j.Position,
+		Priority:      uint32(j.Priority),
+		Version:       CurrentJobVersion,
+	}
+	if j.Deadline != nil {
+		msg.Deadline = timestamppb.New(*j.Deadline)
+	}
+
+	return fibonacciOfJobProto{msg}
+}
+
+type fibonacciOfJobProto struct {
+	*pb.FibonacciOfJob
+}
+
+func (j fibonacciOfJobProto) RoutingKey() string {
+	return FibonacciOfRoutingKey
+}
+
+func (j fibonacciOfJobProto) MessagePriority() uint8 {
+	return uint8(j.Priority)
+}
+
+func (j fibonacciOfJobProto) MessageDeadline() (time.Time, bool) {
+	return j.Deadline.AsTime(), j.Deadline != nil
+}
+
+// Queue is a work queue jobs are published to as JSON. Queues that can also
+// publish protobuf implement PublishProto.
+type Queue interface {
+	PublishJSON(context.Context, any) error
+}
+
+type protoQueue interface {
+	PublishProto(context.Context, proto.Message) error
+}
+
+// PublishFibonacciOf publishes job to q, encoded as protobuf when asProtobuf is
+// set and q can publish protobuf, or else as JSON.
+func PublishFibonacciOf(ctx context.Context, q Queue, job FibonacciOfJob, asProtobuf bool) error {
+	if pq, ok := q.(protoQueue); ok && asProtobuf {
+		return pq.PublishProto(ctx, job.Proto())
+	}
+
+	return q.PublishJSON(ctx, job.Envelope())
+}
+
+type batchQueue interface {
+	PublishJSONBatch(context.Context, []any) (int, error)
+}
+
+// PublishFibonacciOfBatch publishes jobs to q like PublishFibonacciOf, all at
+// once when q can publish JSON in bulk and they are not to be encoded as
+// protobuf. It returns the error publishing each job, in order, which is nil
+// for those published.
+func PublishFibonacciOfBatch(ctx context.Context, q Queue, jobs []FibonacciOfJob, asProtobuf bool) []error {
+	errs := make([]error, len(jobs))
+
+	_, protobuf := q.(protoQueue)
+	if bq, ok := q.(batchQueue); ok && !(protobuf && asProtobuf) {
+		messages := make([]any, len(jobs))
+		for i, job := range jobs {
+			messages[i] = job.Envelope()
+		}
+
+		published, err := bq.PublishJSONBatch(ctx, messages)
+		for i := published; i < len(jobs); i++ {
+			errs[i] = err
+		}
+
+		return errs
+	}
+
+	for i, job := range jobs {
+		errs[i] = PublishFibonacciOf(ctx, q, job, asProtobuf)
+	}
+
+	return errs
 }
 
 type FibOfHandler struct {
 	datastore datastore
+
+	// maxExecutionTime limits how long a calculation may run. There is no
+	// limit when it is 0.
+	maxExecutionTime time.Duration
+
+	// heartbeats, when set, are kept for calculations while they run so that
+	// those left behind by a worker that died can be recovered.
+	heartbeats   heartbeats
+	heartbeatTTL time.Duration
+
+	// retryPolicy retries reading and writing the datastore.
+	retryPolicy RetryPolicy
+
+	// results, when set, caches the results of successful calculations for
+	// identical calculations to reuse.
+	results resultCache
+
+	// flights, when set, are where the calculations following the ones this
+	// worker runs are found, to complete them with the same outcome.
+	flights flights
+
+	// notifier, when set, calls back the clients of the calculations the
+	// worker completes.
+	notifier notifier
+
+	clock clock.Clock
 }
 
 type datastore interface {
 	Get(context.Context, string) (store.Calculation, error)
 	Save(context.Context, store.Calculation) error
-	SetStartedTime(context.Context, string, time.Time) error
 }
 
-func NewFibOf(ds datastore) *FibOfHandler {
-	return &FibOfHandler{datastore: ds}
+type heartbeats interface {
+	Start(ctx context.Context, name string, job json.RawMessage, ttl time.Duration) (func(context.Context) error, error)
+}
+
+type resultCache interface {
+	Put(context.Context, string, json.RawMessage) error
+}
+
+type flights interface {
+	Land(ctx context.Context, key, primary string) ([]string, error)
+	Unfollow(ctx context.Context, primary, name string) error
+}
+
+type notifier interface {
+	Notify(context.Context, store.Calculation)
+}
+
+type Option func(*FibOfHandler)
+
+// WithHeartbeats keeps a heartbeat for each calculation while it runs. The
+// heartbeat expires ttl after the worker stops renewing it, such as when it
+// dies.
+func WithHeartbeats(hb heartbeats, ttl time.Duration) Option {
+	return func(w *FibOfHandler) {
+		w.heartbeats = hb
+		w.heartbeatTTL = ttl
+	}
+}
+
+// WithMaxExecutionTime fails calculations running longer than d with
+// DEADLINE_EXCEEDED.
+func WithMaxExecutionTime(d time.Duration) Option {
+	return func(w *FibOfHandler) {
+		w.maxExecutionTime = d
+	}
+}
+
+// WithRetryPolicy retries reading and writing the datastore with p rather than
+// DefaultStoreRetryPolicy.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(w *FibOfHandler) {
+		w.retryPolicy = p
+	}
+}
+
+// WithResultCache caches the results of successful calculations in results.
+func WithResultCache(results resultCache) Option {
+	return func(w *FibOfHandler) {
+		w.results = results
+	}
+}
+
+// WithCoalescing completes the calculations following each calculation the
+// worker runs, found in flights, with the same outcome.
+func WithCoalescing(flights flights) Option {
+	return func(w *FibOfHandler) {
+		w.flights = flights
+	}
+}
+
+// WithNotifier has notifier call back the clients of the calculations the
+// worker completes, when they asked for a callback.
+func WithNotifier(n notifier) Option {
+	return func(w *FibOfHandler) {
+		w.notifier = n
+	}
+}
+
+// WithClock tells the time with clk, which also times the retry policy unless
+// it has its own clock.
+func WithClock(clk clock.Clock) Option {
+	return func(w *FibOfHandler) {
+		w.clock = clk
+	}
+}
+
+func NewFibOf(ds datastore, opts ...Option) *FibOfHandler {
+	w := &FibOfHandler{
+		datastore:   ds,
+		retryPolicy: DefaultStoreRetryPolicy,
+		clock:       clock.Real{},
+	}
+
+	for _, o := range opts {
+		o(w)
+	}
+
+	if w.retryPolicy.Clock == nil {
+		w.retryPolicy.Clock = w.clock
+	}
+
+	return w
 }
 
 func (w *FibOfHandler) Handle(ctx context.Context, payload []byte) error {
-	var job FibonacciOfJob
-	if err := json.Unmarshal(payload, &job); err != nil {
-		return fmt.Errorf("unable to unmarshal payload: %w", err)
+	job, err := decodeFibonacciOfJob(ctx, payload)
+	if err != nil {
+		return err
 	}
 
 	// TODO: Consider a validate function on the FibonacciOfJob instead.
@@ -53,74 +292,377 @@ func (w *FibOfHandler) Handle(ctx context.Context, payload []byte) error {
 		return fmt.Errorf("job has no operation name; payload: %s", payload)
 	}
 
-	// This is a weak area where a job could get lost. Give it a good
-	// college effort.
-	err := Retry(ctx, func() error {
-		err := w.datastore.SetStartedTime(ctx, job.OperationName, time.Now())
-		if err != nil {
-			err = fmt.Errorf("error setting job started time on %q: %w", job.OperationName, err)
-			log.Println(err)
-			return err
-		}
+	if job.Expired(w.clock.Now()) {
+		log.Printf("not starting calculation %q after its deadline", job.OperationName)
+		return w.expire(ctx, job)
+	}
+
+	started, err := w.claim(ctx, job)
+	if errors.Is(err, errNotClaimed) {
+		log.Printf("skipping calculation %q: %s", job.OperationName, err)
 		return nil
-	})
-	if err != nil {
+	} else if err != nil {
 		return err
 	} else {
 		log.Printf("successfully set job started time for %q", job.OperationName)
 	}
 
+	stopHeartbeat, err := w.startHeartbeat(ctx, job)
+	if err != nil {
+		return err
+	}
+	defer stopHeartbeat()
+
+	calcCtx, cancel := w.calculationContext(ctx, job)
+	defer cancel()
+
 	c := calculators.NewFibonacci(job.First, job.Second)
-	solution, jobErr := c.NumberAtPosition(job.Position)
+	solution, jobErr := c.NumberAtPositionContext(calcCtx, job.Position)
 
-	calculation, err := w.datastore.Get(ctx, job.OperationName)
-	if err != nil {
-		return fmt.Errorf("error getting calculation from store: %w", err)
+	// A calculation cut short by the handler's own context, such as on
+	// shutdown, is not finished; leave it to be requeued. One cut short by the
+	// message timeout would only time out again, so it fails like one that
+	// ran out of execution time, given a little more time to be saved.
+	if jobErr != nil && ctx.Err() != nil {
+		if !errors.Is(context.Cause(ctx), workqueue.ErrMessageTimeout) {
+			return fmt.Errorf("calculation %q was interrupted: %w", job.OperationName, jobErr)
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = w.clock.WithTimeout(context.WithoutCancel(ctx), timedOutSaveTime)
+		defer cancel()
 	}
 
-	calculation.Done = true
-	// TODO: add job completed time.
+	var state *status.Status
+	var result []byte
 
 	if jobErr != nil {
 		log.Printf("error processing calculation %q: %s", job.OperationName, jobErr)
 
-		state := &status.Status{
+		state = &status.Status{
 			Code:    int32(codes.Internal), // Default to internal.
 			Message: jobErr.Error(),
 		}
 
 		if errors.Is(jobErr, calculators.ErrFibonacciPositionInvalid) {
 			state.Code = int32(codes.InvalidArgument)
+		} else if errors.Is(jobErr, context.DeadlineExceeded) {
+			state.Code = int32(codes.DeadlineExceeded)
 		}
-
-		calculation.Error = state
 	} else {
-		result := store.FibonacciOfResult{
+		result, err = json.Marshal(store.FibonacciOfResult{
 			First:    job.First,
 			Second:   job.Second,
 			Position: job.Position,
 			Result:   solution,
-		}
-		b, err := json.Marshal(result)
+		})
 		if err != nil {
 			return fmt.Errorf("error marshaling result: %w", err)
 		}
-		calculation.Result = b
 	}
 
-	err = Retry(ctx, func() error {
+	complete := func(calculation *store.Calculation) {
+		completed := w.clock.Now()
+		calculation.Done = true
+		calculation.Metadata.Completed = &completed
+		calculation.Error = state
+		calculation.Result = result
+	}
+
+	owned, err := w.finish(ctx, job.OperationName, started, complete)
+	if err != nil {
+		return err
+	}
+
+	// Only the worker that completed the calculation completes its followers.
+	// Those it fails to complete are republished by the reconciler, since the
+	// calculation they follow is done.
+	if owned {
+		if err := w.completeFollowers(ctx, job, complete); err != nil {
+			log.Printf("error completing the followers of calculation %q: %s", job.OperationName, err)
+		}
+	}
+
+	if result != nil {
+		w.cacheResult(ctx, job, result)
+	}
+
+	return nil
+}
+
+// cacheResult caches the result of the job's calculation. The calculation is
+// done either way, so failing to cache it is only logged.
+func (w *FibOfHandler) cacheResult(ctx context.Context, job FibonacciOfJob, result json.RawMessage) {
+	if w.results == nil {
+		return
+	}
+
+	key := resultcache.FibonacciOfKey(job.First, job.Second, job.Position)
+	if err := w.results.Put(ctx, key, result); err != nil {
+		log.Printf("error caching result of calculation %q: %s", job.OperationName, err)
+	}
+}
+
+// timedOutSaveTime is how long a worker has to save a calculation that timed
+// out with its message.
+const timedOutSaveTime = 10 * time.Second
+
+// errNotClaimed reports that a job's calculation is done or belongs to another
+// worker, so the job is a duplicate to drop.
+var errNotClaimed = errors.New("calculation was not claimed")
+
+// claim takes ownership of the job's calculation by recording when it started,
+// which it returns. A calculation that was already started is only taken over
+// when the job was redelivered, as the worker that started it has given it up.
+// The started time is swapped in against the version of the calculation read,
+// so only one of the workers given duplicates of a job claims it.
+func (w *FibOfHandler) claim(ctx context.Context, job FibonacciOfJob) (time.Time, error) {
+	var started time.Time
+	var claimErr error
+
+	// This is a weak area where a job could get lost. Give it a good
+	// college effort.
+	err := w.retryPolicy.Do(ctx, func() error {
+		started, claimErr = w.claimOnce(ctx, job)
+		if claimErr != nil && !errors.Is(claimErr, errNotClaimed) {
+			log.Println(claimErr)
+			return claimErr
+		}
+		return nil
+	})
+	if errors.Is(err, store.ErrKeyNotFound) {
+		// There is nothing to run the job for, however many times it is tried.
+		return time.Time{}, fmt.Errorf("%w: %w", workqueue.ErrDoNotRequeue, err)
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	return started, claimErr
+}
+
+func (w *FibOfHandler) claimOnce(ctx context.Context, job FibonacciOfJob) (time.Time, error) {
+	calculation, err := w.datastore.Get(ctx, job.OperationName)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error getting calculation %q: %w", job.OperationName, err)
+	}
+
+	if calculation.Done {
+		return time.Time{}, fmt.Errorf("%w: it is already done", errNotClaimed)
+	}
+
+	if calculation.Metadata.Started != nil {
+		if delivery, _ := workqueue.DeliveryFromContext(ctx); !delivery.Redelivered {
+			return time.Time{}, fmt.Errorf("%w: another worker started it", errNotClaimed)
+		}
+		calculation.Metadata.Redeliveries++
+	}
+
+	started := w.clock.Now()
+	calculation.Metadata.Started = &started
+
+	err = w.datastore.Save(ctx, calculation)
+	if errors.Is(err, store.ErrUpdateUnsuccessful) {
+		return time.Time{}, fmt.Errorf("%w: another worker claimed it first", errNotClaimed)
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("error setting job started time on %q: %w", job.OperationName, err)
+	}
+
+	return started, nil
+}
+
+// finish completes the calculation started at started and reports whether it
+// did. If another worker has since taken the calculation over, the outcome is
+// dropped.
+func (w *FibOfHandler) finish(ctx context.Context, name string, started time.Time, complete func(*store.Calculation)) (bool, error) {
+	var owned bool
+	err := w.retryPolicy.Do(ctx, func() error {
+		calculation, err := w.datastore.Get(ctx, name)
+		if err != nil {
+			err = fmt.Errorf("error getting calculation %q from store: %w", name, err)
+			log.Println(err)
+			return err
+		}
+
+		if calculation.Done || calculation.Metadata.Started == nil || !calculation.Metadata.Started.Equal(started) {
+			log.Printf("dropping the outcome of calculation %q taken over by another worker", name)
+			return nil
+		}
+
+		complete(&calculation)
+
 		if err := w.datastore.Save(ctx, calculation); err != nil {
-			err = fmt.Errorf("error saving calculation %q: %w", job.OperationName, err)
+			err = fmt.Errorf("error saving calculation %q: %w", name, err)
 			log.Println(err)
 			return err
 		}
+
+		log.Printf("successfully saved calculation %q", name)
+		owned = true
+		w.notify(ctx, calculation)
 		return nil
 	})
+
+	return owned, err
+}
+
+// notify calls back the client of a calculation that was just completed, if
+// it asked for a callback.
+func (w *FibOfHandler) notify(ctx context.Context, calculation store.Calculation) {
+	if w.notifier != nil && calculation.Metadata.Callback != nil {
+		w.notifier.Notify(ctx, calculation)
+	}
+}
+
+// completeFollowers takes the job's calculation out of flight and completes
+// the calculations that followed it like complete does the calculation.
+func (w *FibOfHandler) completeFollowers(ctx context.Context, job FibonacciOfJob, complete func(*store.Calculation)) error {
+	if w.flights == nil {
+		return nil
+	}
+
+	key := resultcache.FibonacciOfKey(job.First, job.Second, job.Position)
+
+	var followers []string
+	err := w.retryPolicy.Do(ctx, func() error {
+		var err error
+		followers, err = w.flights.Land(ctx, key, job.OperationName)
+		if err != nil {
+			log.Println(err)
+		}
+		return err
+	})
 	if err != nil {
 		return err
-	} else {
-		log.Printf("successfully saved calculation %q", job.OperationName)
+	}
+
+	for _, name := range followers {
+		err := w.retryPolicy.Do(ctx, func() error {
+			return w.completeFollower(ctx, job.OperationName, name, complete)
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+func (w *FibOfHandler) completeFollower(ctx context.Context, primary, name string, complete func(*store.Calculation)) error {
+	calculation, err := w.datastore.Get(ctx, name)
+	if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		err = fmt.Errorf("error getting follower %q from store: %w", name, err)
+		log.Println(err)
+		return err
+	}
+
+	// A follower that is already done, such as by being run itself after
+	// waiting too long, keeps its own outcome.
+	if err == nil && !calculation.Done {
+		complete(&calculation)
+
+		if err := w.datastore.Save(ctx, calculation); err != nil {
+			err = fmt.Errorf("error saving follower %q: %w", name, err)
+			log.Println(err)
+			return err
+		}
+
+		log.Printf("completed calculation %q following %q", name, primary)
+		w.notify(ctx, calculation)
+	}
+
+	if err := w.flights.Unfollow(ctx, primary, name); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// startHeartbeat keeps a heartbeat for the job's calculation until the returned
+// function is called.
+func (w *FibOfHandler) startHeartbeat(ctx context.Context, job FibonacciOfJob) (func(), error) {
+	if w.heartbeats == nil {
+		return func() {}, nil
+	}
+
+	payload, err := json.Marshal(job.Envelope())
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling job for heartbeat: %w", err)
+	}
+
+	stop, err := w.heartbeats.Start(ctx, job.OperationName, payload, w.heartbeatTTL)
+	if err != nil {
+		return nil, fmt.Errorf("error starting heartbeat for %q: %w", job.OperationName, err)
+	}
+
+	return func() {
+		// Stop even if ctx is done so that the job is not mistaken for stalled.
+		stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+
+		if err := stop(stopCtx); err != nil {
+			log.Println(err)
+		}
+	}, nil
+}
+
+// calculationContext limits the calculation to the maximum execution time and
+// the job's deadline.
+func (w *FibOfHandler) calculationContext(ctx context.Context, job FibonacciOfJob) (context.Context, context.CancelFunc) {
+	var cancels []context.CancelFunc
+
+	if w.maxExecutionTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = w.clock.WithTimeout(ctx, w.maxExecutionTime)
+		cancels = append(cancels, cancel)
+	}
+
+	if job.Deadline != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = clock.WithDeadline(ctx, w.clock, *job.Deadline)
+		cancels = append(cancels, cancel)
+	}
+
+	return ctx, func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+// expire fails the job's calculation with DEADLINE_EXCEEDED without starting
+// it. The calculation is read again before each attempt to save it, so that a
+// calculation written in the meantime, such as by the reconciler, is neither
+// saved over nor retried against a stale version.
+func (w *FibOfHandler) expire(ctx context.Context, job FibonacciOfJob) error {
+	return w.retryPolicy.Do(ctx, func() error {
+		calculation, err := w.datastore.Get(ctx, job.OperationName)
+		if err != nil {
+			err = fmt.Errorf("error getting calculation %q from store: %w", job.OperationName, err)
+			log.Println(err)
+			return err
+		}
+
+		if calculation.Done {
+			return nil
+		}
+
+		completed := w.clock.Now()
+		calculation.Done = true
+		calculation.Metadata.Completed = &completed
+		calculation.Error = &status.Status{
+			Code:    int32(codes.DeadlineExceeded),
+			Message: "the deadline passed before the calculation started",
+		}
+
+		if err := w.datastore.Save(ctx, calculation); err != nil {
+			err = fmt.Errorf("error saving calculation %q: %w", job.OperationName, err)
+			log.Println(err)
+			return err
+		}
+
+		log.Printf("successfully saved calculation %q", job.OperationName)
+		w.notify(ctx, calculation)
+		return nil
+	})
+}
@@ -3,42 +3,52 @@ package worker_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"math"
 	"testing"
 	"time"
 
 	"github.com/vickleford/calculator/internal/calculators"
+	"github.com/vickleford/calculator/internal/clock/clocktest"
+	"github.com/vickleford/calculator/internal/resultcache"
 	"github.com/vickleford/calculator/internal/store"
 	"github.com/vickleford/calculator/internal/worker"
+	"github.com/vickleford/calculator/internal/workqueue"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
 )
 
 type storeSpy struct {
 	saveErr error
 	saved   store.Calculation
-
-	setStartedName string
-	setStartedTime time.Time
-	setStartedErr  error
+	// saves are all the calculations saved, in order.
+	saves []store.Calculation
+	// stored is the last calculation saved without error. Get returns it
+	// rather than calling getFunc once there is one.
+	stored *store.Calculation
 
 	getFunc func(context.Context, string) (store.Calculation, error)
 }
 
 func (s *storeSpy) Get(ctx context.Context, name string) (store.Calculation, error) {
+	if s.stored != nil {
+		return *s.stored, nil
+	}
 	if s.getFunc == nil {
 		panic("unimplemented")
 	}
 	return s.getFunc(ctx, name)
 }
 
-func (s *storeSpy) SetStartedTime(ctx context.Context, name string, t time.Time) error {
-	s.setStartedName = name
-	s.setStartedTime = t
-	return s.setStartedErr
-}
-
 func (s *storeSpy) Save(ctx context.Context, calc store.Calculation) error {
 	s.saved = calc
-	return s.saveErr
+	s.saves = append(s.saves, calc)
+	if s.saveErr != nil {
+		return s.saveErr
+	}
+	calc.Metadata.Version++
+	s.stored = &calc
+	return nil
 }
 
 func FibonacciOfJobJSON(t *testing.T, j worker.FibonacciOfJob) []byte {
@@ -188,19 +198,852 @@ func TestFibOfWorker_SetsStartedTime(t *testing.T) {
 		t.Errorf("unexpected error: %s", err)
 	}
 
-	if fakeStore.setStartedTime.IsZero() {
-		t.Error("the started time was not set")
-	} else if time.Since(fakeStore.setStartedTime) > 5*time.Second {
-		t.Errorf("the started time %q is older than expected",
-			fakeStore.setStartedTime)
+	if len(fakeStore.saves) == 0 {
+		t.Fatal("the calculation was not saved")
+	}
+
+	claimed := fakeStore.saves[0]
+	started := claimed.Metadata.Started
+
+	if claimed.Done {
+		t.Error("expected the calculation to be started before it was done")
+	}
+
+	if started == nil {
+		t.Fatal("the started time was not set")
+	} else if time.Since(*started) > 5*time.Second {
+		t.Errorf("the started time %q is older than expected", started)
+	}
+
+	if now := time.Now(); started.After(now) {
+		t.Errorf("the started time %q is after now %q", started, now)
+	}
+
+	if claimed.Name != job.OperationName {
+		t.Errorf("got %q but expected %q", claimed.Name, job.OperationName)
+	}
+}
+
+func TestFibOfWorker_DecodesProtobufJobs(t *testing.T) {
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george"}, nil
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      5,
+	}
+
+	payload, err := proto.Marshal(job.Proto())
+	if err != nil {
+		t.Fatalf("error marshaling job to protobuf: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = workqueue.ContextWithDelivery(ctx, workqueue.Delivery{
+		ContentType: workqueue.ContentTypeProtobuf,
+	})
+
+	w := worker.NewFibOf(fakeStore)
+	if err := w.Handle(ctx, payload); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fakeStore.saved.Name != job.OperationName {
+		t.Errorf("got %q but expected %q", fakeStore.saved.Name, job.OperationName)
+	}
+
+	res := store.FibonacciOfResult{}
+	if err := json.Unmarshal(fakeStore.saved.Result, &res); err != nil {
+		t.Fatalf("unable to unmarshal result: %s", err)
+	}
+
+	if res.Result != 3 {
+		t.Errorf("got wrong result: %d", res.Result)
+	}
+}
+
+func TestFibOfWorker_RejectsUnsupportedContentTypes(t *testing.T) {
+	ctx := workqueue.ContextWithDelivery(context.Background(), workqueue.Delivery{
+		ContentType: "text/plain",
+	})
+
+	w := worker.NewFibOf(&storeSpy{})
+	err := w.Handle(ctx, []byte("george"))
+	if !errors.Is(err, workqueue.ErrDoNotRequeue) {
+		t.Errorf("expected the job not to be requeued but got %v", err)
+	}
+}
+
+func TestFibOfWorker_RefusesExpiredJobs(t *testing.T) {
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george"}, nil
+	}
+
+	deadline := time.Now().Add(-time.Second)
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      5,
+		Deadline:      &deadline,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	w := worker.NewFibOf(fakeStore)
+	if err := w.Handle(ctx, FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fakeStore.saved.Metadata.Started != nil {
+		t.Errorf("expected the expired job not to start but it started at %s", fakeStore.saved.Metadata.Started)
+	}
+
+	if !fakeStore.saved.Done {
+		t.Error("expected Done to be set")
+	}
+
+	if fakeStore.saved.Error.GetCode() != int32(codes.DeadlineExceeded) {
+		t.Errorf("expected DEADLINE_EXCEEDED but got %v", fakeStore.saved.Error)
+	}
+
+	if fakeStore.saved.Result != nil {
+		t.Errorf("expected no result but got %s", fakeStore.saved.Result)
+	}
+}
+
+func TestFibOfWorker_MaxExecutionTime(t *testing.T) {
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george"}, nil
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      math.MaxInt64,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	w := worker.NewFibOf(fakeStore, worker.WithMaxExecutionTime(time.Millisecond))
+	if err := w.Handle(ctx, FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !fakeStore.saved.Done {
+		t.Error("expected Done to be set")
+	}
+
+	if fakeStore.saved.Error.GetCode() != int32(codes.DeadlineExceeded) {
+		t.Errorf("expected DEADLINE_EXCEEDED but got %v", fakeStore.saved.Error)
+	}
+}
+
+func TestFibOfWorker_FailsCalculationsOutlastingTheMessageTimeout(t *testing.T) {
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george"}, nil
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      math.MaxInt64,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	h := workqueue.Chain(worker.NewFibOf(fakeStore), workqueue.Timeout(10*time.Millisecond))
+	if err := h.Handle(ctx, FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("expected the timed out calculation not to be requeued but got %s", err)
 	}
 
-	if now := time.Now(); fakeStore.setStartedTime.After(now) {
-		t.Errorf("the started time %q is after now %q",
-			fakeStore.setStartedTime, now)
+	if !fakeStore.saved.Done {
+		t.Error("expected Done to be set")
+	}
+
+	if fakeStore.saved.Error.GetCode() != int32(codes.DeadlineExceeded) {
+		t.Errorf("expected DEADLINE_EXCEEDED but got %v", fakeStore.saved.Error)
+	}
+}
+
+func TestFibOfWorker_InterruptedCalculationIsNotSaved(t *testing.T) {
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george"}, nil
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      math.MaxInt64,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	w := worker.NewFibOf(fakeStore)
+	err := w.Handle(ctx, FibonacciOfJobJSON(t, job))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the calculation to be interrupted but got %v", err)
+	}
+
+	if fakeStore.saved.Done {
+		t.Error("expected the interrupted calculation not to be saved")
+	}
+}
+
+func TestFibOfWorker_SkipsDoneCalculations(t *testing.T) {
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george", Done: true, Result: []byte(`{"result":3}`)}, nil
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      5,
+	}
+
+	ctx := workqueue.ContextWithDelivery(context.Background(), workqueue.Delivery{
+		Redelivered: true,
+	})
+
+	w := worker.NewFibOf(fakeStore)
+	if err := w.Handle(ctx, FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(fakeStore.saves) != 0 {
+		t.Errorf("expected the done calculation not to be saved but it was saved as %#v", fakeStore.saved)
+	}
+}
+
+func TestFibOfWorker_Duplicates(t *testing.T) {
+	started := time.Now().Add(-time.Minute)
+
+	startedCalculation := func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{
+			Name:     "george",
+			Metadata: store.CalculationMetadata{Started: &started, Version: 2},
+		}, nil
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      5,
+	}
+
+	t.Run("started by another worker", func(t *testing.T) {
+		fakeStore := &storeSpy{getFunc: startedCalculation}
+
+		w := worker.NewFibOf(fakeStore)
+		if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if len(fakeStore.saves) != 0 {
+			t.Errorf("expected the duplicate not to run but it saved %#v", fakeStore.saved)
+		}
+	})
+
+	t.Run("redelivered", func(t *testing.T) {
+		fakeStore := &storeSpy{getFunc: startedCalculation}
+
+		ctx := workqueue.ContextWithDelivery(context.Background(), workqueue.Delivery{
+			Redelivered: true,
+		})
+
+		w := worker.NewFibOf(fakeStore)
+		if err := w.Handle(ctx, FibonacciOfJobJSON(t, job)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if !fakeStore.saved.Done {
+			t.Error("expected the redelivered job to be taken over and done")
+		}
+
+		if got := fakeStore.saved.Metadata.Redeliveries; got != 1 {
+			t.Errorf("expected 1 redelivery to be recorded but got %d", got)
+		}
+
+		if !fakeStore.saved.Metadata.Started.After(started) {
+			t.Errorf("expected the started time to be reset when taken over but got %s", fakeStore.saved.Metadata.Started)
+		}
+	})
+
+	t.Run("claimed first by another worker", func(t *testing.T) {
+		fakeStore := &storeSpy{saveErr: store.ErrUpdateUnsuccessful}
+		fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+			return store.Calculation{Name: "george", Metadata: store.CalculationMetadata{Version: 1}}, nil
+		}
+
+		w := worker.NewFibOf(fakeStore)
+		if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if len(fakeStore.saves) != 1 || fakeStore.saved.Done {
+			t.Errorf("expected only the failed claim to be saved but saved %#v", fakeStore.saves)
+		}
+	})
+
+	t.Run("taken over while running", func(t *testing.T) {
+		fakeStore := &takenOverStore{}
+		fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+			return store.Calculation{Name: "george", Metadata: store.CalculationMetadata{Version: 1}}, nil
+		}
+
+		w := worker.NewFibOf(fakeStore)
+		if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if len(fakeStore.saves) != 1 || fakeStore.saved.Done {
+			t.Errorf("expected the outcome to be dropped but saved %#v", fakeStore.saves)
+		}
+	})
+}
+
+// takenOverStore is a storeSpy whose calculation is started again by another
+// worker as soon as it is claimed.
+type takenOverStore struct {
+	storeSpy
+}
+
+func (s *takenOverStore) Get(ctx context.Context, name string) (store.Calculation, error) {
+	calc, err := s.storeSpy.Get(ctx, name)
+	if s.stored != nil {
+		later := calc.Metadata.Started.Add(time.Second)
+		calc.Metadata.Started = &later
+		calc.Metadata.Redeliveries++
+	}
+	return calc, err
+}
+
+type heartbeatsSpy struct {
+	started []string
+	job     json.RawMessage
+	ttl     time.Duration
+	stopped []string
+	onStop  func()
+}
+
+func (h *heartbeatsSpy) Start(ctx context.Context, name string, job json.RawMessage, ttl time.Duration) (func(context.Context) error, error) {
+	h.started = append(h.started, name)
+	h.job = job
+	h.ttl = ttl
+	return func(context.Context) error {
+		h.stopped = append(h.stopped, name)
+		if h.onStop != nil {
+			h.onStop()
+		}
+		return nil
+	}, nil
+}
+
+func TestFibOfWorker_KeepsHeartbeatWhileRunning(t *testing.T) {
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george"}, nil
+	}
+
+	hb := &heartbeatsSpy{}
+	hb.onStop = func() {
+		if !fakeStore.saved.Done {
+			t.Error("expected the heartbeat to be kept until the calculation was done")
+		}
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      5,
+	}
+
+	w := worker.NewFibOf(fakeStore, worker.WithHeartbeats(hb, 10*time.Second))
+	if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(hb.started) != 1 || hb.started[0] != job.OperationName {
+		t.Errorf("expected a heartbeat for %q but started %v", job.OperationName, hb.started)
+	}
+
+	if len(hb.stopped) != 1 {
+		t.Errorf("expected the heartbeat to be stopped but stopped %v", hb.stopped)
+	}
+
+	if hb.ttl != 10*time.Second {
+		t.Errorf("expected a ttl of 10s but got %s", hb.ttl)
+	}
+
+	recorded, err := worker.DecodeFibonacciOfJob(hb.job)
+	if err != nil {
+		t.Fatalf("unable to decode the job kept with the heartbeat: %s", err)
+	}
+	if recorded != job {
+		t.Errorf("expected the job %#v to be kept but got %#v", job, recorded)
+	}
+}
+
+func TestFibOfWorker_MissingCalculationIsNotRequeued(t *testing.T) {
+	var gets int
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		gets++
+		return store.Calculation{}, store.ErrKeyNotFound
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      5,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	w := worker.NewFibOf(fakeStore)
+	err := w.Handle(ctx, FibonacciOfJobJSON(t, job))
+	if !errors.Is(err, workqueue.ErrDoNotRequeue) {
+		t.Errorf("expected the job not to be requeued but got %v", err)
+	}
+
+	if gets != 1 {
+		t.Errorf("expected the missing calculation not to be retried but it was read %d times", gets)
+	}
+}
+
+func TestFibOfWorker_RecordsStartedAndCompletedTimes(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 7, 15, 20, 33, 8, 0, time.UTC))
+
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george"}, nil
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      5,
+	}
+
+	w := worker.NewFibOf(fakeStore, worker.WithClock(clk))
+	if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if started := fakeStore.saved.Metadata.Started; started == nil || !started.Equal(clk.Now()) {
+		t.Errorf("expected started time %s but got %v", clk.Now(), started)
+	}
+
+	if completed := fakeStore.saved.Metadata.Completed; completed == nil || !completed.Equal(clk.Now()) {
+		t.Errorf("expected completed time %s but got %v", clk.Now(), completed)
+	}
+}
+
+func TestFibOfWorker_DeadlineByClock(t *testing.T) {
+	clk := clocktest.NewFake(time.Now())
+
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george"}, nil
+	}
+
+	deadline := clk.Now()
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      5,
+		Deadline:      &deadline,
+	}
+
+	w := worker.NewFibOf(fakeStore, worker.WithClock(clk))
+	if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fakeStore.saved.Metadata.Started != nil {
+		t.Errorf("expected the job expiring now not to start but it started at %s", fakeStore.saved.Metadata.Started)
+	}
+
+	if fakeStore.saved.Error.GetCode() != int32(codes.DeadlineExceeded) {
+		t.Errorf("expected DEADLINE_EXCEEDED but got %v", fakeStore.saved.Error)
+	}
+
+	if completed := fakeStore.saved.Metadata.Completed; completed == nil || !completed.Equal(clk.Now()) {
+		t.Errorf("expected completed time %s but got %v", clk.Now(), completed)
+	}
+}
+
+func TestFibOfWorker_MaxExecutionTimeByClock(t *testing.T) {
+	clk := clocktest.NewFake(time.Now())
+
+	fakeStore := &storeSpy{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george"}, nil
+	}
+
+	job := worker.FibonacciOfJob{
+		OperationName: "george",
+		First:         0,
+		Second:        1,
+		Position:      math.MaxInt64,
+	}
+
+	w := worker.NewFibOf(fakeStore,
+		worker.WithClock(clk),
+		worker.WithMaxExecutionTime(time.Hour))
+
+	handled := make(chan error)
+	go func() {
+		handled <- w.Handle(context.Background(), FibonacciOfJobJSON(t, job))
+	}()
+
+	// Wait for the calculation's timeout to be set before letting it pass.
+	clk.BlockUntil(1)
+	clk.Advance(time.Hour)
+
+	select {
+	case err := <-handled:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the calculation to stop once the clock passed its maximum execution time")
+	}
+
+	if fakeStore.saved.Error.GetCode() != int32(codes.DeadlineExceeded) {
+		t.Errorf("expected DEADLINE_EXCEEDED but got %v", fakeStore.saved.Error)
+	}
+
+	if completed := fakeStore.saved.Metadata.Completed; completed == nil || !completed.Equal(clk.Now()) {
+		t.Errorf("expected completed time %s but got %v", clk.Now(), completed)
+	}
+}
+
+type resultCacheSpy map[string]json.RawMessage
+
+func (c resultCacheSpy) Put(ctx context.Context, key string, result json.RawMessage) error {
+	c[key] = result
+	return nil
+}
+
+func TestFibOfWorker_CachesResults(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		position int64
+		cached   bool
+	}{
+		{name: "successful", position: 5, cached: true},
+		{name: "failed", position: -1, cached: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fakeStore := &storeSpy{}
+			fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+				return store.Calculation{Name: "george"}, nil
+			}
+			results := resultCacheSpy{}
+
+			job := worker.FibonacciOfJob{OperationName: "george", First: 0, Second: 1, Position: test.position}
+
+			w := worker.NewFibOf(fakeStore, worker.WithResultCache(results))
+			if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			result, ok := results[resultcache.FibonacciOfKey(0, 1, test.position)]
+			if ok != test.cached {
+				t.Fatalf("expected cached to be %t but cache holds %v", test.cached, results)
+			}
+			if ok && string(result) != string(fakeStore.saved.Result) {
+				t.Errorf("expected the saved result %s to be cached but got %s", fakeStore.saved.Result, result)
+			}
+		})
+	}
+}
+
+// flightStore keeps calculations by name along with the followers of each.
+type flightStore struct {
+	calculations map[string]store.Calculation
+	followers    map[string][]string
+	landed       []string
+}
+
+func (s *flightStore) Get(ctx context.Context, name string) (store.Calculation, error) {
+	calc, ok := s.calculations[name]
+	if !ok {
+		return calc, store.ErrKeyNotFound
+	}
+	return calc, nil
+}
+
+func (s *flightStore) Save(ctx context.Context, calc store.Calculation) error {
+	s.calculations[calc.Name] = calc
+	return nil
+}
+
+func (s *flightStore) Land(ctx context.Context, key, primary string) ([]string, error) {
+	s.landed = append(s.landed, key)
+	return s.followers[primary], nil
+}
+
+func (s *flightStore) Unfollow(ctx context.Context, primary, name string) error {
+	followers := s.followers[primary]
+	for i, follower := range followers {
+		if follower == name {
+			s.followers[primary] = append(followers[:i:i], followers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func TestFibOfWorker_CompletesFollowers(t *testing.T) {
+	fakeStore := &flightStore{
+		calculations: map[string]store.Calculation{
+			"primary":  {Name: "primary"},
+			"follower": {Name: "follower", Metadata: store.CalculationMetadata{Primary: "primary"}},
+			"done": {
+				Name:     "done",
+				Metadata: store.CalculationMetadata{Primary: "primary"},
+				Done:     true,
+				Result:   []byte(`{"result":-1}`),
+			},
+		},
+		followers: map[string][]string{"primary": {"follower", "done", "gone"}},
+	}
+
+	job := worker.FibonacciOfJob{OperationName: "primary", First: 0, Second: 1, Position: 5}
+
+	w := worker.NewFibOf(fakeStore, worker.WithCoalescing(fakeStore))
+	if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(fakeStore.landed) != 1 || fakeStore.landed[0] != resultcache.FibonacciOfKey(0, 1, 5) {
+		t.Errorf("expected the calculation to land once by its key but landed %v", fakeStore.landed)
+	}
+
+	primary := fakeStore.calculations["primary"]
+	follower := fakeStore.calculations["follower"]
+	if !follower.Done || string(follower.Result) != string(primary.Result) {
+		t.Errorf("expected the follower to be done with the primary's result %s but got %#v", primary.Result, follower)
+	}
+
+	if done := fakeStore.calculations["done"]; string(done.Result) != `{"result":-1}` {
+		t.Errorf("expected the follower already done to keep its result but got %s", done.Result)
+	}
+
+	if _, ok := fakeStore.calculations["gone"]; ok {
+		t.Error("expected the missing follower not to be created")
+	}
+
+	if left := fakeStore.followers["primary"]; len(left) != 0 {
+		t.Errorf("expected every follower to be forgotten but %v are left", left)
+	}
+}
+
+// takenOverFlightStore is a flightStore where another worker takes over each
+// calculation as soon as it is claimed.
+type takenOverFlightStore struct {
+	*flightStore
+}
+
+func (s takenOverFlightStore) Save(ctx context.Context, calc store.Calculation) error {
+	if !calc.Done {
+		later := calc.Metadata.Started.Add(time.Minute)
+		calc.Metadata.Started = &later
+	}
+	return s.flightStore.Save(ctx, calc)
+}
+
+func TestFibOfWorker_LeavesFollowersToTheWorkerThatTookOver(t *testing.T) {
+	fakeStore := takenOverFlightStore{&flightStore{
+		calculations: map[string]store.Calculation{
+			"primary":  {Name: "primary"},
+			"follower": {Name: "follower", Metadata: store.CalculationMetadata{Primary: "primary"}},
+		},
+		followers: map[string][]string{"primary": {"follower"}},
+	}}
+
+	job := worker.FibonacciOfJob{OperationName: "primary", First: 0, Second: 1, Position: 5}
+
+	w := worker.NewFibOf(fakeStore, worker.WithCoalescing(fakeStore))
+	if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(fakeStore.landed) != 0 {
+		t.Errorf("expected the calculation taken over not to land but landed %v", fakeStore.landed)
+	}
+
+	if follower := fakeStore.calculations["follower"]; follower.Done {
+		t.Errorf("expected the follower to be left to the worker that took over but it is done: %#v", follower)
+	}
+}
+
+type notifierSpy struct {
+	notified []store.Calculation
+}
+
+func (n *notifierSpy) Notify(ctx context.Context, calc store.Calculation) {
+	n.notified = append(n.notified, calc)
+}
+
+func TestFibOfWorker_NotifiesCallbacks(t *testing.T) {
+	for name, callback := range map[string]*store.Callback{
+		"WithCallback":    {URL: "http://example.com/done", State: store.CallbackPending},
+		"WithoutCallback": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fakeStore := &storeSpy{}
+			fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+				return store.Calculation{
+					Name: "george",
+					Metadata: store.CalculationMetadata{
+						Version:  1,
+						Callback: callback,
+					},
+				}, nil
+			}
+
+			spy := &notifierSpy{}
+			w := worker.NewFibOf(fakeStore, worker.WithNotifier(spy))
+
+			job := worker.FibonacciOfJob{OperationName: "george", Second: 1, Position: 5}
+			if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if callback == nil {
+				if len(spy.notified) != 0 {
+					t.Errorf("expected no notifications but got %d", len(spy.notified))
+				}
+				return
+			}
+
+			if len(spy.notified) != 1 || !spy.notified[0].Done {
+				t.Fatalf("expected the done calculation to be notified once but got %+v", spy.notified)
+			}
+			if spy.notified[0].Metadata.Callback.URL != callback.URL {
+				t.Errorf("expected callback %q but got %+v", callback.URL, spy.notified[0].Metadata.Callback)
+			}
+		})
+	}
+}
+
+// failingFinishStore fails to save the first calculation done, like a worker
+// losing etcd after starting a calculation.
+type failingFinishStore struct {
+	storeSpy
+	failed bool
+}
+
+func (s *failingFinishStore) Save(ctx context.Context, calc store.Calculation) error {
+	if calc.Done && !s.failed {
+		s.failed = true
+		return errors.New("etcd went away")
+	}
+	return s.storeSpy.Save(ctx, calc)
+}
+
+func TestFibOfWorker_CompletesJobsRequeuedOnTheMemoryQueue(t *testing.T) {
+	fakeStore := &failingFinishStore{}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george", Metadata: store.CalculationMetadata{Created: time.Now()}}, nil
+	}
+
+	q := workqueue.NewMemory()
+	job := worker.FibonacciOfJob{OperationName: "george", First: 0, Second: 1, Position: 5}
+	if err := q.PublishJSON(context.Background(), job); err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+
+	handler := worker.NewFibOf(fakeStore, worker.WithRetryPolicy(worker.RetryPolicy{MaxAttempts: 1}))
+	consumer := workqueue.NewMemoryConsumer(q, handler)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error)
+	go func() { done <- consumer.Start(ctx) }()
+
+	for q.Len() != 0 || q.Unacked() != 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("the job was never acknowledged")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+
+	if !fakeStore.failed {
+		t.Fatal("expected the first attempt to fail")
+	}
+
+	calc := fakeStore.stored
+	if calc == nil || !calc.Done || calc.Error != nil || calc.Metadata.Redeliveries != 1 {
+		t.Errorf("expected the requeued job to complete its calculation but stored %+v", calc)
+	}
+}
+
+// expiredElsewhereStore reports the calculation changed by another writer the
+// first time it is saved, after which it holds what that writer saved.
+type expiredElsewhereStore struct {
+	storeSpy
+	other store.Calculation
+}
+
+func (s *expiredElsewhereStore) Save(ctx context.Context, calc store.Calculation) error {
+	if s.stored == nil {
+		s.stored = &s.other
+		return store.ErrUpdateUnsuccessful
+	}
+	return s.storeSpy.Save(ctx, calc)
+}
+
+func TestFibOfWorker_ExpiresCalculationsWrittenInTheMeantime(t *testing.T) {
+	completed := time.Now()
+	fakeStore := &expiredElsewhereStore{
+		other: store.Calculation{Name: "george", Done: true, Metadata: store.CalculationMetadata{Completed: &completed, Version: 2}},
+	}
+	fakeStore.getFunc = func(context.Context, string) (store.Calculation, error) {
+		return store.Calculation{Name: "george", Metadata: store.CalculationMetadata{Version: 1}}, nil
+	}
+
+	deadline := time.Now().Add(-time.Second)
+	job := worker.FibonacciOfJob{OperationName: "george", Position: 5, Deadline: &deadline}
+
+	w := worker.NewFibOf(fakeStore, worker.WithClock(clocktest.NewFake(time.Now(), clocktest.WithAutoAdvance())))
+	if err := w.Handle(context.Background(), FibonacciOfJobJSON(t, job)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
 
-	if fakeStore.setStartedName != job.OperationName {
-		t.Errorf("got %q but expected %q", fakeStore.setStartedName, job.OperationName)
+	if len(fakeStore.saves) != 0 || fakeStore.stored.Metadata.Version != 2 {
+		t.Errorf("expected the calculation done in the meantime to be left alone but saved %v", fakeStore.saves)
 	}
 }
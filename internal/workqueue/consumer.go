@@ -5,25 +5,51 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 var ErrChannelClosed = errors.New("channel was closed")
 
-type handler interface {
+// Handler handles the payload of a message taken from a queue. Returning an
+// error rejects the message, requeueing it unless the error wraps
+// ErrDoNotRequeue.
+type Handler interface {
 	Handle(context.Context, []byte) error
 }
 
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(context.Context, []byte) error
+
+// Handle calls f.
+func (f HandlerFunc) Handle(ctx context.Context, payload []byte) error {
+	return f(ctx, payload)
+}
+
 type AMQP091Consumer struct {
-	conn     amqpConnection
-	strategy handler
+	conn       amqpConnection
+	strategy   Handler
+	middleware []Middleware
 
 	desiredQueueName string
 	durable          bool
+	maxPriority      uint8
+	// deadLetterExchange receives the messages rejected from the queue
+	// without being requeued.
+	deadLetterExchange string
+
+	exchange     string
+	exchangeKind string
+	// bindings are the routing keys binding the queue to the exchange.
+	bindings []string
+
+	// gracePeriod is how long an in-flight message may continue to be handled
+	// after consumption has been canceled.
+	gracePeriod time.Duration
 }
 
-func NewConsumer[T AMQP091Consumer](conn amqpConnection, strategy handler, opts ...AMQP091Option[T]) *T {
+func NewConsumer[T AMQP091Consumer](conn amqpConnection, strategy Handler, opts ...AMQP091Option[T]) *T {
 	c := new(T)
 
 	concrete, ok := any(c).(*AMQP091Consumer)
@@ -45,6 +71,8 @@ func (c *AMQP091Consumer) Start(ctx context.Context) error {
 		return fmt.Errorf("no strategy provided for handling messages")
 	}
 
+	strategy := Chain(c.strategy, c.middleware...)
+
 	recvCh, err := c.conn.Channel()
 	if err != nil {
 		return fmt.Errorf("error opening channel: %w", err)
@@ -58,12 +86,20 @@ func (c *AMQP091Consumer) Start(ctx context.Context) error {
 		false,              // autodelete
 		false,              // exclusive
 		false,              // noWait
-		nil,                // args
+		queueArgs(c.maxPriority, c.deadLetterExchange), // args
 	)
 	if err != nil {
 		return fmt.Errorf("error declaring queue: %w", err)
 	}
 
+	if err := c.bind(recvCh, q); err != nil {
+		return err
+	}
+
+	if err := c.declareDeadLetters(recvCh); err != nil {
+		return err
+	}
+
 	msgs, err := recvCh.Consume(
 		q.Name,
 		"",    // consumer identifier
@@ -78,7 +114,7 @@ func (c *AMQP091Consumer) Start(ctx context.Context) error {
 	}
 
 	for {
-		if err := c.receive(ctx, msgs); errors.Is(err, ErrChannelClosed) {
+		if err := c.receive(ctx, msgs, strategy); errors.Is(err, ErrChannelClosed) {
 			return err
 		} else if ackErr, ok := err.(*AcknowledgementError); ok {
 			return ackErr
@@ -90,7 +126,75 @@ func (c *AMQP091Consumer) Start(ctx context.Context) error {
 	}
 }
 
-func (c *AMQP091Consumer) receive(ctx context.Context, msgs <-chan amqp.Delivery) error {
+// bind declares the consumer's exchange and binds q to it with each routing
+// key. Without bindings, q is bound with its own name. Nothing is done when
+// consuming from the default exchange.
+func (c *AMQP091Consumer) bind(ch *amqp.Channel, q amqp.Queue) error {
+	if c.exchange == "" {
+		return nil
+	}
+
+	err := ch.ExchangeDeclare(
+		c.exchange,
+		c.exchangeKind,
+		c.durable,
+		false, // autodelete
+		false, // internal
+		false, // noWait
+		nil,   // args
+	)
+	if err != nil {
+		return fmt.Errorf("error declaring exchange: %w", err)
+	}
+
+	bindings := c.bindings
+	if len(bindings) == 0 {
+		bindings = []string{q.Name}
+	}
+
+	for _, key := range bindings {
+		if err := ch.QueueBind(q.Name, key, c.exchange, false, nil); err != nil {
+			return fmt.Errorf("error binding queue %q to exchange %q with key %q: %w",
+				q.Name, c.exchange, key, err)
+		}
+	}
+
+	return nil
+}
+
+// declareDeadLetters declares the dead letter exchange as a fanout exchange
+// with a queue of the same name to keep the dead letters in.
+func (c *AMQP091Consumer) declareDeadLetters(ch *amqp.Channel) error {
+	if c.deadLetterExchange == "" {
+		return nil
+	}
+
+	err := ch.ExchangeDeclare(
+		c.deadLetterExchange,
+		amqp.ExchangeFanout,
+		c.durable,
+		false, // autodelete
+		false, // internal
+		false, // noWait
+		nil,   // args
+	)
+	if err != nil {
+		return fmt.Errorf("error declaring dead letter exchange: %w", err)
+	}
+
+	q, err := ch.QueueDeclare(c.deadLetterExchange, c.durable, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring dead letter queue: %w", err)
+	}
+
+	if err := ch.QueueBind(q.Name, "", c.deadLetterExchange, false, nil); err != nil {
+		return fmt.Errorf("error binding dead letter queue: %w", err)
+	}
+
+	return nil
+}
+
+func (c *AMQP091Consumer) receive(ctx context.Context, msgs <-chan amqp.Delivery, strategy Handler) error {
 	var delivery amqp.Delivery
 
 	select {
@@ -103,9 +207,25 @@ func (c *AMQP091Consumer) receive(ctx context.Context, msgs <-chan amqp.Delivery
 		return ErrChannelClosed
 	}
 
-	if err := c.strategy.Handle(ctx, delivery.Body); err != nil {
-		const alwaysRequeue = true
-		if rejectErr := delivery.Reject(alwaysRequeue); rejectErr != nil {
+	// Consumption may have been canceled while a delivery was also ready. Give
+	// the message back rather than starting work that is about to be cut off.
+	if ctx.Err() != nil {
+		const requeue = true
+		if rejectErr := delivery.Reject(requeue); rejectErr != nil {
+			return NewAcknowledgementError(AcknowledgementErrorOpReject, rejectErr, ctx.Err())
+		}
+		return ctx.Err()
+	}
+
+	handlerCtx, cancel := deliveryContext(ctx, c.gracePeriod, Delivery{
+		ContentType: delivery.ContentType,
+		Redelivered: delivery.Redelivered,
+	})
+	defer cancel()
+
+	if err := strategy.Handle(handlerCtx, delivery.Body); err != nil {
+		requeue := !errors.Is(err, ErrDoNotRequeue)
+		if rejectErr := delivery.Reject(requeue); rejectErr != nil {
 			return NewAcknowledgementError(AcknowledgementErrorOpReject, rejectErr, err)
 		}
 		return fmt.Errorf("error handling message: %w", err)
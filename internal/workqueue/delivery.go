@@ -0,0 +1,70 @@
+package workqueue
+
+import (
+	"context"
+	"time"
+)
+
+// Content types of published messages. Handlers should assume ContentTypeJSON
+// when a message has none.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Delivery describes the message being handled. Consumers that know more about
+// a message than its payload give it to the handler's context.
+type Delivery struct {
+	// ContentType is the encoding of the payload.
+	ContentType string
+	// Redelivered reports that the message may have been handled before.
+	Redelivered bool
+}
+
+type deliveryKey struct{}
+
+// ContextWithDelivery returns a copy of ctx carrying d for the handler.
+func ContextWithDelivery(ctx context.Context, d Delivery) context.Context {
+	return context.WithValue(ctx, deliveryKey{}, d)
+}
+
+// DeliveryFromContext returns the Delivery of the message being handled with
+// ctx, if the consumer provided one.
+func DeliveryFromContext(ctx context.Context) (Delivery, bool) {
+	d, ok := ctx.Value(deliveryKey{}).(Delivery)
+	return d, ok
+}
+
+// deliveryContext returns the context to handle the message described by d
+// with, which every consumer gives its handler: it carries d and is detached
+// from ctx like handlerContext.
+func deliveryContext(ctx context.Context, gracePeriod time.Duration, d Delivery) (context.Context, context.CancelFunc) {
+	handlerCtx, cancel := handlerContext(ctx, gracePeriod)
+	return ContextWithDelivery(handlerCtx, d), cancel
+}
+
+// handlerContext detaches the context given to a handler from ctx so that an
+// in-flight message can finish after consumption is canceled. The returned
+// context is canceled once the grace period elapses after ctx is done.
+func handlerContext(ctx context.Context, gracePeriod time.Duration) (context.Context, context.CancelFunc) {
+	handlerCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-handlerCtx.Done():
+			return
+		}
+
+		grace := time.NewTimer(gracePeriod)
+		defer grace.Stop()
+
+		select {
+		case <-grace.C:
+			cancel()
+		case <-handlerCtx.Done():
+		}
+	}()
+
+	return handlerCtx, cancel
+}
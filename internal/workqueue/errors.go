@@ -1,6 +1,17 @@
 package workqueue
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDoNotRequeue may be wrapped by an error returned from a Handler to reject
+// the message without requeueing it, such as when it can never be handled.
+var ErrDoNotRequeue = errors.New("message should not be requeued")
+
+// ErrMessageTimeout is the cause of the handler's context being canceled by
+// Timeout, as opposed to the consumer stopping.
+var ErrMessageTimeout = errors.New("message timed out")
 
 func NewAcknowledgementError(operation string, err, original error) *AcknowledgementError {
 	return &AcknowledgementError{original: original, err: err, operation: operation}
@@ -0,0 +1,454 @@
+package workqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/clock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// An etcd work queue keeps each job under its prefix:
+//
+//	<prefix>/jobs/<id>       the job's payload, in the order it was published
+//	<prefix>/claims/<id>     the consumer handling the job, held by its lease
+//	<prefix>/delivered/<id>  marks a job that has been claimed before
+//	<prefix>/released/<id>   when a job released after failing may be taken again
+//	<prefix>/dead/<id>       jobs rejected without being requeued
+//
+// A consumer claims a job by creating its claim key with the consumer's lease.
+// If the consumer dies, its lease expires, the claim disappears and another
+// consumer may take the job, which is then handled as a redelivery.
+const (
+	etcdJobsDir      = "/jobs/"
+	etcdClaimsDir    = "/claims/"
+	etcdDeliveredDir = "/delivered/"
+	etcdReleasedDir  = "/released/"
+	etcdDeadDir      = "/dead/"
+
+	defaultEtcdPrefix   = "workqueue"
+	defaultClaimTTL     = 30
+	defaultPollInterval = 5 * time.Second
+	defaultReleaseDelay = 5 * time.Second
+)
+
+type etcdQueueClient interface {
+	clientv3.KV
+	clientv3.Lease
+	clientv3.Watcher
+}
+
+// EtcdProducer publishes jobs to a work queue kept in etcd. Message priorities
+// and routing keys are not supported.
+type EtcdProducer struct {
+	cli    clientv3.KV
+	prefix string
+}
+
+func NewEtcdProducer[T EtcdProducer](cli clientv3.KV, opts ...EtcdOption[T]) *T {
+	p := new(T)
+
+	producer, ok := any(p).(*EtcdProducer)
+	if !ok {
+		panic("unsupported producer type")
+	}
+	producer.cli = cli
+	producer.prefix = defaultEtcdPrefix
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	return p
+}
+
+func (p *EtcdProducer) PublishJSON(ctx context.Context, message any) error {
+	b, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("unable to marshal message to JSON: %w", err)
+	}
+
+	key := p.prefix + etcdJobsDir + uuid.NewString()
+	if _, err := p.cli.Put(ctx, key, string(b)); err != nil {
+		return fmt.Errorf("unable to publish message: %w", err)
+	}
+
+	return nil
+}
+
+// maxEtcdTxnOps is how many jobs are published in one transaction, which is
+// the most etcd allows by default.
+const maxEtcdTxnOps = 128
+
+// PublishJSONBatch publishes messages in as few transactions as it can. It
+// returns how many messages were published, which are the first ones, along
+// with the error that stopped it from publishing the rest.
+func (p *EtcdProducer) PublishJSONBatch(ctx context.Context, messages []any) (int, error) {
+	for start := 0; start < len(messages); start += maxEtcdTxnOps {
+		end := min(start+maxEtcdTxnOps, len(messages))
+
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, message := range messages[start:end] {
+			b, err := json.Marshal(message)
+			if err != nil {
+				return start, fmt.Errorf("unable to marshal message to JSON: %w", err)
+			}
+			ops = append(ops, clientv3.OpPut(p.prefix+etcdJobsDir+uuid.NewString(), string(b)))
+		}
+
+		if _, err := p.cli.Txn(ctx).Then(ops...).Commit(); err != nil {
+			return start, fmt.Errorf("unable to publish messages: %w", err)
+		}
+	}
+
+	return len(messages), nil
+}
+
+// Close does nothing; the etcd client belongs to the caller.
+func (p *EtcdProducer) Close() error {
+	return nil
+}
+
+// EtcdConsumer consumes jobs from a work queue kept in etcd. Jobs are handled
+// one at a time, oldest first.
+type EtcdConsumer struct {
+	cli      etcdQueueClient
+	strategy Handler
+
+	id           string
+	prefix       string
+	claimTTL     int64
+	pollInterval time.Duration
+	releaseDelay time.Duration
+	gracePeriod  time.Duration
+	clock        clock.Clock
+}
+
+func NewEtcdConsumer[T EtcdConsumer](cli etcdQueueClient, strategy Handler, opts ...EtcdOption[T]) *T {
+	c := new(T)
+
+	concrete, ok := any(c).(*EtcdConsumer)
+	if !ok {
+		panic("unsupported consumer type")
+	}
+	concrete.cli = cli
+	concrete.strategy = strategy
+	concrete.id = uuid.NewString()
+	concrete.prefix = defaultEtcdPrefix
+	concrete.claimTTL = defaultClaimTTL
+	concrete.pollInterval = defaultPollInterval
+	concrete.releaseDelay = defaultReleaseDelay
+	concrete.clock = clock.Real{}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
+}
+
+// etcdJob is a job claimed by a consumer.
+type etcdJob struct {
+	id   string
+	body []byte
+	// redelivered reports that the job was claimed before.
+	redelivered bool
+}
+
+// ErrClaimLeaseLost is returned by EtcdConsumer.Start when the lease holding
+// its claims could not be kept alive, so that other consumers may take the jobs
+// it claimed.
+var ErrClaimLeaseLost = errors.New("claim lease lost")
+
+// Start handles jobs until ctx is done. Like AMQP091Consumer, a job is removed
+// when it is handled successfully and is otherwise released for any consumer to
+// take again once the release delay has passed, unless the error wraps
+// ErrDoNotRequeue, in which case it is moved to the dead jobs. If the claim lease is lost, Start stops taking jobs, gives
+// the job in progress the grace period to finish and returns ErrClaimLeaseLost.
+func (c *EtcdConsumer) Start(ctx context.Context) error {
+	if c.strategy == nil {
+		return fmt.Errorf("no strategy provided for handling messages")
+	}
+
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+
+	lease, err := c.cli.Grant(ctx, c.claimTTL)
+	if err != nil {
+		return fmt.Errorf("error granting claim lease: %w", err)
+	}
+
+	// Claims must outlive ctx while an in-flight job finishes within the grace
+	// period, so the lease is kept alive until Start returns.
+	keepAliveCtx, stopKeepAlive := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopKeepAlive()
+
+	keepAlive, err := c.cli.KeepAlive(keepAliveCtx, lease.ID)
+	if err != nil {
+		return fmt.Errorf("error keeping claim lease alive: %w", err)
+	}
+	go func() {
+		for range keepAlive {
+		}
+		// The channel closes when the lease expires or can no longer be
+		// kept alive, after which claims made with it would not hold.
+		if keepAliveCtx.Err() == nil {
+			stop(ErrClaimLeaseLost)
+		}
+	}()
+
+	defer func() {
+		// Revoking the lease releases any claim left behind right away
+		// rather than when it expires.
+		revokeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if _, err := c.cli.Revoke(revokeCtx, lease.ID); err != nil {
+			log.Printf("error revoking claim lease: %s", err)
+		}
+	}()
+
+	// Watch for new jobs and released claims to know when to look again.
+	watchCtx, stopWatching := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer stopWatching()
+
+	w := &etcdWatch{cli: c.cli, ctx: watchCtx, key: c.prefix + "/"}
+	w.start()
+
+	poll := time.NewTicker(c.pollInterval)
+	defer poll.Stop()
+
+	for {
+		job, err := c.claim(ctx, lease.ID)
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		} else if err != nil {
+			log.Printf("error claiming job: %s", err)
+		} else if job != nil {
+			c.handle(ctx, *job)
+			continue
+		}
+
+		select {
+		case resp, ok := <-w.changes:
+			w.received(resp, ok)
+		case <-poll.C:
+			// A watch that ended is started again no more often than
+			// polling, so that one failing at once does not spin.
+			if w.changes == nil {
+				w.start()
+			}
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// etcdWatch watches a prefix for changes, resuming after the last revision it
+// saw when the watch ends, such as when its connection is lost.
+type etcdWatch struct {
+	cli clientv3.Watcher
+	ctx context.Context
+	key string
+
+	// changes is nil while there is no watch.
+	changes clientv3.WatchChan
+	// rev is the last revision seen, or 0 to watch from the current one.
+	rev int64
+}
+
+func (w *etcdWatch) start() {
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if w.rev > 0 {
+		opts = append(opts, clientv3.WithRev(w.rev+1))
+	}
+	w.changes = w.cli.Watch(w.ctx, w.key, opts...)
+}
+
+// received handles a response from the watch, or its end when ok is false.
+func (w *etcdWatch) received(resp clientv3.WatchResponse, ok bool) {
+	if ok && resp.Header.Revision > w.rev {
+		w.rev = resp.Header.Revision
+	}
+
+	if ok && !resp.Canceled && resp.Err() == nil {
+		return
+	}
+
+	if w.ctx.Err() != nil {
+		w.changes = nil
+		return
+	}
+
+	if ok && resp.CompactRevision != 0 {
+		// The revisions after the last one seen are gone; the jobs are
+		// listed again before waiting, so watching from now misses none.
+		w.rev = 0
+	}
+
+	if ok {
+		log.Printf("watch of %q ended, watching again at the next poll: %s", w.key, resp.Err())
+	} else {
+		log.Printf("watch of %q ended, watching again at the next poll", w.key)
+	}
+
+	w.changes = nil
+}
+
+// claim claims the oldest job that is neither claimed nor waiting out its
+// release delay, returning nil when there is none.
+func (c *EtcdConsumer) claim(ctx context.Context, lease clientv3.LeaseID) (*etcdJob, error) {
+	claimsPrefix := c.prefix + etcdClaimsDir
+	releasedPrefix := c.prefix + etcdReleasedDir
+	jobsPrefix := c.prefix + etcdJobsDir
+
+	claims, err := c.cli.Get(ctx, claimsPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, fmt.Errorf("error getting claims: %w", err)
+	}
+
+	claimed := make(map[string]bool, len(claims.Kvs))
+	for _, kv := range claims.Kvs {
+		claimed[strings.TrimPrefix(string(kv.Key), claimsPrefix)] = true
+	}
+
+	released, err := c.cli.Get(ctx, releasedPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("error getting released jobs: %w", err)
+	}
+
+	// Jobs still waiting out their release delay are skipped like claimed
+	// ones. Polling finds them once the delay has passed.
+	now := c.clock.Now()
+	for _, kv := range released.Kvs {
+		notBefore, err := time.Parse(time.RFC3339Nano, string(kv.Value))
+		if err != nil {
+			log.Printf("error parsing when job %q may be taken again: %s", kv.Key, err)
+			continue
+		}
+		if now.Before(notBefore) {
+			claimed[strings.TrimPrefix(string(kv.Key), releasedPrefix)] = true
+		}
+	}
+
+	// The oldest jobs are the most likely to be claimed already, so look past
+	// them for a few more.
+	const lookahead = 10
+	jobs, err := c.cli.Get(ctx, jobsPrefix,
+		clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend),
+		clientv3.WithLimit(int64(len(claimed)+lookahead)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting jobs: %w", err)
+	}
+
+	for _, kv := range jobs.Kvs {
+		id := strings.TrimPrefix(string(kv.Key), jobsPrefix)
+		if claimed[id] {
+			continue
+		}
+
+		claimKey := claimsPrefix + id
+		deliveredKey := c.prefix + etcdDeliveredDir + id
+		resp, err := c.cli.Txn(ctx).If(
+			clientv3.Compare(clientv3.CreateRevision(claimKey), "=", 0),
+			clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision),
+		).Then(
+			clientv3.OpGet(deliveredKey, clientv3.WithCountOnly()),
+			clientv3.OpPut(claimKey, c.id, clientv3.WithLease(lease)),
+			clientv3.OpPut(deliveredKey, c.id),
+		).Commit()
+		if err != nil {
+			return nil, fmt.Errorf("error claiming job %q: %w", id, err)
+		}
+
+		if resp.Succeeded {
+			return &etcdJob{
+				id:          id,
+				body:        kv.Value,
+				redelivered: resp.Responses[0].GetResponseRange().GetCount() > 0,
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (c *EtcdConsumer) handle(ctx context.Context, job etcdJob) {
+	handlerCtx, cancel := deliveryContext(ctx, c.gracePeriod, Delivery{
+		ContentType: ContentTypeJSON,
+		Redelivered: job.redelivered,
+	})
+	defer cancel()
+
+	handleErr := c.strategy.Handle(handlerCtx, job.body)
+
+	// Settle the job even if ctx is done so that it is not handled twice.
+	settleCtx, cancelSettle := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancelSettle()
+
+	var err error
+	switch {
+	case handleErr == nil:
+		err = c.ack(settleCtx, job)
+	case errors.Is(handleErr, ErrDoNotRequeue):
+		err = c.deadLetter(settleCtx, job)
+	default:
+		err = c.release(settleCtx, job)
+	}
+
+	if handleErr != nil {
+		log.Printf("error handling message: %s", handleErr)
+	}
+	if err != nil {
+		log.Printf("error settling job %q: %s", job.id, err)
+	}
+}
+
+func (c *EtcdConsumer) ack(ctx context.Context, job etcdJob) error {
+	_, err := c.cli.Txn(ctx).Then(
+		clientv3.OpDelete(c.prefix+etcdJobsDir+job.id),
+		clientv3.OpDelete(c.prefix+etcdClaimsDir+job.id),
+		clientv3.OpDelete(c.prefix+etcdDeliveredDir+job.id),
+		clientv3.OpDelete(c.prefix+etcdReleasedDir+job.id),
+	).Commit()
+	if err != nil {
+		return NewAcknowledgementError(AcknowledgementErrorOpAck, err, nil)
+	}
+	return nil
+}
+
+// release gives up the claim on a job that failed, holding it back for the
+// release delay so that it is not taken again at once only to fail the same
+// way.
+func (c *EtcdConsumer) release(ctx context.Context, job etcdJob) error {
+	notBefore := c.clock.Now().Add(c.releaseDelay)
+	_, err := c.cli.Txn(ctx).Then(
+		clientv3.OpPut(c.prefix+etcdReleasedDir+job.id, notBefore.Format(time.RFC3339Nano)),
+		clientv3.OpDelete(c.prefix+etcdClaimsDir+job.id),
+	).Commit()
+	if err != nil {
+		return NewAcknowledgementError(AcknowledgementErrorOpReject, err, nil)
+	}
+	return nil
+}
+
+func (c *EtcdConsumer) deadLetter(ctx context.Context, job etcdJob) error {
+	_, err := c.cli.Txn(ctx).Then(
+		clientv3.OpPut(c.prefix+etcdDeadDir+job.id, string(job.body)),
+		clientv3.OpDelete(c.prefix+etcdJobsDir+job.id),
+		clientv3.OpDelete(c.prefix+etcdClaimsDir+job.id),
+		clientv3.OpDelete(c.prefix+etcdDeliveredDir+job.id),
+		clientv3.OpDelete(c.prefix+etcdReleasedDir+job.id),
+	).Commit()
+	if err != nil {
+		return NewAcknowledgementError(AcknowledgementErrorOpReject, err, nil)
+	}
+	return nil
+}
@@ -0,0 +1,451 @@
+package workqueue_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vickleford/calculator/internal/clock/clocktest"
+	"github.com/vickleford/calculator/internal/workqueue"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func newEtcdTestClient(t *testing.T) *clientv3.Client {
+	t.Helper()
+
+	etcdEndpoint := os.Getenv("ETCD_ENDPOINT")
+	if etcdEndpoint == "" {
+		t.Skip(`set ETCD_ENDPOINT to run this test, e.g. ETCD_ENDPOINT="localhost:2379"`)
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdEndpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to set up client: %s", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+
+	return cli
+}
+
+func TestIntegration_Etcd_PublishAndConsumeJSON(t *testing.T) {
+	cli := newEtcdTestClient(t)
+	prefix := "integration/" + uuid.NewString()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	producer := workqueue.NewEtcdProducer(cli,
+		workqueue.WithPrefix[workqueue.EtcdProducer](prefix))
+
+	for i := 0; i < 3; i++ {
+		if err := producer.PublishJSON(ctx, map[string]int{"n": i}); err != nil {
+			t.Fatalf("unexpected error publishing: %s", err)
+		}
+	}
+
+	var received []int
+	h := consumerHandlerFunc(func(ctx context.Context, payload []byte) error {
+		var msg map[string]int
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			t.Errorf("unexpected error unmarshaling JSON: %s", err)
+		}
+		received = append(received, msg["n"])
+		if len(received) == 3 {
+			cancel()
+		}
+		return nil
+	})
+
+	consumer := workqueue.NewEtcdConsumer(cli, h,
+		workqueue.WithPrefix[workqueue.EtcdConsumer](prefix))
+	consumer.Start(ctx)
+
+	if fmt.Sprint(received) != "[0 1 2]" {
+		t.Errorf("expected jobs in the order they were published but got %v", received)
+	}
+
+	resp, err := cli.Get(context.Background(), prefix+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		t.Fatalf("unexpected error getting queue: %s", err)
+	}
+	if resp.Count != 0 {
+		t.Errorf("expected acknowledged jobs to be removed but %d keys remain", resp.Count)
+	}
+}
+
+func TestIntegration_Etcd_ExpiredClaimIsTakenAgain(t *testing.T) {
+	cli := newEtcdTestClient(t)
+	prefix := "integration/" + uuid.NewString()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	producer := workqueue.NewEtcdProducer(cli,
+		workqueue.WithPrefix[workqueue.EtcdProducer](prefix))
+	if err := producer.PublishJSON(ctx, "hello"); err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+
+	// Claim the job as a worker that crashes and never renews its lease.
+	jobs, err := cli.Get(ctx, prefix+"/jobs/", clientv3.WithPrefix())
+	if err != nil || len(jobs.Kvs) != 1 {
+		t.Fatalf("expected 1 job but got %v (error %v)", jobs, err)
+	}
+	id := strings.TrimPrefix(string(jobs.Kvs[0].Key), prefix+"/jobs/")
+
+	lease, err := cli.Grant(ctx, 1)
+	if err != nil {
+		t.Fatalf("unexpected error granting lease: %s", err)
+	}
+	if _, err := cli.Put(ctx, prefix+"/claims/"+id, "crashed", clientv3.WithLease(lease.ID)); err != nil {
+		t.Fatalf("unexpected error claiming job: %s", err)
+	}
+	if _, err := cli.Put(ctx, prefix+"/delivered/"+id, "crashed"); err != nil {
+		t.Fatalf("unexpected error marking job delivered: %s", err)
+	}
+
+	claimed := time.Now()
+	var retakenAfter time.Duration
+	var delivery workqueue.Delivery
+	h := consumerHandlerFunc(func(ctx context.Context, payload []byte) error {
+		retakenAfter = time.Since(claimed)
+		delivery, _ = workqueue.DeliveryFromContext(ctx)
+		cancel()
+		return nil
+	})
+
+	consumer := workqueue.NewEtcdConsumer(cli, h,
+		workqueue.WithPrefix[workqueue.EtcdConsumer](prefix),
+		workqueue.WithPollInterval[workqueue.EtcdConsumer](100*time.Millisecond))
+	consumer.Start(ctx)
+
+	if retakenAfter == 0 {
+		t.Fatal("expected the job to be taken once its claim expired")
+	}
+	if retakenAfter < 500*time.Millisecond {
+		t.Errorf("expected the job to stay claimed until the lease expired but it was taken after %s", retakenAfter)
+	}
+	if !delivery.Redelivered {
+		t.Error("expected the job taken again to be redelivered")
+	}
+}
+
+func TestIntegration_Etcd_RejectedJobs(t *testing.T) {
+	cli := newEtcdTestClient(t)
+	prefix := "integration/" + uuid.NewString()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	producer := workqueue.NewEtcdProducer(cli,
+		workqueue.WithPrefix[workqueue.EtcdProducer](prefix))
+	if err := producer.PublishJSON(ctx, "hello"); err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+
+	var attempts int
+	h := consumerHandlerFunc(func(ctx context.Context, payload []byte) error {
+		attempts++
+		if attempts == 1 {
+			return fmt.Errorf("try again")
+		}
+		cancel()
+		return fmt.Errorf("give up: %w", workqueue.ErrDoNotRequeue)
+	})
+
+	consumer := workqueue.NewEtcdConsumer(cli, h,
+		workqueue.WithPrefix[workqueue.EtcdConsumer](prefix))
+	consumer.Start(ctx)
+
+	if attempts != 2 {
+		t.Errorf("expected the requeued job to be handled again but it was handled %d times", attempts)
+	}
+
+	getCtx := context.Background()
+	jobs, err := cli.Get(getCtx, prefix+"/jobs/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		t.Fatalf("unexpected error getting jobs: %s", err)
+	}
+	if jobs.Count != 0 {
+		t.Errorf("expected the rejected job to leave the queue but %d jobs remain", jobs.Count)
+	}
+
+	dead, err := cli.Get(getCtx, prefix+"/dead/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatalf("unexpected error getting dead jobs: %s", err)
+	}
+	if len(dead.Kvs) != 1 || string(dead.Kvs[0].Value) != `"hello"` {
+		t.Errorf("expected the rejected job to be kept with the dead jobs but got %v", dead.Kvs)
+	}
+}
+
+func TestIntegration_Etcd_PublishJSONBatch(t *testing.T) {
+	cli := newEtcdTestClient(t)
+	prefix := "integration/" + uuid.NewString()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	producer := workqueue.NewEtcdProducer(cli,
+		workqueue.WithPrefix[workqueue.EtcdProducer](prefix))
+
+	// More messages than fit in one transaction.
+	messages := make([]any, 300)
+	for i := range messages {
+		messages[i] = map[string]int{"n": i}
+	}
+
+	n, err := producer.PublishJSONBatch(ctx, messages)
+	if err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+	if n != len(messages) {
+		t.Errorf("expected %d messages published but got %d", len(messages), n)
+	}
+
+	resp, err := cli.Get(ctx, prefix+"/jobs/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		t.Fatalf("unable to count jobs: %s", err)
+	}
+	if resp.Count != int64(len(messages)) {
+		t.Errorf("expected %d jobs queued but found %d", len(messages), resp.Count)
+	}
+}
+
+// flakyEtcd is an etcd client whose lease and watches end when told to and
+// whose queue is always empty.
+type flakyEtcd struct {
+	clientv3.KV
+	clientv3.Lease
+	clientv3.Watcher
+
+	// keepAlive is returned by KeepAlive; closing it loses the lease.
+	keepAlive chan *clientv3.LeaseKeepAliveResponse
+	// closedWatches makes every watch end at once.
+	closedWatches bool
+
+	gets    atomic.Int64
+	watches atomic.Int64
+}
+
+func (e *flakyEtcd) Close() error {
+	return nil
+}
+
+func (e *flakyEtcd) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	return &clientv3.LeaseGrantResponse{ID: 1, TTL: ttl}, nil
+}
+
+func (e *flakyEtcd) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	return e.keepAlive, nil
+}
+
+func (e *flakyEtcd) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func (e *flakyEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	e.watches.Add(1)
+	ch := make(chan clientv3.WatchResponse)
+	if e.closedWatches {
+		close(ch)
+	}
+	return ch
+}
+
+func (e *flakyEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	e.gets.Add(1)
+	return &clientv3.GetResponse{}, nil
+}
+
+func TestEtcdConsumer_StopsWhenTheClaimLeaseIsLost(t *testing.T) {
+	cli := &flakyEtcd{keepAlive: make(chan *clientv3.LeaseKeepAliveResponse)}
+	h := consumerHandlerFunc(func(ctx context.Context, payload []byte) error { return nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	consumer := workqueue.NewEtcdConsumer(cli, h)
+
+	errs := make(chan error)
+	go func() { errs <- consumer.Start(ctx) }()
+
+	close(cli.keepAlive)
+
+	if err := <-errs; !errors.Is(err, workqueue.ErrClaimLeaseLost) {
+		t.Errorf("expected the lost lease to stop the consumer but got %v", err)
+	}
+}
+
+func TestEtcdConsumer_WatchesAgainWithoutSpinning(t *testing.T) {
+	cli := &flakyEtcd{
+		keepAlive:     make(chan *clientv3.LeaseKeepAliveResponse),
+		closedWatches: true,
+	}
+	h := consumerHandlerFunc(func(ctx context.Context, payload []byte) error { return nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	consumer := workqueue.NewEtcdConsumer(cli, h,
+		workqueue.WithPollInterval[workqueue.EtcdConsumer](50*time.Millisecond))
+	consumer.Start(ctx)
+
+	// Claiming gets the claims, the released jobs and the jobs, so each
+	// pass is 3 gets: one for the closed watch and one per poll.
+	if gets := cli.gets.Load(); gets > 45 {
+		t.Errorf("expected to look for jobs about once per poll but looked %d times", gets/3)
+	}
+	if watches := cli.watches.Load(); watches < 2 {
+		t.Errorf("expected the closed watch to be started again but it was started %d times", watches)
+	}
+}
+
+// memoryEtcd is an etcd client keeping keys in memory, enough for a consumer
+// to claim and settle jobs. Comparisons are not checked, so only one consumer
+// may use it at a time.
+type memoryEtcd struct {
+	flakyEtcd
+
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func (e *memoryEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	e.gets.Add(1)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return &clientv3.GetResponse{Kvs: e.prefixed(key)}, nil
+}
+
+func (e *memoryEtcd) prefixed(prefix string) []*mvccpb.KeyValue {
+	var kvs []*mvccpb.KeyValue
+	for k, v := range e.keys {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(v)})
+		}
+	}
+	slices.SortFunc(kvs, func(a, b *mvccpb.KeyValue) int { return bytes.Compare(a.Key, b.Key) })
+	return kvs
+}
+
+func (e *memoryEtcd) Txn(ctx context.Context) clientv3.Txn {
+	return &memoryTxn{e: e}
+}
+
+type memoryTxn struct {
+	e   *memoryEtcd
+	ops []clientv3.Op
+}
+
+func (t *memoryTxn) If(cs ...clientv3.Cmp) clientv3.Txn   { return t }
+func (t *memoryTxn) Else(ops ...clientv3.Op) clientv3.Txn { return t }
+
+func (t *memoryTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.ops = ops
+	return t
+}
+
+func (t *memoryTxn) Commit() (*clientv3.TxnResponse, error) {
+	t.e.mu.Lock()
+	defer t.e.mu.Unlock()
+
+	resp := &clientv3.TxnResponse{Succeeded: true}
+	for _, op := range t.ops {
+		key := string(op.KeyBytes())
+		switch {
+		case op.IsGet():
+			var count int64
+			if _, ok := t.e.keys[key]; ok {
+				count = 1
+			}
+			resp.Responses = append(resp.Responses, &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponseRange{
+					ResponseRange: &etcdserverpb.RangeResponse{Count: count},
+				},
+			})
+		case op.IsPut():
+			t.e.keys[key] = string(op.ValueBytes())
+			resp.Responses = append(resp.Responses, &etcdserverpb.ResponseOp{})
+		case op.IsDelete():
+			delete(t.e.keys, key)
+			resp.Responses = append(resp.Responses, &etcdserverpb.ResponseOp{})
+		}
+	}
+	return resp, nil
+}
+
+func TestEtcdConsumer_HoldsBackReleasedJobs(t *testing.T) {
+	cli := &memoryEtcd{
+		flakyEtcd: flakyEtcd{keepAlive: make(chan *clientv3.LeaseKeepAliveResponse)},
+		keys:      map[string]string{"workqueue/jobs/1": `"hello"`},
+	}
+	clk := clocktest.NewFake(time.Now())
+
+	deliveries := make(chan workqueue.Delivery, 10)
+	h := consumerHandlerFunc(func(ctx context.Context, payload []byte) error {
+		delivery, _ := workqueue.DeliveryFromContext(ctx)
+		select {
+		case deliveries <- delivery:
+		default:
+		}
+		return errors.New("failed")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	consumer := workqueue.NewEtcdConsumer(cli, h,
+		workqueue.WithPollInterval[workqueue.EtcdConsumer](time.Millisecond),
+		workqueue.WithReleaseDelay[workqueue.EtcdConsumer](time.Minute),
+		workqueue.WithEtcdClock[workqueue.EtcdConsumer](clk))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if first := <-deliveries; first.Redelivered {
+		t.Error("expected the first delivery not to be a redelivery")
+	}
+
+	// Let the consumer look for jobs a good many times while the released
+	// job is held back.
+	for gets := cli.gets.Load(); cli.gets.Load() < gets+50 && ctx.Err() == nil; {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(deliveries); n != 0 {
+		t.Fatalf("expected the released job to be held back but it was taken %d more times", n)
+	}
+
+	clk.Advance(time.Minute)
+
+	select {
+	case second := <-deliveries:
+		if !second.Redelivered {
+			t.Error("expected the job taken again to be redelivered")
+		}
+	case <-ctx.Done():
+		t.Fatal("expected the released job to be taken again once the delay passed")
+	}
+}
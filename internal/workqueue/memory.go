@@ -0,0 +1,216 @@
+package workqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Memory is a work queue held in memory. It publishes like Producer and is
+// consumed by a MemoryConsumer like an AMQP091Consumer, so that the whole
+// pipeline can run in one process, such as in tests. Messages are delivered in
+// the order they were published and are lost when the process exits.
+type Memory struct {
+	mu       sync.Mutex
+	messages []memoryMessage
+	// unacked counts messages taken by consumers but not yet acknowledged.
+	unacked     int
+	deadLetters [][]byte
+
+	// ready signals consumers waiting for a message that one may be available.
+	ready chan struct{}
+}
+
+type memoryMessage struct {
+	body []byte
+	// redelivered is set once the message was requeued, as it may have been
+	// handled before.
+	redelivered bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{ready: make(chan struct{}, 1)}
+}
+
+// PublishJSON adds message to the queue as JSON.
+func (q *Memory) PublishJSON(ctx context.Context, message any) error {
+	b, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("unable to marshal message to JSON: %w", err)
+	}
+
+	q.mu.Lock()
+	q.messages = append(q.messages, memoryMessage{body: b})
+	q.mu.Unlock()
+
+	q.signal()
+
+	return nil
+}
+
+// PublishJSONBatch adds messages to the queue as JSON, all or none of them. It
+// returns how many messages were published.
+func (q *Memory) PublishJSONBatch(ctx context.Context, messages []any) (int, error) {
+	batch := make([]memoryMessage, 0, len(messages))
+	for _, message := range messages {
+		b, err := json.Marshal(message)
+		if err != nil {
+			return 0, fmt.Errorf("unable to marshal message to JSON: %w", err)
+		}
+		batch = append(batch, memoryMessage{body: b})
+	}
+
+	q.mu.Lock()
+	q.messages = append(q.messages, batch...)
+	q.mu.Unlock()
+
+	q.signal()
+
+	return len(messages), nil
+}
+
+// Len returns how many messages are waiting to be consumed, not counting those
+// being handled.
+func (q *Memory) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// Unacked returns how many messages are being handled by consumers.
+func (q *Memory) Unacked() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.unacked
+}
+
+// DeadLetters returns the bodies of messages that were rejected without being
+// requeued.
+func (q *Memory) DeadLetters() [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([][]byte(nil), q.deadLetters...)
+}
+
+func (q *Memory) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for the next message and removes it from the queue until it is
+// acknowledged or rejected.
+func (q *Memory) take(ctx context.Context) (memoryMessage, error) {
+	for {
+		q.mu.Lock()
+		if len(q.messages) > 0 {
+			msg := q.messages[0]
+			q.messages = q.messages[1:]
+			q.unacked++
+			remaining := len(q.messages)
+			q.mu.Unlock()
+
+			// Pass the signal along so that other consumers wake up too.
+			if remaining > 0 {
+				q.signal()
+			}
+
+			return msg, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return memoryMessage{}, ctx.Err()
+		}
+	}
+}
+
+func (q *Memory) ack() {
+	q.mu.Lock()
+	q.unacked--
+	q.mu.Unlock()
+}
+
+// reject returns msg to the front of the queue marked as redelivered, as
+// RabbitMQ does, or moves it to the dead letters.
+func (q *Memory) reject(msg memoryMessage, requeue bool) {
+	q.mu.Lock()
+	q.unacked--
+	if requeue {
+		msg.redelivered = true
+		q.messages = append([]memoryMessage{msg}, q.messages...)
+	} else {
+		q.deadLetters = append(q.deadLetters, msg.body)
+	}
+	q.mu.Unlock()
+
+	if requeue {
+		q.signal()
+	}
+}
+
+// MemoryConsumer consumes messages from a Memory queue. Any number of consumers
+// may compete for the messages of one queue.
+type MemoryConsumer struct {
+	queue    *Memory
+	strategy Handler
+
+	middleware []Middleware
+	// gracePeriod is how long an in-flight message may continue to be handled
+	// after consumption is canceled.
+	gracePeriod time.Duration
+}
+
+// NewMemoryConsumer creates a consumer of q handling messages with strategy.
+func NewMemoryConsumer(q *Memory, strategy Handler, opts ...MemoryOption[MemoryConsumer]) *MemoryConsumer {
+	c := &MemoryConsumer{queue: q}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	if strategy != nil {
+		c.strategy = Chain(strategy, c.middleware...)
+	}
+	return c
+}
+
+// Start handles messages until ctx is done. Like AMQP091Consumer, a message is
+// acknowledged when it is handled successfully and is otherwise rejected,
+// being requeued unless the error wraps ErrDoNotRequeue, and the handler is
+// given the grace period and the message's Delivery. A message being handled
+// when ctx is done is requeued if it fails.
+func (c *MemoryConsumer) Start(ctx context.Context) error {
+	if c.strategy == nil {
+		return fmt.Errorf("no strategy provided for handling messages")
+	}
+
+	for {
+		msg, err := c.queue.take(ctx)
+		if err != nil {
+			return err
+		}
+
+		handlerCtx, cancel := deliveryContext(ctx, c.gracePeriod, Delivery{
+			ContentType: ContentTypeJSON,
+			Redelivered: msg.redelivered,
+		})
+		err = c.strategy.Handle(handlerCtx, msg.body)
+		cancel()
+
+		if err != nil {
+			c.queue.reject(msg, !errors.Is(err, ErrDoNotRequeue))
+			log.Printf("error handling message: %s", err)
+			continue
+		}
+
+		c.queue.ack()
+	}
+}
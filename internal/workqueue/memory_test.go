@@ -0,0 +1,233 @@
+package workqueue_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vickleford/calculator/internal/workqueue"
+)
+
+func TestMemory_PublishAndConsumeJSON(t *testing.T) {
+	q := workqueue.NewMemory()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, id := range []string{"first", "second"} {
+		if err := q.PublishJSON(ctx, map[string]string{"id": id}); err != nil {
+			t.Fatalf("unexpected error publishing: %s", err)
+		}
+	}
+
+	if q.Len() != 2 {
+		t.Errorf("expected 2 messages waiting but got %d", q.Len())
+	}
+
+	received := make(chan string)
+	consumer := workqueue.NewMemoryConsumer(q, workqueue.HandlerFunc(func(ctx context.Context, payload []byte) error {
+		var msg map[string]string
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			t.Errorf("unexpected error ummarshaling JSON: %s", err)
+		}
+		received <- msg["id"]
+		return nil
+	}))
+
+	go consumer.Start(ctx)
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case actual := <-received:
+			if actual != expected {
+				t.Errorf("expected message %q but got %q", expected, actual)
+			}
+		case <-ctx.Done():
+			t.Fatalf("never received message %q", expected)
+		}
+	}
+}
+
+func TestMemory_RequeuesFailedMessages(t *testing.T) {
+	q := workqueue.NewMemory()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := q.PublishJSON(ctx, "retry me"); err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+
+	var attempts int
+	handled := make(chan struct{})
+	consumer := workqueue.NewMemoryConsumer(q, workqueue.HandlerFunc(func(context.Context, []byte) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("not yet")
+		}
+		close(handled)
+		return nil
+	}))
+
+	go consumer.Start(ctx)
+
+	select {
+	case <-handled:
+	case <-ctx.Done():
+		t.Fatal("message was never handled successfully")
+	}
+
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts but got %d", attempts)
+	}
+}
+
+func TestMemory_DeadLettersWithoutRequeue(t *testing.T) {
+	q := workqueue.NewMemory()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := q.PublishJSON(ctx, "poison"); err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+
+	consumer := workqueue.NewMemoryConsumer(q,
+		workqueue.HandlerFunc(func(context.Context, []byte) error {
+			panic("cannot handle this")
+		}),
+		workqueue.WithMemoryMiddleware[workqueue.MemoryConsumer](workqueue.Recover()),
+	)
+
+	go consumer.Start(ctx)
+
+	for len(q.DeadLetters()) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("message was never dead lettered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if string(q.DeadLetters()[0]) != `"poison"` {
+		t.Errorf("unexpected dead letter: %s", q.DeadLetters()[0])
+	}
+
+	if q.Len() != 0 || q.Unacked() != 0 {
+		t.Errorf("expected an empty queue but %d are waiting and %d unacked", q.Len(), q.Unacked())
+	}
+}
+
+func TestMemory_ConsumersCompete(t *testing.T) {
+	q := workqueue.NewMemory()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const messages = 100
+
+	var mu sync.Mutex
+	seen := make(map[int]int)
+	var wg sync.WaitGroup
+	wg.Add(messages)
+
+	h := workqueue.HandlerFunc(func(ctx context.Context, payload []byte) error {
+		var n int
+		if err := json.Unmarshal(payload, &n); err != nil {
+			t.Errorf("unexpected error ummarshaling JSON: %s", err)
+		}
+		mu.Lock()
+		seen[n]++
+		mu.Unlock()
+		wg.Done()
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		go workqueue.NewMemoryConsumer(q, h).Start(ctx)
+	}
+
+	for i := 0; i < messages; i++ {
+		if err := q.PublishJSON(ctx, i); err != nil {
+			t.Fatalf("unexpected error publishing: %s", err)
+		}
+	}
+
+	wg.Wait()
+
+	for i := 0; i < messages; i++ {
+		if seen[i] != 1 {
+			t.Errorf("message %d was handled %d times", i, seen[i])
+		}
+	}
+}
+
+func TestMemoryConsumer_StopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	consumer := workqueue.NewMemoryConsumer(workqueue.NewMemory(),
+		workqueue.HandlerFunc(func(context.Context, []byte) error { return nil }))
+
+	if err := consumer.Start(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestMemory_PublishJSONBatch(t *testing.T) {
+	q := workqueue.NewMemory()
+
+	n, err := q.PublishJSONBatch(context.Background(), []any{map[string]int{"n": 1}, map[string]int{"n": 2}})
+	if err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+
+	if n != 2 || q.Len() != 2 {
+		t.Errorf("expected 2 messages published and queued but published %d and queued %d", n, q.Len())
+	}
+}
+
+func TestMemoryConsumer_GivesHandlersTheDeliveryAndGracePeriod(t *testing.T) {
+	q := workqueue.NewMemory()
+	if err := q.PublishJSON(context.Background(), "slow"); err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan struct{})
+	handled := make(chan error, 1)
+	consumer := workqueue.NewMemoryConsumer(q, workqueue.HandlerFunc(func(ctx context.Context, payload []byte) error {
+		if d, ok := workqueue.DeliveryFromContext(ctx); !ok || d.ContentType != workqueue.ContentTypeJSON || d.Redelivered {
+			t.Errorf("expected a first JSON delivery but got %+v", d)
+		}
+
+		close(started)
+		// Outlive the consumer's context within the grace period.
+		select {
+		case <-time.After(50 * time.Millisecond):
+			handled <- nil
+		case <-ctx.Done():
+			handled <- ctx.Err()
+		}
+		return nil
+	}), workqueue.WithMemoryGracePeriod[workqueue.MemoryConsumer](5*time.Second))
+
+	done := make(chan error)
+	go func() { done <- consumer.Start(ctx) }()
+
+	<-started
+	cancel()
+
+	if err := <-handled; err != nil {
+		t.Errorf("expected the handler to finish within the grace period but got %s", err)
+	}
+	<-done
+
+	if q.Len() != 0 || q.Unacked() != 0 {
+		t.Errorf("expected the message to be acknowledged but %d are waiting and %d unacked", q.Len(), q.Unacked())
+	}
+}
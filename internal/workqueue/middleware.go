@@ -0,0 +1,161 @@
+package workqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Middleware wraps a Handler to add behavior around handling each message.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with middleware. The first middleware given is the outermost,
+// so it sees each message first and each result last.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Recover turns a panic while handling a message into an error wrapping
+// ErrDoNotRequeue. The message is rejected instead of crashing the consumer,
+// and is not requeued since it would likely panic again.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, payload []byte) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%w: panic handling message: %v\n%s",
+						ErrDoNotRequeue, r, debug.Stack())
+				}
+			}()
+
+			return next.Handle(ctx, payload)
+		})
+	}
+}
+
+// Timeout cancels the context given to the wrapped handler after d, with
+// ErrMessageTimeout as its cause.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, payload []byte) error {
+			ctx, cancel := context.WithTimeoutCause(ctx, d, ErrMessageTimeout)
+			defer cancel()
+
+			return next.Handle(ctx, payload)
+		})
+	}
+}
+
+// Logging logs the outcome and duration of handling each message.
+func Logging(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, payload []byte) error {
+			start := time.Now()
+			err := next.Handle(ctx, payload)
+
+			attrs := []any{
+				slog.Int("bytes", len(payload)),
+				slog.Duration("duration", time.Since(start)),
+			}
+
+			if err != nil {
+				attrs = append(attrs,
+					slog.String("outcome", outcome(err)),
+					slog.Any("error", err),
+				)
+				logger.ErrorContext(ctx, "error handling message", attrs...)
+				return err
+			}
+
+			logger.InfoContext(ctx, "handled message", attrs...)
+			return nil
+		})
+	}
+}
+
+const (
+	outcomeAcked    = "acked"
+	outcomeRequeued = "requeued"
+	outcomeRejected = "rejected"
+)
+
+// outcome describes what will become of a message given the error from
+// handling it.
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return outcomeAcked
+	case errors.Is(err, ErrDoNotRequeue):
+		return outcomeRejected
+	default:
+		return outcomeRequeued
+	}
+}
+
+// HandlerMetrics is a prometheus.Collector describing the messages handled by a
+// consumer. Register it, then add its Middleware to the consumer.
+type HandlerMetrics struct {
+	handled  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+}
+
+func NewHandlerMetrics() *HandlerMetrics {
+	return &HandlerMetrics{
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "workqueue",
+			Name:      "messages_handled_total",
+			Help:      "Total number of messages handled by outcome.",
+		}, []string{"outcome"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "workqueue",
+			Name:      "message_handling_seconds",
+			Help:      "Time spent handling a message by outcome.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"outcome"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "workqueue",
+			Name:      "messages_in_flight",
+			Help:      "Number of messages currently being handled.",
+		}),
+	}
+}
+
+func (m *HandlerMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.handled.Describe(ch)
+	m.duration.Describe(ch)
+	m.inFlight.Describe(ch)
+}
+
+func (m *HandlerMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.handled.Collect(ch)
+	m.duration.Collect(ch)
+	m.inFlight.Collect(ch)
+}
+
+// Middleware instruments each message handled.
+func (m *HandlerMetrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, payload []byte) error {
+			m.inFlight.Inc()
+			defer m.inFlight.Dec()
+
+			start := time.Now()
+			err := next.Handle(ctx, payload)
+
+			result := outcome(err)
+			m.handled.WithLabelValues(result).Inc()
+			m.duration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+
+			return err
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package workqueue_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vickleford/calculator/internal/workqueue"
+)
+
+func TestChain_FirstMiddlewareIsOutermost(t *testing.T) {
+	var seen []string
+
+	record := func(name string) workqueue.Middleware {
+		return func(next workqueue.Handler) workqueue.Handler {
+			return workqueue.HandlerFunc(func(ctx context.Context, payload []byte) error {
+				seen = append(seen, name+" before")
+				err := next.Handle(ctx, payload)
+				seen = append(seen, name+" after")
+				return err
+			})
+		}
+	}
+
+	h := workqueue.Chain(
+		workqueue.HandlerFunc(func(context.Context, []byte) error {
+			seen = append(seen, "handler")
+			return nil
+		}),
+		record("outer"),
+		record("inner"),
+	)
+
+	if err := h.Handle(context.Background(), nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	expected := "outer before,inner before,handler,inner after,outer after"
+	if actual := strings.Join(seen, ","); actual != expected {
+		t.Errorf("expected order %q but got %q", expected, actual)
+	}
+}
+
+func TestRecover_TurnsPanicIntoRejection(t *testing.T) {
+	h := workqueue.Chain(
+		workqueue.HandlerFunc(func(context.Context, []byte) error {
+			panic("oh no")
+		}),
+		workqueue.Recover(),
+	)
+
+	err := h.Handle(context.Background(), nil)
+	if !errors.Is(err, workqueue.ErrDoNotRequeue) {
+		t.Errorf("expected error to wrap ErrDoNotRequeue but got %#v", err)
+	}
+
+	if err != nil && !strings.Contains(err.Error(), "oh no") {
+		t.Errorf("expected the panic value in the error: %q", err)
+	}
+}
+
+func TestRecover_PassesThroughErrors(t *testing.T) {
+	expected := errors.New("regular failure")
+
+	h := workqueue.Chain(
+		workqueue.HandlerFunc(func(context.Context, []byte) error {
+			return expected
+		}),
+		workqueue.Recover(),
+	)
+
+	if err := h.Handle(context.Background(), nil); err != expected {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestTimeout_CancelsHandlerContext(t *testing.T) {
+	h := workqueue.Chain(
+		workqueue.HandlerFunc(func(ctx context.Context, _ []byte) error {
+			select {
+			case <-ctx.Done():
+				if cause := context.Cause(ctx); !errors.Is(cause, workqueue.ErrMessageTimeout) {
+					t.Errorf("expected the message timeout as the cause but got %v", cause)
+				}
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}),
+		workqueue.Timeout(10*time.Millisecond),
+	)
+
+	if err := h.Handle(context.Background(), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestLogging_LogsOutcome(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	h := workqueue.Chain(
+		workqueue.HandlerFunc(func(context.Context, []byte) error {
+			return errors.New("bad things")
+		}),
+		workqueue.Logging(logger),
+	)
+
+	if err := h.Handle(context.Background(), []byte("abc")); err == nil {
+		t.Error("expected the handler's error to be returned")
+	}
+
+	for _, expected := range []string{"level=ERROR", "bytes=3", "outcome=requeued", "error=\"bad things\""} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected log to contain %q: %s", expected, buf.String())
+		}
+	}
+}
+
+func TestHandlerMetrics_CountsOutcomes(t *testing.T) {
+	metrics := workqueue.NewHandlerMetrics()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics)
+
+	results := []error{
+		nil,
+		nil,
+		errors.New("try again"),
+		workqueue.ErrDoNotRequeue,
+	}
+
+	for _, result := range results {
+		result := result
+		h := workqueue.Chain(
+			workqueue.HandlerFunc(func(context.Context, []byte) error {
+				return result
+			}),
+			metrics.Middleware(),
+		)
+		_ = h.Handle(context.Background(), nil)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+
+	counts := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "workqueue_messages_handled_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			counts[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+
+	expected := map[string]float64{"acked": 2, "requeued": 1, "rejected": 1}
+	for outcome, n := range expected {
+		if counts[outcome] != n {
+			t.Errorf("expected %v %s messages but got %v", n, outcome, counts[outcome])
+		}
+	}
+}
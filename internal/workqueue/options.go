@@ -1,5 +1,11 @@
 package workqueue
 
+import (
+	"time"
+
+	"github.com/vickleford/calculator/internal/clock"
+)
+
 type AMQP091Option[T Producer | AMQP091Consumer] func(*T)
 
 func WithQueueName[T Producer | AMQP091Consumer](name string) AMQP091Option[T] {
@@ -27,3 +33,230 @@ func WithDurableQueue[T Producer | AMQP091Consumer]() AMQP091Option[T] {
 		}
 	}
 }
+
+// WithMaxPriority declares the queue as a priority queue supporting message
+// priorities up to max. RabbitMQ recommends keeping it at 10 or lower. The
+// queue must be declared with the same maximum everywhere it is used.
+func WithMaxPriority[T Producer | AMQP091Consumer](max uint8) AMQP091Option[T] {
+	return func(t *T) {
+		switch concrete := any(t).(type) {
+		case *Producer:
+			concrete.maxPriority = max
+		case *AMQP091Consumer:
+			concrete.maxPriority = max
+		default:
+			panic("unsupported type")
+		}
+	}
+}
+
+// WithDeadLetterExchange declares the queue to send the messages rejected
+// without being requeued, such as with ErrDoNotRequeue, to the named exchange.
+// Consumers declare the exchange along with a queue of the same name holding
+// the dead letters. Like the maximum priority, the queue must be declared with
+// the same dead letter exchange everywhere it is used.
+func WithDeadLetterExchange[T Producer | AMQP091Consumer](name string) AMQP091Option[T] {
+	return func(t *T) {
+		switch concrete := any(t).(type) {
+		case *Producer:
+			concrete.deadLetterExchange = name
+		case *AMQP091Consumer:
+			concrete.deadLetterExchange = name
+		default:
+			panic("unsupported type")
+		}
+	}
+}
+
+// WithExchange publishes to, or consumes from, the named exchange of the given
+// kind, such as amqp.ExchangeDirect or amqp.ExchangeTopic, instead of the
+// default exchange.
+func WithExchange[T Producer | AMQP091Consumer](name, kind string) AMQP091Option[T] {
+	return func(t *T) {
+		switch concrete := any(t).(type) {
+		case *Producer:
+			concrete.exchange = name
+			concrete.exchangeKind = kind
+		case *AMQP091Consumer:
+			concrete.exchange = name
+			concrete.exchangeKind = kind
+		default:
+			panic("unsupported type")
+		}
+	}
+}
+
+// WithBindings binds the consumer's queue to its exchange with each of the
+// routing keys.
+func WithBindings[T AMQP091Consumer](routingKeys ...string) AMQP091Option[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*AMQP091Consumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.bindings = append(concrete.bindings, routingKeys...)
+	}
+}
+
+// WithGracePeriod allows a message being handled when the consumer is stopped
+// up to d to finish before its context is canceled. Messages that do not finish
+// in time are rejected and requeued.
+func WithGracePeriod[T AMQP091Consumer](d time.Duration) AMQP091Option[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*AMQP091Consumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.gracePeriod = d
+	}
+}
+
+// WithMiddleware wraps the consumer's handler with middleware. The first
+// middleware given is the outermost.
+func WithMiddleware[T AMQP091Consumer](middleware ...Middleware) AMQP091Option[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*AMQP091Consumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.middleware = append(concrete.middleware, middleware...)
+	}
+}
+
+type EtcdOption[T EtcdProducer | EtcdConsumer] func(*T)
+
+// WithPrefix keeps the work queue under the given etcd key prefix. Producers
+// and consumers of the same queue must use the same prefix.
+func WithPrefix[T EtcdProducer | EtcdConsumer](prefix string) EtcdOption[T] {
+	return func(t *T) {
+		switch concrete := any(t).(type) {
+		case *EtcdProducer:
+			concrete.prefix = prefix
+		case *EtcdConsumer:
+			concrete.prefix = prefix
+		default:
+			panic("unsupported type")
+		}
+	}
+}
+
+// WithClaimTTL sets how many seconds a consumer's claims on jobs outlive it if
+// it stops renewing them, such as when it crashes. Its jobs become available to
+// other consumers after that.
+func WithClaimTTL[T EtcdConsumer](seconds int64) EtcdOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*EtcdConsumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.claimTTL = seconds
+	}
+}
+
+// WithPollInterval sets how often the consumer looks for jobs when it has not
+// been told of any changes to the queue.
+func WithPollInterval[T EtcdConsumer](d time.Duration) EtcdOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*EtcdConsumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.pollInterval = d
+	}
+}
+
+// WithReleaseDelay sets how long a job that failed and was released waits
+// before any consumer may take it again.
+func WithReleaseDelay[T EtcdConsumer](d time.Duration) EtcdOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*EtcdConsumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.releaseDelay = d
+	}
+}
+
+// WithEtcdClock tells the time with clk when releasing jobs and deciding
+// whether released jobs may be taken again.
+func WithEtcdClock[T EtcdConsumer](clk clock.Clock) EtcdOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*EtcdConsumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.clock = clk
+	}
+}
+
+// WithEtcdGracePeriod is like WithGracePeriod for an EtcdConsumer.
+func WithEtcdGracePeriod[T EtcdConsumer](d time.Duration) EtcdOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*EtcdConsumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.gracePeriod = d
+	}
+}
+
+type MemoryOption[T MemoryConsumer] func(*T)
+
+// WithMemoryGracePeriod is like WithGracePeriod for a MemoryConsumer.
+func WithMemoryGracePeriod[T MemoryConsumer](d time.Duration) MemoryOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*MemoryConsumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.gracePeriod = d
+	}
+}
+
+// WithMemoryMiddleware is like WithMiddleware for a MemoryConsumer.
+func WithMemoryMiddleware[T MemoryConsumer](middleware ...Middleware) MemoryOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*MemoryConsumer)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.middleware = append(concrete.middleware, middleware...)
+	}
+}
+
+type SpoolOption[T Spool] func(*T)
+
+// WithMaxSpoolBytes limits the size of the spool file. Messages that would grow
+// it past the limit are refused with ErrSpoolFull. 0 means no limit.
+func WithMaxSpoolBytes[T Spool](n int64) SpoolOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*Spool)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.maxBytes = n
+	}
+}
+
+// WithFsyncPolicy sets when spooled messages are synced to disk. The default is
+// FsyncAlways.
+func WithFsyncPolicy[T Spool](policy FsyncPolicy) SpoolOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*Spool)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.fsync = policy
+	}
+}
+
+// WithReplayInterval sets how often Run tries to publish the spooled messages.
+func WithReplayInterval[T Spool](d time.Duration) SpoolOption[T] {
+	return func(t *T) {
+		concrete, ok := any(t).(*Spool)
+		if !ok {
+			panic("unsupported type")
+		}
+		concrete.replayInterval = d
+	}
+}
@@ -5,25 +5,98 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"google.golang.org/protobuf/proto"
 )
 
 type amqpConnection interface {
 	Channel() (*amqp.Channel, error)
 }
 
-// Producer is capable of publishing to a RabbitMQ exchange.
+// RedialingConnection is an AMQP connection that dials the broker again when a
+// channel is requested after the connection was lost, such as when the broker
+// restarts. A Producer given one recovers once the broker is reachable.
+type RedialingConnection struct {
+	url string
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+}
+
+// DialRedialing dials the broker at url, failing if it cannot be reached now.
+func DialRedialing(url string) (*RedialingConnection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedialingConnection{url: url, conn: conn}, nil
+}
+
+func (c *RedialingConnection) Channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn.IsClosed() {
+		conn, err := amqp.Dial(c.url)
+		if err != nil {
+			return nil, fmt.Errorf("error redialing: %w", err)
+		}
+		c.conn = conn
+	}
+
+	return c.conn.Channel()
+}
+
+func (c *RedialingConnection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.Close()
+}
+
+// Routable is implemented by messages that choose their own routing key when
+// published to an exchange.
+type Routable interface {
+	RoutingKey() string
+}
+
+// Prioritized is implemented by messages that carry an AMQP message priority.
+// Priorities only take effect on queues declared with a maximum priority.
+type Prioritized interface {
+	MessagePriority() uint8
+}
+
+// Expiring is implemented by messages that expire at a deadline. The broker
+// discards an expired message, or sends it to the dead letter exchange, rather
+// than deliver it.
+type Expiring interface {
+	MessageDeadline() (time.Time, bool)
+}
+
+// Producer is capable of publishing to a RabbitMQ exchange. By default it
+// publishes to the default exchange, routing directly to its queue. When given
+// an exchange it declares the exchange instead of a queue, leaving consumers to
+// declare and bind their own queues.
 type Producer struct {
 	desiredQueueName string
 	durable          bool
 	deleteWhenUnused bool
 	exclusive        bool
 	noWait           bool
+	maxPriority      uint8
+	// deadLetterExchange receives the messages rejected from the queue
+	// without being requeued.
+	deadLetterExchange string
 
-	exchange  string
-	mandatory bool
-	immediate bool
+	exchange     string
+	exchangeKind string
+	mandatory    bool
+	immediate    bool
 
 	queue   amqp.Queue
 	channel *amqp.Channel
@@ -40,6 +113,7 @@ func NewProducer[T Producer](conn amqpConnection, opts ...AMQP091Option[T]) *T {
 	if !ok {
 		panic("unsupported producer type")
 	}
+	producer.requestReinit = make(chan struct{})
 	producer.reinitialize = make(chan struct{})
 	producer.ready = make(chan struct{})
 
@@ -50,27 +124,21 @@ func NewProducer[T Producer](conn amqpConnection, opts ...AMQP091Option[T]) *T {
 	go func() {
 		// TODO: consider a backoff for retries.
 		// TODO: protect this routine from leaking.
+		const retryDelay = time.Second
 		for {
 			ch, err := conn.Channel()
 			if err != nil {
 				log.Printf("error creating channel: %s", err)
+				time.Sleep(retryDelay)
 				continue
-				// ???
 			}
 
-			q, err := ch.QueueDeclare(
-				producer.desiredQueueName,
-				producer.durable,
-				producer.deleteWhenUnused,
-				producer.exclusive,
-				producer.noWait,
-				nil,
-			)
+			q, err := producer.declare(ch)
 			if err != nil {
-				log.Printf("error declaring queue: %s", err)
+				log.Printf("error declaring destination: %s", err)
 				ch.Close()
+				time.Sleep(retryDelay)
 				continue
-				// ???
 			}
 
 			producer.channel = ch
@@ -108,6 +176,74 @@ func NewProducer[T Producer](conn amqpConnection, opts ...AMQP091Option[T]) *T {
 	return p
 }
 
+// declare declares the exchange to publish to, or the queue when publishing to
+// the default exchange.
+func (p *Producer) declare(ch *amqp.Channel) (amqp.Queue, error) {
+	if p.exchange != "" {
+		err := ch.ExchangeDeclare(
+			p.exchange,
+			p.exchangeKind,
+			p.durable,
+			p.deleteWhenUnused,
+			false, // internal
+			p.noWait,
+			nil,
+		)
+		if err != nil {
+			return amqp.Queue{}, fmt.Errorf("error declaring exchange: %w", err)
+		}
+
+		return amqp.Queue{}, nil
+	}
+
+	q, err := ch.QueueDeclare(
+		p.desiredQueueName,
+		p.durable,
+		p.deleteWhenUnused,
+		p.exclusive,
+		p.noWait,
+		queueArgs(p.maxPriority, p.deadLetterExchange),
+	)
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("error declaring queue: %w", err)
+	}
+
+	return q, nil
+}
+
+// queueArgs are the optional arguments to declare a queue with. Producers and
+// consumers must agree on them or declaring the queue fails.
+func queueArgs(maxPriority uint8, deadLetterExchange string) amqp.Table {
+	if maxPriority == 0 && deadLetterExchange == "" {
+		return nil
+	}
+
+	args := amqp.Table{}
+	if maxPriority > 0 {
+		args["x-max-priority"] = maxPriority
+	}
+	if deadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = deadLetterExchange
+	}
+
+	return args
+}
+
+// routingKey returns the routing key to publish message with. Messages sent to
+// the default exchange are routed to the producer's queue; otherwise the
+// message decides if it is Routable.
+func (p *Producer) routingKey(message any) string {
+	if p.exchange == "" {
+		return p.queue.Name
+	}
+
+	if r, ok := message.(Routable); ok {
+		return r.RoutingKey()
+	}
+
+	return ""
+}
+
 func (p *Producer) requestChannelReinitialization() {
 	p.requestReinit <- struct{}{}
 }
@@ -118,11 +254,52 @@ func (p *Producer) PublishJSON(ctx context.Context, message any) error {
 		return fmt.Errorf("unable to marshal message to JSON: %w", err)
 	}
 
-	if err := p.channel.PublishWithContext(ctx, p.exchange, p.queue.Name, p.mandatory,
-		p.immediate, amqp.Publishing{
-			ContentType: "application/json",
-			Body:        b,
-		}); err != nil {
+	return p.publish(ctx, message, amqp.Publishing{
+		ContentType: ContentTypeJSON,
+		Body:        b,
+	})
+}
+
+// PublishJSONBatch publishes messages as JSON one after another, stopping at
+// the first that fails. It returns how many messages were published, which are
+// the first ones, along with the error that stopped it from publishing the
+// rest.
+func (p *Producer) PublishJSONBatch(ctx context.Context, messages []any) (int, error) {
+	for i, message := range messages {
+		if err := p.PublishJSON(ctx, message); err != nil {
+			return i, err
+		}
+	}
+
+	return len(messages), nil
+}
+
+// PublishProto publishes message encoded as protobuf. Like PublishJSON, the
+// message may be Routable or Prioritized.
+func (p *Producer) PublishProto(ctx context.Context, message proto.Message) error {
+	b, err := proto.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("unable to marshal message to protobuf: %w", err)
+	}
+
+	return p.publish(ctx, message, amqp.Publishing{
+		ContentType: ContentTypeProtobuf,
+		Body:        b,
+	})
+}
+
+func (p *Producer) publish(ctx context.Context, message any, publishing amqp.Publishing) error {
+	if m, ok := message.(Prioritized); ok {
+		publishing.Priority = m.MessagePriority()
+	}
+	if m, ok := message.(Expiring); ok {
+		if deadline, ok := m.MessageDeadline(); ok {
+			setExpiration(&publishing, deadline)
+		}
+	}
+
+	if err := p.channel.PublishWithContext(ctx, p.exchange, p.routingKey(message), p.mandatory,
+		p.immediate, publishing); err != nil {
 		p.requestChannelReinitialization()
 		return fmt.Errorf("unable to publish message: %s", err)
 	}
@@ -130,6 +307,21 @@ func (p *Producer) PublishJSON(ctx context.Context, message any) error {
 	return nil
 }
 
+// setExpiration expires publishing at deadline, also giving the deadline in the
+// x-deadline header for consumers.
+func setExpiration(publishing *amqp.Publishing, deadline time.Time) {
+	ttl := time.Until(deadline).Milliseconds()
+	if ttl < 0 {
+		ttl = 0
+	}
+	publishing.Expiration = strconv.FormatInt(ttl, 10)
+
+	if publishing.Headers == nil {
+		publishing.Headers = amqp.Table{}
+	}
+	publishing.Headers["x-deadline"] = deadline.UTC().Format(time.RFC3339Nano)
+}
+
 func (p *Producer) Close() error {
 	return p.channel.Close()
 }
@@ -0,0 +1,493 @@
+package workqueue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrSpoolFull is returned when a message cannot be spooled without exceeding
+// the spool's size limit.
+var ErrSpoolFull = errors.New("spool is full")
+
+// FsyncPolicy decides when spooled messages are synced to disk.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs each message to disk before it is acknowledged as
+	// spooled.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval syncs the spool once per replay interval. Messages spooled
+	// since the last sync may be lost if the host crashes.
+	FsyncInterval
+	// FsyncNever leaves syncing to the operating system.
+	FsyncNever
+)
+
+const (
+	defaultSpoolMaxBytes       = 64 << 20
+	defaultSpoolReplayInterval = 5 * time.Second
+)
+
+type jsonPublisher interface {
+	PublishJSON(context.Context, any) error
+}
+
+// Spool publishes messages through another publisher, such as a Producer,
+// appending the messages it fails to publish to a file. The spooled messages
+// are replayed in order by Run. While any remain, new messages are spooled
+// behind them rather than published out of order.
+//
+// A Spool is a prometheus.Collector describing how many messages it holds.
+type Spool struct {
+	publisher      jsonPublisher
+	path           string
+	maxBytes       int64
+	fsync          FsyncPolicy
+	replayInterval time.Duration
+
+	// replaying is held while replaying so that one replay at a time removes
+	// what it published. It is taken before mu.
+	replaying sync.Mutex
+
+	mu      sync.Mutex
+	file    *os.File
+	entries int
+	size    int64
+	dirty   bool
+	closed  bool
+
+	depth prometheus.Gauge
+	bytes prometheus.Gauge
+}
+
+// spoolEntry is a line of the spool file. It keeps what the publisher would
+// have learned from the original message along with its JSON.
+type spoolEntry struct {
+	Body     json.RawMessage `json:"body"`
+	Key      string          `json:"routing_key,omitempty"`
+	Priority uint8           `json:"priority,omitempty"`
+	Deadline *time.Time      `json:"deadline,omitempty"`
+}
+
+// spooledMessage is a spooled message being replayed. It publishes as the
+// original message did.
+type spooledMessage spoolEntry
+
+func (m spooledMessage) MarshalJSON() ([]byte, error) { return m.Body, nil }
+
+func (m spooledMessage) RoutingKey() string { return m.Key }
+
+func (m spooledMessage) MessagePriority() uint8 { return m.Priority }
+
+func (m spooledMessage) MessageDeadline() (time.Time, bool) {
+	if m.Deadline == nil {
+		return time.Time{}, false
+	}
+	return *m.Deadline, true
+}
+
+// NewSpool opens the spool file at path, creating it if needed. Messages left
+// in it by a previous process are kept for replay.
+func NewSpool[T Spool](publisher jsonPublisher, path string, opts ...SpoolOption[T]) (*T, error) {
+	s := new(T)
+
+	spool, ok := any(s).(*Spool)
+	if !ok {
+		panic("unsupported spool type")
+	}
+	spool.publisher = publisher
+	spool.path = path
+	spool.maxBytes = defaultSpoolMaxBytes
+	spool.replayInterval = defaultSpoolReplayInterval
+	spool.depth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "workqueue",
+		Name:      "spooled_messages",
+		Help:      "Number of messages waiting in the spool to be published.",
+	})
+	spool.bytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "workqueue",
+		Name:      "spool_bytes",
+		Help:      "Size of the spool file in bytes.",
+	})
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	if err := spool.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// open opens the spool file and counts the messages in it, truncating a message
+// left partially written by a crash.
+func (s *Spool) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening spool: %w", err)
+	}
+
+	entries, size, err := readSpool(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return fmt.Errorf("error truncating spool: %w", err)
+	}
+
+	s.file = f
+	s.entries = len(entries)
+	s.size = size
+	s.updateMetrics()
+
+	return nil
+}
+
+// readSpool reads the entries in f and the size of the complete lines holding
+// them.
+func readSpool(f *os.File) ([]spoolEntry, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("error reading spool: %w", err)
+	}
+
+	var entries []spoolEntry
+	var size int64
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// A line without its newline was not completely written.
+			break
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("error reading spool: %w", err)
+		}
+		size += int64(len(line))
+
+		var e spoolEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Printf("discarding corrupt spool entry: %s", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, size, nil
+}
+
+// PublishJSON publishes message, spooling it if it cannot be published. An
+// error is returned only if the message could not be spooled either.
+func (s *Spool) PublishJSON(ctx context.Context, message any) error {
+	s.mu.Lock()
+	spooling := s.entries > 0
+	s.mu.Unlock()
+
+	if !spooling {
+		err := s.publisher.PublishJSON(ctx, message)
+		if err == nil {
+			return nil
+		}
+		log.Printf("spooling message that could not be published: %s", err)
+	}
+
+	return s.append(message)
+}
+
+func (s *Spool) append(message any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("unable to marshal message to JSON: %w", err)
+	}
+
+	e := spoolEntry{Body: body}
+	if r, ok := message.(Routable); ok {
+		e.Key = r.RoutingKey()
+	}
+	if p, ok := message.(Prioritized); ok {
+		e.Priority = p.MessagePriority()
+	}
+	if x, ok := message.(Expiring); ok {
+		if deadline, ok := x.MessageDeadline(); ok {
+			e.Deadline = &deadline
+		}
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("unable to marshal spool entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("spool is closed")
+	}
+
+	if s.maxBytes > 0 && s.size+int64(len(line)) > s.maxBytes {
+		return ErrSpoolFull
+	}
+
+	if _, err := s.file.Write(line); err != nil {
+		// Drop whatever part of the line was written so the next one starts
+		// on its own line.
+		s.file.Truncate(s.size)
+		return fmt.Errorf("error writing to spool: %w", err)
+	}
+
+	if s.fsync == FsyncAlways {
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf("error syncing spool: %w", err)
+		}
+	} else {
+		s.dirty = true
+	}
+
+	s.entries++
+	s.size += int64(len(line))
+	s.updateMetrics()
+
+	return nil
+}
+
+// Run replays the spool every replay interval until ctx is done.
+func (s *Spool) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if s.fsync == FsyncInterval {
+			if err := s.sync(); err != nil {
+				log.Printf("error syncing spool: %s", err)
+			}
+		}
+
+		if n, err := s.Replay(ctx); err != nil {
+			log.Printf("error replaying spool after %d messages: %s", n, err)
+		} else if n > 0 {
+			log.Printf("replayed %d spooled messages", n)
+		}
+	}
+}
+
+// Replay publishes the spooled messages in order, stopping at the first that
+// cannot be published, and returns how many were published. Published messages
+// are removed from the spool. Messages may be spooled while it publishes; they
+// are left for the next replay.
+func (s *Spool) Replay(ctx context.Context) (int, error) {
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+
+	entries, err := s.pending()
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	var published int
+	var publishErr error
+	for _, e := range entries {
+		if publishErr = s.publisher.PublishJSON(ctx, spooledMessage(e)); publishErr != nil {
+			break
+		}
+		published++
+	}
+
+	if published > 0 {
+		if err := s.remove(published); err != nil {
+			return published, err
+		}
+	}
+
+	return published, publishErr
+}
+
+// pending returns the spooled messages.
+func (s *Spool) pending() ([]spoolEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.entries == 0 {
+		return nil, nil
+	}
+
+	entries, _, err := readSpool(s.file)
+	return entries, err
+}
+
+// remove removes the first n spooled messages. Messages are only appended
+// outside of a replay, so they are the ones the replay published.
+func (s *Spool) remove(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("spool is closed")
+	}
+
+	entries, _, err := readSpool(s.file)
+	if err != nil {
+		return err
+	}
+
+	return s.rewrite(entries[n:])
+}
+
+// rewrite replaces the spool file with one holding only entries.
+func (s *Spool) rewrite(entries []spoolEntry) error {
+	if len(entries) == 0 {
+		if err := s.file.Truncate(0); err != nil {
+			return fmt.Errorf("error truncating spool: %w", err)
+		}
+		s.entries = 0
+		s.size = 0
+		s.dirty = true
+		s.updateMetrics()
+		return s.syncLocked()
+	}
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("unable to marshal spool entry: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// Write the remaining entries aside and rename them into place so that a
+	// crash leaves either the old spool or the new one.
+	tmp := s.path + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		return fmt.Errorf("error rewriting spool: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("error rewriting spool: %w", err)
+	}
+
+	s.file.Close()
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		// Without a file, the spool cannot take any more messages.
+		s.closed = true
+		return fmt.Errorf("error reopening spool: %w", err)
+	}
+
+	s.file = f
+	s.entries = len(entries)
+	s.size = int64(buf.Len())
+	s.dirty = false
+	s.updateMetrics()
+
+	return nil
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Spool) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	return s.syncLocked()
+}
+
+func (s *Spool) syncLocked() error {
+	if !s.dirty || s.fsync == FsyncNever {
+		return nil
+	}
+
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+
+	return nil
+}
+
+// Len returns how many messages are spooled.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries
+}
+
+// Close syncs and closes the spool file. Messages still spooled are replayed
+// when the spool is next opened.
+func (s *Spool) Close() error {
+	// Let a replay in progress remove what it published first.
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.fsync != FsyncNever {
+		if err := s.file.Sync(); err != nil {
+			s.file.Close()
+			return fmt.Errorf("error syncing spool: %w", err)
+		}
+	}
+
+	return s.file.Close()
+}
+
+func (s *Spool) updateMetrics() {
+	s.depth.Set(float64(s.entries))
+	s.bytes.Set(float64(s.size))
+}
+
+func (s *Spool) Describe(ch chan<- *prometheus.Desc) {
+	s.depth.Describe(ch)
+	s.bytes.Describe(ch)
+}
+
+func (s *Spool) Collect(ch chan<- prometheus.Metric) {
+	s.depth.Collect(ch)
+	s.bytes.Collect(ch)
+}
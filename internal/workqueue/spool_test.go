@@ -0,0 +1,298 @@
+package workqueue_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vickleford/calculator/internal/workqueue"
+)
+
+// flakyPublisher records what it publishes and fails while down.
+type flakyPublisher struct {
+	down      bool
+	published []published
+}
+
+type published struct {
+	body       string
+	routingKey string
+	priority   uint8
+}
+
+func (p *flakyPublisher) PublishJSON(ctx context.Context, message any) error {
+	if p.down {
+		return errors.New("broker is down")
+	}
+
+	b, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	msg := published{body: string(b)}
+	if r, ok := message.(workqueue.Routable); ok {
+		msg.routingKey = r.RoutingKey()
+	}
+	if m, ok := message.(workqueue.Prioritized); ok {
+		msg.priority = m.MessagePriority()
+	}
+	p.published = append(p.published, msg)
+
+	return nil
+}
+
+type spoolTestMessage struct {
+	N int `json:"n"`
+}
+
+func (m spoolTestMessage) RoutingKey() string { return "fibonacci_of" }
+
+func (m spoolTestMessage) MessagePriority() uint8 { return uint8(m.N) }
+
+func TestSpool_PublishesDirectlyWhenHealthy(t *testing.T) {
+	publisher := &flakyPublisher{}
+	spool, err := workqueue.NewSpool(publisher, filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatalf("unexpected error opening spool: %s", err)
+	}
+	defer spool.Close()
+
+	if err := spool.PublishJSON(context.Background(), spoolTestMessage{N: 1}); err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+
+	if len(publisher.published) != 1 {
+		t.Errorf("expected the message to be published but got %v", publisher.published)
+	}
+	if spool.Len() != 0 {
+		t.Errorf("expected nothing spooled but got %d messages", spool.Len())
+	}
+}
+
+func TestSpool_ReplaysInOrderOnceReachable(t *testing.T) {
+	ctx := context.Background()
+	publisher := &flakyPublisher{down: true}
+	spool, err := workqueue.NewSpool(publisher, filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatalf("unexpected error opening spool: %s", err)
+	}
+	defer spool.Close()
+
+	for n := 1; n <= 2; n++ {
+		if err := spool.PublishJSON(ctx, spoolTestMessage{N: n}); err != nil {
+			t.Fatalf("unexpected error spooling: %s", err)
+		}
+	}
+
+	if _, err := spool.Replay(ctx); err == nil {
+		t.Error("expected an error replaying while the broker is down")
+	}
+
+	// Messages published while others are spooled must wait behind them.
+	publisher.down = false
+	if err := spool.PublishJSON(ctx, spoolTestMessage{N: 3}); err != nil {
+		t.Fatalf("unexpected error spooling: %s", err)
+	}
+	if len(publisher.published) != 0 {
+		t.Fatalf("expected the message to be spooled behind the others but it was published")
+	}
+
+	n, err := spool.Replay(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error replaying: %s", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 messages replayed but got %d", n)
+	}
+
+	for i, msg := range publisher.published {
+		expected := published{
+			body:       `{"n":` + string(rune('1'+i)) + `}`,
+			routingKey: "fibonacci_of",
+			priority:   uint8(i + 1),
+		}
+		if msg != expected {
+			t.Errorf("expected message %d to be %+v but got %+v", i, expected, msg)
+		}
+	}
+
+	if spool.Len() != 0 {
+		t.Errorf("expected the spool to be empty but it holds %d messages", spool.Len())
+	}
+}
+
+// blockingPublisher publishes once it is released.
+type blockingPublisher struct {
+	publishing chan struct{}
+	release    chan struct{}
+	flakyPublisher
+}
+
+func (p *blockingPublisher) PublishJSON(ctx context.Context, message any) error {
+	p.publishing <- struct{}{}
+	<-p.release
+	return p.flakyPublisher.PublishJSON(ctx, message)
+}
+
+func TestSpool_SpoolsWhileReplaying(t *testing.T) {
+	ctx := context.Background()
+	publisher := &flakyPublisher{down: true}
+	path := filepath.Join(t.TempDir(), "spool")
+	spool, err := workqueue.NewSpool(publisher, path)
+	if err != nil {
+		t.Fatalf("unexpected error opening spool: %s", err)
+	}
+	if err := spool.PublishJSON(ctx, spoolTestMessage{N: 1}); err != nil {
+		t.Fatalf("unexpected error spooling: %s", err)
+	}
+	spool.Close()
+
+	blocking := &blockingPublisher{publishing: make(chan struct{}), release: make(chan struct{})}
+	spool, err = workqueue.NewSpool(blocking, path)
+	if err != nil {
+		t.Fatalf("unexpected error opening spool: %s", err)
+	}
+	defer spool.Close()
+
+	replayed := make(chan int)
+	go func() {
+		n, err := spool.Replay(ctx)
+		if err != nil {
+			t.Errorf("unexpected error replaying: %s", err)
+		}
+		replayed <- n
+	}()
+
+	// Spooling must not wait for the replay to publish.
+	<-blocking.publishing
+	if err := spool.PublishJSON(ctx, spoolTestMessage{N: 2}); err != nil {
+		t.Fatalf("unexpected error spooling: %s", err)
+	}
+	close(blocking.release)
+
+	if n := <-replayed; n != 1 {
+		t.Errorf("expected 1 message replayed but got %d", n)
+	}
+	if spool.Len() != 1 {
+		t.Fatalf("expected the message spooled during the replay to remain but %d are spooled", spool.Len())
+	}
+
+	go func() { <-blocking.publishing }()
+	if n, err := spool.Replay(ctx); err != nil || n != 1 {
+		t.Fatalf("expected to replay the remaining message but replayed %d: %v", n, err)
+	}
+
+	if len(blocking.published) != 2 || blocking.published[0].body != `{"n":1}` || blocking.published[1].body != `{"n":2}` {
+		t.Errorf("expected both messages in order but got %+v", blocking.published)
+	}
+}
+
+func TestSpool_KeepsUnpublishedMessages(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "spool")
+
+	publisher := &flakyPublisher{down: true}
+	spool, err := workqueue.NewSpool(publisher, path)
+	if err != nil {
+		t.Fatalf("unexpected error opening spool: %s", err)
+	}
+
+	for n := 1; n <= 2; n++ {
+		if err := spool.PublishJSON(ctx, spoolTestMessage{N: n}); err != nil {
+			t.Fatalf("unexpected error spooling: %s", err)
+		}
+	}
+	if err := spool.Close(); err != nil {
+		t.Fatalf("unexpected error closing spool: %s", err)
+	}
+
+	// Simulate a crash while appending a third message.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("unexpected error opening spool file: %s", err)
+	}
+	f.WriteString(`{"body":{"n":`)
+	f.Close()
+
+	publisher.down = false
+	spool, err = workqueue.NewSpool(publisher, path)
+	if err != nil {
+		t.Fatalf("unexpected error reopening spool: %s", err)
+	}
+	defer spool.Close()
+
+	if spool.Len() != 2 {
+		t.Fatalf("expected 2 spooled messages after reopening but got %d", spool.Len())
+	}
+
+	if _, err := spool.Replay(ctx); err != nil {
+		t.Fatalf("unexpected error replaying: %s", err)
+	}
+	if len(publisher.published) != 2 {
+		t.Errorf("expected 2 messages replayed but got %v", publisher.published)
+	}
+}
+
+func TestSpool_RefusesMessagesPastSizeLimit(t *testing.T) {
+	ctx := context.Background()
+	publisher := &flakyPublisher{down: true}
+	spool, err := workqueue.NewSpool(publisher, filepath.Join(t.TempDir(), "spool"),
+		workqueue.WithMaxSpoolBytes[workqueue.Spool](80),
+		workqueue.WithFsyncPolicy[workqueue.Spool](workqueue.FsyncNever))
+	if err != nil {
+		t.Fatalf("unexpected error opening spool: %s", err)
+	}
+	defer spool.Close()
+
+	if err := spool.PublishJSON(ctx, spoolTestMessage{N: 1}); err != nil {
+		t.Fatalf("unexpected error spooling: %s", err)
+	}
+
+	if err := spool.PublishJSON(ctx, spoolTestMessage{N: 2}); !errors.Is(err, workqueue.ErrSpoolFull) {
+		t.Errorf("expected ErrSpoolFull but got %v", err)
+	}
+
+	if spool.Len() != 1 {
+		t.Errorf("expected 1 spooled message but got %d", spool.Len())
+	}
+}
+
+func TestSpool_ReportsDepth(t *testing.T) {
+	ctx := context.Background()
+	publisher := &flakyPublisher{down: true}
+	spool, err := workqueue.NewSpool(publisher, filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatalf("unexpected error opening spool: %s", err)
+	}
+	defer spool.Close()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(spool)
+
+	for n := 1; n <= 3; n++ {
+		if err := spool.PublishJSON(ctx, spoolTestMessage{N: n}); err != nil {
+			t.Fatalf("unexpected error spooling: %s", err)
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+
+	var depth float64
+	for _, family := range families {
+		if family.GetName() == "workqueue_spooled_messages" {
+			depth = family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+
+	if depth != 3 {
+		t.Errorf("expected a spool depth of 3 but got %v", depth)
+	}
+}